@@ -0,0 +1,87 @@
+// Package cachebus propagates invalidations of cached short URLs between B.O.B
+// instances, so that short URLs edited or disabled through one instance are
+// not served from the stale caches of the others.
+package cachebus
+
+import (
+	"context"
+	"sync"
+)
+
+// Bus publishes and delivers short URL cache invalidations. An invalidation
+// published through any instance is delivered to the subscribers of every
+// instance, including the publishing one.
+type Bus interface {
+	// Publish notifies all subscribers that the cached information about
+	// shortURL is stale.
+	Publish(ctx context.Context, shortURL string) error
+	// Subscribe registers fn to be called with every invalidated short URL
+	// and returns a function that unregisters it. An empty short URL means
+	// that invalidations may have been missed and every cached short URL
+	// should be dropped. fn must not block.
+	Subscribe(fn func(shortURL string)) (unsubscribe func())
+	// Close stops delivering invalidations.
+	Close() error
+}
+
+// Subscribers is a set of invalidation subscribers. It is used by Bus
+// implementations to deliver invalidations.
+type Subscribers struct {
+	mtx    sync.RWMutex
+	nextID uint64
+	fns    map[uint64]func(shortURL string)
+}
+
+// Subscribe implements Bus.
+func (s *Subscribers) Subscribe(fn func(shortURL string)) (unsubscribe func()) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.fns == nil {
+		s.fns = make(map[uint64]func(shortURL string))
+	}
+
+	id := s.nextID
+	s.nextID++
+	s.fns[id] = fn
+
+	return func() {
+		s.mtx.Lock()
+		delete(s.fns, id)
+		s.mtx.Unlock()
+	}
+}
+
+// Notify calls every subscriber with shortURL.
+func (s *Subscribers) Notify(shortURL string) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	for _, fn := range s.fns {
+		fn(shortURL)
+	}
+}
+
+// InProcess is a Bus that delivers invalidations to subscribers in the same
+// process. It is enough for a single instance and is used in tests.
+type InProcess struct {
+	Subscribers
+}
+
+// InProcess implements the Bus interface.
+var _ Bus = (*InProcess)(nil)
+
+// NewInProcess creates an *InProcess bus.
+func NewInProcess() *InProcess {
+	return &InProcess{}
+}
+
+// Publish delivers the invalidation of shortURL to all subscribers before it
+// returns. Implements Bus.
+func (b *InProcess) Publish(_ context.Context, shortURL string) error {
+	b.Notify(shortURL)
+	return nil
+}
+
+// Close implements Bus.
+func (b *InProcess) Close() error {
+	return nil
+}
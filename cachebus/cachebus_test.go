@@ -0,0 +1,35 @@
+package cachebus
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInProcess(t *testing.T) {
+	b := NewInProcess()
+
+	var first, second []string
+	unsubscribe := b.Subscribe(func(shortURL string) {
+		first = append(first, shortURL)
+	})
+	b.Subscribe(func(shortURL string) {
+		second = append(second, shortURL)
+	})
+
+	if err := b.Publish(context.Background(), "shorturl"); err != nil {
+		t.Fatalf("Publish error: %v", err)
+	}
+
+	unsubscribe()
+	if err := b.Publish(context.Background(), "other"); err != nil {
+		t.Fatalf("Publish error: %v", err)
+	}
+
+	if len(first) != 1 || first[0] != "shorturl" {
+		t.Fatalf("Unexpected invalidations for the unsubscribed subscriber: %v", first)
+	}
+
+	if len(second) != 2 || second[1] != "other" {
+		t.Fatalf("Unexpected invalidations: %v", second)
+	}
+}
@@ -2,23 +2,51 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/jessevdk/go-flags"
+	"github.com/ukane-philemon/bob/db"
 	"github.com/ukane-philemon/bob/db/mongodb"
+	"github.com/ukane-philemon/bob/db/postgres"
+	"github.com/ukane-philemon/bob/db/sqlite"
+	"github.com/ukane-philemon/bob/mailer"
 	"github.com/ukane-philemon/bob/webserver"
 )
 
 type Config struct {
-	WebServerCfg webserver.Config `group:"Web server" namespace:"webserver"`
-	MongoDBCfg   mongodb.Config   `group:"MongoDB" namespace:"mongodb"`
-	DevMode      bool             `long:"dev" env:"DEV_MODE" description:"Enable development mode"`
+	WebServerCfg webserver.Config       `group:"Web server" namespace:"webserver"`
+	ClicksCfg    webserver.ClicksConfig `group:"Clicks" namespace:"clicks"`
+	OIDCCfg      webserver.OIDCConfig   `group:"OIDC" namespace:"oidc"`
+	PolicyCfg    webserver.PolicyConfig `group:"Account policy" namespace:"policy"`
+	MailerCfg    mailer.Config          `group:"Mailer" namespace:"mailer"`
+	MongoDBCfg   mongodb.Config         `group:"MongoDB" namespace:"mongodb"`
+	PostgresCfg  postgres.Config        `group:"PostgreSQL" namespace:"postgres"`
+	SQLiteCfg    sqlite.Config          `group:"SQLite" namespace:"sqlite"`
+	PasswordCfg  db.PasswordHashConfig  `group:"Password hashing" namespace:"password"`
+	DevMode      bool                   `long:"dev" env:"DEV_MODE" description:"Enable development mode"`
+
+	Migrate      migrateCmd      `command:"migrate" description:"Apply or inspect PostgreSQL schema migrations"`
+	RotateJWTKey rotateJWTKeyCmd `command:"rotate-jwt-key" description:"Add a new auth token signing key to the JWT key file and retire the current one"`
+}
+
+// migrateCmd holds the options for the "migrate" command.
+type migrateCmd struct {
+	Status bool `long:"status" description:"List the migrations and when each one was applied instead of applying pending migrations"`
+}
+
+// rotateJWTKeyCmd holds the options for the "rotate-jwt-key" command.
+type rotateJWTKeyCmd struct {
+	Algorithm string        `long:"alg" default:"EdDSA" choice:"EdDSA" choice:"RS256" choice:"HS256" description:"Algorithm of the new key"`
+	Delay     time.Duration `long:"delay" default:"10m" description:"How long until the new key signs tokens, so that every server and JWKS client learns it first"`
 }
 
 // parseCLIConfig parses the command-line arguments into the provided struct
-// with go-flags tags. If the --help flag has been passed, the struct is
-// described back to the terminal and the program exits using os.Exit.
-func parseCLIConfig(cfg *Config) error {
+// with go-flags tags and returns the name of the command to run, if any. If the
+// --help flag has been passed, the struct is described back to the terminal and
+// the program exits using os.Exit.
+func parseCLIConfig(cfg *Config) (string, error) {
 	preParser := flags.NewParser(cfg, flags.HelpFlag|flags.PassDoubleDash)
+	preParser.SubcommandsOptional = true
 	_, flagerr := preParser.Parse()
 
 	if flagerr != nil {
@@ -30,7 +58,11 @@ func parseCLIConfig(cfg *Config) error {
 			preParser.WriteHelp(os.Stdout)
 			os.Exit(0)
 		}
-		return flagerr
+		return "", flagerr
+	}
+
+	if preParser.Active != nil {
+		return preParser.Active.Name, nil
 	}
-	return nil
+	return "", nil
 }
@@ -0,0 +1,1822 @@
+// Package dbtest provides a conformance test suite that every db.DataStore
+// implementation must pass.
+package dbtest
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+const (
+	tUsername = "fibrealz"
+	tEmail    = "fibrealz@example.com"
+	tPassword = "password"
+	tLongURL  = "https://example.com/some/long/path"
+)
+
+// NewDataStoreFunc returns a new and empty db.DataStore that hashes passwords
+// with hasher, or with db.DefaultPasswordHasher if hasher is nil. It is called
+// once for every test case and the returned db.DataStore is closed when the
+// test case ends.
+type NewDataStoreFunc func(t *testing.T, hasher db.PasswordHasher) db.DataStore
+
+// Run runs the conformance test suite against the db.DataStore returned by
+// newDataStore.
+func Run(t *testing.T, newDataStore NewDataStoreFunc) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, ds db.DataStore)
+	}{
+		{"CreateUser", testCreateUser},
+		{"UsernameExists", testUsernameExists},
+		{"RetrieveUserInfo", testRetrieveUserInfo},
+		{"LoginUser", testLoginUser},
+		{"CreateNewShortURL", testCreateNewShortURL},
+		{"GuestURLLimit", testGuestURLLimit},
+		{"RetrieveURLInfo", testRetrieveURLInfo},
+		{"RetrieveUserURLs", testRetrieveUserURLs},
+		{"UpdateShortURL", testUpdateShortURL},
+		{"RecordShortURLClicks", testRecordShortURLClicks},
+		{"OwnerScopedMethods", testOwnerScopedMethods},
+		{"ToggleShortLinkStatus", testToggleShortLinkStatus},
+		{"ShortURLExpiry", testShortURLExpiry},
+		{"ShortURLPassword", testShortURLPassword},
+		{"ShortURLClickLimit", testShortURLClickLimit},
+		{"ShortURLActiveWindow", testShortURLActiveWindow},
+		{"ShortURLReuse", testShortURLReuse},
+		{"ShortURLClickStats", testShortURLClickStats},
+		{"DeleteShortURLClicksBefore", testDeleteShortURLClicksBefore},
+		{"Sessions", testSessions},
+		{"APIKeys", testAPIKeys},
+		{"UserIdentities", testUserIdentities},
+		{"UserTokens", testUserTokens},
+		{"UpdateUser", testUpdateUser},
+		{"DeleteUser", testDeleteUser},
+		{"UserTOTP", testUserTOTP},
+		{"LoginAttempts", testLoginAttempts},
+		{"Workspaces", testWorkspaces},
+		{"WorkspaceMembers", testWorkspaceMembers},
+		{"WorkspaceInvitations", testWorkspaceInvitations},
+		{"DeleteWorkspace", testDeleteWorkspace},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := newDataStore(t, nil)
+			defer ds.Close()
+			tt.fn(t, ds)
+		})
+	}
+
+	t.Run("PasswordRehash", func(t *testing.T) {
+		hasher := new(tHasher)
+		ds := newDataStore(t, hasher)
+		defer ds.Close()
+		testPasswordRehash(t, ds, hasher)
+	})
+}
+
+// tHasher is a db.PasswordHasher whose algorithm can be changed during a test.
+// It records the last hash it verified.
+type tHasher struct {
+	mtx          sync.Mutex
+	hasher       db.PasswordHasher
+	lastVerified []byte
+}
+
+// setConfig changes the algorithm and parameters of new hashes.
+func (h *tHasher) setConfig(t *testing.T, cfg db.PasswordHashConfig) {
+	t.Helper()
+	hasher, err := db.NewPasswordHasher(cfg)
+	requireNoError(t, "NewPasswordHasher", err)
+	h.mtx.Lock()
+	h.hasher = hasher
+	h.mtx.Unlock()
+}
+
+// Hash implements db.PasswordHasher.
+func (h *tHasher) Hash(password []byte) ([]byte, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.hasher.Hash(password)
+}
+
+// Verify implements db.PasswordHasher.
+func (h *tHasher) Verify(hash, password []byte) (bool, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.lastVerified = append([]byte(nil), hash...)
+	return h.hasher.Verify(hash, password)
+}
+
+// requireLastVerifiedPrefix fails the test if the last hash verified by h
+// does not start with prefix.
+func (h *tHasher) requireLastVerifiedPrefix(t *testing.T, name, prefix string) {
+	t.Helper()
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if !strings.HasPrefix(string(h.lastVerified), prefix) {
+		t.Fatalf("%s: expected a hash starting with %q but got %q", name, prefix, h.lastVerified)
+	}
+}
+
+// requireErrorIs fails the test if err does not wrap target.
+func requireErrorIs(t *testing.T, name string, err, target error) {
+	t.Helper()
+	if !errors.Is(err, target) {
+		t.Fatalf("%s: expected error wrapping %q but got %v", name, target, err)
+	}
+}
+
+// requireNoError fails the test if err is not nil.
+func requireNoError(t *testing.T, name string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", name, err)
+	}
+}
+
+// createUser creates a user with tPassword as the password.
+func createUser(t *testing.T, ds db.DataStore, username, email string) {
+	t.Helper()
+	requireNoError(t, "CreateUser", ds.CreateUser(username, email, []byte(tPassword)))
+}
+
+// createURL creates a short URL owned by the registered user with the
+// specified email.
+func createURL(t *testing.T, ds db.DataStore, email, longURL, customShortURL string) *db.ShortURLInfo {
+	t.Helper()
+	urlInfo, err := ds.CreateNewShortURL(email, longURL, customShortURL, false, nil)
+	requireNoError(t, "CreateNewShortURL", err)
+	return urlInfo
+}
+
+func testCreateUser(t *testing.T, ds db.DataStore) {
+	tests := []struct {
+		name, username, email, password string
+		wantErr                         error
+	}{{
+		name:     "success",
+		username: tUsername,
+		email:    tEmail,
+		password: tPassword,
+	}, {
+		name:     "missing username",
+		email:    "other@example.com",
+		password: tPassword,
+		wantErr:  db.ErrorBadRequest,
+	}, {
+		name:     "invalid email",
+		username: "other",
+		email:    "other@example",
+		password: tPassword,
+		wantErr:  db.ErrorBadRequest,
+	}, {
+		name:     "missing password",
+		username: "other",
+		email:    "other@example.com",
+		wantErr:  db.ErrorBadRequest,
+	}, {
+		name:     "duplicate email",
+		username: "other",
+		email:    tEmail,
+		password: tPassword,
+		wantErr:  db.ErrorBadRequest,
+	}, {
+		name:     "duplicate username",
+		username: tUsername,
+		email:    "other@example.com",
+		password: tPassword,
+		wantErr:  db.ErrorBadRequest,
+	}}
+
+	for _, tt := range tests {
+		var password []byte
+		if tt.password != "" {
+			password = []byte(tt.password)
+		}
+
+		err := ds.CreateUser(tt.username, tt.email, password)
+		if tt.wantErr != nil {
+			requireErrorIs(t, tt.name, err, tt.wantErr)
+			continue
+		}
+		requireNoError(t, tt.name, err)
+	}
+}
+
+func testUsernameExists(t *testing.T, ds db.DataStore) {
+	exists, err := ds.UsernameExists(tUsername)
+	requireNoError(t, "unknown username", err)
+	if exists {
+		t.Fatalf("unknown username: expected username to not exist")
+	}
+
+	createUser(t, ds, tUsername, tEmail)
+	exists, err = ds.UsernameExists(tUsername)
+	requireNoError(t, "registered username", err)
+	if !exists {
+		t.Fatalf("registered username: expected username to exist")
+	}
+}
+
+func testRetrieveUserInfo(t *testing.T, ds db.DataStore) {
+	_, err := ds.RetrieveUserInfo(tEmail)
+	requireErrorIs(t, "unknown user", err, db.ErrorBadRequest)
+
+	createUser(t, ds, tUsername, tEmail)
+	createURL(t, ds, tEmail, tLongURL, "")
+	createURL(t, ds, tEmail, tLongURL, "custom")
+
+	userInfo, err := ds.RetrieveUserInfo(tEmail)
+	requireNoError(t, "registered user", err)
+	if userInfo.Username != tUsername || userInfo.Email != tEmail || userInfo.Timestamp == 0 {
+		t.Fatalf("registered user: unexpected user info %+v", userInfo)
+	}
+
+	if userInfo.TotalLinks != 2 {
+		t.Fatalf("registered user: expected 2 total links but got %d", userInfo.TotalLinks)
+	}
+}
+
+func testLoginUser(t *testing.T, ds db.DataStore) {
+	_, err := ds.LoginUser(tEmail, []byte(tPassword))
+	requireErrorIs(t, "unknown user", err, db.ErrorBadRequest)
+
+	createUser(t, ds, tUsername, tEmail)
+
+	_, err = ds.LoginUser(tEmail, nil)
+	requireErrorIs(t, "missing password", err, db.ErrorBadRequest)
+
+	_, err = ds.LoginUser(tEmail, []byte("incorrect password"))
+	requireErrorIs(t, "incorrect password", err, db.ErrorBadRequest)
+
+	userInfo, err := ds.LoginUser(tEmail, []byte(tPassword))
+	requireNoError(t, "correct password", err)
+	if userInfo.Email != tEmail || userInfo.Username != tUsername {
+		t.Fatalf("correct password: unexpected user info %+v", userInfo)
+	}
+}
+
+func testCreateNewShortURL(t *testing.T, ds db.DataStore) {
+	_, err := ds.CreateNewShortURL(tEmail, tLongURL, "", false, nil)
+	requireErrorIs(t, "unknown user", err, db.ErrorBadRequest)
+
+	_, err = ds.CreateNewShortURL("not-an-email", tLongURL, "", false, nil)
+	requireErrorIs(t, "invalid email", err, db.ErrorBadRequest)
+
+	_, err = ds.CreateNewShortURL(tEmail, "", "", false, nil)
+	requireErrorIs(t, "missing long URL", err, db.ErrorBadRequest)
+
+	createUser(t, ds, tUsername, tEmail)
+
+	urlInfo := createURL(t, ds, tEmail, tLongURL, "")
+	if urlInfo.ShortURL == "" || urlInfo.OwnerID != tEmail || urlInfo.OriginalURL != tLongURL || urlInfo.Timestamp == 0 {
+		t.Fatalf("generated short URL: unexpected URL info %+v", urlInfo)
+	}
+
+	if urlInfo.Clicks != 0 || urlInfo.Disabled {
+		t.Fatalf("generated short URL: expected a new enabled link but got %+v", urlInfo)
+	}
+
+	sameURLInfo := createURL(t, ds, tEmail, tLongURL, "")
+	if sameURLInfo.ShortURL != urlInfo.ShortURL {
+		t.Fatalf("same long URL: expected short URL %s but got %s", urlInfo.ShortURL, sameURLInfo.ShortURL)
+	}
+
+	customURLInfo := createURL(t, ds, tEmail, tLongURL, "custom")
+	if customURLInfo.ShortURL != "custom" {
+		t.Fatalf("custom short URL: expected short URL custom but got %s", customURLInfo.ShortURL)
+	}
+
+	_, err = ds.CreateNewShortURL(tEmail, "https://example.org", "custom", false, nil)
+	requireErrorIs(t, "duplicate custom short URL", err, db.ErrorBadRequest)
+
+	_, err = ds.CreateNewShortURL(tEmail, "https://example.org", urlInfo.ShortURL, false, nil)
+	requireErrorIs(t, "custom short URL matching generated short URL", err, db.ErrorBadRequest)
+}
+
+func testGuestURLLimit(t *testing.T, ds db.DataStore) {
+	guestID := "127.0.0.1"
+	for i := 0; i < db.MaxGuestURLs; i++ {
+		longURL := tLongURL + string(rune('a'+i))
+		urlInfo, err := ds.CreateNewShortURL(guestID, longURL, "", true, nil)
+		requireNoError(t, "guest URL within limit", err)
+		if urlInfo.OwnerID != guestID {
+			t.Fatalf("guest URL within limit: expected owner %s but got %s", guestID, urlInfo.OwnerID)
+		}
+	}
+
+	_, err := ds.CreateNewShortURL(guestID, "https://example.org", "", true, nil)
+	requireErrorIs(t, "guest URL limit reached", err, db.ErrorBadRequest)
+
+	_, err = ds.CreateNewShortURL("127.0.0.2", "https://example.org", "", true, nil)
+	requireNoError(t, "other guest", err)
+}
+
+func testRetrieveURLInfo(t *testing.T, ds db.DataStore) {
+	_, err := ds.RetrieveURLInfo("")
+	requireErrorIs(t, "empty short URL", err, db.ErrorBadRequest)
+
+	_, err = ds.RetrieveURLInfo("unknown")
+	requireErrorIs(t, "unknown short URL", err, db.ErrorNotFound)
+
+	createUser(t, ds, tUsername, tEmail)
+	urlInfo := createURL(t, ds, tEmail, tLongURL, "")
+
+	gotURLInfo, err := ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "existing short URL", err)
+	if !reflect.DeepEqual(gotURLInfo, urlInfo) {
+		t.Fatalf("existing short URL: expected %+v but got %+v", urlInfo, gotURLInfo)
+	}
+}
+
+func testRetrieveUserURLs(t *testing.T, ds db.DataStore) {
+	urls, err := ds.RetrieveUserURLs(tEmail)
+	requireNoError(t, "no URLs", err)
+	if len(urls) != 0 {
+		t.Fatalf("no URLs: expected no URLs but got %d", len(urls))
+	}
+
+	otherEmail := "other@example.com"
+	createUser(t, ds, tUsername, tEmail)
+	createUser(t, ds, "other", otherEmail)
+	createURL(t, ds, tEmail, tLongURL, "")
+	createURL(t, ds, tEmail, "https://example.org", "")
+	createURL(t, ds, otherEmail, tLongURL, "")
+
+	urls, err = ds.RetrieveUserURLs(tEmail)
+	requireNoError(t, "user URLs", err)
+	if len(urls) != 2 {
+		t.Fatalf("user URLs: expected 2 URLs but got %d", len(urls))
+	}
+
+	for _, urlInfo := range urls {
+		if urlInfo.OwnerID != tEmail {
+			t.Fatalf("user URLs: got URL owned by %s", urlInfo.OwnerID)
+		}
+	}
+}
+
+func testUpdateShortURL(t *testing.T, ds db.DataStore) {
+	err := ds.UpdateShortURL("unknown", "", &db.ShortURLClick{IP: "127.0.0.1"})
+	requireErrorIs(t, "unknown short URL", err, db.ErrorBadRequest)
+
+	createUser(t, ds, tUsername, tEmail)
+	urlInfo := createURL(t, ds, tEmail, tLongURL, "")
+
+	err = ds.UpdateShortURL(urlInfo.ShortURL, "", nil)
+	requireErrorIs(t, "nothing to update", err, db.ErrorBadRequest)
+
+	clicks := []*db.ShortURLClick{{
+		IP:         "127.0.0.1",
+		Browser:    "Firefox",
+		Device:     "Linux",
+		DeviceType: "desktop",
+		Timestamp:  1000,
+	}, {
+		IP:             "127.0.0.2",
+		Browser:        "Safari",
+		Device:         "iPhone",
+		DeviceType:     "mobile",
+		Timestamp:      2000,
+		Referrer:       "https://www.example.net/post",
+		ReferrerDomain: "example.net",
+		UTMSource:      "newsletter",
+		UTMMedium:      "email",
+		UTMCampaign:    "launch",
+		UTMTerm:        "shortener",
+		UTMContent:     "header",
+		Country:        "NG",
+		Region:         "Lagos",
+		City:           "Ikeja",
+	}}
+	for _, click := range clicks {
+		requireNoError(t, "click", ds.UpdateShortURL(urlInfo.ShortURL, "", click))
+	}
+
+	newLongURL := "https://example.org"
+	requireNoError(t, "new long URL", ds.UpdateShortURL(urlInfo.ShortURL, newLongURL, nil))
+
+	gotURLInfo, err := ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if gotURLInfo.Clicks != int32(len(clicks)) {
+		t.Fatalf("expected %d clicks but got %d", len(clicks), gotURLInfo.Clicks)
+	}
+
+	if gotURLInfo.OriginalURL != newLongURL {
+		t.Fatalf("expected original URL %s but got %s", newLongURL, gotURLInfo.OriginalURL)
+	}
+
+	gotClicks, err := ds.RetrieveShortURLClicks(tEmail, urlInfo.ShortURL)
+	requireNoError(t, "RetrieveShortURLClicks", err)
+	if len(gotClicks) != len(clicks) {
+		t.Fatalf("expected %d recorded clicks but got %d", len(clicks), len(gotClicks))
+	}
+
+	for i, click := range gotClicks {
+		if *click != *clicks[i] {
+			t.Fatalf("expected click %+v but got %+v", clicks[i], click)
+		}
+	}
+}
+
+func testRecordShortURLClicks(t *testing.T, ds db.DataStore) {
+	requireNoError(t, "empty batch", ds.RecordShortURLClicks(nil))
+
+	createUser(t, ds, tUsername, tEmail)
+	first := createURL(t, ds, tEmail, tLongURL, "")
+	second := createURL(t, ds, tEmail, "https://example.org", "")
+	requireNoError(t, "click", ds.UpdateShortURL(first.ShortURL, "", &db.ShortURLClick{IP: "127.0.0.1", Timestamp: 1000}))
+
+	// The second batch is larger than a single SQL insert statement.
+	batch := map[string][]*db.ShortURLClick{
+		first.ShortURL: {
+			{IP: "127.0.0.2", Browser: "Firefox", Country: "NG", Region: "Lagos", Timestamp: 2000},
+			{IP: "127.0.0.3", Browser: "Safari", Timestamp: 3000},
+		},
+		"unknown": {{IP: "127.0.0.4", Timestamp: 2000}},
+	}
+	for i := 0; i < 1234; i++ {
+		batch[second.ShortURL] = append(batch[second.ShortURL], &db.ShortURLClick{IP: "127.0.0.5", Timestamp: int64(1000 + i)})
+	}
+	requireNoError(t, "RecordShortURLClicks", ds.RecordShortURLClicks(batch))
+
+	for shortURL, wantClicks := range map[string]int{first.ShortURL: 3, second.ShortURL: 1234} {
+		urlInfo, err := ds.RetrieveURLInfo(shortURL)
+		requireNoError(t, "RetrieveURLInfo", err)
+		if urlInfo.Clicks != int32(wantClicks) {
+			t.Fatalf("RetrieveURLInfo: expected %d clicks but got %d", wantClicks, urlInfo.Clicks)
+		}
+
+		clicks, err := ds.RetrieveShortURLClicks(tEmail, shortURL)
+		requireNoError(t, "RetrieveShortURLClicks", err)
+		if len(clicks) != wantClicks {
+			t.Fatalf("RetrieveShortURLClicks: expected %d clicks but got %d", wantClicks, len(clicks))
+		}
+
+		if shortURL == first.ShortURL && !reflect.DeepEqual(clicks[1], batch[first.ShortURL][0]) {
+			t.Fatalf("RetrieveShortURLClicks: expected %+v but got %+v", batch[first.ShortURL][0], clicks[1])
+		}
+	}
+
+	_, err := ds.RetrieveURLInfo("unknown")
+	requireErrorIs(t, "unknown short URL", err, db.ErrorNotFound)
+}
+
+func testOwnerScopedMethods(t *testing.T, ds db.DataStore) {
+	otherEmail := "other@example.com"
+	createUser(t, ds, tUsername, tEmail)
+	createUser(t, ds, "other", otherEmail)
+	urlInfo := createURL(t, ds, tEmail, tLongURL, "")
+
+	tests := []struct {
+		name    string
+		ownerID string
+		short   string
+		wantErr error
+	}{{
+		name:    "owner",
+		ownerID: tEmail,
+		short:   urlInfo.ShortURL,
+	}, {
+		name:    "other user",
+		ownerID: otherEmail,
+		short:   urlInfo.ShortURL,
+		wantErr: db.ErrorForbidden,
+	}, {
+		name:    "unknown short URL",
+		ownerID: tEmail,
+		short:   "unknown",
+		wantErr: db.ErrorNotFound,
+	}}
+
+	for _, tt := range tests {
+		checkErr := func(method string, err error) {
+			t.Helper()
+			if tt.wantErr != nil {
+				requireErrorIs(t, tt.name+": "+method, err, tt.wantErr)
+				return
+			}
+			requireNoError(t, tt.name+": "+method, err)
+		}
+
+		gotURLInfo, err := ds.RetrieveUserURLInfo(tt.ownerID, tt.short)
+		checkErr("RetrieveUserURLInfo", err)
+		if err == nil && gotURLInfo.ShortURL != tt.short {
+			t.Fatalf("%s: expected short URL %s but got %s", tt.name, tt.short, gotURLInfo.ShortURL)
+		}
+
+		_, err = ds.RetrieveShortURLClicks(tt.ownerID, tt.short)
+		checkErr("RetrieveShortURLClicks", err)
+
+		checkErr("UpdateUserShortURL", ds.UpdateUserShortURL(tt.ownerID, tt.short, "https://example.org/"+tt.ownerID, nil))
+		checkErr("ToggleShortLinkStatus", ds.ToggleShortLinkStatus(tt.ownerID, tt.short, false))
+	}
+
+	// Only the owner's update should have been applied.
+	gotURLInfo, err := ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if want := "https://example.org/" + tEmail; gotURLInfo.OriginalURL != want {
+		t.Fatalf("expected original URL %s but got %s", want, gotURLInfo.OriginalURL)
+	}
+}
+
+func testToggleShortLinkStatus(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+	urlInfo := createURL(t, ds, tEmail, tLongURL, "")
+
+	for _, disable := range []bool{true, false, true} {
+		requireNoError(t, "ToggleShortLinkStatus", ds.ToggleShortLinkStatus(tEmail, urlInfo.ShortURL, disable))
+
+		gotURLInfo, err := ds.RetrieveURLInfo(urlInfo.ShortURL)
+		requireNoError(t, "RetrieveURLInfo", err)
+		if gotURLInfo.Disabled != disable {
+			t.Fatalf("expected disabled to be %t but got %t", disable, gotURLInfo.Disabled)
+		}
+	}
+}
+
+func testShortURLExpiry(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+	urlInfo := createURL(t, ds, tEmail, tLongURL, "")
+
+	future := time.Now().Add(time.Hour).Unix()
+	expiringURLInfo, err := ds.CreateNewShortURL(tEmail, tLongURL, "", false, &db.ShortURLOptions{ExpiresAt: &future})
+	requireNoError(t, "expiring short URL", err)
+	if expiringURLInfo.ShortURL == urlInfo.ShortURL {
+		t.Fatalf("expiring short URL: expected a new short URL for a link with settings")
+	}
+
+	if expiringURLInfo.ExpiresAt != future || expiringURLInfo.HasExpired(time.Now()) {
+		t.Fatalf("expiring short URL: unexpected URL info %+v", expiringURLInfo)
+	}
+
+	n, err := ds.MarkExpiredShortURLs()
+	requireNoError(t, "MarkExpiredShortURLs before expiry", err)
+	if n != 0 {
+		t.Fatalf("MarkExpiredShortURLs before expiry: expected 0 marked short URLs but got %d", n)
+	}
+
+	past := time.Now().Add(-time.Second).Unix()
+	requireNoError(t, "expire short URL", ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", &db.ShortURLOptions{ExpiresAt: &past}))
+
+	gotURLInfo, err := ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if gotURLInfo.ExpiresAt != past || !gotURLInfo.HasExpired(time.Now()) {
+		t.Fatalf("expire short URL: unexpected URL info %+v", gotURLInfo)
+	}
+
+	// Expired short URLs must not be reused for the same long URL.
+	newURLInfo := createURL(t, ds, tEmail, tLongURL, "")
+	if newURLInfo.ShortURL == urlInfo.ShortURL {
+		t.Fatalf("expired short URL was reused")
+	}
+
+	// Let a short URL expire and confirm the sweeper marks it.
+	soon := time.Now().Unix() + 1
+	soonURLInfo, err := ds.CreateNewShortURL(tEmail, tLongURL, "", false, &db.ShortURLOptions{ExpiresAt: &soon})
+	requireNoError(t, "short URL expiring soon", err)
+	time.Sleep(time.Until(time.Unix(soon, 0)))
+
+	n, err = ds.MarkExpiredShortURLs()
+	requireNoError(t, "MarkExpiredShortURLs", err)
+	if n != 1 {
+		t.Fatalf("MarkExpiredShortURLs: expected 1 marked short URL but got %d", n)
+	}
+
+	gotURLInfo, err = ds.RetrieveURLInfo(soonURLInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if !gotURLInfo.Expired {
+		t.Fatalf("MarkExpiredShortURLs: expected short URL to be marked as expired")
+	}
+
+	// Extending the expiry revives the short URL.
+	requireNoError(t, "extend expiry", ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", &db.ShortURLOptions{ExpiresAt: &future}))
+	gotURLInfo, err = ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if gotURLInfo.Expired || gotURLInfo.HasExpired(time.Now()) {
+		t.Fatalf("extend expiry: expected short URL to be active but got %+v", gotURLInfo)
+	}
+
+	// Zero removes the expiry.
+	var noExpiry int64
+	requireNoError(t, "remove expiry", ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", &db.ShortURLOptions{ExpiresAt: &noExpiry}))
+	gotURLInfo, err = ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if gotURLInfo.ExpiresAt != 0 || gotURLInfo.Expired {
+		t.Fatalf("remove expiry: unexpected URL info %+v", gotURLInfo)
+	}
+
+	err = ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", nil)
+	requireErrorIs(t, "nothing to update", err, db.ErrorBadRequest)
+}
+
+func testShortURLPassword(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+	urlInfo := createURL(t, ds, tEmail, tLongURL, "")
+	if urlInfo.PasswordProtected || urlInfo.CheckPassword([]byte("")) {
+		t.Fatalf("short URL without password: unexpected URL info %+v", urlInfo)
+	}
+
+	password := "secret"
+	protectedURLInfo, err := ds.CreateNewShortURL(tEmail, tLongURL, "", false, &db.ShortURLOptions{Password: &password})
+	requireNoError(t, "protected short URL", err)
+	if protectedURLInfo.ShortURL == urlInfo.ShortURL {
+		t.Fatalf("protected short URL: expected a new short URL for a link with settings")
+	}
+
+	gotURLInfo, err := ds.RetrieveURLInfo(protectedURLInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if !gotURLInfo.PasswordProtected || string(gotURLInfo.PasswordHash) == password {
+		t.Fatalf("protected short URL: expected a hashed password but got %+v", gotURLInfo)
+	}
+
+	if !gotURLInfo.CheckPassword([]byte(password)) {
+		t.Fatalf("protected short URL: correct password was rejected")
+	}
+
+	if gotURLInfo.CheckPassword([]byte("wrong")) {
+		t.Fatalf("protected short URL: wrong password was accepted")
+	}
+
+	// Change the password of an existing short URL.
+	newPassword := "new-secret"
+	requireNoError(t, "set password", ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", &db.ShortURLOptions{Password: &newPassword}))
+	gotURLInfo, err = ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if !gotURLInfo.CheckPassword([]byte(newPassword)) {
+		t.Fatalf("set password: new password was rejected")
+	}
+
+	// Other settings are left unchanged.
+	future := time.Now().Add(time.Hour).Unix()
+	requireNoError(t, "set expiry", ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", &db.ShortURLOptions{ExpiresAt: &future}))
+	gotURLInfo, err = ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if !gotURLInfo.CheckPassword([]byte(newPassword)) {
+		t.Fatalf("set expiry: password was changed")
+	}
+
+	// An empty password removes the password protection.
+	var noPassword string
+	requireNoError(t, "remove password", ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", &db.ShortURLOptions{Password: &noPassword}))
+	gotURLInfo, err = ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if gotURLInfo.PasswordProtected || len(gotURLInfo.PasswordHash) != 0 {
+		t.Fatalf("remove password: unexpected URL info %+v", gotURLInfo)
+	}
+
+	// A protected short URL is never returned for a link without settings.
+	const otherLongURL = tLongURL + "/protected"
+	protectedURLInfo, err = ds.CreateNewShortURL(tEmail, otherLongURL, "", false, &db.ShortURLOptions{Password: &password})
+	requireNoError(t, "protected short URL", err)
+	plainURLInfo := createURL(t, ds, tEmail, otherLongURL, "")
+	if plainURLInfo.ShortURL == protectedURLInfo.ShortURL || plainURLInfo.PasswordProtected {
+		t.Fatalf("short URL without password: protected short URL %s was reused", protectedURLInfo.ShortURL)
+	}
+}
+
+func testShortURLClickLimit(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+
+	maxClicks := int32(5)
+	urlInfo, err := ds.CreateNewShortURL(tEmail, tLongURL, "", false, &db.ShortURLOptions{MaxClicks: &maxClicks})
+	requireNoError(t, "click limited short URL", err)
+	if urlInfo.MaxClicks != maxClicks || urlInfo.ClicksExhausted() {
+		t.Fatalf("click limited short URL: unexpected URL info %+v", urlInfo)
+	}
+
+	// Concurrent clicks must not exceed the click budget.
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var recorded, rejected int
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := ds.UpdateShortURL(urlInfo.ShortURL, "", &db.ShortURLClick{IP: "127.0.0.1", Timestamp: time.Now().Unix()})
+			mtx.Lock()
+			defer mtx.Unlock()
+			switch {
+			case err == nil:
+				recorded++
+			case errors.Is(err, db.ErrorInactive):
+				rejected++
+			default:
+				t.Errorf("UpdateShortURL: unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if recorded != int(maxClicks) || rejected != 20-int(maxClicks) {
+		t.Fatalf("concurrent clicks: expected %d recorded clicks but got %d (%d rejected)", maxClicks, recorded, rejected)
+	}
+
+	gotURLInfo, err := ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if gotURLInfo.Clicks != maxClicks || !gotURLInfo.ClicksExhausted() {
+		t.Fatalf("concurrent clicks: unexpected URL info %+v", gotURLInfo)
+	}
+
+	clicks, err := ds.RetrieveShortURLClicks(tEmail, urlInfo.ShortURL)
+	requireNoError(t, "RetrieveShortURLClicks", err)
+	if len(clicks) != int(maxClicks) {
+		t.Fatalf("RetrieveShortURLClicks: expected %d clicks but got %d", maxClicks, len(clicks))
+	}
+
+	// Raising the click budget allows more clicks.
+	maxClicks++
+	requireNoError(t, "raise click budget", ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", &db.ShortURLOptions{MaxClicks: &maxClicks}))
+	requireNoError(t, "click after raising budget", ds.UpdateShortURL(urlInfo.ShortURL, "", &db.ShortURLClick{Timestamp: time.Now().Unix()}))
+	err = ds.UpdateShortURL(urlInfo.ShortURL, "", &db.ShortURLClick{Timestamp: time.Now().Unix()})
+	requireErrorIs(t, "click after budget is used up", err, db.ErrorInactive)
+
+	// Zero removes the limit.
+	var noLimit int32
+	requireNoError(t, "remove click budget", ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", &db.ShortURLOptions{MaxClicks: &noLimit}))
+	requireNoError(t, "click without budget", ds.UpdateShortURL(urlInfo.ShortURL, "", &db.ShortURLClick{Timestamp: time.Now().Unix()}))
+
+	err = ds.UpdateShortURL("unknown", "", &db.ShortURLClick{Timestamp: time.Now().Unix()})
+	requireErrorIs(t, "click on unknown short URL", err, db.ErrorBadRequest)
+}
+
+func testShortURLActiveWindow(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+
+	now := time.Now()
+	activeFrom := now.Add(time.Hour).Unix()
+	urlInfo, err := ds.CreateNewShortURL(tEmail, tLongURL, "", false, &db.ShortURLOptions{ActiveFrom: &activeFrom})
+	requireNoError(t, "scheduled short URL", err)
+	if urlInfo.ActiveFrom != activeFrom || urlInfo.IsActive(now) {
+		t.Fatalf("scheduled short URL: unexpected URL info %+v", urlInfo)
+	}
+
+	err = ds.UpdateShortURL(urlInfo.ShortURL, "", &db.ShortURLClick{Timestamp: now.Unix()})
+	requireErrorIs(t, "click before active window", err, db.ErrorInactive)
+
+	// Move the window to the past.
+	activeFrom = now.Add(-time.Hour).Unix()
+	activeUntil := now.Add(-time.Minute).Unix()
+	opts := &db.ShortURLOptions{ActiveFrom: &activeFrom, ActiveUntil: &activeUntil}
+	requireNoError(t, "past active window", ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", opts))
+	gotURLInfo, err := ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if gotURLInfo.ActiveFrom != activeFrom || gotURLInfo.ActiveUntil != activeUntil || gotURLInfo.IsActive(now) {
+		t.Fatalf("past active window: unexpected URL info %+v", gotURLInfo)
+	}
+
+	err = ds.UpdateShortURL(urlInfo.ShortURL, "", &db.ShortURLClick{Timestamp: now.Unix()})
+	requireErrorIs(t, "click after active window", err, db.ErrorInactive)
+
+	// Extend the window to include now.
+	activeUntil = now.Add(time.Hour).Unix()
+	requireNoError(t, "current active window", ds.UpdateUserShortURL(tEmail, urlInfo.ShortURL, "", &db.ShortURLOptions{ActiveUntil: &activeUntil}))
+	requireNoError(t, "click in active window", ds.UpdateShortURL(urlInfo.ShortURL, "", &db.ShortURLClick{Timestamp: now.Unix()}))
+
+	gotURLInfo, err = ds.RetrieveURLInfo(urlInfo.ShortURL)
+	requireNoError(t, "RetrieveURLInfo", err)
+	if gotURLInfo.Clicks != 1 || !gotURLInfo.IsActive(now) {
+		t.Fatalf("click in active window: unexpected URL info %+v", gotURLInfo)
+	}
+}
+
+func testShortURLReuse(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+
+	urlInfo := createURL(t, ds, tEmail, tLongURL, "")
+	if gotURLInfo := createURL(t, ds, tEmail, tLongURL, ""); gotURLInfo.ShortURL != urlInfo.ShortURL {
+		t.Fatalf("plain short URL: expected %s to be reused but got %s", urlInfo.ShortURL, gotURLInfo.ShortURL)
+	}
+
+	// A disabled short URL is never returned for a new link.
+	requireNoError(t, "ToggleShortLinkStatus", ds.ToggleShortLinkStatus(tEmail, urlInfo.ShortURL, true))
+	if gotURLInfo := createURL(t, ds, tEmail, tLongURL, ""); gotURLInfo.ShortURL == urlInfo.ShortURL || gotURLInfo.Disabled {
+		t.Fatalf("disabled short URL: %s was reused", urlInfo.ShortURL)
+	}
+
+	// Neither is a short URL with settings.
+	maxClicks := int32(1)
+	future := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name    string
+		longURL string
+		opts    *db.ShortURLOptions
+	}{{
+		name:    "click limited short URL",
+		longURL: tLongURL + "/max-clicks",
+		opts:    &db.ShortURLOptions{MaxClicks: &maxClicks},
+	}, {
+		name:    "scheduled short URL",
+		longURL: tLongURL + "/active-from",
+		opts:    &db.ShortURLOptions{ActiveFrom: &future},
+	}, {
+		name:    "short URL with an active window end",
+		longURL: tLongURL + "/active-until",
+		opts:    &db.ShortURLOptions{ActiveUntil: &future},
+	}}
+
+	for _, tt := range tests {
+		urlInfo, err := ds.CreateNewShortURL(tEmail, tt.longURL, "", false, tt.opts)
+		requireNoError(t, tt.name, err)
+
+		gotURLInfo := createURL(t, ds, tEmail, tt.longURL, "")
+		if gotURLInfo.ShortURL == urlInfo.ShortURL || gotURLInfo.MaxClicks != 0 || gotURLInfo.ActiveFrom != 0 || gotURLInfo.ActiveUntil != 0 {
+			t.Fatalf("%s: %s was reused for a link without settings", tt.name, urlInfo.ShortURL)
+		}
+	}
+}
+func testShortURLClickStats(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+	createUser(t, ds, "other", "other@example.com")
+	urlInfo := createURL(t, ds, tEmail, tLongURL, "")
+
+	day := db.StatsIntervalDay.Seconds()
+	from := db.StatsIntervalDay.BucketStart(time.Now().Unix()) - 2*day
+	to := from + 2*day
+	clicks := []*db.ShortURLClick{
+		{Browser: "Chrome", Device: "Pixel", DeviceType: "mobile", Referrer: "https://a.example", ReferrerDomain: "a.example", UTMSource: "x", Country: "NG", Timestamp: from + 10},
+		{Browser: "Chrome", Device: "Linux", DeviceType: "desktop", Referrer: "https://a.example/b", ReferrerDomain: "a.example", UTMMedium: "social", UTMCampaign: "launch", Country: "NG", Timestamp: from + 20},
+		{Browser: "Firefox", Device: "Linux", DeviceType: "desktop", Timestamp: from + day + 5},
+		// Outside the time range.
+		{Browser: "Safari", Device: "iPhone", DeviceType: "mobile", Timestamp: to},
+		{Browser: "Safari", Device: "iPhone", DeviceType: "mobile", Timestamp: from - 1},
+	}
+	for _, click := range clicks {
+		requireNoError(t, "UpdateShortURL", ds.UpdateShortURL(urlInfo.ShortURL, "", click))
+	}
+
+	stats, err := ds.RetrieveShortURLClickStats(tEmail, urlInfo.ShortURL, from, to, db.StatsIntervalDay)
+	requireNoError(t, "RetrieveShortURLClickStats", err)
+	if stats.Total != 3 || stats.From != from || stats.To != to || stats.Interval != db.StatsIntervalDay {
+		t.Fatalf("RetrieveShortURLClickStats: unexpected stats %+v", stats)
+	}
+
+	wantTimeSeries := []*db.ClickTimeBucket{{Timestamp: from, Clicks: 2}, {Timestamp: from + day, Clicks: 1}}
+	if !reflect.DeepEqual(stats.TimeSeries, wantTimeSeries) {
+		t.Fatalf("time series: expected %v but got %v", wantTimeSeries, stats.TimeSeries)
+	}
+
+	wantBreakdowns := map[string][]*db.ClickBreakdown{
+		"browsers":        {{Value: "Chrome", Clicks: 2}, {Value: "Firefox", Clicks: 1}},
+		"devices":         {{Value: "Linux", Clicks: 2}, {Value: "Pixel", Clicks: 1}},
+		"deviceTypes":     {{Value: "desktop", Clicks: 2}, {Value: "mobile", Clicks: 1}},
+		"referrers":       {{Value: "https://a.example", Clicks: 1}, {Value: "https://a.example/b", Clicks: 1}, {Value: db.UnknownStatsValue, Clicks: 1}},
+		"referrerDomains": {{Value: "a.example", Clicks: 2}, {Value: db.UnknownStatsValue, Clicks: 1}},
+		"utmSources":      {{Value: db.UnknownStatsValue, Clicks: 2}, {Value: "x", Clicks: 1}},
+		"utmMediums":      {{Value: db.UnknownStatsValue, Clicks: 2}, {Value: "social", Clicks: 1}},
+		"utmCampaigns":    {{Value: db.UnknownStatsValue, Clicks: 2}, {Value: "launch", Clicks: 1}},
+		"countries":       {{Value: "NG", Clicks: 2}, {Value: db.UnknownStatsValue, Clicks: 1}},
+	}
+	gotBreakdowns := map[string][]*db.ClickBreakdown{
+		"browsers":        stats.Browsers,
+		"devices":         stats.Devices,
+		"deviceTypes":     stats.DeviceTypes,
+		"referrers":       stats.Referrers,
+		"referrerDomains": stats.ReferrerDomains,
+		"utmSources":      stats.UTMSources,
+		"utmMediums":      stats.UTMMediums,
+		"utmCampaigns":    stats.UTMCampaigns,
+		"countries":       stats.Countries,
+	}
+	for name, want := range wantBreakdowns {
+		if !reflect.DeepEqual(gotBreakdowns[name], want) {
+			t.Fatalf("%s breakdown: expected %v but got %v", name, want, gotBreakdowns[name])
+		}
+	}
+
+	// Hourly buckets cover the whole time range.
+	stats, err = ds.RetrieveShortURLClickStats(tEmail, urlInfo.ShortURL, from, to, db.StatsIntervalHour)
+	requireNoError(t, "hourly stats", err)
+	if len(stats.TimeSeries) != 48 || stats.TimeSeries[0].Clicks != 2 || stats.TimeSeries[24].Clicks != 1 {
+		t.Fatalf("hourly stats: unexpected time series %v", stats.TimeSeries)
+	}
+
+	// Weekly buckets start on Mondays.
+	stats, err = ds.RetrieveShortURLClickStats(tEmail, urlInfo.ShortURL, from, to, db.StatsIntervalWeek)
+	requireNoError(t, "weekly stats", err)
+	for _, bucket := range stats.TimeSeries {
+		if weekday := time.Unix(bucket.Timestamp, 0).UTC().Weekday(); weekday != time.Monday {
+			t.Fatalf("weekly stats: expected buckets to start on Monday but got %s", weekday)
+		}
+	}
+	if stats.Total != 3 {
+		t.Fatalf("weekly stats: expected 3 clicks but got %d", stats.Total)
+	}
+
+	_, err = ds.RetrieveShortURLClickStats(tEmail, urlInfo.ShortURL, to, from, db.StatsIntervalDay)
+	requireErrorIs(t, "invalid time range", err, db.ErrorBadRequest)
+
+	_, err = ds.RetrieveShortURLClickStats(tEmail, urlInfo.ShortURL, from, to, "month")
+	requireErrorIs(t, "invalid interval", err, db.ErrorBadRequest)
+
+	_, err = ds.RetrieveShortURLClickStats("other@example.com", urlInfo.ShortURL, from, to, db.StatsIntervalDay)
+	requireErrorIs(t, "not owner", err, db.ErrorForbidden)
+
+	_, err = ds.RetrieveShortURLClickStats(tEmail, "unknown", from, to, db.StatsIntervalDay)
+	requireErrorIs(t, "unknown short URL", err, db.ErrorNotFound)
+}
+
+func testDeleteShortURLClicksBefore(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+	first := createURL(t, ds, tEmail, tLongURL, "")
+	second := createURL(t, ds, tEmail, "https://example.org", "")
+
+	for _, click := range []struct {
+		shortURL  string
+		timestamp int64
+	}{{first.ShortURL, 1000}, {first.ShortURL, 3000}, {second.ShortURL, 1500}, {second.ShortURL, 2000}} {
+		err := ds.UpdateShortURL(click.shortURL, "", &db.ShortURLClick{IP: "127.0.0.1", Timestamp: click.timestamp})
+		requireNoError(t, "click", err)
+	}
+
+	n, err := ds.DeleteShortURLClicksBefore(2000)
+	requireNoError(t, "DeleteShortURLClicksBefore", err)
+	if n != 2 {
+		t.Fatalf("DeleteShortURLClicksBefore: expected 2 deleted clicks but got %d", n)
+	}
+
+	for _, want := range []struct {
+		shortURL  string
+		timestamp int64
+	}{{first.ShortURL, 3000}, {second.ShortURL, 2000}} {
+		clicks, err := ds.RetrieveShortURLClicks(tEmail, want.shortURL)
+		requireNoError(t, "RetrieveShortURLClicks", err)
+		if len(clicks) != 1 || clicks[0].Timestamp != want.timestamp {
+			t.Fatalf("RetrieveShortURLClicks: expected a single click at %d but got %v", want.timestamp, clicks)
+		}
+
+		// Click counters are kept.
+		urlInfo, err := ds.RetrieveURLInfo(want.shortURL)
+		requireNoError(t, "RetrieveURLInfo", err)
+		if urlInfo.Clicks != 2 {
+			t.Fatalf("RetrieveURLInfo: expected 2 clicks but got %d", urlInfo.Clicks)
+		}
+	}
+
+	n, err = ds.DeleteShortURLClicksBefore(2000)
+	requireNoError(t, "DeleteShortURLClicksBefore again", err)
+	if n != 0 {
+		t.Fatalf("DeleteShortURLClicksBefore again: expected 0 deleted clicks but got %d", n)
+	}
+}
+
+func testSessions(t *testing.T, ds db.DataStore) {
+	now := time.Now().Unix()
+	newSession := func(id, email string, expiresAt int64) *db.Session {
+		session := &db.Session{
+			ID:               id,
+			Email:            email,
+			RefreshTokenHash: []byte("hash-" + id),
+			CreatedAt:        now,
+			ExpiresAt:        expiresAt,
+		}
+		requireNoError(t, "CreateSession", ds.CreateSession(session))
+		return session
+	}
+
+	first := newSession("first", tEmail, now+3600)
+	newSession("second", tEmail, now+3600)
+	newSession("expired", tEmail, now-10)
+	newSession("other", "other@example.com", now+3600)
+
+	requireErrorIs(t, "duplicate ID", ds.CreateSession(first), db.ErrorBadRequest)
+	requireErrorIs(t, "missing email", ds.CreateSession(&db.Session{ID: "missing"}), db.ErrorBadRequest)
+
+	session, err := ds.RetrieveSession(first.ID)
+	requireNoError(t, "RetrieveSession", err)
+	if !reflect.DeepEqual(session, first) {
+		t.Fatalf("RetrieveSession: expected %+v but got %+v", first, session)
+	}
+
+	_, err = ds.RetrieveSession("unknown")
+	requireErrorIs(t, "unknown session", err, db.ErrorNotFound)
+
+	// The refresh token is only rotated if the old hash matches.
+	newHash := []byte("new-hash")
+	err = ds.RotateSessionRefreshToken(first.ID, []byte("wrong"), newHash, now+7200)
+	requireErrorIs(t, "wrong hash", err, db.ErrorNotFound)
+
+	requireNoError(t, "RotateSessionRefreshToken", ds.RotateSessionRefreshToken(first.ID, first.RefreshTokenHash, newHash, now+7200))
+	err = ds.RotateSessionRefreshToken(first.ID, first.RefreshTokenHash, []byte("other-hash"), now+7200)
+	requireErrorIs(t, "reused hash", err, db.ErrorNotFound)
+
+	session, err = ds.RetrieveSession(first.ID)
+	requireNoError(t, "RetrieveSession", err)
+	if string(session.RefreshTokenHash) != string(newHash) || session.ExpiresAt != now+7200 {
+		t.Fatalf("RetrieveSession: unexpected rotated session %+v", session)
+	}
+
+	err = ds.RotateSessionRefreshToken("expired", []byte("hash-expired"), newHash, now+7200)
+	requireErrorIs(t, "expired session", err, db.ErrorNotFound)
+
+	// Revoking is idempotent and keeps the first revocation time.
+	requireNoError(t, "RevokeSession", ds.RevokeSession(first.ID))
+	session, err = ds.RetrieveSession(first.ID)
+	requireNoError(t, "RetrieveSession", err)
+	if session.RevokedAt == 0 || session.IsActive(time.Unix(now, 0)) {
+		t.Fatalf("RetrieveSession: expected a revoked session but got %+v", session)
+	}
+
+	requireNoError(t, "RevokeSession again", ds.RevokeSession(first.ID))
+	requireErrorIs(t, "revoke unknown session", ds.RevokeSession("unknown"), db.ErrorNotFound)
+
+	err = ds.RotateSessionRefreshToken(first.ID, newHash, []byte("other-hash"), now+7200)
+	requireErrorIs(t, "revoked session", err, db.ErrorNotFound)
+
+	// Only active sessions of the user are revoked.
+	n, err := ds.RevokeUserSessions(tEmail)
+	requireNoError(t, "RevokeUserSessions", err)
+	if n != 1 {
+		t.Fatalf("RevokeUserSessions: expected 1 revoked session but got %d", n)
+	}
+
+	session, err = ds.RetrieveSession("other")
+	requireNoError(t, "RetrieveSession", err)
+	if !session.IsActive(time.Unix(now, 0)) {
+		t.Fatal("RevokeUserSessions: expected the session of another user to be active")
+	}
+
+	n, err = ds.DeleteExpiredSessions(now)
+	requireNoError(t, "DeleteExpiredSessions", err)
+	if n != 1 {
+		t.Fatalf("DeleteExpiredSessions: expected 1 deleted session but got %d", n)
+	}
+
+	_, err = ds.RetrieveSession("expired")
+	requireErrorIs(t, "deleted session", err, db.ErrorNotFound)
+}
+
+func testAPIKeys(t *testing.T, ds db.DataStore) {
+	newKey := func(id, email string, createdAt int64, scopes ...string) *db.APIKey {
+		key := &db.APIKey{
+			ID:        id,
+			Email:     email,
+			Name:      "key " + id,
+			Prefix:    "bob_" + id,
+			KeyHash:   []byte("hash-" + id),
+			Scopes:    scopes,
+			CreatedAt: createdAt,
+		}
+		requireNoError(t, "CreateAPIKey", ds.CreateAPIKey(key))
+		return key
+	}
+
+	second := newKey("second", tEmail, 2000, "links:read")
+	first := newKey("first", tEmail, 1000, "links:write", "stats:read")
+	other := newKey("other", "other@example.com", 1500)
+
+	requireErrorIs(t, "duplicate ID", ds.CreateAPIKey(&db.APIKey{ID: first.ID, Email: tEmail, KeyHash: []byte("new")}), db.ErrorBadRequest)
+	requireErrorIs(t, "duplicate hash", ds.CreateAPIKey(&db.APIKey{ID: "new", Email: tEmail, KeyHash: first.KeyHash}), db.ErrorBadRequest)
+	requireErrorIs(t, "missing hash", ds.CreateAPIKey(&db.APIKey{ID: "new", Email: tEmail}), db.ErrorBadRequest)
+
+	key, err := ds.RetrieveAPIKey(first.KeyHash)
+	requireNoError(t, "RetrieveAPIKey", err)
+	if !reflect.DeepEqual(key, first) {
+		t.Fatalf("RetrieveAPIKey: expected %+v but got %+v", first, key)
+	}
+
+	if !key.HasScope("stats:read") || key.HasScope("links:read") {
+		t.Fatalf("HasScope: unexpected scopes %v", key.Scopes)
+	}
+
+	_, err = ds.RetrieveAPIKey([]byte("unknown"))
+	requireErrorIs(t, "unknown key", err, db.ErrorNotFound)
+
+	keys, err := ds.RetrieveUserAPIKeys(tEmail)
+	requireNoError(t, "RetrieveUserAPIKeys", err)
+	if len(keys) != 2 || keys[0].ID != first.ID || keys[1].ID != second.ID {
+		t.Fatalf("RetrieveUserAPIKeys: expected keys [first second] but got %v", keys)
+	}
+
+	keys, err = ds.RetrieveUserAPIKeys("unknown@example.com")
+	requireNoError(t, "RetrieveUserAPIKeys unknown user", err)
+	if len(keys) != 0 {
+		t.Fatalf("RetrieveUserAPIKeys unknown user: expected no keys but got %d", len(keys))
+	}
+
+	requireNoError(t, "UpdateAPIKeyLastUsed", ds.UpdateAPIKeyLastUsed(second.ID, 3000))
+	requireErrorIs(t, "update unknown key", ds.UpdateAPIKeyLastUsed("unknown", 3000), db.ErrorNotFound)
+
+	key, err = ds.RetrieveAPIKey(second.KeyHash)
+	requireNoError(t, "RetrieveAPIKey", err)
+	if key.LastUsedAt != 3000 {
+		t.Fatalf("RetrieveAPIKey: expected last used at 3000 but got %d", key.LastUsedAt)
+	}
+
+	// Keys can only be deleted by their owner.
+	requireErrorIs(t, "delete key of another user", ds.DeleteAPIKey(tEmail, other.ID), db.ErrorNotFound)
+	requireNoError(t, "DeleteAPIKey", ds.DeleteAPIKey(tEmail, first.ID))
+	requireErrorIs(t, "delete deleted key", ds.DeleteAPIKey(tEmail, first.ID), db.ErrorNotFound)
+
+	_, err = ds.RetrieveAPIKey(first.KeyHash)
+	requireErrorIs(t, "deleted key", err, db.ErrorNotFound)
+
+	_, err = ds.RetrieveAPIKey(other.KeyHash)
+	requireNoError(t, "RetrieveAPIKey other", err)
+}
+
+func testUserIdentities(t *testing.T, ds db.DataStore) {
+	const provider = "https://idp.example.com"
+	identity := &db.UserIdentity{Provider: provider, Subject: "sub-1", Email: "sso@example.com", CreatedAt: 1000}
+
+	_, err := ds.RetrieveIdentityUser(provider, identity.Subject)
+	requireErrorIs(t, "unknown identity", err, db.ErrorNotFound)
+
+	requireNoError(t, "CreateIdentityUser", ds.CreateIdentityUser("ssouser", identity))
+
+	user, err := ds.RetrieveIdentityUser(provider, identity.Subject)
+	requireNoError(t, "RetrieveIdentityUser", err)
+	if user.Email != identity.Email || user.Username != "ssouser" || !user.EmailVerified {
+		t.Fatalf("RetrieveIdentityUser: unexpected user %+v", user)
+	}
+
+	// Users created for an identity cannot log in with a password.
+	for _, password := range []string{"", tPassword} {
+		if _, err := ds.LoginUser(identity.Email, []byte(password)); err == nil {
+			t.Fatalf("LoginUser: expected an error for password %q", password)
+		}
+	}
+
+	createUser(t, ds, tUsername, tEmail)
+	err = ds.CreateIdentityUser("newuser", &db.UserIdentity{Provider: provider, Subject: "sub-2", Email: tEmail})
+	requireErrorIs(t, "existing email", err, db.ErrorBadRequest)
+	err = ds.CreateIdentityUser(tUsername, &db.UserIdentity{Provider: provider, Subject: "sub-2", Email: "new@example.com"})
+	requireErrorIs(t, "existing username", err, db.ErrorBadRequest)
+	err = ds.CreateIdentityUser("newuser", &db.UserIdentity{Provider: provider, Subject: identity.Subject, Email: "new@example.com"})
+	requireErrorIs(t, "linked identity", err, db.ErrorBadRequest)
+
+	// A failed creation does not leave a user behind.
+	exists, err := ds.UsernameExists("newuser")
+	requireNoError(t, "UsernameExists", err)
+	if exists {
+		t.Fatal("CreateIdentityUser: expected no user to be created for a linked identity")
+	}
+
+	linked := &db.UserIdentity{Provider: provider, Subject: "sub-2", Email: tEmail, CreatedAt: 2000}
+	requireNoError(t, "LinkUserIdentity", ds.LinkUserIdentity(linked))
+	requireErrorIs(t, "link linked identity", ds.LinkUserIdentity(linked), db.ErrorBadRequest)
+	err = ds.LinkUserIdentity(&db.UserIdentity{Provider: provider, Subject: "sub-3", Email: "unknown@example.com"})
+	requireErrorIs(t, "link unknown user", err, db.ErrorBadRequest)
+
+	user, err = ds.RetrieveIdentityUser(provider, linked.Subject)
+	requireNoError(t, "RetrieveIdentityUser", err)
+	if user.Email != tEmail || user.Username != tUsername || !user.EmailVerified {
+		t.Fatalf("RetrieveIdentityUser: unexpected user %+v", user)
+	}
+
+	// Linking an identity keeps the password of the user.
+	_, err = ds.LoginUser(tEmail, []byte(tPassword))
+	requireNoError(t, "LoginUser", err)
+
+	_, err = ds.RetrieveIdentityUser("https://other.example.com", linked.Subject)
+	requireErrorIs(t, "other provider", err, db.ErrorNotFound)
+}
+
+func testUserTokens(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+
+	user, err := ds.RetrieveUserInfo(tEmail)
+	requireNoError(t, "RetrieveUserInfo", err)
+	if user.EmailVerified {
+		t.Fatal("RetrieveUserInfo: expected the email of a new user to be unverified")
+	}
+
+	requireNoError(t, "SetEmailVerified", ds.SetEmailVerified(tEmail))
+	user, err = ds.RetrieveUserInfo(tEmail)
+	requireNoError(t, "RetrieveUserInfo", err)
+	if !user.EmailVerified {
+		t.Fatal("SetEmailVerified: expected the email to be verified")
+	}
+	requireErrorIs(t, "SetEmailVerified unknown user", ds.SetEmailVerified("unknown@example.com"), db.ErrorBadRequest)
+
+	now := time.Now().Unix()
+	newToken := func(hash, purpose string, expiresAt int64) *db.UserToken {
+		return &db.UserToken{TokenHash: []byte(hash), Email: tEmail, Purpose: purpose, CreatedAt: now, ExpiresAt: expiresAt}
+	}
+
+	for _, token := range []*db.UserToken{
+		newToken("reset-1", db.UserTokenResetPassword, now+60),
+		newToken("reset-2", db.UserTokenResetPassword, now+60),
+		newToken("verify-1", db.UserTokenVerifyEmail, now+60),
+		newToken("expired", db.UserTokenResetPassword, now-60),
+	} {
+		requireNoError(t, "CreateUserToken", ds.CreateUserToken(token))
+	}
+
+	err = ds.CreateUserToken(newToken("reset-1", db.UserTokenResetPassword, now+60))
+	requireErrorIs(t, "duplicate token", err, db.ErrorBadRequest)
+	unknownUserToken := newToken("unknown", db.UserTokenResetPassword, now+60)
+	unknownUserToken.Email = "unknown@example.com"
+	requireErrorIs(t, "unknown user token", ds.CreateUserToken(unknownUserToken), db.ErrorBadRequest)
+
+	_, err = ds.ConsumeUserToken([]byte("expired"), db.UserTokenResetPassword, now)
+	requireErrorIs(t, "expired token", err, db.ErrorNotFound)
+	_, err = ds.ConsumeUserToken([]byte("verify-1"), db.UserTokenResetPassword, now)
+	requireErrorIs(t, "token with another purpose", err, db.ErrorNotFound)
+
+	token, err := ds.ConsumeUserToken([]byte("reset-1"), db.UserTokenResetPassword, now)
+	requireNoError(t, "ConsumeUserToken", err)
+	if token.Email != tEmail || token.Purpose != db.UserTokenResetPassword || token.ExpiresAt != now+60 {
+		t.Fatalf("ConsumeUserToken: unexpected token %+v", token)
+	}
+
+	// Tokens can only be used once and consuming a token deletes the other
+	// tokens of the user with the same purpose.
+	_, err = ds.ConsumeUserToken([]byte("reset-1"), db.UserTokenResetPassword, now)
+	requireErrorIs(t, "consumed token", err, db.ErrorNotFound)
+	_, err = ds.ConsumeUserToken([]byte("reset-2"), db.UserTokenResetPassword, now)
+	requireErrorIs(t, "other token", err, db.ErrorNotFound)
+	_, err = ds.ConsumeUserToken([]byte("verify-1"), db.UserTokenVerifyEmail, now)
+	requireNoError(t, "ConsumeUserToken", err)
+
+	requireNoError(t, "CreateUserToken", ds.CreateUserToken(newToken("expired-2", db.UserTokenVerifyEmail, now-60)))
+	requireNoError(t, "CreateUserToken", ds.CreateUserToken(newToken("active", db.UserTokenVerifyEmail, now+60)))
+	n, err := ds.DeleteExpiredUserTokens(now)
+	requireNoError(t, "DeleteExpiredUserTokens", err)
+	if n != 1 {
+		t.Fatalf("DeleteExpiredUserTokens: expected 1 deleted token but got %d", n)
+	}
+	_, err = ds.ConsumeUserToken([]byte("active"), db.UserTokenVerifyEmail, now)
+	requireNoError(t, "ConsumeUserToken", err)
+
+	requireNoError(t, "ResetUserPassword", ds.ResetUserPassword(tEmail, []byte("new password")))
+	_, err = ds.LoginUser(tEmail, []byte(tPassword))
+	requireErrorIs(t, "old password", err, db.ErrorBadRequest)
+	_, err = ds.LoginUser(tEmail, []byte("new password"))
+	requireNoError(t, "LoginUser", err)
+	requireErrorIs(t, "ResetUserPassword unknown user", ds.ResetUserPassword("unknown@example.com", []byte("password")), db.ErrorBadRequest)
+}
+
+func testUpdateUser(t *testing.T, ds db.DataStore) {
+	const newEmail = "new@example.com"
+	createUser(t, ds, tUsername, tEmail)
+	createUser(t, ds, "other", "other@example.com")
+
+	requireErrorIs(t, "taken username", ds.UpdateUsername(tEmail, "other"), db.ErrorBadRequest)
+	requireErrorIs(t, "empty username", ds.UpdateUsername(tEmail, ""), db.ErrorBadRequest)
+	requireErrorIs(t, "UpdateUsername unknown user", ds.UpdateUsername("unknown@example.com", "unknown"), db.ErrorBadRequest)
+	requireNoError(t, "UpdateUsername", ds.UpdateUsername(tEmail, "newname"))
+	requireNoError(t, "UpdateUsername same username", ds.UpdateUsername(tEmail, "newname"))
+
+	exists, err := ds.UsernameExists(tUsername)
+	requireNoError(t, "UsernameExists", err)
+	if exists {
+		t.Fatal("UsernameExists: expected the old username to be free")
+	}
+
+	urlInfo := createURL(t, ds, tEmail, tLongURL, "")
+	requireNoError(t, "SetEmailVerified", ds.SetEmailVerified(tEmail))
+	requireNoError(t, "CreateSession", ds.CreateSession(&db.Session{ID: "session", Email: tEmail, RefreshTokenHash: []byte("hash"), CreatedAt: 1000, ExpiresAt: time.Now().Unix() + 3600}))
+	requireNoError(t, "CreateAPIKey", ds.CreateAPIKey(&db.APIKey{ID: "key", Email: tEmail, Name: "key", Prefix: "bob_key", KeyHash: []byte("hash-key"), Scopes: []string{"links:read"}, CreatedAt: 1000}))
+	requireNoError(t, "LinkUserIdentity", ds.LinkUserIdentity(&db.UserIdentity{Provider: "https://idp.example.com", Subject: "sub", Email: tEmail, CreatedAt: 1000}))
+	token := &db.UserToken{TokenHash: []byte("verify"), Email: tEmail, Purpose: db.UserTokenVerifyEmail, CreatedAt: 1000, ExpiresAt: time.Now().Unix() + 3600}
+	requireNoError(t, "CreateUserToken", ds.CreateUserToken(token))
+
+	requireErrorIs(t, "taken email", ds.ChangeUserEmail(tEmail, "other@example.com"), db.ErrorBadRequest)
+	requireErrorIs(t, "invalid email", ds.ChangeUserEmail(tEmail, "invalid"), db.ErrorBadRequest)
+	requireErrorIs(t, "ChangeUserEmail unknown user", ds.ChangeUserEmail("unknown@example.com", "unknown2@example.com"), db.ErrorBadRequest)
+	requireNoError(t, "ChangeUserEmail", ds.ChangeUserEmail(tEmail, newEmail))
+
+	_, err = ds.RetrieveUserInfo(tEmail)
+	requireErrorIs(t, "old email", err, db.ErrorBadRequest)
+	user, err := ds.LoginUser(newEmail, []byte(tPassword))
+	requireNoError(t, "LoginUser", err)
+	if user.Email != newEmail || user.Username != "newname" || user.EmailVerified || user.TotalLinks != 1 || !user.HasPassword {
+		t.Fatalf("LoginUser: unexpected user %+v", user)
+	}
+
+	// The user's data moves to the new email.
+	_, err = ds.RetrieveUserURLInfo(newEmail, urlInfo.ShortURL)
+	requireNoError(t, "RetrieveUserURLInfo", err)
+	session, err := ds.RetrieveSession("session")
+	requireNoError(t, "RetrieveSession", err)
+	if session.Email != newEmail {
+		t.Fatalf("RetrieveSession: expected email %q but got %q", newEmail, session.Email)
+	}
+	key, err := ds.RetrieveAPIKey([]byte("hash-key"))
+	requireNoError(t, "RetrieveAPIKey", err)
+	if key.Email != newEmail {
+		t.Fatalf("RetrieveAPIKey: expected email %q but got %q", newEmail, key.Email)
+	}
+	user, err = ds.RetrieveIdentityUser("https://idp.example.com", "sub")
+	requireNoError(t, "RetrieveIdentityUser", err)
+	if user.Email != newEmail {
+		t.Fatalf("RetrieveIdentityUser: expected email %q but got %q", newEmail, user.Email)
+	}
+
+	// Tokens sent to the old email are deleted.
+	_, err = ds.ConsumeUserToken(token.TokenHash, db.UserTokenVerifyEmail, 1000)
+	requireErrorIs(t, "token of the old email", err, db.ErrorNotFound)
+}
+
+func testDeleteUser(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+	createUser(t, ds, "other", "other@example.com")
+	first := createURL(t, ds, tEmail, tLongURL, "")
+	second := createURL(t, ds, tEmail, "https://example.org", "")
+	other := createURL(t, ds, "other@example.com", tLongURL, "")
+	requireNoError(t, "RecordShortURLClicks", ds.RecordShortURLClicks(map[string][]*db.ShortURLClick{
+		first.ShortURL: {{IP: "127.0.0.1", Timestamp: 1000}},
+		other.ShortURL: {{IP: "127.0.0.1", Timestamp: 1000}},
+	}))
+	requireNoError(t, "CreateSession", ds.CreateSession(&db.Session{ID: "session", Email: tEmail, RefreshTokenHash: []byte("hash"), CreatedAt: 1000, ExpiresAt: time.Now().Unix() + 3600}))
+	requireNoError(t, "CreateAPIKey", ds.CreateAPIKey(&db.APIKey{ID: "key", Email: tEmail, Name: "key", Prefix: "bob_key", KeyHash: []byte("hash-key"), Scopes: []string{"links:read"}, CreatedAt: 1000}))
+	requireNoError(t, "LinkUserIdentity", ds.LinkUserIdentity(&db.UserIdentity{Provider: "https://idp.example.com", Subject: "sub", Email: tEmail, CreatedAt: 1000}))
+
+	shortURLs, err := ds.DeleteUser(tEmail)
+	requireNoError(t, "DeleteUser", err)
+	sort.Strings(shortURLs)
+	wantShortURLs := []string{first.ShortURL, second.ShortURL}
+	sort.Strings(wantShortURLs)
+	if !reflect.DeepEqual(shortURLs, wantShortURLs) {
+		t.Fatalf("DeleteUser: expected short URLs %v but got %v", wantShortURLs, shortURLs)
+	}
+
+	_, err = ds.DeleteUser(tEmail)
+	requireErrorIs(t, "deleted user", err, db.ErrorBadRequest)
+	_, err = ds.RetrieveUserInfo(tEmail)
+	requireErrorIs(t, "RetrieveUserInfo", err, db.ErrorBadRequest)
+	_, err = ds.RetrieveURLInfo(first.ShortURL)
+	requireErrorIs(t, "RetrieveURLInfo", err, db.ErrorNotFound)
+	_, err = ds.RetrieveSession("session")
+	requireErrorIs(t, "RetrieveSession", err, db.ErrorNotFound)
+	_, err = ds.RetrieveAPIKey([]byte("hash-key"))
+	requireErrorIs(t, "RetrieveAPIKey", err, db.ErrorNotFound)
+	_, err = ds.RetrieveIdentityUser("https://idp.example.com", "sub")
+	requireErrorIs(t, "RetrieveIdentityUser", err, db.ErrorNotFound)
+
+	// The email and username can be used again, without the old data.
+	createUser(t, ds, tUsername, tEmail)
+	user, err := ds.RetrieveUserInfo(tEmail)
+	requireNoError(t, "RetrieveUserInfo", err)
+	if user.TotalLinks != 0 {
+		t.Fatalf("RetrieveUserInfo: expected no links but got %d", user.TotalLinks)
+	}
+	reused := createURL(t, ds, tEmail, tLongURL, first.ShortURL)
+	clicks, err := ds.RetrieveShortURLClicks(tEmail, reused.ShortURL)
+	requireNoError(t, "RetrieveShortURLClicks", err)
+	if len(clicks) != 0 {
+		t.Fatalf("RetrieveShortURLClicks: expected the clicks of the deleted short URL to be deleted but got %d", len(clicks))
+	}
+
+	// Other users are not affected.
+	clicks, err = ds.RetrieveShortURLClicks("other@example.com", other.ShortURL)
+	requireNoError(t, "RetrieveShortURLClicks", err)
+	if len(clicks) != 1 {
+		t.Fatalf("RetrieveShortURLClicks: expected 1 click but got %d", len(clicks))
+	}
+}
+
+func testUserTOTP(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+
+	_, err := ds.RetrieveUserTOTP(tEmail)
+	requireErrorIs(t, "TOTP not set up", err, db.ErrorNotFound)
+	_, err = ds.RetrieveUserTOTP("unknown@example.com")
+	requireErrorIs(t, "RetrieveUserTOTP unknown user", err, db.ErrorBadRequest)
+	requireErrorIs(t, "EnableUserTOTP without secret", ds.EnableUserTOTP(tEmail, nil), db.ErrorBadRequest)
+	requireErrorIs(t, "SetUserTOTPSecret unknown user", ds.SetUserTOTPSecret("unknown@example.com", []byte("secret")), db.ErrorBadRequest)
+
+	// A secret that is not enabled can be replaced.
+	requireNoError(t, "SetUserTOTPSecret", ds.SetUserTOTPSecret(tEmail, []byte("old secret")))
+	requireNoError(t, "SetUserTOTPSecret", ds.SetUserTOTPSecret(tEmail, []byte("secret")))
+	totp, err := ds.RetrieveUserTOTP(tEmail)
+	requireNoError(t, "RetrieveUserTOTP", err)
+	if want := (&db.UserTOTP{Secret: []byte("secret")}); !reflect.DeepEqual(totp, want) {
+		t.Fatalf("RetrieveUserTOTP: expected %+v but got %+v", want, totp)
+	}
+
+	requireNoError(t, "UseUserTOTPStep", ds.UseUserTOTPStep(tEmail, 100))
+	requireErrorIs(t, "same step", ds.UseUserTOTPStep(tEmail, 100), db.ErrorBadRequest)
+	requireErrorIs(t, "earlier step", ds.UseUserTOTPStep(tEmail, 99), db.ErrorBadRequest)
+	requireNoError(t, "UseUserTOTPStep", ds.UseUserTOTPStep(tEmail, 101))
+
+	requireNoError(t, "EnableUserTOTP", ds.EnableUserTOTP(tEmail, [][]byte{[]byte("code-1"), []byte("code-2")}))
+	requireErrorIs(t, "SetUserTOTPSecret enabled", ds.SetUserTOTPSecret(tEmail, []byte("new secret")), db.ErrorBadRequest)
+	totp, err = ds.RetrieveUserTOTP(tEmail)
+	requireNoError(t, "RetrieveUserTOTP", err)
+	if want := (&db.UserTOTP{Secret: []byte("secret"), Enabled: true, LastStep: 101, RecoveryCodes: 2}); !reflect.DeepEqual(totp, want) {
+		t.Fatalf("RetrieveUserTOTP: expected %+v but got %+v", want, totp)
+	}
+
+	user, err := ds.LoginUser(tEmail, []byte(tPassword))
+	requireNoError(t, "LoginUser", err)
+	if !user.TOTPEnabled {
+		t.Fatal("LoginUser: expected TOTP to be enabled")
+	}
+
+	// Recovery codes can only be used once.
+	requireNoError(t, "ConsumeUserRecoveryCode", ds.ConsumeUserRecoveryCode(tEmail, []byte("code-1")))
+	requireErrorIs(t, "used recovery code", ds.ConsumeUserRecoveryCode(tEmail, []byte("code-1")), db.ErrorNotFound)
+	requireErrorIs(t, "unknown recovery code", ds.ConsumeUserRecoveryCode(tEmail, []byte("unknown")), db.ErrorNotFound)
+
+	// Enabling TOTP again replaces the recovery codes.
+	requireNoError(t, "EnableUserTOTP", ds.EnableUserTOTP(tEmail, [][]byte{[]byte("code-3")}))
+	requireErrorIs(t, "replaced recovery code", ds.ConsumeUserRecoveryCode(tEmail, []byte("code-2")), db.ErrorNotFound)
+
+	// TOTP moves to the new email.
+	const newEmail = "new@example.com"
+	requireNoError(t, "ChangeUserEmail", ds.ChangeUserEmail(tEmail, newEmail))
+	totp, err = ds.RetrieveUserTOTP(newEmail)
+	requireNoError(t, "RetrieveUserTOTP", err)
+	if !totp.Enabled || totp.RecoveryCodes != 1 {
+		t.Fatalf("RetrieveUserTOTP: unexpected settings after changing the email %+v", totp)
+	}
+	requireNoError(t, "ConsumeUserRecoveryCode", ds.ConsumeUserRecoveryCode(newEmail, []byte("code-3")))
+
+	requireNoError(t, "DisableUserTOTP", ds.DisableUserTOTP(newEmail))
+	_, err = ds.RetrieveUserTOTP(newEmail)
+	requireErrorIs(t, "disabled TOTP", err, db.ErrorNotFound)
+	user, err = ds.RetrieveUserInfo(newEmail)
+	requireNoError(t, "RetrieveUserInfo", err)
+	if user.TOTPEnabled {
+		t.Fatal("RetrieveUserInfo: expected TOTP to be disabled")
+	}
+	requireErrorIs(t, "DisableUserTOTP unknown user", ds.DisableUserTOTP("unknown@example.com"), db.ErrorBadRequest)
+
+	// Deleting the user deletes the recovery codes.
+	requireNoError(t, "SetUserTOTPSecret", ds.SetUserTOTPSecret(newEmail, []byte("secret")))
+	requireNoError(t, "EnableUserTOTP", ds.EnableUserTOTP(newEmail, [][]byte{[]byte("code-4")}))
+	_, err = ds.DeleteUser(newEmail)
+	requireNoError(t, "DeleteUser", err)
+	createUser(t, ds, tUsername, newEmail)
+	requireErrorIs(t, "recovery code of the deleted user", ds.ConsumeUserRecoveryCode(newEmail, []byte("code-4")), db.ErrorNotFound)
+	_, err = ds.RetrieveUserTOTP(newEmail)
+	requireErrorIs(t, "TOTP of the deleted user", err, db.ErrorNotFound)
+}
+
+func testLoginAttempts(t *testing.T, ds db.DataStore) {
+	const key = "account:" + tEmail
+	attempts, err := ds.RetrieveLoginAttempts(key)
+	requireNoError(t, "RetrieveLoginAttempts", err)
+	if !reflect.DeepEqual(attempts, &db.LoginAttempts{}) {
+		t.Fatalf("RetrieveLoginAttempts: expected no attempts but got %+v", attempts)
+	}
+
+	for i := 1; i <= 3; i++ {
+		attempts, err = ds.RecordFailedLogin(key, int64(100+i))
+		requireNoError(t, "RecordFailedLogin", err)
+		if want := (&db.LoginAttempts{Failures: i, LastFailure: int64(100 + i)}); !reflect.DeepEqual(attempts, want) {
+			t.Fatalf("RecordFailedLogin: expected %+v but got %+v", want, attempts)
+		}
+	}
+
+	requireNoError(t, "LockLogin", ds.LockLogin(key, 200))
+	attempts, err = ds.RetrieveLoginAttempts(key)
+	requireNoError(t, "RetrieveLoginAttempts", err)
+	if want := (&db.LoginAttempts{Failures: 3, LastFailure: 103, LockedUntil: 200}); !reflect.DeepEqual(attempts, want) {
+		t.Fatalf("RetrieveLoginAttempts: expected %+v but got %+v", want, attempts)
+	}
+
+	attempts, err = ds.RecordFailedLogin(key, 150)
+	requireNoError(t, "RecordFailedLogin", err)
+	if want := (&db.LoginAttempts{Failures: 4, LastFailure: 150, LockedUntil: 200}); !reflect.DeepEqual(attempts, want) {
+		t.Fatalf("RecordFailedLogin: expected %+v but got %+v", want, attempts)
+	}
+
+	// Keys can be locked without failed attempts.
+	const ipKey = "ip:127.0.0.1"
+	requireNoError(t, "LockLogin", ds.LockLogin(ipKey, 300))
+	attempts, err = ds.RetrieveLoginAttempts(ipKey)
+	requireNoError(t, "RetrieveLoginAttempts", err)
+	if want := (&db.LoginAttempts{LockedUntil: 300}); !reflect.DeepEqual(attempts, want) {
+		t.Fatalf("RetrieveLoginAttempts: expected %+v but got %+v", want, attempts)
+	}
+
+	// Attempts are stale once both the last failure and the lock are over.
+	n, err := ds.DeleteStaleLoginAttempts(250)
+	requireNoError(t, "DeleteStaleLoginAttempts", err)
+	if n != 1 {
+		t.Fatalf("DeleteStaleLoginAttempts: expected 1 deleted key but got %d", n)
+	}
+
+	attempts, err = ds.RetrieveLoginAttempts(key)
+	requireNoError(t, "RetrieveLoginAttempts", err)
+	if !reflect.DeepEqual(attempts, &db.LoginAttempts{}) {
+		t.Fatalf("RetrieveLoginAttempts: expected stale attempts to be deleted but got %+v", attempts)
+	}
+
+	requireNoError(t, "ClearLoginAttempts", ds.ClearLoginAttempts(ipKey))
+	requireNoError(t, "ClearLoginAttempts unknown key", ds.ClearLoginAttempts(ipKey))
+	attempts, err = ds.RetrieveLoginAttempts(ipKey)
+	requireNoError(t, "RetrieveLoginAttempts", err)
+	if !reflect.DeepEqual(attempts, &db.LoginAttempts{}) {
+		t.Fatalf("RetrieveLoginAttempts: expected cleared attempts but got %+v", attempts)
+	}
+}
+
+func testPasswordRehash(t *testing.T, ds db.DataStore, hasher *tHasher) {
+	bcryptCfg := db.DefaultPasswordHashConfig()
+	bcryptCfg.Algorithm = db.PasswordAlgorithmBcrypt
+	bcryptCfg.BcryptCost = 4
+	argon2idCfg := db.DefaultPasswordHashConfig()
+	argon2idCfg.Argon2idMemory = 1024
+	argon2idCfg.Argon2idIterations = 1
+	argon2idCfg.Argon2idParallelism = 1
+
+	hasher.setConfig(t, bcryptCfg)
+	createUser(t, ds, tUsername, tEmail)
+	_, err := ds.LoginUser(tEmail, []byte(tPassword))
+	requireNoError(t, "LoginUser", err)
+	hasher.requireLastVerifiedPrefix(t, "bcrypt hash", "$2a$")
+
+	// The first login after the algorithm changes replaces the hash.
+	hasher.setConfig(t, argon2idCfg)
+	_, err = ds.LoginUser(tEmail, []byte(tPassword))
+	requireNoError(t, "LoginUser", err)
+	hasher.requireLastVerifiedPrefix(t, "bcrypt hash", "$2a$")
+	_, err = ds.LoginUser(tEmail, []byte(tPassword))
+	requireNoError(t, "LoginUser", err)
+	hasher.requireLastVerifiedPrefix(t, "rehashed", "$argon2id$v=19$m=1024,t=1,p=1$")
+
+	// Incorrect passwords do not replace the hash.
+	argon2idCfg.Argon2idIterations = 2
+	hasher.setConfig(t, argon2idCfg)
+	_, err = ds.LoginUser(tEmail, []byte("incorrect password"))
+	requireErrorIs(t, "incorrect password", err, db.ErrorBadRequest)
+	_, err = ds.LoginUser(tEmail, []byte(tPassword))
+	requireNoError(t, "LoginUser", err)
+	hasher.requireLastVerifiedPrefix(t, "outdated parameters", "$argon2id$v=19$m=1024,t=1,p=1$")
+	_, err = ds.LoginUser(tEmail, []byte(tPassword))
+	requireNoError(t, "LoginUser", err)
+	hasher.requireLastVerifiedPrefix(t, "rehashed parameters", "$argon2id$v=19$m=1024,t=2,p=1$")
+
+	// New passwords use the current algorithm.
+	requireNoError(t, "ResetUserPassword", ds.ResetUserPassword(tEmail, []byte("new password")))
+	_, err = ds.LoginUser(tEmail, []byte("new password"))
+	requireNoError(t, "LoginUser", err)
+	hasher.requireLastVerifiedPrefix(t, "reset password", "$argon2id$v=19$m=1024,t=2,p=1$")
+}
+
+// createWorkspace creates a workspace owned by the user with the specified
+// email.
+func createWorkspace(t *testing.T, ds db.DataStore, id, ownerEmail string, createdAt int64) {
+	t.Helper()
+	workspace := &db.Workspace{ID: id, Name: "Marketing", CreatedAt: createdAt}
+	requireNoError(t, "CreateWorkspace", ds.CreateWorkspace(workspace, ownerEmail))
+}
+
+// requireWorkspaceRole fails the test if the user with the specified email is
+// not a member of the workspace with the specified role.
+func requireWorkspaceRole(t *testing.T, ds db.DataStore, workspaceID, email, role string) {
+	t.Helper()
+	member, err := ds.RetrieveWorkspaceMember(workspaceID, email)
+	requireNoError(t, "RetrieveWorkspaceMember", err)
+	if member.Role != role {
+		t.Fatalf("RetrieveWorkspaceMember: expected role %q for %s but got %q", role, email, member.Role)
+	}
+}
+
+func testWorkspaces(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+
+	requireErrorIs(t, "invalid ID", ds.CreateWorkspace(&db.Workspace{ID: "marketing", Name: "Marketing"}, tEmail), db.ErrorBadRequest)
+	requireErrorIs(t, "no name", ds.CreateWorkspace(&db.Workspace{ID: "ws_1"}, tEmail), db.ErrorBadRequest)
+	requireErrorIs(t, "unknown owner", ds.CreateWorkspace(&db.Workspace{ID: "ws_1", Name: "Marketing"}, "unknown@example.com"), db.ErrorBadRequest)
+	_, err := ds.RetrieveWorkspace("ws_1")
+	requireErrorIs(t, "workspace of unknown owner", err, db.ErrorNotFound)
+
+	createWorkspace(t, ds, "ws_2", tEmail, 2000)
+	createWorkspace(t, ds, "ws_1", tEmail, 1000)
+	requireErrorIs(t, "duplicate workspace", ds.CreateWorkspace(&db.Workspace{ID: "ws_1", Name: "Sales"}, tEmail), db.ErrorBadRequest)
+
+	workspace, err := ds.RetrieveWorkspace("ws_1")
+	requireNoError(t, "RetrieveWorkspace", err)
+	if want := (&db.Workspace{ID: "ws_1", Name: "Marketing", CreatedAt: 1000}); !reflect.DeepEqual(workspace, want) {
+		t.Fatalf("RetrieveWorkspace: expected %+v but got %+v", want, workspace)
+	}
+	requireWorkspaceRole(t, ds, "ws_1", tEmail, db.WorkspaceRoleOwner)
+
+	workspaces, err := ds.RetrieveUserWorkspaces(tEmail)
+	requireNoError(t, "RetrieveUserWorkspaces", err)
+	if len(workspaces) != 2 || workspaces[0].ID != "ws_1" || workspaces[1].ID != "ws_2" || workspaces[0].Role != db.WorkspaceRoleOwner {
+		t.Fatalf("RetrieveUserWorkspaces: unexpected workspaces %+v", workspaces)
+	}
+	workspaces, err = ds.RetrieveUserWorkspaces("unknown@example.com")
+	requireNoError(t, "RetrieveUserWorkspaces", err)
+	if len(workspaces) != 0 {
+		t.Fatalf("RetrieveUserWorkspaces: expected no workspaces but got %d", len(workspaces))
+	}
+
+	// Short URLs can be owned by workspaces and are not counted as links of
+	// their members.
+	urlInfo := createURL(t, ds, "ws_1", tLongURL, "")
+	if urlInfo.OwnerID != "ws_1" {
+		t.Fatalf("CreateNewShortURL: expected owner ws_1 but got %q", urlInfo.OwnerID)
+	}
+	_, err = ds.CreateNewShortURL("ws_unknown", tLongURL, "", false, nil)
+	requireErrorIs(t, "unknown workspace", err, db.ErrorBadRequest)
+	urls, err := ds.RetrieveUserURLs("ws_1")
+	requireNoError(t, "RetrieveUserURLs", err)
+	if len(urls) != 1 || urls[0].ShortURL != urlInfo.ShortURL {
+		t.Fatalf("RetrieveUserURLs: unexpected workspace URLs %+v", urls)
+	}
+	_, err = ds.RetrieveUserURLInfo(tEmail, urlInfo.ShortURL)
+	requireErrorIs(t, "workspace URL of member", err, db.ErrorForbidden)
+	user, err := ds.RetrieveUserInfo(tEmail)
+	requireNoError(t, "RetrieveUserInfo", err)
+	if user.TotalLinks != 0 {
+		t.Fatalf("RetrieveUserInfo: expected no links but got %d", user.TotalLinks)
+	}
+}
+
+func testWorkspaceMembers(t *testing.T, ds db.DataStore) {
+	const editor, newEmail = "editor@example.com", "new@example.com"
+	createUser(t, ds, tUsername, tEmail)
+	createUser(t, ds, "editor", editor)
+	createWorkspace(t, ds, "ws_1", tEmail, 1000)
+	_, err := ds.RetrieveWorkspaceMember("ws_1", editor)
+	requireErrorIs(t, "not a member", err, db.ErrorNotFound)
+
+	invitation := &db.WorkspaceInvitation{ID: "inv", WorkspaceID: "ws_1", Email: editor, Role: db.WorkspaceRoleEditor, InvitedBy: tEmail, TokenHash: []byte("hash"), CreatedAt: 1000, ExpiresAt: 3000}
+	requireNoError(t, "CreateWorkspaceInvitation", ds.CreateWorkspaceInvitation(invitation))
+	_, err = ds.AcceptWorkspaceInvitation([]byte("hash"), editor, 2000)
+	requireNoError(t, "AcceptWorkspaceInvitation", err)
+
+	members, err := ds.RetrieveWorkspaceMembers("ws_1")
+	requireNoError(t, "RetrieveWorkspaceMembers", err)
+	if len(members) != 2 || members[0].Email != tEmail || members[1].Email != editor || members[1].JoinedAt != 2000 {
+		t.Fatalf("RetrieveWorkspaceMembers: unexpected members %+v", members)
+	}
+
+	// A workspace always has an owner.
+	requireErrorIs(t, "demote last owner", ds.UpdateWorkspaceMemberRole("ws_1", tEmail, db.WorkspaceRoleEditor), db.ErrorBadRequest)
+	requireErrorIs(t, "remove last owner", ds.RemoveWorkspaceMember("ws_1", tEmail), db.ErrorBadRequest)
+	requireErrorIs(t, "invalid role", ds.UpdateWorkspaceMemberRole("ws_1", editor, "admin"), db.ErrorBadRequest)
+	requireErrorIs(t, "UpdateWorkspaceMemberRole unknown member", ds.UpdateWorkspaceMemberRole("ws_1", "unknown@example.com", db.WorkspaceRoleViewer), db.ErrorNotFound)
+	requireErrorIs(t, "RemoveWorkspaceMember unknown member", ds.RemoveWorkspaceMember("ws_1", "unknown@example.com"), db.ErrorNotFound)
+
+	requireNoError(t, "UpdateWorkspaceMemberRole", ds.UpdateWorkspaceMemberRole("ws_1", editor, db.WorkspaceRoleOwner))
+	requireNoError(t, "UpdateWorkspaceMemberRole", ds.UpdateWorkspaceMemberRole("ws_1", tEmail, db.WorkspaceRoleViewer))
+	requireWorkspaceRole(t, ds, "ws_1", tEmail, db.WorkspaceRoleViewer)
+	requireNoError(t, "RemoveWorkspaceMember", ds.RemoveWorkspaceMember("ws_1", tEmail))
+	_, err = ds.RetrieveWorkspaceMember("ws_1", tEmail)
+	requireErrorIs(t, "removed member", err, db.ErrorNotFound)
+
+	// Memberships move with the email of the user and are deleted with the
+	// user, but the workspace and its short URLs are kept.
+	urlInfo := createURL(t, ds, "ws_1", tLongURL, "")
+	requireNoError(t, "ChangeUserEmail", ds.ChangeUserEmail(editor, newEmail))
+	requireWorkspaceRole(t, ds, "ws_1", newEmail, db.WorkspaceRoleOwner)
+	_, err = ds.RetrieveWorkspaceMember("ws_1", editor)
+	requireErrorIs(t, "member with the old email", err, db.ErrorNotFound)
+
+	_, err = ds.DeleteUser(newEmail)
+	requireNoError(t, "DeleteUser", err)
+	_, err = ds.RetrieveWorkspaceMember("ws_1", newEmail)
+	requireErrorIs(t, "member of deleted user", err, db.ErrorNotFound)
+	_, err = ds.RetrieveWorkspace("ws_1")
+	requireNoError(t, "RetrieveWorkspace", err)
+	_, err = ds.RetrieveUserURLInfo("ws_1", urlInfo.ShortURL)
+	requireNoError(t, "RetrieveUserURLInfo", err)
+}
+
+func testWorkspaceInvitations(t *testing.T, ds db.DataStore) {
+	const invitee = "invitee@example.com"
+	createUser(t, ds, tUsername, tEmail)
+	createUser(t, ds, "invitee", invitee)
+	createWorkspace(t, ds, "ws_1", tEmail, 1000)
+
+	now := time.Now().Unix()
+	newInvitation := func(id, email, role string, createdAt, expiresAt int64) *db.WorkspaceInvitation {
+		return &db.WorkspaceInvitation{ID: id, WorkspaceID: "ws_1", Email: email, Role: role, InvitedBy: tEmail,
+			TokenHash: []byte("hash-" + id), CreatedAt: createdAt, ExpiresAt: expiresAt}
+	}
+
+	for _, invitation := range []*db.WorkspaceInvitation{
+		newInvitation("second", invitee, db.WorkspaceRoleViewer, now+1, now+60),
+		newInvitation("first", invitee, db.WorkspaceRoleEditor, now, now+60),
+		newInvitation("expired", invitee, db.WorkspaceRoleOwner, now-120, now-60),
+		newInvitation("unregistered", "unregistered@example.com", db.WorkspaceRoleViewer, now+2, now+60),
+	} {
+		requireNoError(t, "CreateWorkspaceInvitation", ds.CreateWorkspaceInvitation(invitation))
+	}
+
+	requireErrorIs(t, "duplicate ID", ds.CreateWorkspaceInvitation(newInvitation("first", invitee, db.WorkspaceRoleEditor, now, now+60)), db.ErrorBadRequest)
+	duplicateHash := newInvitation("other", invitee, db.WorkspaceRoleEditor, now, now+60)
+	duplicateHash.TokenHash = []byte("hash-first")
+	requireErrorIs(t, "duplicate hash", ds.CreateWorkspaceInvitation(duplicateHash), db.ErrorBadRequest)
+	unknownWorkspace := newInvitation("unknown", invitee, db.WorkspaceRoleEditor, now, now+60)
+	unknownWorkspace.WorkspaceID = "ws_unknown"
+	requireErrorIs(t, "unknown workspace", ds.CreateWorkspaceInvitation(unknownWorkspace), db.ErrorBadRequest)
+	requireErrorIs(t, "invalid role", ds.CreateWorkspaceInvitation(newInvitation("invalid", invitee, "admin", now, now+60)), db.ErrorBadRequest)
+
+	invitations, err := ds.RetrieveWorkspaceInvitations("ws_1")
+	requireNoError(t, "RetrieveWorkspaceInvitations", err)
+	var ids []string
+	for _, invitation := range invitations {
+		ids = append(ids, invitation.ID)
+	}
+	if want := []string{"expired", "first", "second", "unregistered"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("RetrieveWorkspaceInvitations: expected invitations %v but got %v", want, ids)
+	}
+	if !reflect.DeepEqual(invitations[1], newInvitation("first", invitee, db.WorkspaceRoleEditor, now, now+60)) {
+		t.Fatalf("RetrieveWorkspaceInvitations: unexpected invitation %+v", invitations[1])
+	}
+
+	_, err = ds.AcceptWorkspaceInvitation([]byte("hash-expired"), invitee, now)
+	requireErrorIs(t, "expired invitation", err, db.ErrorNotFound)
+	_, err = ds.AcceptWorkspaceInvitation([]byte("hash-first"), tEmail, now)
+	requireErrorIs(t, "invitation of another email", err, db.ErrorNotFound)
+	_, err = ds.AcceptWorkspaceInvitation([]byte("hash-unregistered"), "unregistered@example.com", now)
+	requireErrorIs(t, "unregistered user", err, db.ErrorBadRequest)
+
+	member, err := ds.AcceptWorkspaceInvitation([]byte("hash-first"), invitee, now)
+	requireNoError(t, "AcceptWorkspaceInvitation", err)
+	if want := (&db.WorkspaceMember{WorkspaceID: "ws_1", Email: invitee, Role: db.WorkspaceRoleEditor, JoinedAt: now}); !reflect.DeepEqual(member, want) {
+		t.Fatalf("AcceptWorkspaceInvitation: expected %+v but got %+v", want, member)
+	}
+	requireWorkspaceRole(t, ds, "ws_1", invitee, db.WorkspaceRoleEditor)
+
+	// Invitations can only be accepted once and not by existing members.
+	_, err = ds.AcceptWorkspaceInvitation([]byte("hash-first"), invitee, now)
+	requireErrorIs(t, "accepted invitation", err, db.ErrorNotFound)
+	_, err = ds.AcceptWorkspaceInvitation([]byte("hash-second"), invitee, now)
+	requireErrorIs(t, "existing member", err, db.ErrorBadRequest)
+	requireWorkspaceRole(t, ds, "ws_1", invitee, db.WorkspaceRoleEditor)
+
+	requireErrorIs(t, "DeleteWorkspaceInvitation other workspace", ds.DeleteWorkspaceInvitation("ws_2", "second"), db.ErrorNotFound)
+	requireNoError(t, "DeleteWorkspaceInvitation", ds.DeleteWorkspaceInvitation("ws_1", "second"))
+	requireErrorIs(t, "deleted invitation", ds.DeleteWorkspaceInvitation("ws_1", "second"), db.ErrorNotFound)
+
+	n, err := ds.DeleteExpiredWorkspaceInvitations(now)
+	requireNoError(t, "DeleteExpiredWorkspaceInvitations", err)
+	if n != 1 {
+		t.Fatalf("DeleteExpiredWorkspaceInvitations: expected 1 deleted invitation but got %d", n)
+	}
+	invitations, err = ds.RetrieveWorkspaceInvitations("ws_1")
+	requireNoError(t, "RetrieveWorkspaceInvitations", err)
+	if len(invitations) != 1 || invitations[0].ID != "unregistered" {
+		t.Fatalf("RetrieveWorkspaceInvitations: unexpected invitations %+v", invitations)
+	}
+}
+
+func testDeleteWorkspace(t *testing.T, ds db.DataStore) {
+	createUser(t, ds, tUsername, tEmail)
+	createWorkspace(t, ds, "ws_1", tEmail, 1000)
+	createWorkspace(t, ds, "ws_2", tEmail, 2000)
+	first := createURL(t, ds, "ws_1", tLongURL, "")
+	second := createURL(t, ds, "ws_1", "https://example.org", "")
+	other := createURL(t, ds, "ws_2", tLongURL, "")
+	own := createURL(t, ds, tEmail, tLongURL, "")
+	requireNoError(t, "RecordShortURLClicks", ds.RecordShortURLClicks(map[string][]*db.ShortURLClick{
+		first.ShortURL: {{IP: "127.0.0.1", Timestamp: 1000}},
+		other.ShortURL: {{IP: "127.0.0.1", Timestamp: 1000}},
+	}))
+	invitation := &db.WorkspaceInvitation{ID: "inv", WorkspaceID: "ws_1", Email: "invitee@example.com", Role: db.WorkspaceRoleViewer, InvitedBy: tEmail, TokenHash: []byte("hash"), CreatedAt: 1000, ExpiresAt: time.Now().Unix() + 60}
+	requireNoError(t, "CreateWorkspaceInvitation", ds.CreateWorkspaceInvitation(invitation))
+
+	shortURLs, err := ds.DeleteWorkspace("ws_1")
+	requireNoError(t, "DeleteWorkspace", err)
+	sort.Strings(shortURLs)
+	wantShortURLs := []string{first.ShortURL, second.ShortURL}
+	sort.Strings(wantShortURLs)
+	if !reflect.DeepEqual(shortURLs, wantShortURLs) {
+		t.Fatalf("DeleteWorkspace: expected short URLs %v but got %v", wantShortURLs, shortURLs)
+	}
+
+	_, err = ds.DeleteWorkspace("ws_1")
+	requireErrorIs(t, "deleted workspace", err, db.ErrorNotFound)
+	_, err = ds.RetrieveWorkspace("ws_1")
+	requireErrorIs(t, "RetrieveWorkspace", err, db.ErrorNotFound)
+	_, err = ds.RetrieveWorkspaceMember("ws_1", tEmail)
+	requireErrorIs(t, "RetrieveWorkspaceMember", err, db.ErrorNotFound)
+	_, err = ds.RetrieveURLInfo(first.ShortURL)
+	requireErrorIs(t, "RetrieveURLInfo", err, db.ErrorNotFound)
+	invitations, err := ds.RetrieveWorkspaceInvitations("ws_1")
+	requireNoError(t, "RetrieveWorkspaceInvitations", err)
+	if len(invitations) != 0 {
+		t.Fatalf("RetrieveWorkspaceInvitations: expected no invitations but got %d", len(invitations))
+	}
+
+	// The deleted short URLs can be used again, without the old clicks.
+	reused := createURL(t, ds, tEmail, tLongURL, first.ShortURL)
+	clicks, err := ds.RetrieveShortURLClicks(tEmail, reused.ShortURL)
+	requireNoError(t, "RetrieveShortURLClicks", err)
+	if len(clicks) != 0 {
+		t.Fatalf("RetrieveShortURLClicks: expected the clicks of the deleted short URL to be deleted but got %d", len(clicks))
+	}
+
+	// Other workspaces and the short URLs of the user are not affected.
+	workspaces, err := ds.RetrieveUserWorkspaces(tEmail)
+	requireNoError(t, "RetrieveUserWorkspaces", err)
+	if len(workspaces) != 1 || workspaces[0].ID != "ws_2" {
+		t.Fatalf("RetrieveUserWorkspaces: unexpected workspaces %+v", workspaces)
+	}
+	clicks, err = ds.RetrieveShortURLClicks("ws_2", other.ShortURL)
+	requireNoError(t, "RetrieveShortURLClicks", err)
+	if len(clicks) != 1 {
+		t.Fatalf("RetrieveShortURLClicks: expected 1 click but got %d", len(clicks))
+	}
+	_, err = ds.RetrieveUserURLInfo(tEmail, own.ShortURL)
+	requireNoError(t, "RetrieveUserURLInfo", err)
+}
@@ -5,4 +5,12 @@ import "errors"
 var (
 	// ErrorBadRequest is returned for user-facing errors.
 	ErrorBadRequest = errors.New("bad request")
+	// ErrorNotFound is returned when a requested resource does not exist.
+	ErrorNotFound = errors.New("not found")
+	// ErrorForbidden is returned when a user tries to access or modify a
+	// resource they do not own.
+	ErrorForbidden = errors.New("forbidden")
+	// ErrorInactive is returned when a click is recorded for a short URL that
+	// is outside its active window or has used up its click budget.
+	ErrorInactive = errors.New("inactive")
 )
@@ -3,8 +3,12 @@ package db
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"net/mail"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -28,21 +32,251 @@ type DataStore interface {
 	LoginUser(email string, password []byte) (*UserInfo, error)
 	// CreateNewShortURL adds a new URL to the database and returns the
 	// shortened URL. userID will can be any unique identifier for a guest user
-	// but it is an email for non-guest users.
-	CreateNewShortURL(userID, longURL, customShortURL string, isGuest bool) (*ShortURLInfo, error)
+	// but it is an email or a workspace ID for non-guest users, see
+	// IsWorkspaceID. opts is optional. An existing short URL for longURL is
+	// only reused if opts has no settings and the existing short URL is
+	// enabled and has no settings either.
+	CreateNewShortURL(userID, longURL, customShortURL string, isGuest bool, opts *ShortURLOptions) (*ShortURLInfo, error)
 	// UpdateShortURL updates the information for the specified short URL. This
-	// method is used for click update and link editing.
+	// method is used for click update and link editing. A click is only
+	// recorded if the short URL is active and has not used up its click budget
+	// at the time of the update, otherwise ErrorInactive is returned. The
+	// check and the increment are performed atomically.
 	UpdateShortURL(shortURL string, newLongURL string, click *ShortURLClick) error
+	// RecordShortURLClicks records a batch of clicks keyed by short URL and
+	// increments the click count of each short URL by its number of clicks.
+	// Unlike UpdateShortURL, the click budget and active window are not
+	// checked. Clicks on short URLs that do not exist are dropped.
+	RecordShortURLClicks(clicks map[string][]*ShortURLClick) error
+	// UpdateUserShortURL changes the original URL and/or the settings in opts
+	// of a short URL owned by the specified user. An empty newLongURL leaves
+	// the original URL unchanged. ErrorNotFound is returned if the short URL
+	// does not exist and ErrorForbidden is returned if it is not owned by
+	// ownerID.
+	UpdateUserShortURL(ownerID, shortURL, newLongURL string, opts *ShortURLOptions) error
 	// RetrieveURLInfo fetches information about a short URL using the shortened
-	// URL.
+	// URL. ErrorNotFound is returned if the short URL does not exist.
 	RetrieveURLInfo(short string) (*ShortURLInfo, error)
-	// RetrieveUserURLs fetches all the shorted URLs for the specified user.
-	RetrieveUserURLs(email string) ([]*ShortURLInfo, error)
+	// RetrieveUserURLInfo fetches information about a short URL owned by the
+	// specified user. ErrorNotFound is returned if the short URL does not exist
+	// and ErrorForbidden is returned if it is not owned by ownerID.
+	RetrieveUserURLInfo(ownerID, shortURL string) (*ShortURLInfo, error)
+	// RetrieveUserURLs fetches all the shorted URLs owned by the specified
+	// user email or workspace ID.
+	RetrieveUserURLs(ownerID string) ([]*ShortURLInfo, error)
 	// RetrieveShortURLClicks returns a list of complete click information for a
-	// short URL.
-	RetrieveShortURLClicks(shortURL string) ([]*ShortURLClick, error)
-	// ToggleShortLinkStatus enables/disables a short link.
-	ToggleShortLinkStatus(shortURL string, disable bool) error
+	// short URL owned by the specified user. ErrorNotFound is returned if the
+	// short URL does not exist and ErrorForbidden is returned if it is not
+	// owned by ownerID.
+	RetrieveShortURLClicks(ownerID, shortURL string) ([]*ShortURLClick, error)
+	// RetrieveShortURLClickStats returns aggregated statistics about the
+	// clicks on a short URL owned by the specified user within the time range
+	// [from, to). ErrorNotFound is returned if the short URL does not exist
+	// and ErrorForbidden is returned if it is not owned by ownerID.
+	RetrieveShortURLClickStats(ownerID, shortURL string, from, to int64, interval StatsInterval) (*ShortURLClickStats, error)
+	// ToggleShortLinkStatus enables/disables a short link owned by the
+	// specified user. ErrorNotFound is returned if the short URL does not exist
+	// and ErrorForbidden is returned if it is not owned by ownerID.
+	ToggleShortLinkStatus(ownerID, shortURL string, disable bool) error
+	// MarkExpiredShortURLs marks all short URLs whose expiry time has passed
+	// as expired and returns the number of short URLs that were marked.
+	MarkExpiredShortURLs() (int64, error)
+	// DeleteShortURLClicksBefore deletes all short URL clicks recorded before
+	// the specified unix timestamp and returns the number of clicks that were
+	// deleted. The click counters of the short URLs are not changed.
+	DeleteShortURLClicksBefore(timestamp int64) (int64, error)
+	// CreateSession adds a new login session to the database.
+	CreateSession(session *Session) error
+	// RetrieveSession fetches the session with the specified ID. ErrorNotFound
+	// is returned if the session does not exist.
+	RetrieveSession(id string) (*Session, error)
+	// RotateSessionRefreshToken replaces the refresh token hash of the session
+	// with the specified ID with newHash and extends the session until
+	// expiresAt. The check that the session is active and that its refresh
+	// token hash is oldHash and the update are performed atomically, so a
+	// refresh token can only be used once. ErrorNotFound is returned if the
+	// session does not exist, is not active or has a different refresh token
+	// hash.
+	RotateSessionRefreshToken(id string, oldHash, newHash []byte, expiresAt int64) error
+	// RevokeSession revokes the session with the specified ID. Revoking a
+	// revoked session does nothing. ErrorNotFound is returned if the session
+	// does not exist.
+	RevokeSession(id string) error
+	// RevokeUserSessions revokes all the active sessions of the user with the
+	// specified email and returns the number of sessions that were revoked.
+	RevokeUserSessions(email string) (int64, error)
+	// DeleteExpiredSessions deletes all sessions that expired before the
+	// specified unix timestamp and returns the number of sessions that were
+	// deleted.
+	DeleteExpiredSessions(timestamp int64) (int64, error)
+	// CreateAPIKey adds a new API key to the database. ErrorBadRequest is
+	// returned if a key with the same ID or hash exists.
+	CreateAPIKey(key *APIKey) error
+	// RetrieveAPIKey fetches the API key with the specified hash.
+	// ErrorNotFound is returned if the key does not exist.
+	RetrieveAPIKey(keyHash []byte) (*APIKey, error)
+	// RetrieveUserAPIKeys fetches the API keys of the user with the specified
+	// email, oldest first.
+	RetrieveUserAPIKeys(email string) ([]*APIKey, error)
+	// DeleteAPIKey deletes the API key with the specified ID owned by the user
+	// with the specified email. ErrorNotFound is returned if the user has no
+	// such key.
+	DeleteAPIKey(email, id string) error
+	// UpdateAPIKeyLastUsed sets the time the API key with the specified ID was
+	// last used. ErrorNotFound is returned if the key does not exist.
+	UpdateAPIKeyLastUsed(id string, timestamp int64) error
+	// RetrieveIdentityUser fetches the user linked to the identity with the
+	// specified subject at an external identity provider. ErrorNotFound is
+	// returned if no user is linked to the identity.
+	RetrieveIdentityUser(provider, subject string) (*UserInfo, error)
+	// CreateIdentityUser adds a new user with the email of identity and links
+	// identity to it. The user has no password and can only log in with the
+	// identity provider. ErrorBadRequest is returned if the username or email
+	// exists or if the identity is linked to another user.
+	CreateIdentityUser(username string, identity *UserIdentity) error
+	// LinkUserIdentity links identity to the existing user with the email of
+	// identity. ErrorBadRequest is returned if the user does not exist or if
+	// the identity is already linked.
+	LinkUserIdentity(identity *UserIdentity) error
+	// SetEmailVerified marks the email of the user with the specified email as
+	// verified. ErrorBadRequest is returned if the user does not exist.
+	SetEmailVerified(email string) error
+	// ResetUserPassword replaces the password of the user with the specified
+	// email. The password is hashed before being stored. ErrorBadRequest is
+	// returned if the user does not exist.
+	ResetUserPassword(email string, password []byte) error
+	// CreateUserToken adds a new single-use user token to the database.
+	// ErrorBadRequest is returned if the user does not exist or a token with
+	// the same hash exists.
+	CreateUserToken(token *UserToken) error
+	// ConsumeUserToken deletes the token with the specified hash and purpose
+	// and returns it. The other tokens of the user with the same purpose are
+	// deleted too. The lookup and the deletion are performed atomically, so a
+	// token can only be used once. ErrorNotFound is returned if the token does
+	// not exist or has expired at the specified unix timestamp.
+	ConsumeUserToken(tokenHash []byte, purpose string, timestamp int64) (*UserToken, error)
+	// DeleteExpiredUserTokens deletes all user tokens that expired before the
+	// specified unix timestamp and returns the number of tokens that were
+	// deleted.
+	DeleteExpiredUserTokens(timestamp int64) (int64, error)
+	// UpdateUsername changes the username of the user with the specified
+	// email. ErrorBadRequest is returned if the user does not exist or the
+	// username is taken.
+	UpdateUsername(email, username string) error
+	// ChangeUserEmail changes the email of the user with the specified email
+	// to newEmail and moves the user's short URLs, sessions, API keys,
+	// identities and workspace memberships to it. The new email is not verified and the user tokens
+	// sent to the old email are deleted. ErrorBadRequest is returned if the
+	// user does not exist or newEmail is taken.
+	ChangeUserEmail(email, newEmail string) error
+	// DeleteUser deletes the user with the specified email together with the
+	// user's short URLs and their clicks, sessions, API keys, identities, user
+	// tokens and workspace memberships, and returns the deleted short URLs.
+	// The short URLs of the user's workspaces are kept. ErrorBadRequest is
+	// returned if the user does not exist.
+	DeleteUser(email string) ([]string, error)
+	// SetUserTOTPSecret saves a new TOTP secret for the user with the
+	// specified email, replacing a secret that was not enabled. TOTP stays
+	// disabled until EnableUserTOTP is called. ErrorBadRequest is returned if
+	// the user does not exist or TOTP is enabled.
+	SetUserTOTPSecret(email string, secret []byte) error
+	// RetrieveUserTOTP fetches the TOTP settings of the user with the
+	// specified email. ErrorBadRequest is returned if the user does not exist
+	// and ErrorNotFound if the user has no TOTP secret.
+	RetrieveUserTOTP(email string) (*UserTOTP, error)
+	// EnableUserTOTP enables TOTP two-factor authentication for the user with
+	// the specified email and replaces the user's recovery codes with the
+	// specified hashes. Calling it when TOTP is enabled only replaces the
+	// recovery codes. ErrorBadRequest is returned if the user does not exist
+	// or has no TOTP secret.
+	EnableUserTOTP(email string, recoveryCodeHashes [][]byte) error
+	// UseUserTOTPStep records that a TOTP code of the specified time step was
+	// used by the user with the specified email. ErrorBadRequest is returned
+	// if the user does not exist or a code of the same or a later time step
+	// was used, so that codes cannot be used twice.
+	UseUserTOTPStep(email string, step int64) error
+	// ConsumeUserRecoveryCode deletes the recovery code with the specified
+	// hash of the user with the specified email. ErrorNotFound is returned if
+	// the user has no such recovery code.
+	ConsumeUserRecoveryCode(email string, codeHash []byte) error
+	// DisableUserTOTP disables TOTP two-factor authentication for the user
+	// with the specified email and deletes the TOTP secret and the recovery
+	// codes. ErrorBadRequest is returned if the user does not exist.
+	DisableUserTOTP(email string) error
+	// RetrieveLoginAttempts fetches the failed login attempts recorded for
+	// key, e.g. an account or a client IP. A zero LoginAttempts is returned if
+	// none are recorded.
+	RetrieveLoginAttempts(key string) (*LoginAttempts, error)
+	// RecordFailedLogin adds a failed login attempt at the specified unix
+	// timestamp to the attempts recorded for key and returns the updated
+	// attempts.
+	RecordFailedLogin(key string, timestamp int64) (*LoginAttempts, error)
+	// LockLogin refuses logins for key until the specified unix timestamp.
+	LockLogin(key string, until int64) error
+	// ClearLoginAttempts deletes the failed login attempts and lock of key.
+	ClearLoginAttempts(key string) error
+	// DeleteStaleLoginAttempts deletes the login attempts whose last failure
+	// and lock are before the specified unix timestamp and returns the number
+	// of keys that were deleted.
+	DeleteStaleLoginAttempts(timestamp int64) (int64, error)
+	// CreateWorkspace adds a new workspace to the database with the user
+	// with the specified email as its owner. ErrorBadRequest is returned if
+	// the user does not exist or a workspace with the same ID exists.
+	CreateWorkspace(workspace *Workspace, ownerEmail string) error
+	// RetrieveWorkspace fetches the workspace with the specified ID.
+	// ErrorNotFound is returned if the workspace does not exist.
+	RetrieveWorkspace(id string) (*Workspace, error)
+	// RetrieveUserWorkspaces fetches the workspaces the user with the
+	// specified email is a member of, oldest first, with the role of the
+	// user.
+	RetrieveUserWorkspaces(email string) ([]*Workspace, error)
+	// DeleteWorkspace deletes the workspace with the specified ID together
+	// with its members, invitations, short URLs and their clicks, and returns
+	// the deleted short URLs. ErrorNotFound is returned if the workspace does
+	// not exist.
+	DeleteWorkspace(id string) ([]string, error)
+	// RetrieveWorkspaceMember fetches the membership of the user with the
+	// specified email in the workspace with the specified ID. ErrorNotFound
+	// is returned if the user is not a member of the workspace.
+	RetrieveWorkspaceMember(workspaceID, email string) (*WorkspaceMember, error)
+	// RetrieveWorkspaceMembers fetches the members of the workspace with the
+	// specified ID, oldest first.
+	RetrieveWorkspaceMembers(workspaceID string) ([]*WorkspaceMember, error)
+	// UpdateWorkspaceMemberRole changes the role of the user with the
+	// specified email in the workspace with the specified ID. ErrorNotFound
+	// is returned if the user is not a member of the workspace and
+	// ErrorBadRequest is returned if the workspace would be left without an
+	// owner.
+	UpdateWorkspaceMemberRole(workspaceID, email, role string) error
+	// RemoveWorkspaceMember removes the user with the specified email from
+	// the workspace with the specified ID. ErrorNotFound is returned if the
+	// user is not a member of the workspace and ErrorBadRequest is returned
+	// if the workspace would be left without an owner.
+	RemoveWorkspaceMember(workspaceID, email string) error
+	// CreateWorkspaceInvitation adds a new invitation to join a workspace to
+	// the database. ErrorBadRequest is returned if the workspace does not
+	// exist or an invitation with the same ID or token hash exists.
+	CreateWorkspaceInvitation(invitation *WorkspaceInvitation) error
+	// RetrieveWorkspaceInvitations fetches the invitations of the workspace
+	// with the specified ID that have not been accepted, oldest first.
+	RetrieveWorkspaceInvitations(workspaceID string) ([]*WorkspaceInvitation, error)
+	// DeleteWorkspaceInvitation deletes the invitation with the specified ID
+	// of the workspace with the specified ID. ErrorNotFound is returned if
+	// the workspace has no such invitation.
+	DeleteWorkspaceInvitation(workspaceID, id string) error
+	// AcceptWorkspaceInvitation deletes the invitation with the specified
+	// token hash sent to the specified email and adds the user with that
+	// email to the workspace with the role of the invitation. The lookup, the
+	// deletion and the insertion are performed atomically, so an invitation
+	// can only be used once. ErrorNotFound is returned if the invitation does
+	// not exist, was sent to another email or has expired at the specified
+	// unix timestamp, and ErrorBadRequest is returned if the user does not
+	// exist or is already a member of the workspace.
+	AcceptWorkspaceInvitation(tokenHash []byte, email string, timestamp int64) (*WorkspaceMember, error)
+	// DeleteExpiredWorkspaceInvitations deletes all workspace invitations
+	// that expired before the specified unix timestamp and returns the number
+	// of invitations that were deleted.
+	DeleteExpiredWorkspaceInvitations(timestamp int64) (int64, error)
 	// Close ends the connection to the database.
 	Close() error
 }
@@ -53,6 +287,190 @@ type UserInfo struct {
 	Email      string `json:"email" bson:"email"`
 	Timestamp  int64  `json:"timestamp" bson:"timestamp"`
 	TotalLinks int    `json:"totalLinks" bson:"total_links"`
+	// EmailVerified is true once the user has proven that they own the
+	// email.
+	EmailVerified bool `json:"emailVerified" bson:"email_verified"`
+	// HasPassword is false for users that can only log in with an identity
+	// provider. It is not stored.
+	HasPassword bool `json:"hasPassword" bson:"-"`
+	// TOTPEnabled is true if the user must enter a TOTP code or a recovery
+	// code to log in.
+	TOTPEnabled bool `json:"totpEnabled" bson:"totp_enabled"`
+}
+
+// UserTOTP are the TOTP two-factor authentication settings of a user.
+type UserTOTP struct {
+	// Secret is the shared secret TOTP codes are generated from.
+	Secret []byte `json:"-"`
+	// Enabled is false until the user has entered a code of Secret.
+	Enabled bool `json:"enabled"`
+	// LastStep is the time step of the last TOTP code that was used.
+	LastStep int64 `json:"lastStep"`
+	// RecoveryCodes is the number of unused recovery codes.
+	RecoveryCodes int `json:"recoveryCodes"`
+}
+
+// LoginAttempts are the failed login attempts of an account or a client.
+type LoginAttempts struct {
+	// Failures is the number of failed attempts since the attempts were last
+	// cleared.
+	Failures int `json:"failures" bson:"failures"`
+	// LastFailure is the unix timestamp of the last failed attempt.
+	LastFailure int64 `json:"lastFailure" bson:"last_failure"`
+	// LockedUntil is the unix timestamp until which logins are refused.
+	LockedUntil int64 `json:"lockedUntil" bson:"locked_until"`
+}
+
+// WorkspaceIDPrefix starts the IDs of workspaces, see IsWorkspaceID.
+const WorkspaceIDPrefix = "ws_"
+
+// The roles of workspace members, from the most to the least privileged.
+const (
+	// WorkspaceRoleOwner members manage the workspace, its members and its
+	// short URLs.
+	WorkspaceRoleOwner = "owner"
+	// WorkspaceRoleEditor members create and edit the short URLs of the
+	// workspace.
+	WorkspaceRoleEditor = "editor"
+	// WorkspaceRoleViewer members can only view the short URLs of the
+	// workspace and their clicks.
+	WorkspaceRoleViewer = "viewer"
+)
+
+// IsWorkspaceID checks if id is the ID of a workspace rather than an email
+// or the identifier of a guest user. The short URLs of a workspace are owned
+// by its ID.
+func IsWorkspaceID(id string) bool {
+	return strings.HasPrefix(id, WorkspaceIDPrefix) && !strings.Contains(id, "@")
+}
+
+// IsValidWorkspaceRole checks if role is one of the workspace roles.
+func IsValidWorkspaceRole(role string) bool {
+	return role == WorkspaceRoleOwner || role == WorkspaceRoleEditor || role == WorkspaceRoleViewer
+}
+
+// Workspace is a group of users that share short URLs.
+type Workspace struct {
+	ID        string `json:"id" bson:"id"`
+	Name      string `json:"name" bson:"name"`
+	CreatedAt int64  `json:"createdAt" bson:"created_at"`
+	// Role is the role of the user the workspace was retrieved for by
+	// DataStore.RetrieveUserWorkspaces. It is not stored.
+	Role string `json:"role,omitempty" bson:"-"`
+}
+
+// WorkspaceMember is the membership of a user in a workspace.
+type WorkspaceMember struct {
+	WorkspaceID string `json:"workspaceID" bson:"workspace_id"`
+	Email       string `json:"email" bson:"email"`
+	// Role is one of the workspace roles, e.g. WorkspaceRoleEditor.
+	Role     string `json:"role" bson:"role"`
+	JoinedAt int64  `json:"joinedAt" bson:"joined_at"`
+}
+
+// WorkspaceInvitation is an invitation sent to an email to join a workspace.
+// Only the hash of the invitation token is stored.
+type WorkspaceInvitation struct {
+	ID          string `json:"id" bson:"id"`
+	WorkspaceID string `json:"workspaceID" bson:"workspace_id"`
+	// Email is the email the invitation was sent to. Only the user with this
+	// email can accept it.
+	Email string `json:"email" bson:"email"`
+	// Role is the role the user gets in the workspace.
+	Role string `json:"role" bson:"role"`
+	// InvitedBy is the email of the member that sent the invitation.
+	InvitedBy string `json:"invitedBy" bson:"invited_by"`
+	// TokenHash is the SHA-256 hash of the invitation token.
+	TokenHash []byte `json:"-" bson:"token_hash"`
+	CreatedAt int64  `json:"createdAt" bson:"created_at"`
+	// ExpiresAt is the unix timestamp after which the invitation can no
+	// longer be accepted.
+	ExpiresAt int64 `json:"expiresAt" bson:"expires_at"`
+}
+
+// UserIdentity is the identity of a user at an external identity provider,
+// e.g. an OpenID Connect issuer.
+type UserIdentity struct {
+	// Provider identifies the identity provider, e.g. the OpenID Connect
+	// issuer URL.
+	Provider string `json:"provider" bson:"provider"`
+	// Subject is the ID of the user at the identity provider.
+	Subject   string `json:"subject" bson:"subject"`
+	Email     string `json:"email" bson:"email"`
+	CreatedAt int64  `json:"createdAt" bson:"created_at"`
+}
+
+// The purposes of user tokens.
+const (
+	// UserTokenVerifyEmail tokens verify the email of a user.
+	UserTokenVerifyEmail = "verify-email"
+	// UserTokenResetPassword tokens reset the password of a user.
+	UserTokenResetPassword = "reset-password"
+)
+
+// UserToken is a single-use token sent to the email of a user, e.g. to verify
+// the email or reset the password. Only the hash of the token is stored.
+type UserToken struct {
+	// TokenHash is the SHA-256 hash of the token.
+	TokenHash []byte `json:"-" bson:"token_hash"`
+	Email     string `json:"email" bson:"email"`
+	// Purpose is what the token can be used for, e.g. UserTokenVerifyEmail.
+	Purpose   string `json:"purpose" bson:"purpose"`
+	CreatedAt int64  `json:"createdAt" bson:"created_at"`
+	// ExpiresAt is the unix timestamp after which the token can no longer be
+	// used.
+	ExpiresAt int64 `json:"expiresAt" bson:"expires_at"`
+}
+
+// Session is a login session of a user. Access tokens issued for the session
+// carry its ID and are rejected once the session is revoked.
+type Session struct {
+	ID    string `json:"id" bson:"id"`
+	Email string `json:"email" bson:"email"`
+	// RefreshTokenHash is the SHA-256 hash of the current refresh token of the
+	// session.
+	RefreshTokenHash []byte `json:"-" bson:"refresh_token_hash"`
+	CreatedAt        int64  `json:"createdAt" bson:"created_at"`
+	// ExpiresAt is the unix timestamp after which the refresh token of the
+	// session can no longer be used.
+	ExpiresAt int64 `json:"expiresAt" bson:"expires_at"`
+	// RevokedAt is the unix timestamp at which the session was revoked. Zero
+	// means the session has not been revoked.
+	RevokedAt int64 `json:"revokedAt,omitempty" bson:"revoked_at"`
+}
+
+// IsActive checks if the session has neither been revoked nor expired at the
+// specified time.
+func (s *Session) IsActive(now time.Time) bool {
+	return s.RevokedAt == 0 && s.ExpiresAt > now.Unix()
+}
+
+// APIKey is a personal API key that lets programs act on behalf of a user
+// within the key's scopes. Only the hash of the key is stored.
+type APIKey struct {
+	ID    string `json:"id" bson:"id"`
+	Email string `json:"email" bson:"email"`
+	Name  string `json:"name" bson:"name"`
+	// Prefix is the start of the key, shown to help users tell their keys
+	// apart.
+	Prefix string `json:"prefix" bson:"prefix"`
+	// KeyHash is the SHA-256 hash of the key.
+	KeyHash   []byte   `json:"-" bson:"key_hash"`
+	Scopes    []string `json:"scopes" bson:"scopes"`
+	CreatedAt int64    `json:"createdAt" bson:"created_at"`
+	// LastUsedAt is the unix timestamp at which the key was last used. Zero
+	// means the key has never been used.
+	LastUsedAt int64 `json:"lastUsedAt" bson:"last_used_at"`
+}
+
+// HasScope checks if the API key has the specified scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
 }
 
 // ShortURLInfo represents a short URL in the database.
@@ -63,6 +481,90 @@ type ShortURLInfo struct {
 	Timestamp   int64  `json:"timestamp" bson:"timestamp"`
 	Clicks      int32  `json:"clicks" bson:"clicks"`
 	Disabled    bool   `json:"disabled" bson:"disabled"`
+	// ExpiresAt is the unix timestamp after which the short URL no longer
+	// redirects. Zero means the short URL never expires.
+	ExpiresAt int64 `json:"expiresAt,omitempty" bson:"expires_at"`
+	// Expired is set by DataStore.MarkExpiredShortURLs once ExpiresAt has
+	// passed.
+	Expired bool `json:"expired" bson:"expired"`
+	// PasswordProtected is true if a password is required to follow the short
+	// URL.
+	PasswordProtected bool `json:"passwordProtected" bson:"password_protected"`
+	// PasswordHash is the bcrypt hash of the short URL's password.
+	PasswordHash []byte `json:"-" bson:"password_hash,omitempty"`
+	// MaxClicks is the number of clicks after which the short URL no longer
+	// redirects. Zero means there is no limit.
+	MaxClicks int32 `json:"maxClicks,omitempty" bson:"max_clicks"`
+	// ActiveFrom is the unix timestamp from which the short URL redirects.
+	// Zero means the short URL is active from its creation.
+	ActiveFrom int64 `json:"activeFrom,omitempty" bson:"active_from"`
+	// ActiveUntil is the unix timestamp after which the short URL no longer
+	// redirects. Unlike ExpiresAt, the short URL is not marked as expired and
+	// is kept. Zero means there is no end.
+	ActiveUntil int64 `json:"activeUntil,omitempty" bson:"active_until"`
+}
+
+// HasExpired checks if the short URL has expired at the specified time.
+func (u *ShortURLInfo) HasExpired(now time.Time) bool {
+	return u.Expired || (u.ExpiresAt > 0 && u.ExpiresAt <= now.Unix())
+}
+
+// IsActive checks if the specified time is within the active window of the
+// short URL.
+func (u *ShortURLInfo) IsActive(now time.Time) bool {
+	return u.ActiveFrom <= now.Unix() && (u.ActiveUntil == 0 || u.ActiveUntil > now.Unix())
+}
+
+// ClicksExhausted checks if the short URL has used up its click budget.
+func (u *ShortURLInfo) ClicksExhausted() bool {
+	return u.MaxClicks > 0 && u.Clicks >= u.MaxClicks
+}
+
+// CheckPassword checks if password is the correct password for a password
+// protected short URL.
+func (u *ShortURLInfo) CheckPassword(password []byte) bool {
+	return u.PasswordProtected && bcrypt.CompareHashAndPassword(u.PasswordHash, password) == nil
+}
+
+// ShortURLOptions are the optional settings of a short URL. Nil fields are
+// left unchanged when updating a short URL.
+type ShortURLOptions struct {
+	// ExpiresAt is the unix timestamp after which the short URL no longer
+	// redirects. Zero removes the expiry.
+	ExpiresAt *int64
+	// Password is the password required to follow the short URL. It is hashed
+	// before being stored. An empty password removes the password protection.
+	Password *string
+	// MaxClicks is the number of clicks after which the short URL no longer
+	// redirects. Zero removes the limit.
+	MaxClicks *int32
+	// ActiveFrom is the unix timestamp from which the short URL redirects.
+	// Zero activates the short URL immediately.
+	ActiveFrom *int64
+	// ActiveUntil is the unix timestamp after which the short URL no longer
+	// redirects. Zero removes the end of the active window.
+	ActiveUntil *int64
+}
+
+// IsZero checks if no setting is specified in opts.
+func (opts *ShortURLOptions) IsZero() bool {
+	return opts == nil || (opts.ExpiresAt == nil && opts.Password == nil && opts.MaxClicks == nil &&
+		opts.ActiveFrom == nil && opts.ActiveUntil == nil)
+}
+
+// PasswordHash returns the bcrypt hash of opts.Password. A nil hash is
+// returned if no password is specified or the password is empty.
+func (opts *ShortURLOptions) PasswordHash() ([]byte, error) {
+	if opts == nil || opts.Password == nil || *opts.Password == "" {
+		return nil, nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(*opts.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("bcrypt.GenerateFromPassword error: %w", err)
+	}
+
+	return hash, nil
 }
 
 // ShortURLClick is information about a click on a short URL.
@@ -72,6 +574,25 @@ type ShortURLClick struct {
 	Device     string `json:"device" bson:"device"`
 	DeviceType string `json:"deviceType" bson:"device_type"`
 	Timestamp  int64  `json:"timestamp" bson:"timestamp"`
+	// Referrer is the Referer header sent with the click.
+	Referrer string `json:"referrer" bson:"referrer"`
+	// ReferrerDomain is the host name of Referrer without the "www." prefix.
+	ReferrerDomain string `json:"referrerDomain" bson:"referrer_domain"`
+	// The UTM fields are the values of the utm_* query parameters sent to the
+	// short URL.
+	UTMSource   string `json:"utmSource" bson:"utm_source"`
+	UTMMedium   string `json:"utmMedium" bson:"utm_medium"`
+	UTMCampaign string `json:"utmCampaign" bson:"utm_campaign"`
+	UTMTerm     string `json:"utmTerm" bson:"utm_term"`
+	UTMContent  string `json:"utmContent" bson:"utm_content"`
+	// Country is the ISO 3166-1 alpha-2 code of the country the click came
+	// from. It is empty if the country is unknown.
+	Country string `json:"country" bson:"country"`
+	// Region is the name of the first level subdivision, e.g. a state, and
+	// City is the name of the city the click came from. They are empty if
+	// unknown.
+	Region string `json:"region" bson:"region"`
+	City   string `json:"city" bson:"city"`
 }
 
 // IsValidEmail checks if the given email is valid.
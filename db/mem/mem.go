@@ -1,12 +1,15 @@
 package mem
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ukane-philemon/bob/db"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // MemDB is an in-memory database.
@@ -16,7 +19,26 @@ type MemDB struct {
 	users      map[string]*db.UserInfo
 	urlClicks  map[string][]*db.ShortURLClick
 	hashedPass map[string][]byte
-	err        error
+	sessions   map[string]*db.Session
+	apiKeys    map[string]*db.APIKey
+	// identities maps provider and subject to user identities.
+	identities map[[2]string]*db.UserIdentity
+	// userTokens maps token hashes to user tokens.
+	userTokens map[string]*db.UserToken
+	// totp maps emails to TOTP settings. RecoveryCodes is not set, see
+	// recoveryCodes.
+	totp map[string]*db.UserTOTP
+	// recoveryCodes maps emails to the set of recovery code hashes.
+	recoveryCodes map[string]map[string]bool
+	// loginAttempts maps accounts and clients to failed login attempts.
+	loginAttempts map[string]*db.LoginAttempts
+	workspaces    map[string]*db.Workspace
+	// workspaceMembers maps workspace IDs and emails to memberships.
+	workspaceMembers     map[[2]string]*db.WorkspaceMember
+	workspaceInvitations map[string]*db.WorkspaceInvitation
+	// hasher hashes and verifies the passwords of users.
+	hasher db.PasswordHasher
+	err    error
 }
 
 // MemDB implements the db.DataStore interface.
@@ -25,10 +47,22 @@ var _ db.DataStore = (*MemDB)(nil)
 // New returns a new *MemDB instance.
 func New() *MemDB {
 	return &MemDB{
-		urls:       make(map[string]*db.ShortURLInfo),
-		users:      make(map[string]*db.UserInfo),
-		urlClicks:  make(map[string][]*db.ShortURLClick),
-		hashedPass: make(map[string][]byte),
+		urls:          make(map[string]*db.ShortURLInfo),
+		users:         make(map[string]*db.UserInfo),
+		urlClicks:     make(map[string][]*db.ShortURLClick),
+		hashedPass:    make(map[string][]byte),
+		sessions:      make(map[string]*db.Session),
+		apiKeys:       make(map[string]*db.APIKey),
+		identities:    make(map[[2]string]*db.UserIdentity),
+		userTokens:    make(map[string]*db.UserToken),
+		totp:          make(map[string]*db.UserTOTP),
+		recoveryCodes: make(map[string]map[string]bool),
+		loginAttempts: make(map[string]*db.LoginAttempts),
+		workspaces:    make(map[string]*db.Workspace),
+		hasher:        db.DefaultPasswordHasher(),
+
+		workspaceMembers:     make(map[[2]string]*db.WorkspaceMember),
+		workspaceInvitations: make(map[string]*db.WorkspaceInvitation),
 	}
 }
 
@@ -59,24 +93,39 @@ func (m *MemDB) CreateUser(username, email string, password []byte) error {
 		return err
 	}
 
+	if username == "" || email == "" || password == nil {
+		return fmt.Errorf("%w: username, email, and password are required", db.ErrorBadRequest)
+	}
+
+	if !db.IsValidEmail(email) {
+		return fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	}
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 	if _, ok := m.users[email]; ok {
 		return fmt.Errorf("%w: email already exists", db.ErrorBadRequest)
 	}
 
+	for _, user := range m.users {
+		if user.Username == username {
+			return fmt.Errorf("%w: username already exists", db.ErrorBadRequest)
+		}
+	}
+
 	m.users[email] = &db.UserInfo{
 		Username:  username,
 		Email:     email,
 		Timestamp: time.Now().Unix(),
 	}
 
-	var err error
-	m.hashedPass[email], err = bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	hashedPass, err := m.hasher.Hash(password)
 	if err != nil {
-		return fmt.Errorf("bcrypt.GenerateFromPassword error: %w", err)
+		delete(m.users, email)
+		return fmt.Errorf("error hashing password: %w", err)
 	}
 
+	m.hashedPass[email] = hashedPass
 	return nil
 }
 
@@ -96,8 +145,7 @@ func (m *MemDB) RetrieveUserInfo(email string) (*db.UserInfo, error) {
 		return nil, fmt.Errorf("%w: email does not exist", db.ErrorBadRequest)
 	}
 
-	u := *user
-	return &u, nil
+	return m.userInfo(user), nil
 }
 
 // LoginUser logs a user in and returns a nil error if the user exists and the
@@ -109,66 +157,161 @@ func (m *MemDB) LoginUser(email string, password []byte) (*db.UserInfo, error) {
 		return nil, err
 	}
 
+	if !db.IsValidEmail(email) {
+		return nil, fmt.Errorf("%w: a valid email is required", db.ErrorBadRequest)
+	}
+
+	if len(password) == 0 {
+		return nil, fmt.Errorf("%w: password is required", db.ErrorBadRequest)
+	}
+
 	m.mtx.RLock()
-	defer m.mtx.RUnlock()
+	_, userExists := m.users[email]
+	userPass, hasPassword := m.hashedPass[email]
+	m.mtx.RUnlock()
 
-	user, ok := m.users[email]
-	if !ok {
+	if !userExists || !hasPassword {
+		db.CompareDummyPassword(m.hasher, password)
 		return nil, fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
 	}
 
-	userPass, ok := m.hashedPass[email]
+	ok, needsRehash := m.hasher.Verify(userPass, password)
+	if !ok {
+		return nil, fmt.Errorf("%w: incorrect password", db.ErrorBadRequest)
+	}
+
+	// Hashes with outdated algorithms or parameters are replaced, unless the
+	// password was changed in the meantime.
+	var newHash []byte
+	if needsRehash {
+		newHash, _ = m.hasher.Hash(password)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user, ok := m.users[email]
 	if !ok {
 		return nil, fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
 	}
 
-	if err := bcrypt.CompareHashAndPassword(userPass, password); err != nil {
-		return nil, fmt.Errorf("%w: incorrect password", db.ErrorBadRequest)
+	if newHash != nil && bytes.Equal(m.hashedPass[email], userPass) {
+		m.hashedPass[email] = newHash
 	}
 
-	return user, nil
+	return m.userInfo(user), nil
+}
+
+// userInfo returns a copy of user with the total links set. The caller must
+// hold the mtx lock.
+func (m *MemDB) userInfo(user *db.UserInfo) *db.UserInfo {
+	u := *user
+	u.TotalLinks = 0
+	u.HasPassword = len(m.hashedPass[user.Email]) > 0
+	for _, url := range m.urls {
+		if url.OwnerID == user.Email {
+			u.TotalLinks++
+		}
+	}
+	return &u
 }
 
 // CreateNewShortURL adds a new URL to the database and returns the
 // shortened URL. userID will can be any unique identifier for a guest user
 // but it is an email for non-guest users.
-func (m *MemDB) CreateNewShortURL(userID, longURL, customShortURL string, isGuest bool) (*db.ShortURLInfo, error) {
+func (m *MemDB) CreateNewShortURL(userID, longURL, customShortURL string, isGuest bool, opts *db.ShortURLOptions) (*db.ShortURLInfo, error) {
 	if m.err != nil {
 		err := m.err
 		m.err = nil
 		return nil, err
 	}
 
+	if userID == "" || longURL == "" {
+		return nil, fmt.Errorf("%w: id and url are required", db.ErrorBadRequest)
+	}
+
+	if !isGuest && !db.IsValidEmail(userID) && !db.IsWorkspaceID(userID) {
+		return nil, fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	}
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	if !isGuest && !db.IsValidEmail(userID) {
-		return nil, fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	now := time.Now()
+	var nURLs int
+	var oldURL *db.ShortURLInfo
+	for _, url := range m.urls {
+		if url.OwnerID != userID {
+			continue
+		}
+
+		nURLs++
+		if url.OriginalURL == longURL && isReusableURL(url, now) {
+			oldURL = url
+		}
 	}
 
-	if customShortURL != "" {
-		if _, ok := m.urls[customShortURL]; ok {
-			return nil, fmt.Errorf("%w: short URL already exists", db.ErrorBadRequest)
+	if isGuest {
+		if nURLs >= db.MaxGuestURLs {
+			return nil, fmt.Errorf("%w: maximum number of URLs reached", db.ErrorBadRequest)
+		}
+	} else if db.IsWorkspaceID(userID) {
+		if _, ok := m.workspaces[userID]; !ok {
+			return nil, fmt.Errorf("%w: workspace does not exist", db.ErrorBadRequest)
 		}
+	} else if _, ok := m.users[userID]; !ok {
+		return nil, fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
 	}
 
-	var err error
-	shortURL := customShortURL
-	if shortURL == "" {
-		shortURL, err = db.RandomString(3)
-		if err != nil {
-			return nil, err
+	shortURL := strings.TrimSpace(customShortURL)
+	if shortURL != "" {
+		if _, ok := m.urls[shortURL]; ok {
+			return nil, fmt.Errorf("%w: short URL already exists", db.ErrorBadRequest)
+		}
+	} else if oldURL != nil && opts.IsZero() {
+		l := *oldURL
+		return &l, nil
+	} else {
+		url := longURL
+		for maxTries := 5; maxTries > 0; maxTries-- {
+			shortURL = db.GenerateShortURL(url)
+			if _, ok := m.urls[shortURL]; !ok {
+				break
+			}
+
+			randomStr, err := db.RandomString(db.URLLength)
+			if err != nil {
+				return nil, err
+			}
+
+			url = longURL + randomStr
+			shortURL = ""
+		}
+
+		if shortURL == "" {
+			return nil, errors.New("failed to save new URL")
 		}
 	}
 
-	m.urls[shortURL] = &db.ShortURLInfo{
+	url := &db.ShortURLInfo{
 		OriginalURL: longURL,
 		ShortURL:    shortURL,
 		OwnerID:     userID,
-		Timestamp:   time.Now().Unix(),
+		Timestamp:   now.Unix(),
+	}
+	if err := applyShortURLOptions(url, opts, now); err != nil {
+		return nil, err
 	}
+	m.urls[shortURL] = url
 
-	return m.urls[shortURL], nil
+	l := *url
+	return &l, nil
+}
+
+// isReusableURL checks if url can be returned for a new short URL without
+// settings. Short URLs that are expired, disabled or have settings are never
+// reused.
+func isReusableURL(url *db.ShortURLInfo, now time.Time) bool {
+	return !url.HasExpired(now) && !url.Disabled && !url.PasswordProtected && url.MaxClicks == 0 && url.ActiveFrom == 0 && url.ActiveUntil == 0
 }
 
 // UpdateShortURL updates the information for the specified short URL. This
@@ -191,12 +334,40 @@ func (m *MemDB) UpdateShortURL(shortURL string, newLongURL string, click *db.Sho
 		return fmt.Errorf("%w: short URL not found", db.ErrorBadRequest)
 	}
 
-	if newLongURL != "" {
-		url.OriginalURL = newLongURL
-	} else if click != nil {
+	if click != nil {
+		if !url.IsActive(time.Now()) || url.ClicksExhausted() {
+			return fmt.Errorf("%w: short URL is not active", db.ErrorInactive)
+		}
+
+		url.Clicks++
 		m.urlClicks[shortURL] = append(m.urlClicks[shortURL], click)
+	} else {
+		url.OriginalURL = newLongURL
+	}
+
+	return nil
+}
+
+// RecordShortURLClicks records a batch of clicks keyed by short URL and
+// increments the click count of each short URL by its number of clicks.
+func (m *MemDB) RecordShortURLClicks(clicks map[string][]*db.ShortURLClick) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
 	}
 
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for shortURL, urlClicks := range clicks {
+		url := m.urls[shortURL]
+		if url == nil {
+			continue // short URL no longer exists
+		}
+
+		url.Clicks += int32(len(urlClicks))
+		m.urlClicks[shortURL] = append(m.urlClicks[shortURL], urlClicks...)
+	}
 	return nil
 }
 
@@ -209,19 +380,24 @@ func (m *MemDB) RetrieveURLInfo(short string) (*db.ShortURLInfo, error) {
 		return nil, err
 	}
 
+	if short == "" {
+		return nil, fmt.Errorf("%w: short URL is empty", db.ErrorBadRequest)
+	}
+
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 	url := m.urls[short]
 	if url == nil {
-		return nil, fmt.Errorf("%w: short URL not found", db.ErrorBadRequest)
+		return nil, fmt.Errorf("%w: short URL not found", db.ErrorNotFound)
 	}
 
 	l := *url
 	return &l, nil
 }
 
-// RetrieveUserURLs fetches all the shorted URLs for the specified user.
-func (m *MemDB) RetrieveUserURLs(email string) ([]*db.ShortURLInfo, error) {
+// RetrieveUserURLs fetches all the shorted URLs owned by the specified user
+// email or workspace ID.
+func (m *MemDB) RetrieveUserURLs(ownerID string) ([]*db.ShortURLInfo, error) {
 	if m.err != nil {
 		err := m.err
 		m.err = nil
@@ -232,16 +408,152 @@ func (m *MemDB) RetrieveUserURLs(email string) ([]*db.ShortURLInfo, error) {
 	defer m.mtx.RUnlock()
 	var urls []*db.ShortURLInfo
 	for _, url := range m.urls {
-		if url.OwnerID == email {
-			urls = append(urls, url)
+		if url.OwnerID == ownerID {
+			l := *url
+			urls = append(urls, &l)
 		}
 	}
 	return urls, nil
 }
 
+// UpdateUserShortURL changes the original URL and/or the settings in opts of a
+// short URL owned by the specified user.
+func (m *MemDB) UpdateUserShortURL(ownerID, shortURL, newLongURL string, opts *db.ShortURLOptions) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if newLongURL == "" && opts.IsZero() {
+		return fmt.Errorf("%w: nothing to update", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	url, err := m.userURL(ownerID, shortURL)
+	if err != nil {
+		return err
+	}
+
+	if err := applyShortURLOptions(url, opts, time.Now()); err != nil {
+		return err
+	}
+
+	if newLongURL != "" {
+		url.OriginalURL = newLongURL
+	}
+	return nil
+}
+
+// MarkExpiredShortURLs marks all short URLs whose expiry time has passed as
+// expired and returns the number of short URLs that were marked.
+func (m *MemDB) MarkExpiredShortURLs() (int64, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return 0, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := time.Now()
+	var n int64
+	for _, url := range m.urls {
+		if !url.Expired && url.HasExpired(now) {
+			url.Expired = true
+			n++
+		}
+	}
+	return n, nil
+}
+
+// DeleteShortURLClicksBefore deletes all short URL clicks recorded before the
+// specified unix timestamp and returns the number of clicks that were deleted.
+func (m *MemDB) DeleteShortURLClicksBefore(timestamp int64) (int64, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return 0, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var n int64
+	for shortURL, clicks := range m.urlClicks {
+		kept := make([]*db.ShortURLClick, 0, len(clicks))
+		for _, click := range clicks {
+			if click.Timestamp < timestamp {
+				n++
+				continue
+			}
+			kept = append(kept, click)
+		}
+		m.urlClicks[shortURL] = kept
+	}
+	return n, nil
+}
+
+// applyShortURLOptions sets the non-nil settings in opts on url. url is not
+// modified if an error is returned.
+func applyShortURLOptions(url *db.ShortURLInfo, opts *db.ShortURLOptions, now time.Time) error {
+	if opts == nil {
+		return nil
+	}
+
+	if opts.Password != nil {
+		passwordHash, err := opts.PasswordHash()
+		if err != nil {
+			return err
+		}
+
+		url.PasswordHash = passwordHash
+		url.PasswordProtected = passwordHash != nil
+	}
+
+	if opts.ExpiresAt != nil {
+		url.ExpiresAt = *opts.ExpiresAt
+		url.Expired = url.ExpiresAt > 0 && url.ExpiresAt <= now.Unix()
+	}
+
+	if opts.MaxClicks != nil {
+		url.MaxClicks = *opts.MaxClicks
+	}
+
+	if opts.ActiveFrom != nil {
+		url.ActiveFrom = *opts.ActiveFrom
+	}
+
+	if opts.ActiveUntil != nil {
+		url.ActiveUntil = *opts.ActiveUntil
+	}
+
+	return nil
+}
+
+// RetrieveUserURLInfo fetches information about a short URL owned by the
+// specified user.
+func (m *MemDB) RetrieveUserURLInfo(ownerID, shortURL string) (*db.ShortURLInfo, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	url, err := m.userURL(ownerID, shortURL)
+	if err != nil {
+		return nil, err
+	}
+
+	l := *url
+	return &l, nil
+}
+
 // RetrieveShortURLClicks returns a list of complete click information for a
-// short URL.
-func (m *MemDB) RetrieveShortURLClicks(shortURL string) ([]*db.ShortURLClick, error) {
+// short URL owned by the specified user.
+func (m *MemDB) RetrieveShortURLClicks(ownerID, shortURL string) ([]*db.ShortURLClick, error) {
 	if m.err != nil {
 		err := m.err
 		m.err = nil
@@ -250,11 +562,16 @@ func (m *MemDB) RetrieveShortURLClicks(shortURL string) ([]*db.ShortURLClick, er
 
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
+	if _, err := m.userURL(ownerID, shortURL); err != nil {
+		return nil, err
+	}
+
 	return m.urlClicks[shortURL], nil
 }
 
-// ToggleShortLinkStatus enables/disables a short link.
-func (m *MemDB) ToggleShortLinkStatus(shortURL string, disable bool) error {
+// ToggleShortLinkStatus enables/disables a short link owned by the specified
+// user.
+func (m *MemDB) ToggleShortLinkStatus(ownerID, shortURL string, disable bool) error {
 	if m.err != nil {
 		err := m.err
 		m.err = nil
@@ -263,26 +580,1348 @@ func (m *MemDB) ToggleShortLinkStatus(shortURL string, disable bool) error {
 
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
-	if url, ok := m.urls[shortURL]; ok {
-		url.Disabled = disable
-		return nil
+	url, err := m.userURL(ownerID, shortURL)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("%w: short URL does not exist", db.ErrorBadRequest)
+
+	url.Disabled = disable
+	return nil
 }
 
-// Close ends the connection to the database.
-func (m *MemDB) Close() error {
-	// Empty the db to free up memory.
+// userURL returns the short URL if it exists and is owned by ownerID. The
+// caller must hold the mtx lock.
+func (m *MemDB) userURL(ownerID, shortURL string) (*db.ShortURLInfo, error) {
+	url, ok := m.urls[shortURL]
+	if !ok {
+		return nil, fmt.Errorf("%w: short URL does not exist", db.ErrorNotFound)
+	}
+
+	if url.OwnerID != ownerID {
+		return nil, fmt.Errorf("%w: short URL belongs to another user", db.ErrorForbidden)
+	}
+
+	return url, nil
+}
+
+// CreateSession adds a new login session to the database.
+func (m *MemDB) CreateSession(session *db.Session) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if session.ID == "" || session.Email == "" {
+		return fmt.Errorf("%w: session ID and email are required", db.ErrorBadRequest)
+	}
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
-	m.urls = make(map[string]*db.ShortURLInfo)
-	m.users = make(map[string]*db.UserInfo)
-	m.urlClicks = make(map[string][]*db.ShortURLClick)
-	m.hashedPass = make(map[string][]byte)
+	if _, ok := m.sessions[session.ID]; ok {
+		return fmt.Errorf("%w: session already exists", db.ErrorBadRequest)
+	}
+
+	s := *session
+	s.RefreshTokenHash = append([]byte(nil), session.RefreshTokenHash...)
+	m.sessions[s.ID] = &s
 	return nil
 }
 
-// SetError is used by tests to simulate errors.
-func (m *MemDB) SetError(err error) {
-	m.err = err
+// RetrieveSession fetches the session with the specified ID.
+func (m *MemDB) RetrieveSession(id string) (*db.Session, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: session does not exist", db.ErrorNotFound)
+	}
+
+	s := *session
+	s.RefreshTokenHash = append([]byte(nil), session.RefreshTokenHash...)
+	return &s, nil
+}
+
+// RotateSessionRefreshToken replaces the refresh token hash of the session
+// with the specified ID with newHash if it is active and its refresh token hash
+// is oldHash, and extends the session until expiresAt.
+func (m *MemDB) RotateSessionRefreshToken(id string, oldHash, newHash []byte, expiresAt int64) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	session, ok := m.sessions[id]
+	if !ok || !session.IsActive(time.Now()) || !bytes.Equal(session.RefreshTokenHash, oldHash) {
+		return fmt.Errorf("%w: session does not exist or is not active", db.ErrorNotFound)
+	}
+
+	session.RefreshTokenHash = append([]byte(nil), newHash...)
+	session.ExpiresAt = expiresAt
+	return nil
+}
+
+// RevokeSession revokes the session with the specified ID.
+func (m *MemDB) RevokeSession(id string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return fmt.Errorf("%w: session does not exist", db.ErrorNotFound)
+	}
+
+	if session.RevokedAt == 0 {
+		session.RevokedAt = time.Now().Unix()
+	}
+	return nil
+}
+
+// RevokeUserSessions revokes all the active sessions of the user with the
+// specified email and returns the number of sessions that were revoked.
+func (m *MemDB) RevokeUserSessions(email string) (int64, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return 0, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := time.Now()
+	var n int64
+	for _, session := range m.sessions {
+		if session.Email == email && session.IsActive(now) {
+			session.RevokedAt = now.Unix()
+			n++
+		}
+	}
+	return n, nil
+}
+
+// DeleteExpiredSessions deletes all sessions that expired before the
+// specified unix timestamp and returns the number of sessions that were
+// deleted.
+func (m *MemDB) DeleteExpiredSessions(timestamp int64) (int64, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return 0, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var n int64
+	for id, session := range m.sessions {
+		if session.ExpiresAt < timestamp {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CreateAPIKey adds a new API key to the database.
+func (m *MemDB) CreateAPIKey(key *db.APIKey) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if key.ID == "" || key.Email == "" || len(key.KeyHash) == 0 {
+		return fmt.Errorf("%w: API key ID, email and hash are required", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, k := range m.apiKeys {
+		if k.ID == key.ID || bytes.Equal(k.KeyHash, key.KeyHash) {
+			return fmt.Errorf("%w: API key already exists", db.ErrorBadRequest)
+		}
+	}
+
+	m.apiKeys[key.ID] = copyAPIKey(key)
+	return nil
+}
+
+// RetrieveAPIKey fetches the API key with the specified hash.
+func (m *MemDB) RetrieveAPIKey(keyHash []byte) (*db.APIKey, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for _, key := range m.apiKeys {
+		if bytes.Equal(key.KeyHash, keyHash) {
+			return copyAPIKey(key), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: API key does not exist", db.ErrorNotFound)
+}
+
+// RetrieveUserAPIKeys fetches the API keys of the user with the specified
+// email, oldest first.
+func (m *MemDB) RetrieveUserAPIKeys(email string) ([]*db.APIKey, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	var keys []*db.APIKey
+	for _, key := range m.apiKeys {
+		if key.Email == email {
+			keys = append(keys, copyAPIKey(key))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt != keys[j].CreatedAt {
+			return keys[i].CreatedAt < keys[j].CreatedAt
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+// DeleteAPIKey deletes the API key with the specified ID owned by the user
+// with the specified email.
+func (m *MemDB) DeleteAPIKey(email, id string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	key, ok := m.apiKeys[id]
+	if !ok || key.Email != email {
+		return fmt.Errorf("%w: API key does not exist", db.ErrorNotFound)
+	}
+
+	delete(m.apiKeys, id)
+	return nil
+}
+
+// UpdateAPIKeyLastUsed sets the time the API key with the specified ID was
+// last used.
+func (m *MemDB) UpdateAPIKeyLastUsed(id string, timestamp int64) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	key, ok := m.apiKeys[id]
+	if !ok {
+		return fmt.Errorf("%w: API key does not exist", db.ErrorNotFound)
+	}
+
+	key.LastUsedAt = timestamp
+	return nil
+}
+
+// RetrieveIdentityUser fetches the user linked to the identity with the
+// specified subject at an external identity provider.
+func (m *MemDB) RetrieveIdentityUser(provider, subject string) (*db.UserInfo, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	identity, ok := m.identities[[2]string{provider, subject}]
+	if !ok {
+		return nil, fmt.Errorf("%w: identity is not linked to a user", db.ErrorNotFound)
+	}
+
+	user, ok := m.users[identity.Email]
+	if !ok {
+		return nil, fmt.Errorf("%w: identity is not linked to a user", db.ErrorNotFound)
+	}
+
+	return m.userInfo(user), nil
+}
+
+// CreateIdentityUser adds a new user with the email of identity and links
+// identity to it.
+func (m *MemDB) CreateIdentityUser(username string, identity *db.UserIdentity) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if username == "" || identity.Provider == "" || identity.Subject == "" {
+		return fmt.Errorf("%w: username, provider and subject are required", db.ErrorBadRequest)
+	}
+
+	if !db.IsValidEmail(identity.Email) {
+		return fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.users[identity.Email]; ok {
+		return fmt.Errorf("%w: email already exists", db.ErrorBadRequest)
+	}
+
+	for _, user := range m.users {
+		if user.Username == username {
+			return fmt.Errorf("%w: username already exists", db.ErrorBadRequest)
+		}
+	}
+
+	key := [2]string{identity.Provider, identity.Subject}
+	if _, ok := m.identities[key]; ok {
+		return fmt.Errorf("%w: identity is already linked", db.ErrorBadRequest)
+	}
+
+	// The identity provider verified the email.
+	m.users[identity.Email] = &db.UserInfo{
+		Username:      username,
+		Email:         identity.Email,
+		Timestamp:     time.Now().Unix(),
+		EmailVerified: true,
+	}
+	// An empty hash never matches a password.
+	m.hashedPass[identity.Email] = nil
+	i := *identity
+	m.identities[key] = &i
+	return nil
+}
+
+// LinkUserIdentity links identity to the existing user with the email of
+// identity.
+func (m *MemDB) LinkUserIdentity(identity *db.UserIdentity) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if identity.Provider == "" || identity.Subject == "" {
+		return fmt.Errorf("%w: provider and subject are required", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user, ok := m.users[identity.Email]
+	if !ok {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	key := [2]string{identity.Provider, identity.Subject}
+	if _, ok := m.identities[key]; ok {
+		return fmt.Errorf("%w: identity is already linked", db.ErrorBadRequest)
+	}
+
+	i := *identity
+	m.identities[key] = &i
+	user.EmailVerified = true
+	return nil
+}
+
+// SetEmailVerified marks the email of the user with the specified email as
+// verified.
+func (m *MemDB) SetEmailVerified(email string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	user.EmailVerified = true
+	return nil
+}
+
+// ResetUserPassword replaces the password of the user with the specified
+// email. The password is hashed before being stored.
+func (m *MemDB) ResetUserPassword(email string, password []byte) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if len(password) == 0 {
+		return fmt.Errorf("%w: password is required", db.ErrorBadRequest)
+	}
+
+	hashedPass, err := m.hasher.Hash(password)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.users[email]; !ok {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	m.hashedPass[email] = hashedPass
+	return nil
+}
+
+// CreateUserToken adds a new single-use user token to the database.
+func (m *MemDB) CreateUserToken(token *db.UserToken) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if len(token.TokenHash) == 0 || token.Purpose == "" {
+		return fmt.Errorf("%w: token hash and purpose are required", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.users[token.Email]; !ok {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	if _, ok := m.userTokens[string(token.TokenHash)]; ok {
+		return fmt.Errorf("%w: token already exists", db.ErrorBadRequest)
+	}
+
+	t := *token
+	t.TokenHash = append([]byte(nil), token.TokenHash...)
+	m.userTokens[string(t.TokenHash)] = &t
+	return nil
+}
+
+// ConsumeUserToken deletes the token with the specified hash and purpose and
+// the other tokens of the user with the same purpose, and returns it.
+func (m *MemDB) ConsumeUserToken(tokenHash []byte, purpose string, timestamp int64) (*db.UserToken, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	token, ok := m.userTokens[string(tokenHash)]
+	if !ok || token.Purpose != purpose || token.ExpiresAt <= timestamp {
+		return nil, fmt.Errorf("%w: token does not exist or has expired", db.ErrorNotFound)
+	}
+
+	for hash, t := range m.userTokens {
+		if t.Email == token.Email && t.Purpose == purpose {
+			delete(m.userTokens, hash)
+		}
+	}
+	return token, nil
+}
+
+// DeleteExpiredUserTokens deletes all user tokens that expired before the
+// specified unix timestamp and returns the number of tokens that were deleted.
+func (m *MemDB) DeleteExpiredUserTokens(timestamp int64) (int64, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return 0, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var n int64
+	for hash, token := range m.userTokens {
+		if token.ExpiresAt < timestamp {
+			delete(m.userTokens, hash)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// UpdateUsername changes the username of the user with the specified email.
+func (m *MemDB) UpdateUsername(email, username string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if username == "" {
+		return fmt.Errorf("%w: username is required", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	for _, u := range m.users {
+		if u.Username == username && u.Email != email {
+			return fmt.Errorf("%w: username already exists", db.ErrorBadRequest)
+		}
+	}
+
+	user.Username = username
+	return nil
+}
+
+// ChangeUserEmail changes the email of the user with the specified email to
+// newEmail and moves the user's short URLs, sessions, API keys, identities and
+// workspace memberships to it.
+func (m *MemDB) ChangeUserEmail(email, newEmail string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if !db.IsValidEmail(newEmail) {
+		return fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	if _, ok := m.users[newEmail]; ok {
+		return fmt.Errorf("%w: email already exists", db.ErrorBadRequest)
+	}
+
+	delete(m.users, email)
+	user.Email = newEmail
+	user.EmailVerified = false
+	m.users[newEmail] = user
+	m.hashedPass[newEmail] = m.hashedPass[email]
+	delete(m.hashedPass, email)
+	if totp, ok := m.totp[email]; ok {
+		m.totp[newEmail] = totp
+		delete(m.totp, email)
+	}
+	if codes, ok := m.recoveryCodes[email]; ok {
+		m.recoveryCodes[newEmail] = codes
+		delete(m.recoveryCodes, email)
+	}
+
+	for _, url := range m.urls {
+		if url.OwnerID == email {
+			url.OwnerID = newEmail
+		}
+	}
+	for _, session := range m.sessions {
+		if session.Email == email {
+			session.Email = newEmail
+		}
+	}
+	for _, key := range m.apiKeys {
+		if key.Email == email {
+			key.Email = newEmail
+		}
+	}
+	for _, identity := range m.identities {
+		if identity.Email == email {
+			identity.Email = newEmail
+		}
+	}
+	for k, member := range m.workspaceMembers {
+		if member.Email == email {
+			delete(m.workspaceMembers, k)
+			member.Email = newEmail
+			m.workspaceMembers[[2]string{member.WorkspaceID, newEmail}] = member
+		}
+	}
+	for hash, token := range m.userTokens {
+		if token.Email == email {
+			delete(m.userTokens, hash)
+		}
+	}
+	return nil
+}
+
+// DeleteUser deletes the user with the specified email together with the
+// user's short URLs and their clicks, sessions, API keys, identities, user
+// tokens and workspace memberships, and returns the deleted short URLs.
+func (m *MemDB) DeleteUser(email string) ([]string, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.users[email]; !ok {
+		return nil, fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	delete(m.users, email)
+	delete(m.hashedPass, email)
+	delete(m.totp, email)
+	delete(m.recoveryCodes, email)
+
+	var shortURLs []string
+	for shortURL, url := range m.urls {
+		if url.OwnerID == email {
+			delete(m.urls, shortURL)
+			delete(m.urlClicks, shortURL)
+			shortURLs = append(shortURLs, shortURL)
+		}
+	}
+	for id, session := range m.sessions {
+		if session.Email == email {
+			delete(m.sessions, id)
+		}
+	}
+	for id, key := range m.apiKeys {
+		if key.Email == email {
+			delete(m.apiKeys, id)
+		}
+	}
+	for k, identity := range m.identities {
+		if identity.Email == email {
+			delete(m.identities, k)
+		}
+	}
+	for hash, token := range m.userTokens {
+		if token.Email == email {
+			delete(m.userTokens, hash)
+		}
+	}
+	for k, member := range m.workspaceMembers {
+		if member.Email == email {
+			delete(m.workspaceMembers, k)
+		}
+	}
+	return shortURLs, nil
+}
+
+// SetUserTOTPSecret saves a new TOTP secret for the user with the specified
+// email, replacing a secret that was not enabled.
+func (m *MemDB) SetUserTOTPSecret(email string, secret []byte) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if len(secret) == 0 {
+		return fmt.Errorf("%w: secret is required", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user, ok := m.users[email]
+	if !ok || user.TOTPEnabled {
+		return fmt.Errorf("%w: user does not exist or TOTP is enabled", db.ErrorBadRequest)
+	}
+
+	m.totp[email] = &db.UserTOTP{Secret: append([]byte(nil), secret...)}
+	return nil
+}
+
+// RetrieveUserTOTP fetches the TOTP settings of the user with the specified
+// email.
+func (m *MemDB) RetrieveUserTOTP(email string) (*db.UserTOTP, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	if _, ok := m.users[email]; !ok {
+		return nil, fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	totp, ok := m.totp[email]
+	if !ok {
+		return nil, fmt.Errorf("%w: TOTP is not set up", db.ErrorNotFound)
+	}
+
+	t := *totp
+	t.Secret = append([]byte(nil), totp.Secret...)
+	t.RecoveryCodes = len(m.recoveryCodes[email])
+	return &t, nil
+}
+
+// EnableUserTOTP enables TOTP two-factor authentication for the user with the
+// specified email and replaces the user's recovery codes.
+func (m *MemDB) EnableUserTOTP(email string, recoveryCodeHashes [][]byte) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user, ok := m.users[email]
+	totp, hasTOTP := m.totp[email]
+	if !ok || !hasTOTP {
+		return fmt.Errorf("%w: user does not exist or has no TOTP secret", db.ErrorBadRequest)
+	}
+
+	codes := make(map[string]bool, len(recoveryCodeHashes))
+	for _, hash := range recoveryCodeHashes {
+		codes[string(hash)] = true
+	}
+
+	totp.Enabled = true
+	user.TOTPEnabled = true
+	m.recoveryCodes[email] = codes
+	return nil
+}
+
+// UseUserTOTPStep records that a TOTP code of the specified time step was
+// used by the user with the specified email.
+func (m *MemDB) UseUserTOTPStep(email string, step int64) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.users[email]; !ok {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	totp, ok := m.totp[email]
+	if ok && totp.LastStep >= step {
+		return fmt.Errorf("%w: TOTP code was already used", db.ErrorBadRequest)
+	}
+
+	if ok {
+		totp.LastStep = step
+	}
+	return nil
+}
+
+// ConsumeUserRecoveryCode deletes the recovery code with the specified hash of
+// the user with the specified email.
+func (m *MemDB) ConsumeUserRecoveryCode(email string, codeHash []byte) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	codes := m.recoveryCodes[email]
+	if !codes[string(codeHash)] {
+		return fmt.Errorf("%w: recovery code does not exist", db.ErrorNotFound)
+	}
+
+	delete(codes, string(codeHash))
+	return nil
+}
+
+// DisableUserTOTP disables TOTP two-factor authentication for the user with
+// the specified email and deletes the TOTP secret and the recovery codes.
+func (m *MemDB) DisableUserTOTP(email string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	user.TOTPEnabled = false
+	delete(m.totp, email)
+	delete(m.recoveryCodes, email)
+	return nil
+}
+
+// copyAPIKey returns a deep copy of key.
+func copyAPIKey(key *db.APIKey) *db.APIKey {
+	k := *key
+	k.KeyHash = append([]byte(nil), key.KeyHash...)
+	k.Scopes = append([]string(nil), key.Scopes...)
+	return &k
+}
+
+// RetrieveLoginAttempts fetches the failed login attempts recorded for key.
+func (m *MemDB) RetrieveLoginAttempts(key string) (*db.LoginAttempts, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	attempts := new(db.LoginAttempts)
+	if a, ok := m.loginAttempts[key]; ok {
+		*attempts = *a
+	}
+	return attempts, nil
+}
+
+// RecordFailedLogin adds a failed login attempt to the attempts recorded for
+// key.
+func (m *MemDB) RecordFailedLogin(key string, timestamp int64) (*db.LoginAttempts, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	attempts, ok := m.loginAttempts[key]
+	if !ok {
+		attempts = new(db.LoginAttempts)
+		m.loginAttempts[key] = attempts
+	}
+	attempts.Failures++
+	attempts.LastFailure = timestamp
+
+	a := *attempts
+	return &a, nil
+}
+
+// LockLogin refuses logins for key until the specified unix timestamp.
+func (m *MemDB) LockLogin(key string, until int64) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	attempts, ok := m.loginAttempts[key]
+	if !ok {
+		attempts = new(db.LoginAttempts)
+		m.loginAttempts[key] = attempts
+	}
+	attempts.LockedUntil = until
+	return nil
+}
+
+// ClearLoginAttempts deletes the failed login attempts and lock of key.
+func (m *MemDB) ClearLoginAttempts(key string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.loginAttempts, key)
+	return nil
+}
+
+// DeleteStaleLoginAttempts deletes the login attempts whose last failure and
+// lock are before the specified unix timestamp.
+func (m *MemDB) DeleteStaleLoginAttempts(timestamp int64) (int64, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return 0, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var n int64
+	for key, attempts := range m.loginAttempts {
+		if attempts.LastFailure < timestamp && attempts.LockedUntil < timestamp {
+			delete(m.loginAttempts, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CreateWorkspace adds a new workspace to the database with the user with the
+// specified email as its owner.
+func (m *MemDB) CreateWorkspace(workspace *db.Workspace, ownerEmail string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if !db.IsWorkspaceID(workspace.ID) || workspace.Name == "" {
+		return fmt.Errorf("%w: workspace ID and name are required", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.users[ownerEmail]; !ok {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	if _, ok := m.workspaces[workspace.ID]; ok {
+		return fmt.Errorf("%w: workspace already exists", db.ErrorBadRequest)
+	}
+
+	w := *workspace
+	w.Role = ""
+	m.workspaces[w.ID] = &w
+	m.workspaceMembers[[2]string{w.ID, ownerEmail}] = &db.WorkspaceMember{
+		WorkspaceID: w.ID,
+		Email:       ownerEmail,
+		Role:        db.WorkspaceRoleOwner,
+		JoinedAt:    w.CreatedAt,
+	}
+	return nil
+}
+
+// RetrieveWorkspace fetches the workspace with the specified ID.
+func (m *MemDB) RetrieveWorkspace(id string) (*db.Workspace, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	workspace, ok := m.workspaces[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: workspace does not exist", db.ErrorNotFound)
+	}
+
+	w := *workspace
+	return &w, nil
+}
+
+// RetrieveUserWorkspaces fetches the workspaces the user with the specified
+// email is a member of, oldest first, with the role of the user.
+func (m *MemDB) RetrieveUserWorkspaces(email string) ([]*db.Workspace, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	var workspaces []*db.Workspace
+	for _, member := range m.workspaceMembers {
+		if member.Email != email {
+			continue
+		}
+
+		w := *m.workspaces[member.WorkspaceID]
+		w.Role = member.Role
+		workspaces = append(workspaces, &w)
+	}
+
+	sort.Slice(workspaces, func(i, j int) bool {
+		if workspaces[i].CreatedAt != workspaces[j].CreatedAt {
+			return workspaces[i].CreatedAt < workspaces[j].CreatedAt
+		}
+		return workspaces[i].ID < workspaces[j].ID
+	})
+	return workspaces, nil
+}
+
+// DeleteWorkspace deletes the workspace with the specified ID together with
+// its members, invitations, short URLs and their clicks, and returns the
+// deleted short URLs.
+func (m *MemDB) DeleteWorkspace(id string) ([]string, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.workspaces[id]; !ok {
+		return nil, fmt.Errorf("%w: workspace does not exist", db.ErrorNotFound)
+	}
+
+	delete(m.workspaces, id)
+	for k, member := range m.workspaceMembers {
+		if member.WorkspaceID == id {
+			delete(m.workspaceMembers, k)
+		}
+	}
+	for invitationID, invitation := range m.workspaceInvitations {
+		if invitation.WorkspaceID == id {
+			delete(m.workspaceInvitations, invitationID)
+		}
+	}
+
+	var shortURLs []string
+	for shortURL, url := range m.urls {
+		if url.OwnerID == id {
+			delete(m.urls, shortURL)
+			delete(m.urlClicks, shortURL)
+			shortURLs = append(shortURLs, shortURL)
+		}
+	}
+	return shortURLs, nil
+}
+
+// RetrieveWorkspaceMember fetches the membership of the user with the
+// specified email in the workspace with the specified ID.
+func (m *MemDB) RetrieveWorkspaceMember(workspaceID, email string) (*db.WorkspaceMember, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	member, ok := m.workspaceMembers[[2]string{workspaceID, email}]
+	if !ok {
+		return nil, fmt.Errorf("%w: user is not a member of the workspace", db.ErrorNotFound)
+	}
+
+	mem := *member
+	return &mem, nil
+}
+
+// RetrieveWorkspaceMembers fetches the members of the workspace with the
+// specified ID, oldest first.
+func (m *MemDB) RetrieveWorkspaceMembers(workspaceID string) ([]*db.WorkspaceMember, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	var members []*db.WorkspaceMember
+	for _, member := range m.workspaceMembers {
+		if member.WorkspaceID == workspaceID {
+			mem := *member
+			members = append(members, &mem)
+		}
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].JoinedAt != members[j].JoinedAt {
+			return members[i].JoinedAt < members[j].JoinedAt
+		}
+		return members[i].Email < members[j].Email
+	})
+	return members, nil
+}
+
+// UpdateWorkspaceMemberRole changes the role of the user with the specified
+// email in the workspace with the specified ID.
+func (m *MemDB) UpdateWorkspaceMemberRole(workspaceID, email, role string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if !db.IsValidWorkspaceRole(role) {
+		return fmt.Errorf("%w: invalid workspace role", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	member, ok := m.workspaceMembers[[2]string{workspaceID, email}]
+	if !ok {
+		return fmt.Errorf("%w: user is not a member of the workspace", db.ErrorNotFound)
+	}
+
+	if role != db.WorkspaceRoleOwner && m.isLastWorkspaceOwner(member) {
+		return fmt.Errorf("%w: a workspace must have an owner", db.ErrorBadRequest)
+	}
+
+	member.Role = role
+	return nil
+}
+
+// RemoveWorkspaceMember removes the user with the specified email from the
+// workspace with the specified ID.
+func (m *MemDB) RemoveWorkspaceMember(workspaceID, email string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	k := [2]string{workspaceID, email}
+	member, ok := m.workspaceMembers[k]
+	if !ok {
+		return fmt.Errorf("%w: user is not a member of the workspace", db.ErrorNotFound)
+	}
+
+	if m.isLastWorkspaceOwner(member) {
+		return fmt.Errorf("%w: a workspace must have an owner", db.ErrorBadRequest)
+	}
+
+	delete(m.workspaceMembers, k)
+	return nil
+}
+
+// isLastWorkspaceOwner checks if member is the only owner of their workspace.
+// m.mtx must be locked.
+func (m *MemDB) isLastWorkspaceOwner(member *db.WorkspaceMember) bool {
+	if member.Role != db.WorkspaceRoleOwner {
+		return false
+	}
+
+	for _, other := range m.workspaceMembers {
+		if other.WorkspaceID == member.WorkspaceID && other.Email != member.Email && other.Role == db.WorkspaceRoleOwner {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateWorkspaceInvitation adds a new invitation to join a workspace to the
+// database.
+func (m *MemDB) CreateWorkspaceInvitation(invitation *db.WorkspaceInvitation) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	if invitation.ID == "" || len(invitation.TokenHash) == 0 || !db.IsValidWorkspaceRole(invitation.Role) {
+		return fmt.Errorf("%w: invitation ID, token hash and role are required", db.ErrorBadRequest)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.workspaces[invitation.WorkspaceID]; !ok {
+		return fmt.Errorf("%w: workspace does not exist", db.ErrorBadRequest)
+	}
+
+	for id, inv := range m.workspaceInvitations {
+		if id == invitation.ID || bytes.Equal(inv.TokenHash, invitation.TokenHash) {
+			return fmt.Errorf("%w: invitation already exists", db.ErrorBadRequest)
+		}
+	}
+
+	inv := *invitation
+	m.workspaceInvitations[inv.ID] = &inv
+	return nil
+}
+
+// RetrieveWorkspaceInvitations fetches the invitations of the workspace with
+// the specified ID that have not been accepted, oldest first.
+func (m *MemDB) RetrieveWorkspaceInvitations(workspaceID string) ([]*db.WorkspaceInvitation, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	var invitations []*db.WorkspaceInvitation
+	for _, invitation := range m.workspaceInvitations {
+		if invitation.WorkspaceID == workspaceID {
+			inv := *invitation
+			invitations = append(invitations, &inv)
+		}
+	}
+
+	sort.Slice(invitations, func(i, j int) bool {
+		if invitations[i].CreatedAt != invitations[j].CreatedAt {
+			return invitations[i].CreatedAt < invitations[j].CreatedAt
+		}
+		return invitations[i].ID < invitations[j].ID
+	})
+	return invitations, nil
+}
+
+// DeleteWorkspaceInvitation deletes the invitation with the specified ID of
+// the workspace with the specified ID.
+func (m *MemDB) DeleteWorkspaceInvitation(workspaceID, id string) error {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	invitation, ok := m.workspaceInvitations[id]
+	if !ok || invitation.WorkspaceID != workspaceID {
+		return fmt.Errorf("%w: invitation does not exist", db.ErrorNotFound)
+	}
+
+	delete(m.workspaceInvitations, id)
+	return nil
+}
+
+// AcceptWorkspaceInvitation deletes the invitation with the specified token
+// hash sent to the specified email and adds the user with that email to the
+// workspace with the role of the invitation.
+func (m *MemDB) AcceptWorkspaceInvitation(tokenHash []byte, email string, timestamp int64) (*db.WorkspaceMember, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var invitation *db.WorkspaceInvitation
+	for _, inv := range m.workspaceInvitations {
+		if bytes.Equal(inv.TokenHash, tokenHash) {
+			invitation = inv
+			break
+		}
+	}
+
+	if invitation == nil || invitation.Email != email || invitation.ExpiresAt <= timestamp {
+		return nil, fmt.Errorf("%w: invitation does not exist or has expired", db.ErrorNotFound)
+	}
+
+	if _, ok := m.users[email]; !ok {
+		return nil, fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	k := [2]string{invitation.WorkspaceID, email}
+	if _, ok := m.workspaceMembers[k]; ok {
+		return nil, fmt.Errorf("%w: user is already a member of the workspace", db.ErrorBadRequest)
+	}
+
+	delete(m.workspaceInvitations, invitation.ID)
+	member := &db.WorkspaceMember{
+		WorkspaceID: invitation.WorkspaceID,
+		Email:       email,
+		Role:        invitation.Role,
+		JoinedAt:    timestamp,
+	}
+	m.workspaceMembers[k] = member
+
+	mem := *member
+	return &mem, nil
+}
+
+// DeleteExpiredWorkspaceInvitations deletes all workspace invitations that
+// expired before the specified unix timestamp and returns the number of
+// invitations that were deleted.
+func (m *MemDB) DeleteExpiredWorkspaceInvitations(timestamp int64) (int64, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return 0, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var n int64
+	for id, invitation := range m.workspaceInvitations {
+		if invitation.ExpiresAt < timestamp {
+			delete(m.workspaceInvitations, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Close ends the connection to the database.
+func (m *MemDB) Close() error {
+	// Empty the db to free up memory.
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.urls = make(map[string]*db.ShortURLInfo)
+	m.users = make(map[string]*db.UserInfo)
+	m.urlClicks = make(map[string][]*db.ShortURLClick)
+	m.hashedPass = make(map[string][]byte)
+	m.sessions = make(map[string]*db.Session)
+	m.apiKeys = make(map[string]*db.APIKey)
+	m.identities = make(map[[2]string]*db.UserIdentity)
+	m.userTokens = make(map[string]*db.UserToken)
+	m.totp = make(map[string]*db.UserTOTP)
+	m.recoveryCodes = make(map[string]map[string]bool)
+	m.loginAttempts = make(map[string]*db.LoginAttempts)
+	m.workspaces = make(map[string]*db.Workspace)
+	m.workspaceMembers = make(map[[2]string]*db.WorkspaceMember)
+	m.workspaceInvitations = make(map[string]*db.WorkspaceInvitation)
+	return nil
+}
+
+// SetPasswordHasher replaces the hasher of user passwords. It must be called
+// before the database is used.
+func (m *MemDB) SetPasswordHasher(hasher db.PasswordHasher) {
+	m.hasher = hasher
+}
+
+// SetError is used by tests to simulate errors.
+func (m *MemDB) SetError(err error) {
+	m.err = err
+}
+
+// RetrieveShortURLClickStats returns aggregated statistics about the clicks
+// on a short URL owned by the specified user within the time range [from, to).
+func (m *MemDB) RetrieveShortURLClickStats(ownerID, shortURL string, from, to int64, interval db.StatsInterval) (*db.ShortURLClickStats, error) {
+	if m.err != nil {
+		err := m.err
+		m.err = nil
+		return nil, err
+	}
+
+	if err := db.ValidateStatsRange(from, to, interval); err != nil {
+		return nil, err
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	if _, err := m.userURL(ownerID, shortURL); err != nil {
+		return nil, err
+	}
+
+	counts := db.NewClickStatsCounts()
+	for _, click := range m.urlClicks[shortURL] {
+		if click.Timestamp >= from && click.Timestamp < to {
+			counts.Add(click, interval)
+		}
+	}
+
+	return counts.Stats(from, to, interval), nil
 }
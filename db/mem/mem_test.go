@@ -0,0 +1,18 @@
+package mem
+
+import (
+	"testing"
+
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/db/dbtest"
+)
+
+func TestMemDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, hasher db.PasswordHasher) db.DataStore {
+		m := New()
+		if hasher != nil {
+			m.SetPasswordHasher(hasher)
+		}
+		return m
+	})
+}
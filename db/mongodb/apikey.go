@@ -0,0 +1,100 @@
+package mongodb
+
+import (
+	"fmt"
+
+	"github.com/ukane-philemon/bob/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CreateAPIKey adds a new API key to the database. Implements db.DataStore.
+func (m *MongoDB) CreateAPIKey(key *db.APIKey) error {
+	if key.ID == "" || key.Email == "" || len(key.KeyHash) == 0 {
+		return fmt.Errorf("%w: API key ID, email and hash are required", db.ErrorBadRequest)
+	}
+
+	if _, err := m.apiKeysCollection().InsertOne(m.ctx, key); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: API key already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating API key: %w", err)
+	}
+
+	return nil
+}
+
+// RetrieveAPIKey fetches the API key with the specified hash. Implements
+// db.DataStore.
+func (m *MongoDB) RetrieveAPIKey(keyHash []byte) (*db.APIKey, error) {
+	res := m.apiKeysCollection().FindOne(m.ctx, bson.M{keyHashKey: keyHash})
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("%w: API key does not exist", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error retrieving API key: %w", res.Err())
+	}
+
+	var key *db.APIKey
+	if err := res.Decode(&key); err != nil {
+		return nil, fmt.Errorf("error decoding API key: %w", err)
+	}
+
+	return key, nil
+}
+
+// RetrieveUserAPIKeys fetches the API keys of the user with the specified
+// email, oldest first. Implements db.DataStore.
+func (m *MongoDB) RetrieveUserAPIKeys(email string) ([]*db.APIKey, error) {
+	opts := options.Find().SetSort(bson.D{{Key: createdAtKey, Value: 1}, {Key: apiKeyIDKey, Value: 1}})
+	cursor, err := m.apiKeysCollection().Find(m.ctx, bson.M{emailKey: email}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving API keys: %w", err)
+	}
+
+	var keys []*db.APIKey
+	if err := cursor.All(m.ctx, &keys); err != nil {
+		return nil, fmt.Errorf("error decoding API keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// DeleteAPIKey deletes the API key with the specified ID owned by the user
+// with the specified email. Implements db.DataStore.
+func (m *MongoDB) DeleteAPIKey(email, id string) error {
+	res, err := m.apiKeysCollection().DeleteOne(m.ctx, bson.M{apiKeyIDKey: id, emailKey: email})
+	if err != nil {
+		return fmt.Errorf("error deleting API key: %w", err)
+	}
+
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("%w: API key does not exist", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// UpdateAPIKeyLastUsed sets the time the API key with the specified ID was
+// last used. Implements db.DataStore.
+func (m *MongoDB) UpdateAPIKeyLastUsed(id string, timestamp int64) error {
+	update := bson.M{"$set": bson.M{lastUsedAtKey: timestamp}}
+	res, err := m.apiKeysCollection().UpdateOne(m.ctx, bson.M{apiKeyIDKey: id}, update)
+	if err != nil {
+		return fmt.Errorf("error updating API key: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: API key does not exist", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// apiKeysCollection returns the collection for API keys.
+func (m *MongoDB) apiKeysCollection() *mongo.Collection {
+	return m.db.Collection(apiKeysCollectionName)
+}
@@ -0,0 +1,165 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ukane-philemon/bob/cachebus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// cacheInvalidationsCollection is the name of the collection that stores
+	// short URL cache invalidations.
+	cacheInvalidationsCollection = "cache_invalidations"
+	// cacheInvalidationTTLIndexName is the name of the TTL index that deletes
+	// delivered cache invalidations.
+	cacheInvalidationTTLIndexName = "cache_invalidation_ttl"
+	// cacheInvalidationRetention is how long cache invalidations are kept.
+	// Change streams can only resume while the invalidations they missed are
+	// in the oplog, so the documents themselves are not needed for long.
+	cacheInvalidationRetention = time.Hour
+	// cacheBusRetryInterval is how long the CacheBus waits before it watches
+	// cache invalidations again after the change stream failed.
+	cacheBusRetryInterval = 5 * time.Second
+	// invalidationDateKey is the key for the cache invalidation TTL index
+	// date. See: cacheInvalidation.Date.
+	invalidationDateKey = "date"
+)
+
+var busLog = log.New(os.Stdout, "[mongodb] ", log.LstdFlags|log.Lshortfile)
+
+// cacheInvalidation is a short URL cache invalidation document.
+type cacheInvalidation struct {
+	ShortURL string `bson:"short_url"`
+	// Date is used by the TTL index.
+	Date time.Time `bson:"date"`
+}
+
+// CacheBus is a cachebus.Bus that stores invalidations in a MongoDB collection
+// and delivers them to the instances watching the collection with a change
+// stream. Change streams require a replica set or a sharded cluster.
+type CacheBus struct {
+	cachebus.Subscribers
+
+	coll   *mongo.Collection
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// CacheBus implements the cachebus.Bus interface.
+var _ cachebus.Bus = (*CacheBus)(nil)
+
+// NewCacheBus creates a *CacheBus that uses the database of m and starts
+// watching cache invalidations. An error is returned if the server does not
+// support change streams.
+func (m *MongoDB) NewCacheBus() (*CacheBus, error) {
+	err := createTTLIndex(m.ctx, m.db, cacheInvalidationsCollection, cacheInvalidationTTLIndexName, invalidationDateKey, cacheInvalidationRetention)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := m.db.Collection(cacheInvalidationsCollection)
+	ctx, cancel := context.WithCancel(m.ctx)
+	stream, err := watchCacheInvalidations(ctx, coll, nil)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to watch cache invalidations (change streams require a replica set): %w", err)
+	}
+
+	b := &CacheBus{
+		coll:   coll,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go b.run(ctx, stream)
+	return b, nil
+}
+
+// watchCacheInvalidations opens a change stream of the cache invalidations
+// inserted into coll after resumeToken, or from now if resumeToken is nil.
+func watchCacheInvalidations(ctx context.Context, coll *mongo.Collection, resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}}}
+	opts := options.ChangeStream()
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+	return coll.Watch(ctx, pipeline, opts)
+}
+
+// run delivers the invalidations from stream until ctx is canceled. The
+// change stream is opened again if it fails. Every cached short URL is
+// invalidated if it cannot resume where it failed.
+func (b *CacheBus) run(ctx context.Context, stream *mongo.ChangeStream) {
+	defer close(b.done)
+
+	for {
+		for stream.Next(ctx) {
+			var event struct {
+				FullDocument cacheInvalidation `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&event); err != nil {
+				busLog.Printf("\nstream.Decode error: %v\n", err)
+				continue
+			}
+			b.Notify(event.FullDocument.ShortURL)
+		}
+
+		err := stream.Err()
+		resumeToken := stream.ResumeToken()
+		stream.Close(context.Background())
+		if ctx.Err() != nil {
+			return
+		}
+		busLog.Printf("\nCache invalidation change stream error: %v\n", err)
+
+		for stream = nil; stream == nil; {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cacheBusRetryInterval):
+			}
+
+			if resumeToken != nil {
+				stream, err = watchCacheInvalidations(ctx, b.coll, resumeToken)
+				if err != nil {
+					busLog.Printf("\nFailed to resume cache invalidations: %v\n", err)
+					stream, resumeToken = nil, nil
+				}
+			}
+
+			if stream == nil {
+				stream, err = watchCacheInvalidations(ctx, b.coll, nil)
+				if err != nil {
+					busLog.Printf("\nFailed to watch cache invalidations: %v\n", err)
+					stream = nil
+					continue
+				}
+				// Invalidations published while the change stream was down
+				// were missed.
+				b.Notify("")
+			}
+		}
+	}
+}
+
+// Publish stores the invalidation of shortURL. It is delivered to the
+// subscribers of every instance once it is read from the change stream.
+// Implements cachebus.Bus.
+func (b *CacheBus) Publish(ctx context.Context, shortURL string) error {
+	_, err := b.coll.InsertOne(ctx, &cacheInvalidation{ShortURL: shortURL, Date: time.Now()})
+	return err
+}
+
+// Close stops watching cache invalidations. Implements cachebus.Bus.
+func (b *CacheBus) Close() error {
+	b.cancel()
+	<-b.done
+	return nil
+}
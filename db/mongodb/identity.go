@@ -0,0 +1,123 @@
+package mongodb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RetrieveIdentityUser fetches the user linked to the identity with the
+// specified subject at an external identity provider. Implements
+// db.DataStore.
+func (m *MongoDB) RetrieveIdentityUser(provider, subject string) (*db.UserInfo, error) {
+	res := m.identitiesCollection().FindOne(m.ctx, bson.M{providerKey: provider, subjectKey: subject})
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("%w: identity is not linked to a user", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error retrieving identity: %w", res.Err())
+	}
+
+	var identity *db.UserIdentity
+	if err := res.Decode(&identity); err != nil {
+		return nil, fmt.Errorf("error decoding identity: %w", err)
+	}
+
+	userInfo, err := m.RetrieveUserInfo(identity.Email)
+	if err != nil {
+		if errors.Is(err, db.ErrorBadRequest) {
+			return nil, fmt.Errorf("%w: identity is not linked to a user", db.ErrorNotFound)
+		}
+		return nil, err
+	}
+
+	return userInfo, nil
+}
+
+// CreateIdentityUser adds a new user with the email of identity and links
+// identity to it. Implements db.DataStore.
+func (m *MongoDB) CreateIdentityUser(username string, identity *db.UserIdentity) error {
+	if username == "" || identity.Provider == "" || identity.Subject == "" {
+		return fmt.Errorf("%w: username, provider and subject are required", db.ErrorBadRequest)
+	}
+
+	if !db.IsValidEmail(identity.Email) {
+		return fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	}
+
+	// An empty password hash never matches a password. The identity provider
+	// verified the email.
+	userInfo := &completeUserInfo{
+		UserInfo: &db.UserInfo{
+			Username:      username,
+			Email:         identity.Email,
+			Timestamp:     time.Now().Unix(),
+			EmailVerified: true,
+		},
+		Password: []byte{},
+	}
+	if _, err := m.usersCollection().InsertOne(m.ctx, userInfo); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: username or email already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating user: %w", err)
+	}
+
+	if err := m.insertIdentity(identity); err != nil {
+		// Remove the user so that creating it can be retried, transactions
+		// require a replica set.
+		if _, delErr := m.usersCollection().DeleteOne(m.ctx, bson.M{userMapKey(emailKey): identity.Email}); delErr != nil {
+			return fmt.Errorf("%w (error removing user: %v)", err, delErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// LinkUserIdentity links identity to the existing user with the email of
+// identity. Implements db.DataStore.
+func (m *MongoDB) LinkUserIdentity(identity *db.UserIdentity) error {
+	if identity.Provider == "" || identity.Subject == "" {
+		return fmt.Errorf("%w: provider and subject are required", db.ErrorBadRequest)
+	}
+
+	if err := m.insertIdentity(identity); err != nil {
+		return err
+	}
+
+	// The identity provider verified the email.
+	if err := m.SetEmailVerified(identity.Email); err != nil {
+		// Remove the identity of a user that does not exist.
+		if _, delErr := m.identitiesCollection().DeleteOne(m.ctx, bson.M{providerKey: identity.Provider, subjectKey: identity.Subject}); delErr != nil {
+			return fmt.Errorf("%w (error removing identity: %v)", err, delErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// insertIdentity adds identity to the database.
+func (m *MongoDB) insertIdentity(identity *db.UserIdentity) error {
+	if _, err := m.identitiesCollection().InsertOne(m.ctx, identity); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: identity is already linked", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error linking identity: %w", err)
+	}
+
+	return nil
+}
+
+// identitiesCollection returns the collection for user identities.
+func (m *MongoDB) identitiesCollection() *mongo.Collection {
+	return m.db.Collection(identitiesCollectionName)
+}
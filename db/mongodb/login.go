@@ -0,0 +1,97 @@
+package mongodb
+
+import (
+	"fmt"
+
+	"github.com/ukane-philemon/bob/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RetrieveLoginAttempts fetches the failed login attempts recorded for key.
+// Implements db.DataStore.
+func (m *MongoDB) RetrieveLoginAttempts(key string) (*db.LoginAttempts, error) {
+	attempts := new(db.LoginAttempts)
+	res := m.loginAttemptsCollection().FindOne(m.ctx, bson.M{loginAttemptsKeyKey: key})
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return attempts, nil
+		}
+
+		return nil, fmt.Errorf("error retrieving login attempts: %w", res.Err())
+	}
+
+	if err := res.Decode(attempts); err != nil {
+		return nil, fmt.Errorf("error decoding login attempts: %w", err)
+	}
+
+	return attempts, nil
+}
+
+// RecordFailedLogin adds a failed login attempt to the attempts recorded for
+// key. Implements db.DataStore.
+func (m *MongoDB) RecordFailedLogin(key string, timestamp int64) (*db.LoginAttempts, error) {
+	update := bson.M{
+		"$inc":         bson.M{failuresKey: 1},
+		"$set":         bson.M{lastFailureKey: timestamp},
+		"$setOnInsert": bson.M{lockedUntilKey: int64(0)},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	res := m.loginAttemptsCollection().FindOneAndUpdate(m.ctx, bson.M{loginAttemptsKeyKey: key}, update, opts)
+	if res.Err() != nil {
+		return nil, fmt.Errorf("error recording failed login: %w", res.Err())
+	}
+
+	attempts := new(db.LoginAttempts)
+	if err := res.Decode(attempts); err != nil {
+		return nil, fmt.Errorf("error decoding login attempts: %w", err)
+	}
+
+	return attempts, nil
+}
+
+// LockLogin refuses logins for key until the specified unix timestamp.
+// Implements db.DataStore.
+func (m *MongoDB) LockLogin(key string, until int64) error {
+	update := bson.M{
+		"$set":         bson.M{lockedUntilKey: until},
+		"$setOnInsert": bson.M{failuresKey: 0, lastFailureKey: int64(0)},
+	}
+	_, err := m.loginAttemptsCollection().UpdateOne(m.ctx, bson.M{loginAttemptsKeyKey: key}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("error locking login: %w", err)
+	}
+
+	return nil
+}
+
+// ClearLoginAttempts deletes the failed login attempts and lock of key.
+// Implements db.DataStore.
+func (m *MongoDB) ClearLoginAttempts(key string) error {
+	if _, err := m.loginAttemptsCollection().DeleteOne(m.ctx, bson.M{loginAttemptsKeyKey: key}); err != nil {
+		return fmt.Errorf("error clearing login attempts: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteStaleLoginAttempts deletes the login attempts whose last failure and
+// lock are before the specified unix timestamp. Implements db.DataStore.
+func (m *MongoDB) DeleteStaleLoginAttempts(timestamp int64) (int64, error) {
+	filter := bson.M{
+		lastFailureKey: bson.M{"$lt": timestamp},
+		lockedUntilKey: bson.M{"$lt": timestamp},
+	}
+	res, err := m.loginAttemptsCollection().DeleteMany(m.ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting stale login attempts: %w", err)
+	}
+
+	return res.DeletedCount, nil
+}
+
+// loginAttemptsCollection returns the collection for failed login attempts.
+func (m *MongoDB) loginAttemptsCollection() *mongo.Collection {
+	return m.db.Collection(loginAttemptsCollectionName)
+}
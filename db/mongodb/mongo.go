@@ -2,7 +2,9 @@ package mongodb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/ukane-philemon/bob/db"
 	"github.com/ukane-philemon/bob/webserver"
@@ -21,6 +23,30 @@ const (
 	// usersCollectionName is the name of the collection that stores user
 	// information.
 	usersCollectionName = "users"
+	// sessionsCollectionName is the name of the collection that stores login
+	// sessions.
+	sessionsCollectionName = "sessions"
+	// apiKeysCollectionName is the name of the collection that stores
+	// personal API keys.
+	apiKeysCollectionName = "api_keys"
+	// identitiesCollectionName is the name of the collection that stores the
+	// identities of users at external identity providers.
+	identitiesCollectionName = "user_identities"
+	// userTokensCollectionName is the name of the collection that stores
+	// single-use user tokens.
+	userTokensCollectionName = "user_tokens"
+	// loginAttemptsCollectionName is the name of the collection that stores
+	// failed login attempts and lockouts.
+	loginAttemptsCollectionName = "login_attempts"
+	// workspacesCollectionName is the name of the collection that stores
+	// workspaces.
+	workspacesCollectionName = "workspaces"
+	// workspaceMembersCollectionName is the name of the collection that
+	// stores the members of workspaces.
+	workspaceMembersCollectionName = "workspace_members"
+	// workspaceInvitationsCollectionName is the name of the collection that
+	// stores invitations to join workspaces.
+	workspaceInvitationsCollectionName = "workspace_invitations"
 )
 
 const (
@@ -39,6 +65,127 @@ const (
 	// usernameKey is the key for the username in the database. See:
 	// db.UserInfo.Username.
 	usernameKey = "username"
+	// expiresAtKey is the key for the short URL expiry in the database. See:
+	// db.ShortURLInfo.ExpiresAt.
+	expiresAtKey = "expires_at"
+	// expiredKey is the key for the short URL expired flag in the database.
+	// See: db.ShortURLInfo.Expired.
+	expiredKey = "expired"
+	// expiryDateKey is the key for the TTL index date. See:
+	// urlInfo.ExpiryDate.
+	expiryDateKey = "expiry_date"
+	// passwordProtectedKey is the key for the short URL password protected
+	// flag in the database. See: db.ShortURLInfo.PasswordProtected.
+	passwordProtectedKey = "password_protected"
+	// passwordHashKey is the key for the short URL password hash in the
+	// database. See: db.ShortURLInfo.PasswordHash.
+	passwordHashKey = "password_hash"
+	// clicksKey is the key for the short URL clicks in the database. See:
+	// db.ShortURLInfo.Clicks.
+	clicksKey = "clicks"
+	// maxClicksKey is the key for the short URL click budget in the database.
+	// See: db.ShortURLInfo.MaxClicks.
+	maxClicksKey = "max_clicks"
+	// activeFromKey is the key for the start of the short URL active window in
+	// the database. See: db.ShortURLInfo.ActiveFrom.
+	activeFromKey = "active_from"
+	// activeUntilKey is the key for the end of the short URL active window in
+	// the database. See: db.ShortURLInfo.ActiveUntil.
+	activeUntilKey = "active_until"
+	// timestampKey is the key for the click timestamp in the database. See:
+	// db.ShortURLClick.Timestamp.
+	timestampKey = "timestamp"
+	// clickDateKey is the key for the click TTL index date. See:
+	// urlClick.Date.
+	clickDateKey = "date"
+	// sessionIDKey is the key for the session ID in the database. See:
+	// db.Session.ID.
+	sessionIDKey = "id"
+	// refreshTokenHashKey is the key for the session refresh token hash in the
+	// database. See: db.Session.RefreshTokenHash.
+	refreshTokenHashKey = "refresh_token_hash"
+	// revokedAtKey is the key for the session revocation time in the
+	// database. See: db.Session.RevokedAt.
+	revokedAtKey = "revoked_at"
+	// apiKeyIDKey is the key for the API key ID in the database. See:
+	// db.APIKey.ID.
+	apiKeyIDKey = "id"
+	// keyHashKey is the key for the API key hash in the database. See:
+	// db.APIKey.KeyHash.
+	keyHashKey = "key_hash"
+	// createdAtKey is the key for the API key creation time in the database.
+	// See: db.APIKey.CreatedAt.
+	createdAtKey = "created_at"
+	// lastUsedAtKey is the key for the time an API key was last used in the
+	// database. See: db.APIKey.LastUsedAt.
+	lastUsedAtKey = "last_used_at"
+	// providerKey is the key for the identity provider in the database. See:
+	// db.UserIdentity.Provider.
+	providerKey = "provider"
+	// subjectKey is the key for the identity subject in the database. See:
+	// db.UserIdentity.Subject.
+	subjectKey = "subject"
+	// passwordKey is the key for the hashed password of a user in the
+	// database. See: completeUserInfo.Password.
+	passwordKey = "password"
+	// emailVerifiedKey is the key for the email verification status of a user
+	// in the database. See: db.UserInfo.EmailVerified.
+	emailVerifiedKey = "email_verified"
+	// tokenHashKey is the key for the hash of a user token in the database.
+	// See: db.UserToken.TokenHash.
+	tokenHashKey = "token_hash"
+	// purposeKey is the key for the purpose of a user token in the database.
+	// See: db.UserToken.Purpose.
+	purposeKey = "purpose"
+	// totpEnabledKey is the key for the TOTP status of a user in the
+	// database. See: db.UserInfo.TOTPEnabled.
+	totpEnabledKey = "totp_enabled"
+	// totpSecretKey is the key for the TOTP secret of a user in the database.
+	// See: completeUserInfo.TOTPSecret.
+	totpSecretKey = "totp_secret"
+	// totpLastStepKey is the key for the time step of the last TOTP code a
+	// user used in the database. See: completeUserInfo.TOTPLastStep.
+	totpLastStepKey = "totp_last_step"
+	// recoveryCodesKey is the key for the recovery code hashes of a user in
+	// the database. See: completeUserInfo.RecoveryCodes.
+	recoveryCodesKey = "recovery_codes"
+	// loginAttemptsKeyKey is the key for the account or client of login
+	// attempts in the database.
+	loginAttemptsKeyKey = "key"
+	// See: db.LoginAttempts.Failures.
+	failuresKey = "failures"
+	// See: db.LoginAttempts.LastFailure.
+	lastFailureKey = "last_failure"
+	// See: db.LoginAttempts.LockedUntil.
+	lockedUntilKey = "locked_until"
+	// workspaceIDKey is the key for the ID of a workspace or invitation in
+	// the database. See: db.Workspace.ID and db.WorkspaceInvitation.ID.
+	workspaceIDKey = "id"
+	// memberWorkspaceIDKey is the key for the workspace of a member or
+	// invitation in the database. See: db.WorkspaceMember.WorkspaceID.
+	memberWorkspaceIDKey = "workspace_id"
+	// roleKey is the key for the role of a workspace member in the database.
+	// See: db.WorkspaceMember.Role.
+	roleKey = "role"
+	// joinedAtKey is the key for the time a user joined a workspace in the
+	// database. See: db.WorkspaceMember.JoinedAt.
+	joinedAtKey = "joined_at"
+)
+
+const (
+	// expiryTTLIndexName is the name of the TTL index that deletes expired
+	// short URLs.
+	expiryTTLIndexName = "url_expiry_ttl"
+	// clickTTLIndexName is the name of the TTL index that deletes old clicks.
+	clickTTLIndexName = "url_click_ttl"
+	// codeIndexOptionsConflict is the MongoDB error code returned when an
+	// index already exists with different options.
+	codeIndexOptionsConflict = 85
+	// codeNamespaceNotFound and codeIndexNotFound are the MongoDB error codes
+	// returned when dropping an index of a missing collection or a missing
+	// index.
+	codeNamespaceNotFound = 26
+	codeIndexNotFound     = 27
 )
 
 type Config struct {
@@ -46,12 +193,26 @@ type Config struct {
 	DBName string `long:"dbname" env:"MONGODB_DB_NAME" default:"bob" description:"MongoDB database name"`
 	// ConnectionUrl is the URL used to connect to the database.
 	ConnectionURL string `long:"connectionurl" env:"MONGODB_CONNECTION_URL" description:"MongoDB connection URL"`
+	// ExpiredURLRetention is how long expired short URLs are kept before
+	// they are deleted by a TTL index. Zero keeps them forever like the
+	// other databases, so they keep answering as expired.
+	ExpiredURLRetention time.Duration `long:"expiredurlretention" env:"MONGODB_EXPIRED_URL_RETENTION" default:"0" description:"How long expired short URLs are kept before they are deleted, 0 keeps them forever"`
+	// ClickRetention is how long clicks are kept before they are deleted by a
+	// TTL index. Zero keeps them forever. It is set from the clicks retention
+	// policy of the web server, see webserver.ClicksConfig.
+	ClickRetention time.Duration `no-flag:"true"`
+	// PasswordHasher hashes the passwords of users. db.DefaultPasswordHasher
+	// is used if it is nil.
+	PasswordHasher db.PasswordHasher `no-flag:"true"`
 }
 
 // MongoDB is the database handler for MongoDB. Implements db.DataStore.
 type MongoDB struct {
 	ctx context.Context
 	db  *mongo.Database
+
+	// hasher hashes and verifies the passwords of users.
+	hasher db.PasswordHasher
 }
 
 // MongoDB implements the db.DataStore interface.
@@ -63,6 +224,11 @@ func Connect(ctx context.Context, cfg Config) (*MongoDB, error) {
 		return nil, fmt.Errorf("missing required configuration for MongoDB")
 	}
 
+	hasher := cfg.PasswordHasher
+	if hasher == nil {
+		hasher = db.DefaultPasswordHasher()
+	}
+
 	opts := options.Client().ApplyURI(cfg.ConnectionURL).SetAppName(webserver.AppName)
 	if err := opts.Validate(); err != nil {
 		return nil, fmt.Errorf("failed to validate database connection options: %w", err)
@@ -89,23 +255,192 @@ func Connect(ctx context.Context, cfg Config) (*MongoDB, error) {
 		return nil, fmt.Errorf("failed to create index for urls collection: %w", err)
 	}
 
+	// Usernames and emails must be unique on their own, a compound index
+	// would allow the same username to be registered with different emails.
+	models := []mongo.IndexModel{{
+		Keys:    bson.D{{Key: userMapKey(usernameKey), Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys:    bson.D{{Key: userMapKey(emailKey), Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}}
+
+	if _, err = db.Collection(usersCollectionName).Indexes().CreateMany(ctx, models); err != nil {
+		return nil, fmt.Errorf("failed to create index for users collection: %w", err)
+	}
+
+	// Click statistics are filtered by short URL and time range.
 	model = mongo.IndexModel{
-		Keys:    bson.D{{Key: userMapKey(usernameKey), Value: 1}, {Key: userMapKey(emailKey), Value: 1}},
+		Keys: bson.D{{Key: shortURLKey, Value: 1}, {Key: clickMapKey(timestampKey), Value: 1}},
+	}
+
+	if _, err = db.Collection(urlClicksCollection).Indexes().CreateOne(ctx, model); err != nil {
+		return nil, fmt.Errorf("failed to create index for url clicks collection: %w", err)
+	}
+
+	// Sessions are looked up by ID and revoked by user.
+	models = []mongo.IndexModel{{
+		Keys:    bson.D{{Key: sessionIDKey, Value: 1}},
 		Options: options.Index().SetUnique(true),
+	}, {
+		Keys: bson.D{{Key: emailKey, Value: 1}},
+	}}
+
+	if _, err = db.Collection(sessionsCollectionName).Indexes().CreateMany(ctx, models); err != nil {
+		return nil, fmt.Errorf("failed to create index for sessions collection: %w", err)
 	}
 
-	if _, err = db.Collection(usersCollectionName).Indexes().CreateOne(ctx, model); err != nil {
-		return nil, fmt.Errorf("failed to create index for users collection: %w", err)
+	// API keys are looked up by hash and listed by user.
+	models = []mongo.IndexModel{{
+		Keys:    bson.D{{Key: apiKeyIDKey, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys:    bson.D{{Key: keyHashKey, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys: bson.D{{Key: emailKey, Value: 1}},
+	}}
+
+	if _, err = db.Collection(apiKeysCollectionName).Indexes().CreateMany(ctx, models); err != nil {
+		return nil, fmt.Errorf("failed to create index for api keys collection: %w", err)
+	}
+
+	// An identity can only be linked to one user.
+	model = mongo.IndexModel{
+		Keys:    bson.D{{Key: providerKey, Value: 1}, {Key: subjectKey, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+
+	if _, err = db.Collection(identitiesCollectionName).Indexes().CreateOne(ctx, model); err != nil {
+		return nil, fmt.Errorf("failed to create index for user identities collection: %w", err)
+	}
+
+	// User tokens are looked up by hash and deleted by user and purpose.
+	models = []mongo.IndexModel{{
+		Keys:    bson.D{{Key: tokenHashKey, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys: bson.D{{Key: emailKey, Value: 1}, {Key: purposeKey, Value: 1}},
+	}}
+
+	if _, err = db.Collection(userTokensCollectionName).Indexes().CreateMany(ctx, models); err != nil {
+		return nil, fmt.Errorf("failed to create index for user tokens collection: %w", err)
+	}
+
+	model = mongo.IndexModel{
+		Keys:    bson.D{{Key: loginAttemptsKeyKey, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+
+	if _, err = db.Collection(loginAttemptsCollectionName).Indexes().CreateOne(ctx, model); err != nil {
+		return nil, fmt.Errorf("failed to create index for login attempts collection: %w", err)
+	}
+
+	model = mongo.IndexModel{
+		Keys:    bson.D{{Key: workspaceIDKey, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+
+	if _, err = db.Collection(workspacesCollectionName).Indexes().CreateOne(ctx, model); err != nil {
+		return nil, fmt.Errorf("failed to create index for workspaces collection: %w", err)
+	}
+
+	// A user can only be a member of a workspace once, and the workspaces of
+	// a user are listed by email.
+	models = []mongo.IndexModel{{
+		Keys:    bson.D{{Key: memberWorkspaceIDKey, Value: 1}, {Key: emailKey, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys: bson.D{{Key: emailKey, Value: 1}},
+	}}
+
+	if _, err = db.Collection(workspaceMembersCollectionName).Indexes().CreateMany(ctx, models); err != nil {
+		return nil, fmt.Errorf("failed to create index for workspace members collection: %w", err)
+	}
+
+	// Invitations are looked up by hash and listed by workspace.
+	models = []mongo.IndexModel{{
+		Keys:    bson.D{{Key: workspaceIDKey, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys:    bson.D{{Key: tokenHashKey, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys: bson.D{{Key: memberWorkspaceIDKey, Value: 1}},
+	}}
+
+	if _, err = db.Collection(workspaceInvitationsCollectionName).Indexes().CreateMany(ctx, models); err != nil {
+		return nil, fmt.Errorf("failed to create index for workspace invitations collection: %w", err)
+	}
+
+	if cfg.ExpiredURLRetention > 0 {
+		err := createTTLIndex(ctx, db, urlsCollectionName, expiryTTLIndexName, expiryDateKey, cfg.ExpiredURLRetention)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := dropIndex(ctx, db, urlsCollectionName, expiryTTLIndexName); err != nil {
+		// The index of an earlier retention must not keep deleting short URLs.
+		return nil, err
+	}
+
+	if cfg.ClickRetention > 0 {
+		err := createTTLIndex(ctx, db, urlClicksCollection, clickTTLIndexName, clickDateKey, cfg.ClickRetention)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := dropIndex(ctx, db, urlClicksCollection, clickTTLIndexName); err != nil {
+		// Clicks must be kept once retention is disabled.
+		return nil, err
 	}
 
 	mdb := &MongoDB{
-		ctx: ctx,
-		db:  db,
+		ctx:    ctx,
+		db:     db,
+		hasher: hasher,
 	}
 
 	return mdb, nil
 }
 
+// createTTLIndex creates a TTL index named indexName on the date field key of
+// the collection that deletes documents once retention has passed since that
+// date. The index is updated if it exists with a different retention.
+func createTTLIndex(ctx context.Context, db *mongo.Database, collection, indexName, key string, retention time.Duration) error {
+	expireAfter := int32(retention.Seconds())
+	model := mongo.IndexModel{
+		Keys:    bson.D{{Key: key, Value: 1}},
+		Options: options.Index().SetName(indexName).SetExpireAfterSeconds(expireAfter),
+	}
+
+	_, err := db.Collection(collection).Indexes().CreateOne(ctx, model)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == codeIndexOptionsConflict {
+		err = db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: collection},
+			{Key: "index", Value: bson.D{{Key: "name", Value: indexName}, {Key: "expireAfterSeconds", Value: expireAfter}}},
+		}).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create TTL index %s for %s collection: %w", indexName, collection, err)
+	}
+
+	return nil
+}
+
+// dropIndex drops the index named indexName of the collection if it exists.
+func dropIndex(ctx context.Context, db *mongo.Database, collection, indexName string) error {
+	_, err := db.Collection(collection).Indexes().DropOne(ctx, indexName)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Code == codeNamespaceNotFound || cmdErr.Code == codeIndexNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to drop index %s of %s collection: %w", indexName, collection, err)
+	}
+
+	return nil
+}
+
 // Close ends the connection to the database. Implements db.DataStore.
 func (m *MongoDB) Close() error {
 	return m.db.Client().Disconnect(m.ctx)
@@ -0,0 +1,169 @@
+package mongodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/db/dbtest"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tMongoDB drops its database when closed.
+type tMongoDB struct {
+	*MongoDB
+}
+
+// Close drops the test database and ends the connection to the database.
+func (m *tMongoDB) Close() error {
+	if err := m.db.Drop(m.ctx); err != nil {
+		return err
+	}
+	return m.MongoDB.Close()
+}
+
+// tConnectionURL returns the connection URL of the MongoDB server used for
+// tests. The test is skipped if the server is not reachable. Set
+// MONGODB_TEST_CONNECTION_URL to use a server other than a local mongod.
+func tConnectionURL(t *testing.T) string {
+	connectionURL := os.Getenv("MONGODB_TEST_CONNECTION_URL")
+	if connectionURL == "" {
+		connectionURL = "mongodb://127.0.0.1:27017"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	opts := options.Client().ApplyURI(connectionURL).SetServerSelectionTimeout(2 * time.Second)
+	client, err := mongo.Connect(ctx, opts)
+	if err == nil {
+		err = client.Ping(ctx, nil)
+		client.Disconnect(ctx)
+	}
+	if err != nil {
+		t.Skipf("MongoDB is not available at %s: %v", connectionURL, err)
+	}
+
+	return connectionURL
+}
+
+func TestMongoDB(t *testing.T) {
+	connectionURL := tConnectionURL(t)
+	dbtest.Run(t, func(t *testing.T, hasher db.PasswordHasher) db.DataStore {
+		dbName, err := db.RandomString(4)
+		if err != nil {
+			t.Fatalf("db.RandomString error: %v", err)
+		}
+
+		cfg := Config{DBName: "bob_test_" + dbName, ConnectionURL: connectionURL, PasswordHasher: hasher}
+		m, err := Connect(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("Connect error: %v", err)
+		}
+		return &tMongoDB{m}
+	})
+}
+
+func TestConnect_ttlIndexes(t *testing.T) {
+	connectionURL := tConnectionURL(t)
+	dbName, err := db.RandomString(4)
+	if err != nil {
+		t.Fatalf("db.RandomString error: %v", err)
+	}
+
+	cfg := Config{
+		DBName:              "bob_test_" + dbName,
+		ConnectionURL:       connectionURL,
+		ExpiredURLRetention: time.Hour,
+		ClickRetention:      time.Hour,
+	}
+	m, err := Connect(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Connect error: %v", err)
+	}
+	defer (&tMongoDB{m}).Close()
+
+	// indexExists checks if the collection has an index named indexName.
+	indexExists := func(collection, indexName string) bool {
+		t.Helper()
+		specs, err := m.db.Collection(collection).Indexes().ListSpecifications(context.Background())
+		if err != nil {
+			t.Fatalf("ListSpecifications error: %v", err)
+		}
+		for _, spec := range specs {
+			if spec.Name == indexName {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !indexExists(urlsCollectionName, expiryTTLIndexName) || !indexExists(urlClicksCollection, clickTTLIndexName) {
+		t.Fatal("Expected the TTL indexes to be created")
+	}
+
+	// Reconnecting with retention disabled drops the indexes, so that nothing
+	// is deleted anymore.
+	cfg.ExpiredURLRetention, cfg.ClickRetention = 0, 0
+	reconnected, err := Connect(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Connect error: %v", err)
+	}
+	defer reconnected.Close()
+
+	if indexExists(urlsCollectionName, expiryTTLIndexName) {
+		t.Fatal("Expected the expiry TTL index to be dropped")
+	}
+	if indexExists(urlClicksCollection, clickTTLIndexName) {
+		t.Fatal("Expected the click TTL index to be dropped")
+	}
+}
+
+func TestCacheBus(t *testing.T) {
+	connectionURL := tConnectionURL(t)
+	dbName, err := db.RandomString(4)
+	if err != nil {
+		t.Fatalf("db.RandomString error: %v", err)
+	}
+
+	m, err := Connect(context.Background(), Config{DBName: "bob_test_" + dbName, ConnectionURL: connectionURL})
+	if err != nil {
+		t.Fatalf("Connect error: %v", err)
+	}
+	defer (&tMongoDB{m}).Close()
+
+	// Two buses on the same database behave like two instances.
+	publisher, err := m.NewCacheBus()
+	if err != nil {
+		t.Skipf("Change streams are not available: %v", err)
+	}
+	defer publisher.Close()
+
+	subscriber, err := m.NewCacheBus()
+	if err != nil {
+		t.Fatalf("NewCacheBus error: %v", err)
+	}
+	defer subscriber.Close()
+
+	invalidated := make(chan string, 1)
+	unsubscribe := subscriber.Subscribe(func(shortURL string) {
+		invalidated <- shortURL
+	})
+	defer unsubscribe()
+
+	if err := publisher.Publish(context.Background(), "shorturl"); err != nil {
+		t.Fatalf("Publish error: %v", err)
+	}
+
+	select {
+	case shortURL := <-invalidated:
+		if shortURL != "shorturl" {
+			t.Fatalf("Expected shorturl to be invalidated but got %q", shortURL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the invalidation")
+	}
+}
@@ -0,0 +1,128 @@
+package mongodb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CreateSession adds a new login session to the database. Implements
+// db.DataStore.
+func (m *MongoDB) CreateSession(session *db.Session) error {
+	if session.ID == "" || session.Email == "" {
+		return fmt.Errorf("%w: session ID and email are required", db.ErrorBadRequest)
+	}
+
+	if _, err := m.sessionsCollection().InsertOne(m.ctx, session); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: session already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating session: %w", err)
+	}
+
+	return nil
+}
+
+// RetrieveSession fetches the session with the specified ID. Implements
+// db.DataStore.
+func (m *MongoDB) RetrieveSession(id string) (*db.Session, error) {
+	res := m.sessionsCollection().FindOne(m.ctx, bson.M{sessionIDKey: id})
+	if res.Err() != nil {
+		return nil, handleSessionError(res.Err())
+	}
+
+	var session *db.Session
+	if err := res.Decode(&session); err != nil {
+		return nil, fmt.Errorf("error decoding session: %w", err)
+	}
+
+	return session, nil
+}
+
+// RotateSessionRefreshToken replaces the refresh token hash of the session
+// with the specified ID with newHash if it is active and its refresh token hash
+// is oldHash, and extends the session until expiresAt. Implements
+// db.DataStore.
+func (m *MongoDB) RotateSessionRefreshToken(id string, oldHash, newHash []byte, expiresAt int64) error {
+	filter := bson.M{
+		sessionIDKey:        id,
+		refreshTokenHashKey: oldHash,
+		revokedAtKey:        0,
+		expiresAtKey:        bson.M{"$gt": time.Now().Unix()},
+	}
+	update := bson.M{"$set": bson.M{refreshTokenHashKey: newHash, expiresAtKey: expiresAt}}
+	res, err := m.sessionsCollection().UpdateOne(m.ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("error updating session: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: session does not exist or is not active", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// RevokeSession revokes the session with the specified ID. Implements
+// db.DataStore.
+func (m *MongoDB) RevokeSession(id string) error {
+	filter := bson.M{sessionIDKey: id, revokedAtKey: 0}
+	update := bson.M{"$set": bson.M{revokedAtKey: time.Now().Unix()}}
+	res, err := m.sessionsCollection().UpdateOne(m.ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("error revoking session: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		// The session is either missing or already revoked.
+		_, err = m.RetrieveSession(id)
+		return err
+	}
+
+	return nil
+}
+
+// RevokeUserSessions revokes all the active sessions of the user with the
+// specified email and returns the number of sessions that were revoked.
+// Implements db.DataStore.
+func (m *MongoDB) RevokeUserSessions(email string) (int64, error) {
+	now := time.Now().Unix()
+	filter := bson.M{emailKey: email, revokedAtKey: 0, expiresAtKey: bson.M{"$gt": now}}
+	update := bson.M{"$set": bson.M{revokedAtKey: now}}
+	res, err := m.sessionsCollection().UpdateMany(m.ctx, filter, update)
+	if err != nil {
+		return 0, fmt.Errorf("error revoking sessions: %w", err)
+	}
+
+	return res.ModifiedCount, nil
+}
+
+// DeleteExpiredSessions deletes all sessions that expired before the
+// specified unix timestamp and returns the number of sessions that were
+// deleted. Implements db.DataStore.
+func (m *MongoDB) DeleteExpiredSessions(timestamp int64) (int64, error) {
+	res, err := m.sessionsCollection().DeleteMany(m.ctx, bson.M{expiresAtKey: bson.M{"$lt": timestamp}})
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired sessions: %w", err)
+	}
+
+	return res.DeletedCount, nil
+}
+
+// sessionsCollection returns the collection for login sessions.
+func (m *MongoDB) sessionsCollection() *mongo.Collection {
+	return m.db.Collection(sessionsCollectionName)
+}
+
+// handleSessionError handles errors that occur when retrieving a session.
+func handleSessionError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("%w: session does not exist", db.ErrorNotFound)
+	}
+
+	return fmt.Errorf("error retrieving session: %w", err)
+}
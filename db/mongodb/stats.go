@@ -0,0 +1,123 @@
+package mongodb
+
+import (
+	"fmt"
+
+	"github.com/ukane-philemon/bob/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// statsBucket is a time series bucket returned by the click statistics
+// aggregation.
+type statsBucket struct {
+	Timestamp int64 `bson:"_id"`
+	Clicks    int64 `bson:"clicks"`
+}
+
+// statsGroup is a breakdown group returned by the click statistics
+// aggregation.
+type statsGroup struct {
+	Value  string `bson:"_id"`
+	Clicks int64  `bson:"clicks"`
+}
+
+// clickStatsFacets are the results of the click statistics aggregation.
+type clickStatsFacets struct {
+	Buckets         []*statsBucket `bson:"buckets"`
+	Browsers        []*statsGroup  `bson:"browsers"`
+	Devices         []*statsGroup  `bson:"devices"`
+	DeviceTypes     []*statsGroup  `bson:"device_types"`
+	Referrers       []*statsGroup  `bson:"referrers"`
+	ReferrerDomains []*statsGroup  `bson:"referrer_domains"`
+	UTMSources      []*statsGroup  `bson:"utm_sources"`
+	UTMMediums      []*statsGroup  `bson:"utm_mediums"`
+	UTMCampaigns    []*statsGroup  `bson:"utm_campaigns"`
+	Countries       []*statsGroup  `bson:"countries"`
+}
+
+// RetrieveShortURLClickStats returns aggregated statistics about the clicks
+// on a short URL owned by the specified user within the time range [from, to).
+// Implements db.DataStore.
+func (m *MongoDB) RetrieveShortURLClickStats(ownerID, shortURL string, from, to int64, interval db.StatsInterval) (*db.ShortURLClickStats, error) {
+	if err := db.ValidateStatsRange(from, to, interval); err != nil {
+		return nil, err
+	}
+
+	// Confirm link exists and is owned by ownerID.
+	if _, err := m.RetrieveUserURLInfo(ownerID, shortURL); err != nil {
+		return nil, err
+	}
+
+	timestamp := "$" + clickMapKey(timestampKey)
+	// groupBy counts the clicks for every value of the specified click field.
+	// Clicks saved before the field existed are counted as empty.
+	groupBy := func(key string) bson.A {
+		return bson.A{bson.M{"$group": bson.M{
+			"_id":    bson.M{"$ifNull": bson.A{"$" + clickMapKey(key), ""}},
+			"clicks": bson.M{"$sum": 1},
+		}}}
+	}
+
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{
+			shortURLKey:               shortURL,
+			clickMapKey(timestampKey): bson.M{"$gte": from, "$lt": to},
+		}},
+		bson.M{"$facet": bson.M{
+			"buckets": bson.A{bson.M{"$group": bson.M{
+				// See db.StatsInterval.Offset.
+				"_id": bson.M{"$subtract": bson.A{
+					timestamp,
+					bson.M{"$mod": bson.A{bson.M{"$subtract": bson.A{timestamp, interval.Offset()}}, interval.Seconds()}},
+				}},
+				"clicks": bson.M{"$sum": 1},
+			}}},
+			"browsers":         groupBy("browser"),
+			"devices":          groupBy("device"),
+			"device_types":     groupBy("device_type"),
+			"referrers":        groupBy("referrer"),
+			"referrer_domains": groupBy("referrer_domain"),
+			"utm_sources":      groupBy("utm_source"),
+			"utm_mediums":      groupBy("utm_medium"),
+			"utm_campaigns":    groupBy("utm_campaign"),
+			"countries":        groupBy("country"),
+		}},
+	}
+
+	cur, err := m.urlClickCollection().Aggregate(m.ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating link clicks: %w", err)
+	}
+	defer cur.Close(m.ctx)
+
+	var facets []*clickStatsFacets
+	if err := cur.All(m.ctx, &facets); err != nil {
+		return nil, fmt.Errorf("cursor.All error: %w", err)
+	}
+
+	counts := db.NewClickStatsCounts()
+	if len(facets) > 0 {
+		f := facets[0]
+		for _, g := range f.Buckets {
+			counts.Buckets[g.Timestamp] += g.Clicks
+		}
+		addGroups(counts.Browsers, f.Browsers)
+		addGroups(counts.Devices, f.Devices)
+		addGroups(counts.DeviceTypes, f.DeviceTypes)
+		addGroups(counts.Referrers, f.Referrers)
+		addGroups(counts.ReferrerDomains, f.ReferrerDomains)
+		addGroups(counts.UTMSources, f.UTMSources)
+		addGroups(counts.UTMMediums, f.UTMMediums)
+		addGroups(counts.UTMCampaigns, f.UTMCampaigns)
+		addGroups(counts.Countries, f.Countries)
+	}
+
+	return counts.Stats(from, to, interval), nil
+}
+
+// addGroups adds the click counts in groups to counts.
+func addGroups(counts map[string]int64, groups []*statsGroup) {
+	for _, g := range groups {
+		counts[g.Value] += g.Clicks
+	}
+}
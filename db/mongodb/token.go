@@ -0,0 +1,76 @@
+package mongodb
+
+import (
+	"fmt"
+
+	"github.com/ukane-philemon/bob/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CreateUserToken adds a new single-use user token to the database.
+// Implements db.DataStore.
+func (m *MongoDB) CreateUserToken(token *db.UserToken) error {
+	if len(token.TokenHash) == 0 || token.Purpose == "" {
+		return fmt.Errorf("%w: token hash and purpose are required", db.ErrorBadRequest)
+	}
+
+	res := m.usersCollection().FindOne(m.ctx, bson.M{userMapKey(emailKey): token.Email})
+	if res.Err() != nil {
+		return handleUserError(res.Err())
+	}
+
+	if _, err := m.userTokensCollection().InsertOne(m.ctx, token); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: token already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating user token: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeUserToken deletes the token with the specified hash and purpose and
+// the other tokens of the user with the same purpose, and returns it.
+// Implements db.DataStore.
+func (m *MongoDB) ConsumeUserToken(tokenHash []byte, purpose string, timestamp int64) (*db.UserToken, error) {
+	filter := bson.M{tokenHashKey: tokenHash, purposeKey: purpose, expiresAtKey: bson.M{"$gt": timestamp}}
+	res := m.userTokensCollection().FindOneAndDelete(m.ctx, filter)
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("%w: token does not exist or has expired", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error consuming user token: %w", res.Err())
+	}
+
+	var token *db.UserToken
+	if err := res.Decode(&token); err != nil {
+		return nil, fmt.Errorf("error decoding user token: %w", err)
+	}
+
+	_, err := m.userTokensCollection().DeleteMany(m.ctx, bson.M{emailKey: token.Email, purposeKey: purpose})
+	if err != nil {
+		return nil, fmt.Errorf("error deleting user tokens: %w", err)
+	}
+
+	return token, nil
+}
+
+// DeleteExpiredUserTokens deletes all user tokens that expired before the
+// specified unix timestamp and returns the number of tokens that were deleted.
+// Implements db.DataStore.
+func (m *MongoDB) DeleteExpiredUserTokens(timestamp int64) (int64, error) {
+	res, err := m.userTokensCollection().DeleteMany(m.ctx, bson.M{expiresAtKey: bson.M{"$lt": timestamp}})
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired user tokens: %w", err)
+	}
+
+	return res.DeletedCount, nil
+}
+
+// userTokensCollection returns the collection for single-use user tokens.
+func (m *MongoDB) userTokensCollection() *mongo.Collection {
+	return m.db.Collection(userTokensCollectionName)
+}
@@ -0,0 +1,137 @@
+package mongodb
+
+import (
+	"fmt"
+
+	"github.com/ukane-philemon/bob/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SetUserTOTPSecret saves a new TOTP secret for the user with the specified
+// email, replacing a secret that was not enabled. Implements db.DataStore.
+func (m *MongoDB) SetUserTOTPSecret(email string, secret []byte) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("%w: secret is required", db.ErrorBadRequest)
+	}
+
+	filter := bson.M{userMapKey(emailKey): email, userMapKey(totpEnabledKey): bson.M{"$ne": true}}
+	update := bson.M{
+		"$set":   bson.M{totpSecretKey: secret},
+		"$unset": bson.M{totpLastStepKey: ""},
+	}
+	res, err := m.usersCollection().UpdateOne(m.ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("error saving TOTP secret: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: user does not exist or TOTP is enabled", db.ErrorBadRequest)
+	}
+
+	return nil
+}
+
+// RetrieveUserTOTP fetches the TOTP settings of the user with the specified
+// email. Implements db.DataStore.
+func (m *MongoDB) RetrieveUserTOTP(email string) (*db.UserTOTP, error) {
+	res := m.usersCollection().FindOne(m.ctx, bson.M{userMapKey(emailKey): email})
+	if res.Err() != nil {
+		return nil, handleUserError(res.Err())
+	}
+
+	var userInfo *completeUserInfo
+	if err := res.Decode(&userInfo); err != nil {
+		return nil, fmt.Errorf("error decoding user info: %w", err)
+	}
+
+	if len(userInfo.TOTPSecret) == 0 {
+		return nil, fmt.Errorf("%w: TOTP is not set up", db.ErrorNotFound)
+	}
+
+	return &db.UserTOTP{
+		Secret:        userInfo.TOTPSecret,
+		Enabled:       userInfo.TOTPEnabled,
+		LastStep:      userInfo.TOTPLastStep,
+		RecoveryCodes: len(userInfo.RecoveryCodes),
+	}, nil
+}
+
+// EnableUserTOTP enables TOTP two-factor authentication for the user with the
+// specified email and replaces the user's recovery codes. Implements
+// db.DataStore.
+func (m *MongoDB) EnableUserTOTP(email string, recoveryCodeHashes [][]byte) error {
+	if recoveryCodeHashes == nil {
+		recoveryCodeHashes = [][]byte{}
+	}
+
+	filter := bson.M{userMapKey(emailKey): email, totpSecretKey: bson.M{"$exists": true}}
+	update := bson.M{"$set": bson.M{userMapKey(totpEnabledKey): true, recoveryCodesKey: recoveryCodeHashes}}
+	res, err := m.usersCollection().UpdateOne(m.ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("error enabling TOTP: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: user does not exist or has no TOTP secret", db.ErrorBadRequest)
+	}
+
+	return nil
+}
+
+// UseUserTOTPStep records that a TOTP code of the specified time step was
+// used by the user with the specified email. Implements db.DataStore.
+func (m *MongoDB) UseUserTOTPStep(email string, step int64) error {
+	filter := bson.M{
+		userMapKey(emailKey): email,
+		"$or": bson.A{
+			bson.M{totpLastStepKey: bson.M{"$lt": step}},
+			bson.M{totpLastStepKey: bson.M{"$exists": false}},
+		},
+	}
+	res, err := m.usersCollection().UpdateOne(m.ctx, filter, bson.M{"$set": bson.M{totpLastStepKey: step}})
+	if err != nil {
+		return fmt.Errorf("error saving TOTP step: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: user does not exist or TOTP code was already used", db.ErrorBadRequest)
+	}
+
+	return nil
+}
+
+// ConsumeUserRecoveryCode deletes the recovery code with the specified hash of
+// the user with the specified email. Implements db.DataStore.
+func (m *MongoDB) ConsumeUserRecoveryCode(email string, codeHash []byte) error {
+	filter := bson.M{userMapKey(emailKey): email, recoveryCodesKey: codeHash}
+	res, err := m.usersCollection().UpdateOne(m.ctx, filter, bson.M{"$pull": bson.M{recoveryCodesKey: codeHash}})
+	if err != nil {
+		return fmt.Errorf("error consuming recovery code: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: recovery code does not exist", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// DisableUserTOTP disables TOTP two-factor authentication for the user with
+// the specified email and deletes the TOTP secret and the recovery codes.
+// Implements db.DataStore.
+func (m *MongoDB) DisableUserTOTP(email string) error {
+	update := bson.M{
+		"$set":   bson.M{userMapKey(totpEnabledKey): false},
+		"$unset": bson.M{totpSecretKey: "", totpLastStepKey: "", recoveryCodesKey: ""},
+	}
+	res, err := m.usersCollection().UpdateOne(m.ctx, bson.M{userMapKey(emailKey): email}, update)
+	if err != nil {
+		return fmt.Errorf("error disabling TOTP: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	return nil
+}
@@ -1,11 +1,20 @@
 package mongodb
 
-import "github.com/ukane-philemon/bob/db"
+import (
+	"time"
 
-// completeUserInfo is a wrapper around db.User that includes the password.
+	"github.com/ukane-philemon/bob/db"
+)
+
+// completeUserInfo is a wrapper around db.User that includes the password
+// and the TOTP settings.
 type completeUserInfo struct {
 	*db.UserInfo `bson:"user"`
 	Password     []byte `bson:"password"`
+	TOTPSecret   []byte `bson:"totp_secret,omitempty"`
+	TOTPLastStep int64  `bson:"totp_last_step,omitempty"`
+	// RecoveryCodes are the hashes of the unused recovery codes.
+	RecoveryCodes [][]byte `bson:"recovery_codes,omitempty"`
 }
 
 // urlInfo is a wrapper around db.ShortURLInfo that includes whether the URL is
@@ -13,9 +22,16 @@ type completeUserInfo struct {
 type urlInfo struct {
 	URL     *db.ShortURLInfo `bson:"url"`
 	IsGuest bool             `bson:"is_guest"`
+	// ExpiryDate mirrors URL.ExpiresAt as a BSON date for the TTL index that
+	// deletes expired short URLs. It is not set for short URLs that never
+	// expire.
+	ExpiryDate *time.Time `bson:"expiry_date,omitempty"`
 }
 
 type urlClick struct {
 	ShortURL          string `bson:"short_url"`
 	*db.ShortURLClick `bson:"click"`
+	// Date mirrors ShortURLClick.Timestamp as a BSON date for the TTL index
+	// that deletes old clicks.
+	Date time.Time `bson:"date"`
 }
@@ -9,16 +9,17 @@ import (
 	"github.com/ukane-philemon/bob/db"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // CreateNewShortURL creates a new short URL. "userID" is the user's email if
 // they are logged in, otherwise it is the unique identifier for the guest user.
-func (m *MongoDB) CreateNewShortURL(userID, longURL, customShortURL string, isGuest bool) (*db.ShortURLInfo, error) {
+func (m *MongoDB) CreateNewShortURL(userID, longURL, customShortURL string, isGuest bool, opts *db.ShortURLOptions) (*db.ShortURLInfo, error) {
 	if userID == "" || longURL == "" {
 		return nil, fmt.Errorf("%w: id and url are required", db.ErrorBadRequest)
 	}
 
-	if !isGuest && !db.IsValidEmail(userID) {
+	if !isGuest && !db.IsValidEmail(userID) && !db.IsWorkspaceID(userID) {
 		return nil, fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
 	}
 
@@ -32,19 +33,53 @@ func (m *MongoDB) CreateNewShortURL(userID, longURL, customShortURL string, isGu
 		if count >= db.MaxGuestURLs {
 			return nil, fmt.Errorf("%w: maximum number of URLs reached", db.ErrorBadRequest)
 		}
+	} else if db.IsWorkspaceID(userID) {
+		if res := m.workspacesCollection().FindOne(m.ctx, bson.M{workspaceIDKey: userID}); res.Err() != nil {
+			if res.Err() == mongo.ErrNoDocuments {
+				return nil, fmt.Errorf("%w: workspace does not exist", db.ErrorBadRequest)
+			}
+			return nil, fmt.Errorf("error retrieving workspace: %w", res.Err())
+		}
 	} else if res := m.usersCollection().FindOne(m.ctx, bson.M{userMapKey(emailKey): userID}); res.Err() != nil { // Check if user exists.
 		return nil, handleUserError(res.Err())
 	}
 
+	now := time.Now()
 	newURLInfo := &urlInfo{
 		URL: &db.ShortURLInfo{
 			OwnerID:     userID,
 			OriginalURL: longURL,
-			Timestamp:   time.Now().Unix(),
+			Timestamp:   now.Unix(),
 		},
 		IsGuest: isGuest,
 	}
 
+	if opts != nil && opts.ExpiresAt != nil && *opts.ExpiresAt > 0 {
+		newURLInfo.URL.ExpiresAt = *opts.ExpiresAt
+		newURLInfo.URL.Expired = *opts.ExpiresAt <= now.Unix()
+		expiryDate := time.Unix(*opts.ExpiresAt, 0)
+		newURLInfo.ExpiryDate = &expiryDate
+	}
+
+	passwordHash, err := opts.PasswordHash()
+	if err != nil {
+		return nil, err
+	}
+	newURLInfo.URL.PasswordHash = passwordHash
+	newURLInfo.URL.PasswordProtected = passwordHash != nil
+
+	if opts != nil {
+		if opts.MaxClicks != nil {
+			newURLInfo.URL.MaxClicks = *opts.MaxClicks
+		}
+		if opts.ActiveFrom != nil {
+			newURLInfo.URL.ActiveFrom = *opts.ActiveFrom
+		}
+		if opts.ActiveUntil != nil {
+			newURLInfo.URL.ActiveUntil = *opts.ActiveUntil
+		}
+	}
+
 	customShortURL = strings.TrimSpace(customShortURL)
 	if customShortURL != "" {
 		newURLInfo.URL.ShortURL = customShortURL
@@ -57,11 +92,26 @@ func (m *MongoDB) CreateNewShortURL(userID, longURL, customShortURL string, isGu
 		}
 
 	} else {
-		// Check if long URL already exists for this user.
+		// Check if an unexpired short URL for the long URL already exists for
+		// this user. Short URLs with settings are never reused and never
+		// returned.
 		var oldURLInfo *urlInfo
-		err := m.urlsCollection().FindOne(m.ctx, bson.M{urlMapKey(ownerIDKey): userID, urlMapKey(originalURLKey): longURL}).Decode(&oldURLInfo)
-		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, fmt.Errorf("error retrieving URL info: %w", err)
+		filter := bson.M{
+			urlMapKey(ownerIDKey):           userID,
+			urlMapKey(originalURLKey):       longURL,
+			urlMapKey(expiredKey):           bson.M{"$ne": true},
+			urlMapKey(expiresAtKey):         bson.M{"$not": bson.M{"$gt": 0, "$lte": now.Unix()}},
+			urlMapKey(passwordProtectedKey): bson.M{"$ne": true},
+			urlMapKey("disabled"):           bson.M{"$ne": true},
+			urlMapKey(maxClicksKey):         bson.M{"$not": bson.M{"$gt": 0}},
+			urlMapKey(activeFromKey):        bson.M{"$not": bson.M{"$gt": 0}},
+			urlMapKey(activeUntilKey):       bson.M{"$not": bson.M{"$gt": 0}},
+		}
+		if opts.IsZero() {
+			err := m.urlsCollection().FindOne(m.ctx, filter).Decode(&oldURLInfo)
+			if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+				return nil, fmt.Errorf("error retrieving URL info: %w", err)
+			}
 		}
 
 		if oldURLInfo != nil {
@@ -80,8 +130,6 @@ func (m *MongoDB) CreateNewShortURL(userID, longURL, customShortURL string, isGu
 				return nil, fmt.Errorf("error saving guest URL: %v", err)
 			}
 
-			fmt.Printf("%T, %v %v %v", err, err, newURLInfo.URL.ShortURL, mongo.IsDuplicateKeyError(err))
-
 			if res != nil && res.InsertedID != nil {
 				savedURL = true
 				break
@@ -119,14 +167,15 @@ func (m *MongoDB) RetrieveURLInfo(shortURL string) (*db.ShortURLInfo, error) {
 	return urlInfo.URL, nil
 }
 
-// RetrieveUserURLs fetches all the shorted URLs for the specified user.
-// Implements db.DataStore.
-func (m *MongoDB) RetrieveUserURLs(email string) ([]*db.ShortURLInfo, error) {
+// RetrieveUserURLs fetches all the shorted URLs owned by the specified user
+// email or workspace ID. Implements db.DataStore.
+func (m *MongoDB) RetrieveUserURLs(ownerID string) ([]*db.ShortURLInfo, error) {
 	var urls []*db.ShortURLInfo
-	cursor, err := m.urlsCollection().Find(m.ctx, bson.M{urlMapKey(ownerIDKey): email})
+	cursor, err := m.urlsCollection().Find(m.ctx, bson.M{urlMapKey(ownerIDKey): ownerID})
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving user URLs: %v", err)
 	}
+	defer cursor.Close(m.ctx)
 
 	for cursor.Next(m.ctx) {
 		var urlInfo *urlInfo
@@ -151,48 +200,216 @@ func (m *MongoDB) UpdateShortURL(shortURL, newLongURL string, click *db.ShortURL
 	filter := bson.M{urlMapKey(shortURLKey): shortURL}
 	update := make(bson.M)
 	if click != nil {
-		update["$inc"] = bson.M{urlMapKey("clicks"): 1}
+		// Only count the click if the short URL is active and has clicks
+		// left. Missing fields are treated as zero.
+		now := time.Now().Unix()
+		filter[urlMapKey(activeFromKey)] = bson.M{"$not": bson.M{"$gt": now}}
+		filter[urlMapKey(activeUntilKey)] = bson.M{"$not": bson.M{"$gt": 0, "$lte": now}}
+		filter["$or"] = bson.A{
+			bson.M{urlMapKey(maxClicksKey): bson.M{"$not": bson.M{"$gt": 0}}},
+			bson.M{"$expr": bson.M{"$lt": bson.A{"$" + urlMapKey(clicksKey), "$" + urlMapKey(maxClicksKey)}}},
+		}
+		update["$inc"] = bson.M{urlMapKey(clicksKey): 1}
+	} else if newLongURL != "" {
+		update["$set"] = bson.M{urlMapKey(originalURLKey): newLongURL}
+	} else {
+		return fmt.Errorf("%w: nothing to update", db.ErrorBadRequest)
+	}
+
+	res, err := m.urlsCollection().UpdateOne(m.ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("error updating short URL: %v", err)
+	}
+
+	if res.MatchedCount == 0 {
+		if click == nil {
+			return fmt.Errorf("%w: short URL does not exist", db.ErrorBadRequest)
+		}
+
+		if _, err := m.RetrieveURLInfo(shortURL); errors.Is(err, db.ErrorNotFound) {
+			return fmt.Errorf("%w: short URL does not exist", db.ErrorBadRequest)
+		} else if err != nil {
+			return err
+		}
+
+		return fmt.Errorf("%w: short URL is not active", db.ErrorInactive)
+	}
+
+	if click != nil {
 		_, err := m.urlClickCollection().InsertOne(m.ctx, &urlClick{
 			ShortURL:      shortURL,
 			ShortURLClick: click,
+			Date:          time.Unix(click.Timestamp, 0),
 		})
 		if err != nil {
 			return fmt.Errorf("error inserting new click: %w", err)
 		}
-	} else if newLongURL != "" {
-		update["$set"] = bson.M{urlMapKey(originalURLKey): newLongURL}
 	}
 
+	return nil
+}
+
+// RecordShortURLClicks records a batch of clicks keyed by short URL and
+// increments the click count of each short URL by its number of clicks.
+// Implements db.DataStore.
+func (m *MongoDB) RecordShortURLClicks(clicks map[string][]*db.ShortURLClick) error {
+	shortURLs := make(bson.A, 0, len(clicks))
+	for shortURL, urlClicks := range clicks {
+		if len(urlClicks) > 0 {
+			shortURLs = append(shortURLs, shortURL)
+		}
+	}
+
+	if len(shortURLs) == 0 {
+		return nil
+	}
+
+	// Clicks on short URLs that no longer exist are dropped.
+	existing, err := m.urlsCollection().Distinct(m.ctx, urlMapKey(shortURLKey), bson.M{urlMapKey(shortURLKey): bson.M{"$in": shortURLs}})
+	if err != nil {
+		return fmt.Errorf("error retrieving short URLs: %w", err)
+	}
+
+	if len(existing) == 0 {
+		return nil
+	}
+
+	updates := make([]mongo.WriteModel, 0, len(existing))
+	var docs []interface{}
+	for _, v := range existing {
+		shortURL, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		urlClicks := clicks[shortURL]
+		updates = append(updates, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{urlMapKey(shortURLKey): shortURL}).
+			SetUpdate(bson.M{"$inc": bson.M{urlMapKey(clicksKey): len(urlClicks)}}))
+		for _, click := range urlClicks {
+			docs = append(docs, &urlClick{
+				ShortURL:      shortURL,
+				ShortURLClick: click,
+				Date:          time.Unix(click.Timestamp, 0),
+			})
+		}
+	}
+
+	if _, err := m.urlsCollection().BulkWrite(m.ctx, updates, options.BulkWrite().SetOrdered(false)); err != nil {
+		return fmt.Errorf("error updating short URL clicks: %w", err)
+	}
+
+	if _, err := m.urlClickCollection().InsertMany(m.ctx, docs, options.InsertMany().SetOrdered(false)); err != nil {
+		return fmt.Errorf("error inserting new clicks: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateUserShortURL changes the original URL and/or the settings in opts of a
+// short URL owned by the specified user. Implements db.DataStore.
+func (m *MongoDB) UpdateUserShortURL(ownerID, shortURL, newLongURL string, opts *db.ShortURLOptions) error {
+	if ownerID == "" || shortURL == "" {
+		return fmt.Errorf("%w: owner ID and short URL are required", db.ErrorBadRequest)
+	}
+
+	if newLongURL == "" && opts.IsZero() {
+		return fmt.Errorf("%w: nothing to update", db.ErrorBadRequest)
+	}
+
+	set, unset := bson.M{}, bson.M{}
+	if newLongURL != "" {
+		set[urlMapKey(originalURLKey)] = newLongURL
+	}
+
+	if opts != nil && opts.ExpiresAt != nil {
+		expiresAt := *opts.ExpiresAt
+		set[urlMapKey(expiresAtKey)] = expiresAt
+		set[urlMapKey(expiredKey)] = expiresAt > 0 && expiresAt <= time.Now().Unix()
+		if expiresAt > 0 {
+			set[expiryDateKey] = time.Unix(expiresAt, 0)
+		} else {
+			unset[expiryDateKey] = ""
+		}
+	}
+
+	if opts != nil && opts.Password != nil {
+		passwordHash, err := opts.PasswordHash()
+		if err != nil {
+			return err
+		}
+
+		set[urlMapKey(passwordProtectedKey)] = passwordHash != nil
+		if passwordHash != nil {
+			set[urlMapKey(passwordHashKey)] = passwordHash
+		} else {
+			unset[urlMapKey(passwordHashKey)] = ""
+		}
+	}
+
+	if opts != nil {
+		if opts.MaxClicks != nil {
+			set[urlMapKey(maxClicksKey)] = *opts.MaxClicks
+		}
+		if opts.ActiveFrom != nil {
+			set[urlMapKey(activeFromKey)] = *opts.ActiveFrom
+		}
+		if opts.ActiveUntil != nil {
+			set[urlMapKey(activeUntilKey)] = *opts.ActiveUntil
+		}
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	filter := bson.M{urlMapKey(shortURLKey): shortURL, urlMapKey(ownerIDKey): ownerID}
 	res, err := m.urlsCollection().UpdateOne(m.ctx, filter, update)
 	if err != nil {
 		return fmt.Errorf("error updating short URL: %v", err)
 	}
 
 	if res.MatchedCount == 0 {
-		return fmt.Errorf("%w: short URL does not exist", db.ErrorBadRequest)
+		_, err = m.RetrieveUserURLInfo(ownerID, shortURL)
+		return err
 	}
 
 	return nil
 }
 
-// RetrieveShortURLClicks returns a list of complete click information for a
-// short URL.
-func (m *MongoDB) RetrieveShortURLClicks(shortURL string) ([]*db.ShortURLClick, error) {
-	if shortURL == "" {
-		return nil, fmt.Errorf("%w: short URL is empty", db.ErrorBadRequest)
+// RetrieveUserURLInfo fetches information about a short URL owned by the
+// specified user. Implements db.DataStore.
+func (m *MongoDB) RetrieveUserURLInfo(ownerID, shortURL string) (*db.ShortURLInfo, error) {
+	if ownerID == "" || shortURL == "" {
+		return nil, fmt.Errorf("%w: owner ID and short URL are required", db.ErrorBadRequest)
 	}
 
-	// Confirm link exists
-	count, err := m.urlsCollection().CountDocuments(m.ctx, bson.M{urlMapKey(shortURLKey): shortURL})
-	if err != nil {
-		return nil, handleURLError(err)
+	var urlInfo *urlInfo
+	if err := m.urlsCollection().FindOne(m.ctx, bson.M{urlMapKey(shortURLKey): shortURL}).Decode(&urlInfo); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, fmt.Errorf("%w: short URL does not exist", db.ErrorNotFound)
+		}
+		return nil, fmt.Errorf("error retrieving URL info: %w", err)
 	}
 
-	if count == 0 {
-		return nil, fmt.Errorf("%w: short url was not found", db.ErrorBadRequest)
+	if urlInfo.URL.OwnerID != ownerID {
+		return nil, fmt.Errorf("%w: short URL belongs to another user", db.ErrorForbidden)
 	}
 
-	cur, err := m.urlClickCollection().Find(m.ctx, bson.M{shortURLKey: shortURL})
+	return urlInfo.URL, nil
+}
+
+// RetrieveShortURLClicks returns a list of complete click information for a
+// short URL owned by the specified user. Implements db.DataStore.
+func (m *MongoDB) RetrieveShortURLClicks(ownerID, shortURL string) ([]*db.ShortURLClick, error) {
+	// Confirm link exists and is owned by ownerID.
+	if _, err := m.RetrieveUserURLInfo(ownerID, shortURL); err != nil {
+		return nil, err
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: clickMapKey(timestampKey), Value: 1}})
+	cur, err := m.urlClickCollection().Find(m.ctx, bson.M{shortURLKey: shortURL}, opts)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return nil, nil
@@ -200,6 +417,7 @@ func (m *MongoDB) RetrieveShortURLClicks(shortURL string) ([]*db.ShortURLClick,
 			return nil, fmt.Errorf("error retrieving link clicks: %w", err)
 		}
 	}
+	defer cur.Close(m.ctx)
 
 	var urlClicks []*db.ShortURLClick
 	for cur.Next(m.ctx) {
@@ -213,13 +431,14 @@ func (m *MongoDB) RetrieveShortURLClicks(shortURL string) ([]*db.ShortURLClick,
 	return urlClicks, nil
 }
 
-// ToggleShortLinkStatus enables/disables a short link.
-func (m *MongoDB) ToggleShortLinkStatus(shortURL string, disable bool) error {
-	if shortURL == "" {
-		return fmt.Errorf("%w: short URL is empty", db.ErrorBadRequest)
+// ToggleShortLinkStatus enables/disables a short link owned by the specified
+// user. Implements db.DataStore.
+func (m *MongoDB) ToggleShortLinkStatus(ownerID, shortURL string, disable bool) error {
+	if ownerID == "" || shortURL == "" {
+		return fmt.Errorf("%w: owner ID and short URL are required", db.ErrorBadRequest)
 	}
 
-	filter := bson.M{urlMapKey(shortURLKey): shortURL}
+	filter := bson.M{urlMapKey(shortURLKey): shortURL, urlMapKey(ownerIDKey): ownerID}
 	update := bson.M{"$set": bson.M{urlMapKey("disabled"): disable}}
 	res, err := m.urlsCollection().UpdateOne(m.ctx, filter, update)
 	if err != nil {
@@ -227,12 +446,43 @@ func (m *MongoDB) ToggleShortLinkStatus(shortURL string, disable bool) error {
 	}
 
 	if res.MatchedCount == 0 {
-		return fmt.Errorf("%w: short URL does not exist", db.ErrorBadRequest)
+		_, err = m.RetrieveUserURLInfo(ownerID, shortURL)
+		return err
 	}
 
 	return nil
 }
 
+// MarkExpiredShortURLs marks all short URLs whose expiry time has passed as
+// expired and returns the number of short URLs that were marked. Implements
+// db.DataStore.
+func (m *MongoDB) MarkExpiredShortURLs() (int64, error) {
+	filter := bson.M{
+		urlMapKey(expiredKey):   bson.M{"$ne": true},
+		urlMapKey(expiresAtKey): bson.M{"$gt": 0, "$lte": time.Now().Unix()},
+	}
+	update := bson.M{"$set": bson.M{urlMapKey(expiredKey): true}}
+	res, err := m.urlsCollection().UpdateMany(m.ctx, filter, update)
+	if err != nil {
+		return 0, fmt.Errorf("error marking expired short URLs: %w", err)
+	}
+
+	return res.ModifiedCount, nil
+}
+
+// DeleteShortURLClicksBefore deletes all short URL clicks recorded before the
+// specified unix timestamp and returns the number of clicks that were deleted.
+// Implements db.DataStore.
+func (m *MongoDB) DeleteShortURLClicksBefore(timestamp int64) (int64, error) {
+	filter := bson.M{clickMapKey(timestampKey): bson.M{"$lt": timestamp}}
+	res, err := m.urlClickCollection().DeleteMany(m.ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting old clicks: %w", err)
+	}
+
+	return res.DeletedCount, nil
+}
+
 // urlsCollection returns the collection for the short URLs.
 func (m *MongoDB) urlsCollection() *mongo.Collection {
 	return m.db.Collection(urlsCollectionName)
@@ -246,7 +496,7 @@ func (m *MongoDB) urlClickCollection() *mongo.Collection {
 // handleURLError handles errors that occur when retrieving URL information.
 func handleURLError(err error) error {
 	if err == mongo.ErrNoDocuments {
-		return fmt.Errorf("%w: URL does not exist", db.ErrorBadRequest)
+		return fmt.Errorf("%w: URL does not exist", db.ErrorNotFound)
 	}
 
 	return fmt.Errorf("error retrieving URL info: %v", err)
@@ -257,3 +507,10 @@ func urlMapKey(key string) string {
 	// This key is and must remain consistent with the bson key used in urlInfo.
 	return mapKey("url", key)
 }
+
+// clickMapKey returns the key for the specified click field.
+func clickMapKey(key string) string {
+	// This key is and must remain consistent with the bson key used in
+	// urlClick.
+	return mapKey("click", key)
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/ukane-philemon/bob/db"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // UsernameExists checks if a username exists in the database. Implements
@@ -33,7 +32,7 @@ func (m *MongoDB) CreateUser(username, email string, password []byte) error {
 		return fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	hashedPassword, err := m.hasher.Hash(password)
 	if err != nil {
 		return fmt.Errorf("error hashing password: %w", err)
 	}
@@ -81,6 +80,7 @@ func (m *MongoDB) RetrieveUserInfo(email string) (*db.UserInfo, error) {
 		return nil, handleURLError(err)
 	}
 	userInfo.TotalLinks = int(nLinks)
+	userInfo.HasPassword = len(userInfo.Password) > 0
 
 	return userInfo.UserInfo, nil
 }
@@ -98,6 +98,9 @@ func (m *MongoDB) LoginUser(email string, password []byte) (*db.UserInfo, error)
 
 	res := m.usersCollection().FindOne(m.ctx, bson.M{userMapKey(emailKey): email})
 	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			db.CompareDummyPassword(m.hasher, password)
+		}
 		return nil, handleUserError(res.Err())
 	}
 
@@ -106,20 +109,199 @@ func (m *MongoDB) LoginUser(email string, password []byte) (*db.UserInfo, error)
 		return nil, fmt.Errorf("error decoding user info: %w", err)
 	}
 
-	if bcrypt.CompareHashAndPassword(dbUserInfo.Password, password) != nil {
+	ok, needsRehash := m.hasher.Verify(dbUserInfo.Password, password)
+	if !ok {
 		return nil, fmt.Errorf("%w: incorrect password", db.ErrorBadRequest)
 	}
 
+	// Hashes with outdated algorithms or parameters are replaced. The login
+	// does not fail if the hash cannot be replaced, it is tried again on the
+	// next login. The old hash is matched so that a password changed in the
+	// meantime is kept.
+	if needsRehash {
+		if newHash, err := m.hasher.Hash(password); err == nil {
+			_, _ = m.usersCollection().UpdateOne(m.ctx, bson.M{userMapKey(emailKey): email, passwordKey: dbUserInfo.Password},
+				bson.M{"$set": bson.M{passwordKey: newHash}})
+		}
+	}
+
 	// Set user's total links
 	nLinks, err := m.urlsCollection().CountDocuments(m.ctx, bson.M{urlMapKey(ownerIDKey): email})
 	if err != nil {
 		return nil, handleURLError(err)
 	}
 	dbUserInfo.TotalLinks = int(nLinks)
+	dbUserInfo.HasPassword = true
 
 	return dbUserInfo.UserInfo, nil
 }
 
+// SetEmailVerified marks the email of the user with the specified email as
+// verified. Implements db.DataStore.
+func (m *MongoDB) SetEmailVerified(email string) error {
+	res, err := m.usersCollection().UpdateOne(m.ctx, bson.M{userMapKey(emailKey): email},
+		bson.M{"$set": bson.M{userMapKey(emailVerifiedKey): true}})
+	if err != nil {
+		return fmt.Errorf("error verifying email: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	return nil
+}
+
+// ResetUserPassword replaces the password of the user with the specified
+// email. The password is hashed before being stored. Implements db.DataStore.
+func (m *MongoDB) ResetUserPassword(email string, password []byte) error {
+	if len(password) == 0 {
+		return fmt.Errorf("%w: password is required", db.ErrorBadRequest)
+	}
+
+	hashedPassword, err := m.hasher.Hash(password)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+
+	res, err := m.usersCollection().UpdateOne(m.ctx, bson.M{userMapKey(emailKey): email},
+		bson.M{"$set": bson.M{passwordKey: hashedPassword}})
+	if err != nil {
+		return fmt.Errorf("error resetting password: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	return nil
+}
+
+// UpdateUsername changes the username of the user with the specified email.
+// Implements db.DataStore.
+func (m *MongoDB) UpdateUsername(email, username string) error {
+	if username == "" {
+		return fmt.Errorf("%w: username is required", db.ErrorBadRequest)
+	}
+
+	res, err := m.usersCollection().UpdateOne(m.ctx, bson.M{userMapKey(emailKey): email},
+		bson.M{"$set": bson.M{userMapKey(usernameKey): username}})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: username already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error updating username: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	return nil
+}
+
+// ChangeUserEmail changes the email of the user with the specified email to
+// newEmail and moves the user's short URLs, sessions, API keys, identities and
+// workspace memberships to it. Implements db.DataStore.
+func (m *MongoDB) ChangeUserEmail(email, newEmail string) error {
+	if !db.IsValidEmail(newEmail) {
+		return fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	}
+
+	// Transactions require a replica set. The user is changed first so that
+	// nothing is moved to an email that is taken, and the other documents
+	// are moved after.
+	res, err := m.usersCollection().UpdateOne(m.ctx, bson.M{userMapKey(emailKey): email},
+		bson.M{"$set": bson.M{userMapKey(emailKey): newEmail, userMapKey(emailVerifiedKey): false}})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: email already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error changing email: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	moves := []struct {
+		collection *mongo.Collection
+		key        string
+	}{
+		{m.urlsCollection(), urlMapKey(ownerIDKey)},
+		{m.sessionsCollection(), emailKey},
+		{m.apiKeysCollection(), emailKey},
+		{m.identitiesCollection(), emailKey},
+		{m.workspaceMembersCollection(), emailKey},
+	}
+	for _, move := range moves {
+		_, err := move.collection.UpdateMany(m.ctx, bson.M{move.key: email}, bson.M{"$set": bson.M{move.key: newEmail}})
+		if err != nil {
+			return fmt.Errorf("error moving %s to the new email: %w", move.collection.Name(), err)
+		}
+	}
+
+	// Tokens sent to the old email must not be used for the new one.
+	if _, err := m.userTokensCollection().DeleteMany(m.ctx, bson.M{emailKey: email}); err != nil {
+		return fmt.Errorf("error deleting user tokens: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteUser deletes the user with the specified email together with the
+// user's short URLs and their clicks, sessions, API keys, identities, user
+// tokens and workspace memberships, and returns the deleted short URLs.
+// Implements db.DataStore.
+func (m *MongoDB) DeleteUser(email string) ([]string, error) {
+	res := m.usersCollection().FindOne(m.ctx, bson.M{userMapKey(emailKey): email})
+	if res.Err() != nil {
+		return nil, handleUserError(res.Err())
+	}
+
+	values, err := m.urlsCollection().Distinct(m.ctx, urlMapKey(shortURLKey), bson.M{urlMapKey(ownerIDKey): email})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving short URLs: %w", err)
+	}
+
+	shortURLs := make([]string, 0, len(values))
+	for _, v := range values {
+		if shortURL, ok := v.(string); ok {
+			shortURLs = append(shortURLs, shortURL)
+		}
+	}
+
+	// Transactions require a replica set. The user is deleted last so that
+	// deleting it can be retried if deleting its data fails.
+	if len(shortURLs) > 0 {
+		if _, err := m.urlClickCollection().DeleteMany(m.ctx, bson.M{shortURLKey: bson.M{"$in": shortURLs}}); err != nil {
+			return nil, fmt.Errorf("error deleting clicks: %w", err)
+		}
+	}
+
+	deletes := []struct {
+		collection *mongo.Collection
+		key        string
+	}{
+		{m.urlsCollection(), urlMapKey(ownerIDKey)},
+		{m.sessionsCollection(), emailKey},
+		{m.apiKeysCollection(), emailKey},
+		{m.identitiesCollection(), emailKey},
+		{m.userTokensCollection(), emailKey},
+		{m.workspaceMembersCollection(), emailKey},
+		{m.usersCollection(), userMapKey(emailKey)},
+	}
+	for _, d := range deletes {
+		if _, err := d.collection.DeleteMany(m.ctx, bson.M{d.key: email}); err != nil {
+			return nil, fmt.Errorf("error deleting %s: %w", d.collection.Name(), err)
+		}
+	}
+
+	return shortURLs, nil
+}
+
 // usersCollection returns the users collection.
 func (m *MongoDB) usersCollection() *mongo.Collection {
 	return m.db.Collection(usersCollectionName)
@@ -0,0 +1,411 @@
+package mongodb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ukane-philemon/bob/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CreateWorkspace adds a new workspace to the database with the user with the
+// specified email as its owner. Implements db.DataStore.
+func (m *MongoDB) CreateWorkspace(workspace *db.Workspace, ownerEmail string) error {
+	if !db.IsWorkspaceID(workspace.ID) || workspace.Name == "" {
+		return fmt.Errorf("%w: workspace ID and name are required", db.ErrorBadRequest)
+	}
+
+	res := m.usersCollection().FindOne(m.ctx, bson.M{userMapKey(emailKey): ownerEmail})
+	if res.Err() != nil {
+		return handleUserError(res.Err())
+	}
+
+	if _, err := m.workspacesCollection().InsertOne(m.ctx, workspace); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: workspace already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating workspace: %w", err)
+	}
+
+	owner := &db.WorkspaceMember{
+		WorkspaceID: workspace.ID,
+		Email:       ownerEmail,
+		Role:        db.WorkspaceRoleOwner,
+		JoinedAt:    workspace.CreatedAt,
+	}
+	if _, err := m.workspaceMembersCollection().InsertOne(m.ctx, owner); err != nil {
+		// Transactions require a replica set, so the workspace is removed
+		// instead.
+		_, _ = m.workspacesCollection().DeleteOne(m.ctx, bson.M{workspaceIDKey: workspace.ID})
+		return fmt.Errorf("error adding workspace owner: %w", err)
+	}
+
+	return nil
+}
+
+// RetrieveWorkspace fetches the workspace with the specified ID. Implements
+// db.DataStore.
+func (m *MongoDB) RetrieveWorkspace(id string) (*db.Workspace, error) {
+	res := m.workspacesCollection().FindOne(m.ctx, bson.M{workspaceIDKey: id})
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("%w: workspace does not exist", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error retrieving workspace: %w", res.Err())
+	}
+
+	var workspace *db.Workspace
+	if err := res.Decode(&workspace); err != nil {
+		return nil, fmt.Errorf("error decoding workspace: %w", err)
+	}
+
+	return workspace, nil
+}
+
+// RetrieveUserWorkspaces fetches the workspaces the user with the specified
+// email is a member of, oldest first, with the role of the user. Implements
+// db.DataStore.
+func (m *MongoDB) RetrieveUserWorkspaces(email string) ([]*db.Workspace, error) {
+	cursor, err := m.workspaceMembersCollection().Find(m.ctx, bson.M{emailKey: email})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving workspace members: %w", err)
+	}
+
+	var members []*db.WorkspaceMember
+	if err := cursor.All(m.ctx, &members); err != nil {
+		return nil, fmt.Errorf("error decoding workspace members: %w", err)
+	}
+
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	roles := make(map[string]string, len(members))
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		roles[member.WorkspaceID] = member.Role
+		ids = append(ids, member.WorkspaceID)
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: createdAtKey, Value: 1}, {Key: workspaceIDKey, Value: 1}})
+	cursor, err = m.workspacesCollection().Find(m.ctx, bson.M{workspaceIDKey: bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving workspaces: %w", err)
+	}
+
+	var workspaces []*db.Workspace
+	if err := cursor.All(m.ctx, &workspaces); err != nil {
+		return nil, fmt.Errorf("error decoding workspaces: %w", err)
+	}
+
+	for _, workspace := range workspaces {
+		workspace.Role = roles[workspace.ID]
+	}
+
+	return workspaces, nil
+}
+
+// DeleteWorkspace deletes the workspace with the specified ID together with
+// its members, invitations, short URLs and their clicks, and returns the
+// deleted short URLs. Implements db.DataStore.
+func (m *MongoDB) DeleteWorkspace(id string) ([]string, error) {
+	if _, err := m.RetrieveWorkspace(id); err != nil {
+		return nil, err
+	}
+
+	values, err := m.urlsCollection().Distinct(m.ctx, urlMapKey(shortURLKey), bson.M{urlMapKey(ownerIDKey): id})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving short URLs: %w", err)
+	}
+
+	shortURLs := make([]string, 0, len(values))
+	for _, v := range values {
+		if shortURL, ok := v.(string); ok {
+			shortURLs = append(shortURLs, shortURL)
+		}
+	}
+
+	// Transactions require a replica set. The workspace is deleted last so
+	// that deleting it can be retried if deleting its data fails.
+	if len(shortURLs) > 0 {
+		if _, err := m.urlClickCollection().DeleteMany(m.ctx, bson.M{shortURLKey: bson.M{"$in": shortURLs}}); err != nil {
+			return nil, fmt.Errorf("error deleting clicks: %w", err)
+		}
+	}
+
+	deletes := []struct {
+		collection *mongo.Collection
+		key        string
+	}{
+		{m.urlsCollection(), urlMapKey(ownerIDKey)},
+		{m.workspaceMembersCollection(), memberWorkspaceIDKey},
+		{m.workspaceInvitationsCollection(), memberWorkspaceIDKey},
+		{m.workspacesCollection(), workspaceIDKey},
+	}
+	for _, d := range deletes {
+		if _, err := d.collection.DeleteMany(m.ctx, bson.M{d.key: id}); err != nil {
+			return nil, fmt.Errorf("error deleting %s: %w", d.collection.Name(), err)
+		}
+	}
+
+	return shortURLs, nil
+}
+
+// RetrieveWorkspaceMember fetches the membership of the user with the
+// specified email in the workspace with the specified ID. Implements
+// db.DataStore.
+func (m *MongoDB) RetrieveWorkspaceMember(workspaceID, email string) (*db.WorkspaceMember, error) {
+	res := m.workspaceMembersCollection().FindOne(m.ctx, bson.M{memberWorkspaceIDKey: workspaceID, emailKey: email})
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("%w: user is not a member of the workspace", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error retrieving workspace member: %w", res.Err())
+	}
+
+	var member *db.WorkspaceMember
+	if err := res.Decode(&member); err != nil {
+		return nil, fmt.Errorf("error decoding workspace member: %w", err)
+	}
+
+	return member, nil
+}
+
+// RetrieveWorkspaceMembers fetches the members of the workspace with the
+// specified ID, oldest first. Implements db.DataStore.
+func (m *MongoDB) RetrieveWorkspaceMembers(workspaceID string) ([]*db.WorkspaceMember, error) {
+	opts := options.Find().SetSort(bson.D{{Key: joinedAtKey, Value: 1}, {Key: emailKey, Value: 1}})
+	cursor, err := m.workspaceMembersCollection().Find(m.ctx, bson.M{memberWorkspaceIDKey: workspaceID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving workspace members: %w", err)
+	}
+
+	var members []*db.WorkspaceMember
+	if err := cursor.All(m.ctx, &members); err != nil {
+		return nil, fmt.Errorf("error decoding workspace members: %w", err)
+	}
+
+	return members, nil
+}
+
+// UpdateWorkspaceMemberRole changes the role of the user with the specified
+// email in the workspace with the specified ID. Implements db.DataStore.
+func (m *MongoDB) UpdateWorkspaceMemberRole(workspaceID, email, role string) error {
+	if !db.IsValidWorkspaceRole(role) {
+		return fmt.Errorf("%w: invalid workspace role", db.ErrorBadRequest)
+	}
+
+	if role != db.WorkspaceRoleOwner {
+		if err := m.requireOtherWorkspaceOwner(workspaceID, email); err != nil {
+			return err
+		}
+	}
+
+	update := bson.M{"$set": bson.M{roleKey: role}}
+	res, err := m.workspaceMembersCollection().UpdateOne(m.ctx, bson.M{memberWorkspaceIDKey: workspaceID, emailKey: email}, update)
+	if err != nil {
+		return fmt.Errorf("error updating workspace member: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: user is not a member of the workspace", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// RemoveWorkspaceMember removes the user with the specified email from the
+// workspace with the specified ID. Implements db.DataStore.
+func (m *MongoDB) RemoveWorkspaceMember(workspaceID, email string) error {
+	if err := m.requireOtherWorkspaceOwner(workspaceID, email); err != nil {
+		return err
+	}
+
+	res, err := m.workspaceMembersCollection().DeleteOne(m.ctx, bson.M{memberWorkspaceIDKey: workspaceID, emailKey: email})
+	if err != nil {
+		return fmt.Errorf("error removing workspace member: %w", err)
+	}
+
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("%w: user is not a member of the workspace", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// requireOtherWorkspaceOwner returns db.ErrorBadRequest if the user with the
+// specified email is the only owner of the workspace with the specified ID.
+// Transactions require a replica set, so concurrent changes to the owners of
+// a workspace are not detected.
+func (m *MongoDB) requireOtherWorkspaceOwner(workspaceID, email string) error {
+	cursor, err := m.workspaceMembersCollection().Find(m.ctx, bson.M{memberWorkspaceIDKey: workspaceID, roleKey: db.WorkspaceRoleOwner})
+	if err != nil {
+		return fmt.Errorf("error retrieving workspace owners: %w", err)
+	}
+
+	var owners []*db.WorkspaceMember
+	if err := cursor.All(m.ctx, &owners); err != nil {
+		return fmt.Errorf("error decoding workspace owners: %w", err)
+	}
+
+	var isOwner, hasOtherOwner bool
+	for _, owner := range owners {
+		isOwner = isOwner || owner.Email == email
+		hasOtherOwner = hasOtherOwner || owner.Email != email
+	}
+
+	if isOwner && !hasOtherOwner {
+		return fmt.Errorf("%w: a workspace must have an owner", db.ErrorBadRequest)
+	}
+	return nil
+}
+
+// CreateWorkspaceInvitation adds a new invitation to join a workspace to the
+// database. Implements db.DataStore.
+func (m *MongoDB) CreateWorkspaceInvitation(invitation *db.WorkspaceInvitation) error {
+	if invitation.ID == "" || len(invitation.TokenHash) == 0 || !db.IsValidWorkspaceRole(invitation.Role) {
+		return fmt.Errorf("%w: invitation ID, token hash and role are required", db.ErrorBadRequest)
+	}
+
+	if _, err := m.RetrieveWorkspace(invitation.WorkspaceID); err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return fmt.Errorf("%w: workspace does not exist", db.ErrorBadRequest)
+		}
+		return err
+	}
+
+	if _, err := m.workspaceInvitationsCollection().InsertOne(m.ctx, invitation); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: invitation already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating invitation: %w", err)
+	}
+
+	return nil
+}
+
+// RetrieveWorkspaceInvitations fetches the invitations of the workspace with
+// the specified ID that have not been accepted, oldest first. Implements
+// db.DataStore.
+func (m *MongoDB) RetrieveWorkspaceInvitations(workspaceID string) ([]*db.WorkspaceInvitation, error) {
+	opts := options.Find().SetSort(bson.D{{Key: createdAtKey, Value: 1}, {Key: workspaceIDKey, Value: 1}})
+	cursor, err := m.workspaceInvitationsCollection().Find(m.ctx, bson.M{memberWorkspaceIDKey: workspaceID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving invitations: %w", err)
+	}
+
+	var invitations []*db.WorkspaceInvitation
+	if err := cursor.All(m.ctx, &invitations); err != nil {
+		return nil, fmt.Errorf("error decoding invitations: %w", err)
+	}
+
+	return invitations, nil
+}
+
+// DeleteWorkspaceInvitation deletes the invitation with the specified ID of
+// the workspace with the specified ID. Implements db.DataStore.
+func (m *MongoDB) DeleteWorkspaceInvitation(workspaceID, id string) error {
+	res, err := m.workspaceInvitationsCollection().DeleteOne(m.ctx, bson.M{workspaceIDKey: id, memberWorkspaceIDKey: workspaceID})
+	if err != nil {
+		return fmt.Errorf("error deleting invitation: %w", err)
+	}
+
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("%w: invitation does not exist", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// AcceptWorkspaceInvitation deletes the invitation with the specified token
+// hash sent to the specified email and adds the user with that email to the
+// workspace with the role of the invitation. Implements db.DataStore.
+func (m *MongoDB) AcceptWorkspaceInvitation(tokenHash []byte, email string, timestamp int64) (*db.WorkspaceMember, error) {
+	filter := bson.M{tokenHashKey: tokenHash, emailKey: email, expiresAtKey: bson.M{"$gt": timestamp}}
+	res := m.workspaceInvitationsCollection().FindOne(m.ctx, filter)
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("%w: invitation does not exist or has expired", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error retrieving invitation: %w", res.Err())
+	}
+
+	var invitation *db.WorkspaceInvitation
+	if err := res.Decode(&invitation); err != nil {
+		return nil, fmt.Errorf("error decoding invitation: %w", err)
+	}
+
+	if res := m.usersCollection().FindOne(m.ctx, bson.M{userMapKey(emailKey): email}); res.Err() != nil {
+		return nil, handleUserError(res.Err())
+	}
+
+	// Transactions require a replica set. The invitation is only deleted once
+	// the checks pass, and deleting it ensures it is only accepted once.
+	count, err := m.workspaceMembersCollection().CountDocuments(m.ctx, bson.M{memberWorkspaceIDKey: invitation.WorkspaceID, emailKey: email})
+	if err != nil {
+		return nil, fmt.Errorf("error counting workspace members: %w", err)
+	}
+
+	if count > 0 {
+		return nil, fmt.Errorf("%w: user is already a member of the workspace", db.ErrorBadRequest)
+	}
+
+	if res := m.workspaceInvitationsCollection().FindOneAndDelete(m.ctx, bson.M{workspaceIDKey: invitation.ID}); res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("%w: invitation does not exist or has expired", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error deleting invitation: %w", res.Err())
+	}
+
+	member := &db.WorkspaceMember{
+		WorkspaceID: invitation.WorkspaceID,
+		Email:       email,
+		Role:        invitation.Role,
+		JoinedAt:    timestamp,
+	}
+	if _, err := m.workspaceMembersCollection().InsertOne(m.ctx, member); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("%w: user is already a member of the workspace", db.ErrorBadRequest)
+		}
+
+		return nil, fmt.Errorf("error adding workspace member: %w", err)
+	}
+
+	return member, nil
+}
+
+// DeleteExpiredWorkspaceInvitations deletes all workspace invitations that
+// expired before the specified unix timestamp and returns the number of
+// invitations that were deleted. Implements db.DataStore.
+func (m *MongoDB) DeleteExpiredWorkspaceInvitations(timestamp int64) (int64, error) {
+	res, err := m.workspaceInvitationsCollection().DeleteMany(m.ctx, bson.M{expiresAtKey: bson.M{"$lt": timestamp}})
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired invitations: %w", err)
+	}
+
+	return res.DeletedCount, nil
+}
+
+// workspacesCollection returns the collection for workspaces.
+func (m *MongoDB) workspacesCollection() *mongo.Collection {
+	return m.db.Collection(workspacesCollectionName)
+}
+
+// workspaceMembersCollection returns the collection for workspace members.
+func (m *MongoDB) workspaceMembersCollection() *mongo.Collection {
+	return m.db.Collection(workspaceMembersCollectionName)
+}
+
+// workspaceInvitationsCollection returns the collection for workspace
+// invitations.
+func (m *MongoDB) workspaceInvitationsCollection() *mongo.Collection {
+	return m.db.Collection(workspaceInvitationsCollectionName)
+}
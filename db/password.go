@@ -0,0 +1,218 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// These are the identifiers of the supported password hashing algorithms.
+const (
+	PasswordAlgorithmArgon2id = "argon2id"
+	PasswordAlgorithmBcrypt   = "bcrypt"
+)
+
+const (
+	// argon2idSaltLength and argon2idKeyLength are the lengths of Argon2id
+	// salts and keys in bytes.
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+// PasswordHasher hashes and verifies user passwords. Hashes are encoded with
+// the identifier of their algorithm and its parameters, e.g.
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>, so that users whose passwords
+// were hashed with different algorithms or parameters can be stored side by
+// side.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password.
+	Hash(password []byte) ([]byte, error)
+	// Verify returns true if password matches the encoded hash. needsRehash
+	// is true if hash does not use the algorithm and parameters of the
+	// hasher, it should then be replaced with a new hash of password.
+	Verify(hash, password []byte) (ok, needsRehash bool)
+}
+
+// PasswordHashConfig is the configuration of the password hasher.
+type PasswordHashConfig struct {
+	// Algorithm is the algorithm new password hashes are created with.
+	// Passwords hashed with the other algorithm can still log in and are
+	// rehashed when they do.
+	Algorithm string `long:"algorithm" env:"PASSWORD_HASH_ALGORITHM" default:"argon2id" choice:"argon2id" choice:"bcrypt" description:"Algorithm new password hashes are created with, existing hashes are upgraded when users log in"`
+	// Argon2idMemory is the memory used by Argon2id in KiB.
+	Argon2idMemory uint32 `long:"argon2idmemory" env:"PASSWORD_ARGON2ID_MEMORY" default:"65536" description:"Memory used to hash a password with Argon2id in KiB"`
+	// Argon2idIterations is the number of passes of Argon2id over the memory.
+	Argon2idIterations uint32 `long:"argon2iditerations" env:"PASSWORD_ARGON2ID_ITERATIONS" default:"3" description:"Number of Argon2id passes over the memory"`
+	// Argon2idParallelism is the number of threads used by Argon2id.
+	Argon2idParallelism uint8 `long:"argon2idparallelism" env:"PASSWORD_ARGON2ID_PARALLELISM" default:"4" description:"Number of threads used to hash a password with Argon2id"`
+	// BcryptCost is the cost of bcrypt hashes.
+	BcryptCost int `long:"bcryptcost" env:"PASSWORD_BCRYPT_COST" default:"10" description:"Cost of bcrypt password hashes"`
+}
+
+// DefaultPasswordHashConfig returns the configuration of the default password
+// hasher. It matches the defaults of the command-line flags.
+func DefaultPasswordHashConfig() PasswordHashConfig {
+	return PasswordHashConfig{
+		Algorithm:           PasswordAlgorithmArgon2id,
+		Argon2idMemory:      64 * 1024,
+		Argon2idIterations:  3,
+		Argon2idParallelism: 4,
+		BcryptCost:          bcrypt.DefaultCost,
+	}
+}
+
+// passwordHasher implements PasswordHasher for Argon2id and bcrypt.
+type passwordHasher struct {
+	cfg PasswordHashConfig
+
+	// dummyHash is a hash of a dummy password created with cfg, see
+	// CompareDummyPassword.
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+}
+
+// NewPasswordHasher returns a PasswordHasher that creates hashes with the
+// algorithm and parameters of cfg and verifies Argon2id and bcrypt hashes.
+func NewPasswordHasher(cfg PasswordHashConfig) (PasswordHasher, error) {
+	switch cfg.Algorithm {
+	case PasswordAlgorithmArgon2id:
+		if cfg.Argon2idMemory < 8*uint32(cfg.Argon2idParallelism) || cfg.Argon2idIterations < 1 || cfg.Argon2idParallelism < 1 {
+			return nil, fmt.Errorf("invalid Argon2id parameters: memory %d KiB, %d iterations, parallelism %d",
+				cfg.Argon2idMemory, cfg.Argon2idIterations, cfg.Argon2idParallelism)
+		}
+	case PasswordAlgorithmBcrypt:
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("invalid bcrypt cost %d, it must be between %d and %d", cfg.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hashing algorithm %q", cfg.Algorithm)
+	}
+
+	return &passwordHasher{cfg: cfg}, nil
+}
+
+// DefaultPasswordHasher returns a PasswordHasher with the default
+// configuration.
+func DefaultPasswordHasher() PasswordHasher {
+	h, err := NewPasswordHasher(DefaultPasswordHashConfig())
+	if err != nil {
+		panic(err) // the default configuration is valid
+	}
+	return h
+}
+
+// Hash returns the encoded hash of password. Implements PasswordHasher.
+func (h *passwordHasher) Hash(password []byte) ([]byte, error) {
+	if h.cfg.Algorithm == PasswordAlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword(password, h.cfg.BcryptCost)
+		if err != nil {
+			return nil, fmt.Errorf("bcrypt.GenerateFromPassword error: %w", err)
+		}
+		return hash, nil
+	}
+
+	salt := make([]byte, argon2idSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating salt: %w", err)
+	}
+
+	params := argon2idParams{
+		memory:      h.cfg.Argon2idMemory,
+		iterations:  h.cfg.Argon2idIterations,
+		parallelism: h.cfg.Argon2idParallelism,
+	}
+	key := argon2.IDKey(password, salt, params.iterations, params.memory, params.parallelism, argon2idKeyLength)
+	return []byte(encodeArgon2idHash(params, salt, key)), nil
+}
+
+// Verify returns true if password matches the encoded hash. Implements
+// PasswordHasher.
+func (h *passwordHasher) Verify(hash, password []byte) (ok, needsRehash bool) {
+	if bytes.HasPrefix(hash, []byte("$"+PasswordAlgorithmArgon2id+"$")) {
+		params, salt, key, err := decodeArgon2idHash(string(hash))
+		if err != nil {
+			return false, false
+		}
+
+		got := argon2.IDKey(password, salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, false
+		}
+
+		return true, h.cfg.Algorithm != PasswordAlgorithmArgon2id || params.memory != h.cfg.Argon2idMemory ||
+			params.iterations != h.cfg.Argon2idIterations || params.parallelism != h.cfg.Argon2idParallelism ||
+			len(salt) != argon2idSaltLength || len(key) != argon2idKeyLength
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, password) != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost(hash)
+	return true, err != nil || h.cfg.Algorithm != PasswordAlgorithmBcrypt || cost != h.cfg.BcryptCost
+}
+
+// argon2idParams are the parameters of an Argon2id hash.
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+// encodeArgon2idHash encodes an Argon2id hash in the PHC string format.
+func encodeArgon2idHash(params argon2idParams, salt, key []byte) string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", PasswordAlgorithmArgon2id, argon2.Version,
+		params.memory, params.iterations, params.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// decodeArgon2idHash decodes an Argon2id hash encoded by encodeArgon2idHash.
+func decodeArgon2idHash(hash string) (params argon2idParams, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordAlgorithmArgon2id {
+		return params, nil, nil, fmt.Errorf("invalid Argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported Argon2id version %q", parts[2])
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid Argon2id parameters: %w", err)
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid Argon2id salt: %w", err)
+	}
+
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("invalid Argon2id key")
+	}
+
+	return params, salt, key, nil
+}
+
+// CompareDummyPassword compares password with a hash of a dummy password
+// created by hasher. Logins of users that do not exist call it so that they
+// take as long as logins with an incorrect password and do not reveal which
+// emails have an account. It does nothing for hashers that were not created
+// by NewPasswordHasher.
+func CompareDummyPassword(hasher PasswordHasher, password []byte) {
+	h, ok := hasher.(*passwordHasher)
+	if !ok {
+		return
+	}
+
+	h.dummyHashOnce.Do(func() {
+		h.dummyHash, _ = h.Hash([]byte("dummy password"))
+	})
+	h.Verify(h.dummyHash, password)
+}
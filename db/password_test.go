@@ -0,0 +1,110 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+// tArgon2idConfig returns a cheap Argon2id configuration for tests.
+func tArgon2idConfig() PasswordHashConfig {
+	cfg := DefaultPasswordHashConfig()
+	cfg.Argon2idMemory = 1024
+	cfg.Argon2idIterations = 1
+	cfg.Argon2idParallelism = 1
+	return cfg
+}
+
+func tPasswordHasher(t *testing.T, cfg PasswordHashConfig) PasswordHasher {
+	t.Helper()
+	h, err := NewPasswordHasher(cfg)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher error: %v", err)
+	}
+	return h
+}
+
+func TestPasswordHasher(t *testing.T) {
+	argon2idCfg := tArgon2idConfig()
+	argon2id := tPasswordHasher(t, argon2idCfg)
+	moreIterationsCfg := argon2idCfg
+	moreIterationsCfg.Argon2idIterations = 2
+	moreIterations := tPasswordHasher(t, moreIterationsCfg)
+	bcryptCfg := argon2idCfg
+	bcryptCfg.Algorithm = PasswordAlgorithmBcrypt
+	bcryptCfg.BcryptCost = 4
+	bcrypt := tPasswordHasher(t, bcryptCfg)
+	higherCostCfg := bcryptCfg
+	higherCostCfg.BcryptCost = 5
+	higherCost := tPasswordHasher(t, higherCostCfg)
+
+	password := []byte("password")
+	argon2idHash, err := argon2id.Hash(password)
+	if err != nil {
+		t.Fatalf("Hash error: %v", err)
+	}
+	if !strings.HasPrefix(string(argon2idHash), "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("Unexpected Argon2id hash %q", argon2idHash)
+	}
+
+	bcryptHash, err := bcrypt.Hash(password)
+	if err != nil {
+		t.Fatalf("Hash error: %v", err)
+	}
+
+	if otherHash, _ := argon2id.Hash(password); string(otherHash) == string(argon2idHash) {
+		t.Fatal("Expected hashes of the same password to have different salts")
+	}
+
+	tests := []struct {
+		name            string
+		hasher          PasswordHasher
+		hash            []byte
+		password        string
+		wantOk          bool
+		wantNeedsRehash bool
+	}{
+		{"argon2id", argon2id, argon2idHash, "password", true, false},
+		{"argon2id incorrect password", argon2id, argon2idHash, "incorrect", false, false},
+		{"argon2id outdated parameters", moreIterations, argon2idHash, "password", true, true},
+		{"argon2id to bcrypt", bcrypt, argon2idHash, "password", true, true},
+		{"bcrypt", bcrypt, bcryptHash, "password", true, false},
+		{"bcrypt incorrect password", bcrypt, bcryptHash, "incorrect", false, false},
+		{"bcrypt outdated cost", higherCost, bcryptHash, "password", true, true},
+		{"bcrypt to argon2id", argon2id, bcryptHash, "password", true, true},
+		{"no hash", argon2id, nil, "password", false, false},
+		{"corrupt argon2id hash", argon2id, []byte("$argon2id$v=19$m=1024$salt$key"), "password", false, false},
+		{"unsupported argon2id version", argon2id, []byte(strings.Replace(string(argon2idHash), "v=19", "v=16", 1)), "password", false, false},
+	}
+
+	for _, tt := range tests {
+		ok, needsRehash := tt.hasher.Verify(tt.hash, []byte(tt.password))
+		if ok != tt.wantOk || needsRehash != tt.wantNeedsRehash {
+			t.Fatalf("%s: expected ok %v and needsRehash %v but got %v and %v", tt.name, tt.wantOk, tt.wantNeedsRehash, ok, needsRehash)
+		}
+	}
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+	if _, err := NewPasswordHasher(DefaultPasswordHashConfig()); err != nil {
+		t.Fatalf("Expected the default configuration to be valid but got %v", err)
+	}
+
+	invalid := map[string]func(cfg *PasswordHashConfig){
+		"unknown algorithm": func(cfg *PasswordHashConfig) { cfg.Algorithm = "md5" },
+		"no iterations":     func(cfg *PasswordHashConfig) { cfg.Argon2idIterations = 0 },
+		"no parallelism":    func(cfg *PasswordHashConfig) { cfg.Argon2idParallelism = 0 },
+		"too little memory": func(cfg *PasswordHashConfig) { cfg.Argon2idMemory = 7 },
+		"low bcrypt cost": func(cfg *PasswordHashConfig) {
+			cfg.Algorithm = PasswordAlgorithmBcrypt
+			cfg.BcryptCost = 1
+		},
+	}
+
+	for name, modify := range invalid {
+		cfg := tArgon2idConfig()
+		modify(&cfg)
+		if _, err := NewPasswordHasher(cfg); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
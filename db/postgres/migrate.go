@@ -0,0 +1,208 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationsLockID is the advisory lock held while migrations are applied so
+// that replicas starting at the same time do not race each other.
+const migrationsLockID = 0x626f62 // "bob"
+
+// migrationFiles holds the versioned schema migrations. Files are named
+// "<version>_<name>.sql" and are applied in version order. Existing files must
+// never be modified, new schema changes must be added as new files.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	// AppliedAt is the unix timestamp at which the migration was applied. It
+	// is zero if the migration has not been applied.
+	AppliedAt int64
+	stmt      string
+}
+
+// Migrations returns all the known migrations and the time each one was
+// applied to the database specified by cfg.
+func Migrations(ctx context.Context, cfg Config) ([]*Migration, error) {
+	sqlDB, err := open(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer sqlDB.Close()
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx, sqlDB)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range migrations {
+		m.AppliedAt = applied[m.Version]
+	}
+
+	return migrations, nil
+}
+
+// Migrate applies all pending migrations to the database specified by cfg and
+// returns the migrations that were applied.
+func Migrate(ctx context.Context, cfg Config) ([]*Migration, error) {
+	sqlDB, err := open(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer sqlDB.Close()
+
+	return migrate(ctx, sqlDB)
+}
+
+// migrate applies all pending migrations in a single transaction and returns
+// the migrations that were applied.
+func migrate(ctx context.Context, sqlDB *sql.DB) ([]*Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin migrations: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationsLockID); err != nil {
+		return nil, fmt.Errorf("failed to acquire migrations lock: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	applied, err := appliedMigrations(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	for version := range applied {
+		if version > len(migrations) {
+			return nil, fmt.Errorf("database schema version %d is newer than the supported version %d", version, len(migrations))
+		}
+	}
+
+	var newlyApplied []*Migration
+	for _, m := range migrations {
+		if applied[m.Version] > 0 {
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, m.stmt); err != nil {
+			return nil, fmt.Errorf("failed to apply migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		m.AppliedAt = time.Now().Unix()
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)", m.Version, m.Name, m.AppliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		newlyApplied = append(newlyApplied, m)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit migrations: %w", err)
+	}
+
+	return newlyApplied, nil
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// appliedMigrations returns the time each applied migration was applied keyed
+// by version. An empty map is returned if no migration has been applied.
+func appliedMigrations(ctx context.Context, q queryer) (map[int]int64, error) {
+	applied := make(map[int]int64)
+	rows, err := q.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		if isPgError(err, codeUndefinedTable) {
+			return applied, nil
+		}
+		return nil, fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("rows.Scan error: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// loadMigrations reads the embedded migrations sorted by version. Versions
+// must start at 1 and have no gaps.
+func loadMigrations() ([]*Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	var migrations []*Migration
+	for _, entry := range entries {
+		fileName := entry.Name()
+		versionStr, name, found := strings.Cut(strings.TrimSuffix(fileName, ".sql"), "_")
+		version, err := strconv.Atoi(versionStr)
+		if !found || err != nil {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+
+		stmt, err := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", fileName, err)
+		}
+
+		migrations = append(migrations, &Migration{
+			Version: version,
+			Name:    name,
+			stmt:    string(stmt),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("missing migration version %d", i+1)
+		}
+	}
+
+	return migrations, nil
+}
@@ -0,0 +1,32 @@
+-- Users, short URLs and short URL clicks. The unique indexes mirror the ones
+-- created by mongodb.Connect.
+CREATE TABLE users (
+	email TEXT PRIMARY KEY,
+	username TEXT NOT NULL,
+	password BYTEA NOT NULL,
+	timestamp BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX users_username_email_idx ON users (username, email);
+
+CREATE TABLE urls (
+	short_url TEXT NOT NULL,
+	owner_id TEXT NOT NULL,
+	original_url TEXT NOT NULL,
+	timestamp BIGINT NOT NULL,
+	clicks INTEGER NOT NULL DEFAULT 0,
+	disabled BOOLEAN NOT NULL DEFAULT FALSE,
+	is_guest BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE UNIQUE INDEX urls_short_url_idx ON urls (short_url);
+CREATE INDEX urls_owner_id_idx ON urls (owner_id);
+
+CREATE TABLE url_clicks (
+	id BIGSERIAL PRIMARY KEY,
+	short_url TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	browser TEXT NOT NULL,
+	device TEXT NOT NULL,
+	device_type TEXT NOT NULL,
+	timestamp BIGINT NOT NULL
+);
+CREATE INDEX url_clicks_short_url_timestamp_idx ON url_clicks (short_url, timestamp);
@@ -0,0 +1,2 @@
+-- Usernames must be unique on their own.
+CREATE UNIQUE INDEX users_username_idx ON users (username);
@@ -0,0 +1,4 @@
+-- Short URL expiry.
+ALTER TABLE urls ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE urls ADD COLUMN expired BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE INDEX urls_expires_at_idx ON urls (expires_at) WHERE expires_at > 0;
@@ -0,0 +1,2 @@
+-- Short URL passwords.
+ALTER TABLE urls ADD COLUMN password_hash BYTEA;
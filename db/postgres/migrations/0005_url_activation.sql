@@ -0,0 +1,4 @@
+-- Short URL click budget and active window.
+ALTER TABLE urls ADD COLUMN max_clicks INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE urls ADD COLUMN active_from BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE urls ADD COLUMN active_until BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- Click referrer and country for click statistics.
+ALTER TABLE url_clicks ADD COLUMN referrer TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_clicks ADD COLUMN country TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+-- Click referrer domain and UTM parameters.
+ALTER TABLE url_clicks ADD COLUMN referrer_domain TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_clicks ADD COLUMN utm_source TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_clicks ADD COLUMN utm_medium TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_clicks ADD COLUMN utm_campaign TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_clicks ADD COLUMN utm_term TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_clicks ADD COLUMN utm_content TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- Click region and city.
+ALTER TABLE url_clicks ADD COLUMN region TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_clicks ADD COLUMN city TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,11 @@
+-- Login sessions.
+CREATE TABLE sessions (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	refresh_token_hash BYTEA NOT NULL,
+	created_at BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	revoked_at BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX sessions_email_idx ON sessions (email);
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
@@ -0,0 +1,9 @@
+-- Identities of users at external identity providers.
+CREATE TABLE user_identities (
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	email TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	PRIMARY KEY (provider, subject)
+);
+CREATE INDEX user_identities_email_idx ON user_identities (email);
@@ -0,0 +1,11 @@
+-- Email verification and single-use user tokens.
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE user_tokens (
+	token_hash BYTEA PRIMARY KEY,
+	email TEXT NOT NULL,
+	purpose TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL
+);
+CREATE INDEX user_tokens_email_purpose_idx ON user_tokens (email, purpose);
+CREATE INDEX user_tokens_expires_at_idx ON user_tokens (expires_at);
@@ -0,0 +1,9 @@
+-- TOTP two-factor authentication and recovery codes.
+ALTER TABLE users ADD COLUMN totp_secret BYTEA;
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+CREATE TABLE recovery_codes (
+	email TEXT NOT NULL,
+	code_hash BYTEA NOT NULL,
+	PRIMARY KEY (email, code_hash)
+);
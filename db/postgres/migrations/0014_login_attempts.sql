@@ -0,0 +1,7 @@
+-- Failed login attempts and lockouts.
+CREATE TABLE login_attempts (
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	last_failure BIGINT NOT NULL,
+	locked_until BIGINT NOT NULL DEFAULT 0
+);
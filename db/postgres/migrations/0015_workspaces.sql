@@ -0,0 +1,26 @@
+-- Workspaces, their members and invitations.
+CREATE TABLE workspaces (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	created_at BIGINT NOT NULL
+);
+CREATE TABLE workspace_members (
+	workspace_id TEXT NOT NULL,
+	email TEXT NOT NULL,
+	role TEXT NOT NULL,
+	joined_at BIGINT NOT NULL,
+	PRIMARY KEY (workspace_id, email)
+);
+CREATE INDEX workspace_members_email_idx ON workspace_members (email);
+CREATE TABLE workspace_invitations (
+	id TEXT PRIMARY KEY,
+	workspace_id TEXT NOT NULL,
+	email TEXT NOT NULL,
+	role TEXT NOT NULL,
+	invited_by TEXT NOT NULL,
+	token_hash BYTEA NOT NULL UNIQUE,
+	created_at BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL
+);
+CREATE INDEX workspace_invitations_workspace_id_idx ON workspace_invitations (workspace_id);
+CREATE INDEX workspace_invitations_expires_at_idx ON workspace_invitations (expires_at);
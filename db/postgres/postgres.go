@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the "pgx" database/sql driver.
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/db/sqldb"
+)
+
+// PostgreSQL error codes. See:
+// https://www.postgresql.org/docs/current/errcodes-appendix.html.
+const (
+	codeUniqueViolation = "23505"
+	codeUndefinedTable  = "42P01"
+)
+
+// Config is the configuration for the PostgreSQL database.
+type Config struct {
+	// ConnectionURL is the URL used to connect to the database.
+	ConnectionURL string `long:"connectionurl" env:"POSTGRES_CONNECTION_URL" description:"PostgreSQL connection URL"`
+	// SkipMigrations prevents pending migrations from being applied on
+	// startup. They can be applied with the "migrate" command instead.
+	SkipMigrations bool `long:"skipmigrations" env:"POSTGRES_SKIP_MIGRATIONS" description:"Do not apply pending schema migrations on startup"`
+	// PasswordHasher hashes the passwords of users. db.DefaultPasswordHasher
+	// is used if it is nil.
+	PasswordHasher db.PasswordHasher `no-flag:"true"`
+}
+
+// PostgreSQL is the database handler for PostgreSQL. Implements db.DataStore.
+type PostgreSQL struct {
+	*sqldb.DB
+}
+
+// PostgreSQL implements the db.DataStore interface.
+var _ db.DataStore = (*PostgreSQL)(nil)
+
+// dialect describes the SQL of PostgreSQL.
+var dialect = &sqldb.Dialect{
+	Placeholder: func(n int) string {
+		return "$" + strconv.Itoa(n)
+	},
+	BlobType:   "BYTEA",
+	LockRows:   " FOR UPDATE",
+	ClickOrder: "id",
+	IsUniqueViolation: func(err error) bool {
+		return isPgError(err, codeUniqueViolation)
+	},
+}
+
+// Connect connects to the database, applies any pending schema migrations and
+// returns a new *PostgreSQL instance.
+func Connect(ctx context.Context, cfg Config) (*PostgreSQL, error) {
+	sqlDB, err := open(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cfg.SkipMigrations {
+		if _, err := migrate(ctx, sqlDB); err != nil {
+			sqlDB.Close()
+			return nil, err
+		}
+	}
+
+	return &PostgreSQL{sqldb.New(ctx, sqlDB, dialect, cfg.PasswordHasher)}, nil
+}
+
+// open opens and pings a connection pool to the database.
+func open(ctx context.Context, cfg Config) (*sql.DB, error) {
+	if cfg.ConnectionURL == "" {
+		return nil, fmt.Errorf("missing required configuration for PostgreSQL")
+	}
+
+	sqlDB, err := sql.Open("pgx", cfg.ConnectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := sqlDB.PingContext(ctx); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	return sqlDB, nil
+}
+
+// isPgError checks if err is a PostgreSQL error with the specified code.
+func isPgError(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
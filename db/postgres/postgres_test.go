@@ -0,0 +1,78 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/db/dbtest"
+)
+
+// tPostgreSQL drops its schema when closed.
+type tPostgreSQL struct {
+	*PostgreSQL
+	adminDB *sql.DB
+	schema  string
+}
+
+// Close ends the connection to the database and drops the test schema.
+func (p *tPostgreSQL) Close() error {
+	if err := p.PostgreSQL.Close(); err != nil {
+		return err
+	}
+	_, err := p.adminDB.Exec("DROP SCHEMA " + p.schema + " CASCADE")
+	return err
+}
+
+// TestPostgreSQL runs the db.DataStore conformance tests against the database
+// at POSTGRES_TEST_CONNECTION_URL. Each test case uses a new schema, so the
+// connection URL must be in URL format (postgres://...).
+func TestPostgreSQL(t *testing.T) {
+	connectionURL := os.Getenv("POSTGRES_TEST_CONNECTION_URL")
+	if connectionURL == "" {
+		t.Skip("POSTGRES_TEST_CONNECTION_URL is not set")
+	}
+
+	ctx := context.Background()
+	adminDB, err := open(ctx, Config{ConnectionURL: connectionURL})
+	if err != nil {
+		t.Fatalf("open error: %v", err)
+	}
+	defer adminDB.Close()
+
+	dbtest.Run(t, func(t *testing.T, hasher db.PasswordHasher) db.DataStore {
+		return tConnect(t, adminDB, connectionURL, hasher)
+	})
+}
+
+// tConnect creates a new schema and returns a *tPostgreSQL that uses it.
+func tConnect(t *testing.T, adminDB *sql.DB, connectionURL string, hasher db.PasswordHasher) *tPostgreSQL {
+	suffix, err := db.RandomString(4)
+	if err != nil {
+		t.Fatalf("db.RandomString error: %v", err)
+	}
+
+	schema := "bob_test_" + suffix
+	if _, err := adminDB.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+
+	u, err := url.Parse(connectionURL)
+	if err != nil {
+		t.Fatalf("url.Parse error: %v", err)
+	}
+
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+
+	p, err := Connect(context.Background(), Config{ConnectionURL: u.String(), PasswordHasher: hasher})
+	if err != nil {
+		t.Fatalf("Connect error: %v", err)
+	}
+
+	return &tPostgreSQL{PostgreSQL: p, adminDB: adminDB, schema: schema}
+}
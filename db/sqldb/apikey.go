@@ -0,0 +1,116 @@
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// apiKeyColumns are the columns scanned by scanAPIKey.
+const apiKeyColumns = "id, email, name, prefix, key_hash, scopes, created_at, last_used_at"
+
+// CreateAPIKey adds a new API key to the database. Implements db.DataStore.
+func (d *DB) CreateAPIKey(key *db.APIKey) error {
+	if key.ID == "" || key.Email == "" || len(key.KeyHash) == 0 {
+		return fmt.Errorf("%w: API key ID, email and hash are required", db.ErrorBadRequest)
+	}
+
+	_, err := d.exec("INSERT INTO api_keys ("+apiKeyColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		key.ID, key.Email, key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, ","), key.CreatedAt, key.LastUsedAt)
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return fmt.Errorf("%w: API key already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating API key: %w", err)
+	}
+
+	return nil
+}
+
+// RetrieveAPIKey fetches the API key with the specified hash. Implements
+// db.DataStore.
+func (d *DB) RetrieveAPIKey(keyHash []byte) (*db.APIKey, error) {
+	row := d.queryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", keyHash)
+	key, err := scanAPIKey(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: API key does not exist", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error retrieving API key: %w", err)
+	}
+
+	return key, nil
+}
+
+// RetrieveUserAPIKeys fetches the API keys of the user with the specified
+// email, oldest first. Implements db.DataStore.
+func (d *DB) RetrieveUserAPIKeys(email string) ([]*db.APIKey, error) {
+	rows, err := d.query("SELECT "+apiKeyColumns+" FROM api_keys WHERE email = ? ORDER BY created_at, id", email)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving API keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*db.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// DeleteAPIKey deletes the API key with the specified ID owned by the user
+// with the specified email. Implements db.DataStore.
+func (d *DB) DeleteAPIKey(email, id string) error {
+	res, err := d.exec("DELETE FROM api_keys WHERE id = ? AND email = ?", id, email)
+	if err != nil {
+		return fmt.Errorf("error deleting API key: %w", err)
+	}
+
+	return requireAPIKeyAffected(res)
+}
+
+// UpdateAPIKeyLastUsed sets the time the API key with the specified ID was
+// last used. Implements db.DataStore.
+func (d *DB) UpdateAPIKeyLastUsed(id string, timestamp int64) error {
+	res, err := d.exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", timestamp, id)
+	if err != nil {
+		return fmt.Errorf("error updating API key: %w", err)
+	}
+
+	return requireAPIKeyAffected(res)
+}
+
+// scanAPIKey scans a row of apiKeyColumns.
+func scanAPIKey(row rowScanner) (*db.APIKey, error) {
+	key := new(db.APIKey)
+	var scopes string
+	err := row.Scan(&key.ID, &key.Email, &key.Name, &key.Prefix, &key.KeyHash, &scopes, &key.CreatedAt, &key.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	return key, nil
+}
+
+// requireAPIKeyAffected returns db.ErrorNotFound if res affected no API key.
+func requireAPIKeyAffected(res sql.Result) error {
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error updating API key: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: API key does not exist", db.ErrorNotFound)
+	}
+	return nil
+}
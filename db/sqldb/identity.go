@@ -0,0 +1,116 @@
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// RetrieveIdentityUser fetches the user linked to the identity with the
+// specified subject at an external identity provider. Implements
+// db.DataStore.
+func (d *DB) RetrieveIdentityUser(provider, subject string) (*db.UserInfo, error) {
+	var email string
+	err := d.queryRow("SELECT email FROM user_identities WHERE provider = ? AND subject = ?", provider, subject).Scan(&email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: identity is not linked to a user", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error retrieving identity: %w", err)
+	}
+
+	userInfo, _, err := d.user(email)
+	if err != nil {
+		if errors.Is(err, db.ErrorBadRequest) {
+			return nil, fmt.Errorf("%w: identity is not linked to a user", db.ErrorNotFound)
+		}
+		return nil, err
+	}
+
+	return userInfo, nil
+}
+
+// CreateIdentityUser adds a new user with the email of identity and links
+// identity to it. Implements db.DataStore.
+func (d *DB) CreateIdentityUser(username string, identity *db.UserIdentity) error {
+	if username == "" || identity.Provider == "" || identity.Subject == "" {
+		return fmt.Errorf("%w: username, provider and subject are required", db.ErrorBadRequest)
+	}
+
+	if !db.IsValidEmail(identity.Email) {
+		return fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	}
+
+	tx, err := d.begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// An empty password hash never matches a password. The identity provider
+	// verified the email.
+	_, err = tx.exec("INSERT INTO users (email, username, password, timestamp, email_verified) VALUES (?, ?, ?, ?, TRUE)",
+		identity.Email, username, []byte{}, time.Now().Unix())
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return fmt.Errorf("%w: username or email already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating user: %w", err)
+	}
+
+	if err := d.insertIdentity(tx, identity); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LinkUserIdentity links identity to the existing user with the email of
+// identity. Implements db.DataStore.
+func (d *DB) LinkUserIdentity(identity *db.UserIdentity) error {
+	if identity.Provider == "" || identity.Subject == "" {
+		return fmt.Errorf("%w: provider and subject are required", db.ErrorBadRequest)
+	}
+
+	tx, err := d.begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The identity provider verified the email.
+	res, err := tx.exec("UPDATE users SET email_verified = TRUE WHERE email = ?", identity.Email)
+	if err != nil {
+		return fmt.Errorf("error verifying email: %w", err)
+	}
+
+	if err := requireUserAffected(res); err != nil {
+		return err
+	}
+
+	if err := d.insertIdentity(tx, identity); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertIdentity adds identity to the database within tx.
+func (d *DB) insertIdentity(tx *txn, identity *db.UserIdentity) error {
+	_, err := tx.exec("INSERT INTO user_identities (provider, subject, email, created_at) VALUES (?, ?, ?, ?)",
+		identity.Provider, identity.Subject, identity.Email, identity.CreatedAt)
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return fmt.Errorf("%w: identity is already linked", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error linking identity: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// RetrieveLoginAttempts fetches the failed login attempts recorded for key.
+// Implements db.DataStore.
+func (d *DB) RetrieveLoginAttempts(key string) (*db.LoginAttempts, error) {
+	attempts := new(db.LoginAttempts)
+	err := d.queryRow("SELECT failures, last_failure, locked_until FROM login_attempts WHERE key = ?", key).
+		Scan(&attempts.Failures, &attempts.LastFailure, &attempts.LockedUntil)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error retrieving login attempts: %w", err)
+	}
+
+	return attempts, nil
+}
+
+// RecordFailedLogin adds a failed login attempt to the attempts recorded for
+// key. Implements db.DataStore.
+func (d *DB) RecordFailedLogin(key string, timestamp int64) (*db.LoginAttempts, error) {
+	attempts := new(db.LoginAttempts)
+	err := d.queryRow(`INSERT INTO login_attempts (key, failures, last_failure) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET failures = login_attempts.failures + 1, last_failure = excluded.last_failure
+		RETURNING failures, last_failure, locked_until`, key, timestamp).
+		Scan(&attempts.Failures, &attempts.LastFailure, &attempts.LockedUntil)
+	if err != nil {
+		return nil, fmt.Errorf("error recording failed login: %w", err)
+	}
+
+	return attempts, nil
+}
+
+// LockLogin refuses logins for key until the specified unix timestamp.
+// Implements db.DataStore.
+func (d *DB) LockLogin(key string, until int64) error {
+	_, err := d.exec(`INSERT INTO login_attempts (key, failures, last_failure, locked_until) VALUES (?, 0, 0, ?)
+		ON CONFLICT (key) DO UPDATE SET locked_until = excluded.locked_until`, key, until)
+	if err != nil {
+		return fmt.Errorf("error locking login: %w", err)
+	}
+
+	return nil
+}
+
+// ClearLoginAttempts deletes the failed login attempts and lock of key.
+// Implements db.DataStore.
+func (d *DB) ClearLoginAttempts(key string) error {
+	if _, err := d.exec("DELETE FROM login_attempts WHERE key = ?", key); err != nil {
+		return fmt.Errorf("error clearing login attempts: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteStaleLoginAttempts deletes the login attempts whose last failure and
+// lock are before the specified unix timestamp. Implements db.DataStore.
+func (d *DB) DeleteStaleLoginAttempts(timestamp int64) (int64, error) {
+	res, err := d.exec("DELETE FROM login_attempts WHERE last_failure < ? AND locked_until < ?", timestamp, timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting stale login attempts: %w", err)
+	}
+
+	return res.RowsAffected()
+}
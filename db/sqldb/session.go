@@ -0,0 +1,113 @@
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// CreateSession adds a new login session to the database. Implements
+// db.DataStore.
+func (d *DB) CreateSession(session *db.Session) error {
+	if session.ID == "" || session.Email == "" {
+		return fmt.Errorf("%w: session ID and email are required", db.ErrorBadRequest)
+	}
+
+	_, err := d.exec(`INSERT INTO sessions (id, email, refresh_token_hash, created_at, expires_at, revoked_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, session.ID, session.Email, session.RefreshTokenHash, session.CreatedAt, session.ExpiresAt, session.RevokedAt)
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return fmt.Errorf("%w: session already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating session: %w", err)
+	}
+
+	return nil
+}
+
+// RetrieveSession fetches the session with the specified ID. Implements
+// db.DataStore.
+func (d *DB) RetrieveSession(id string) (*db.Session, error) {
+	session := new(db.Session)
+	err := d.queryRow(`SELECT id, email, refresh_token_hash, created_at, expires_at, revoked_at
+		FROM sessions WHERE id = ?`, id).
+		Scan(&session.ID, &session.Email, &session.RefreshTokenHash, &session.CreatedAt, &session.ExpiresAt, &session.RevokedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: session does not exist", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error retrieving session: %w", err)
+	}
+
+	return session, nil
+}
+
+// RotateSessionRefreshToken replaces the refresh token hash of the session
+// with the specified ID with newHash if it is active and its refresh token hash
+// is oldHash, and extends the session until expiresAt. Implements
+// db.DataStore.
+func (d *DB) RotateSessionRefreshToken(id string, oldHash, newHash []byte, expiresAt int64) error {
+	res, err := d.exec(`UPDATE sessions SET refresh_token_hash = ?, expires_at = ?
+		WHERE id = ? AND refresh_token_hash = ? AND revoked_at = 0 AND expires_at > ?`,
+		newHash, expiresAt, id, oldHash, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("error updating session: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error updating session: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: session does not exist or is not active", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// RevokeSession revokes the session with the specified ID. Implements
+// db.DataStore.
+func (d *DB) RevokeSession(id string) error {
+	res, err := d.exec("UPDATE sessions SET revoked_at = CASE WHEN revoked_at = 0 THEN ? ELSE revoked_at END WHERE id = ?",
+		time.Now().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("error revoking session: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error revoking session: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: session does not exist", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// RevokeUserSessions revokes all the active sessions of the user with the
+// specified email and returns the number of sessions that were revoked.
+// Implements db.DataStore.
+func (d *DB) RevokeUserSessions(email string) (int64, error) {
+	now := time.Now().Unix()
+	res, err := d.exec("UPDATE sessions SET revoked_at = ? WHERE email = ? AND revoked_at = 0 AND expires_at > ?",
+		now, email, now)
+	if err != nil {
+		return 0, fmt.Errorf("error revoking sessions: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteExpiredSessions deletes all sessions that expired before the
+// specified unix timestamp and returns the number of sessions that were
+// deleted. Implements db.DataStore.
+func (d *DB) DeleteExpiredSessions(timestamp int64) (int64, error) {
+	res, err := d.exec("DELETE FROM sessions WHERE expires_at < ?", timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired sessions: %w", err)
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,141 @@
+// Package sqldb implements db.DataStore with database/sql. It is shared by the
+// SQL backends, which open the connection, apply their schema migrations and
+// describe how their SQL differs with a Dialect.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// Dialect describes the SQL of a database. Queries are written with "?"
+// placeholders, TRUE and FALSE literals, ON CONFLICT upserts and RETURNING
+// clauses, which every supported database understands.
+type Dialect struct {
+	// Placeholder returns the placeholder of the nth argument of a query,
+	// starting from 1. "?" placeholders are kept if it is nil.
+	Placeholder func(n int) string
+	// BlobType is the type of binary columns, used to cast arguments whose
+	// type cannot be inferred.
+	BlobType string
+	// LockRows is appended to SELECT statements whose rows must stay locked
+	// until the transaction ends, e.g. " FOR UPDATE". It is empty for
+	// databases that allow a single writer at a time.
+	LockRows string
+	// ClickOrder is the column that orders the clicks of a short URL that
+	// have the same timestamp by insertion.
+	ClickOrder string
+	// IsUniqueViolation checks if err was caused by a unique or primary key
+	// constraint violation.
+	IsUniqueViolation func(err error) bool
+}
+
+// DB implements db.DataStore with a database/sql connection pool.
+type DB struct {
+	ctx     context.Context
+	db      *sql.DB
+	dialect *Dialect
+
+	// hasher hashes and verifies the passwords of users.
+	hasher db.PasswordHasher
+}
+
+// DB implements the db.DataStore interface.
+var _ db.DataStore = (*DB)(nil)
+
+// New returns a new *DB that uses sqlDB. The schema of the database must be
+// up to date. db.DefaultPasswordHasher is used if hasher is nil.
+func New(ctx context.Context, sqlDB *sql.DB, dialect *Dialect, hasher db.PasswordHasher) *DB {
+	if hasher == nil {
+		hasher = db.DefaultPasswordHasher()
+	}
+
+	return &DB{
+		ctx:     ctx,
+		db:      sqlDB,
+		dialect: dialect,
+		hasher:  hasher,
+	}
+}
+
+// Close ends the connection to the database. Implements db.DataStore.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// rebind replaces the "?" placeholders of query with the placeholders of the
+// dialect.
+func (d *DB) rebind(query string) string {
+	if d.dialect.Placeholder == nil {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for {
+		i := strings.IndexByte(query, '?')
+		if i < 0 {
+			b.WriteString(query)
+			return b.String()
+		}
+
+		n++
+		b.WriteString(query[:i])
+		b.WriteString(d.dialect.Placeholder(n))
+		query = query[i+1:]
+	}
+}
+
+// isUniqueViolation checks if err was caused by a unique or primary key
+// constraint violation.
+func (d *DB) isUniqueViolation(err error) bool {
+	return d.dialect.IsUniqueViolation(err)
+}
+
+// exec executes query without returning any rows.
+func (d *DB) exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.db.ExecContext(d.ctx, d.rebind(query), args...)
+}
+
+// query executes query and returns its rows.
+func (d *DB) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.db.QueryContext(d.ctx, d.rebind(query), args...)
+}
+
+// queryRow executes query and returns its first row.
+func (d *DB) queryRow(query string, args ...interface{}) *sql.Row {
+	return d.db.QueryRowContext(d.ctx, d.rebind(query), args...)
+}
+
+// txn is a transaction whose queries are written like the queries of DB.
+type txn struct {
+	*sql.Tx
+	d *DB
+}
+
+// begin starts a transaction.
+func (d *DB) begin() (*txn, error) {
+	tx, err := d.db.BeginTx(d.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &txn{Tx: tx, d: d}, nil
+}
+
+// exec executes query in the transaction without returning any rows.
+func (t *txn) exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.ExecContext(t.d.ctx, t.d.rebind(query), args...)
+}
+
+// query executes query in the transaction and returns its rows.
+func (t *txn) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.QueryContext(t.d.ctx, t.d.rebind(query), args...)
+}
+
+// queryRow executes query in the transaction and returns its first row.
+func (t *txn) queryRow(query string, args ...interface{}) *sql.Row {
+	return t.QueryRowContext(t.d.ctx, t.d.rebind(query), args...)
+}
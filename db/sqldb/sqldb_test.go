@@ -0,0 +1,23 @@
+package sqldb
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestDB_rebind(t *testing.T) {
+	query := "SELECT a FROM t WHERE b = ? AND c IN (?, ?)"
+
+	d := &DB{dialect: &Dialect{}}
+	if got := d.rebind(query); got != query {
+		t.Fatalf("expected %q to be kept, got %q", query, got)
+	}
+
+	d.dialect.Placeholder = func(n int) string {
+		return "$" + strconv.Itoa(n)
+	}
+	want := "SELECT a FROM t WHERE b = $1 AND c IN ($2, $3)"
+	if got := d.rebind(query); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,79 @@
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// CreateUserToken adds a new single-use user token to the database.
+// Implements db.DataStore.
+func (d *DB) CreateUserToken(token *db.UserToken) error {
+	if len(token.TokenHash) == 0 || token.Purpose == "" {
+		return fmt.Errorf("%w: token hash and purpose are required", db.ErrorBadRequest)
+	}
+
+	// The selected arguments are cast because their types are not inferred
+	// from the inserted columns.
+	res, err := d.exec(`INSERT INTO user_tokens (token_hash, email, purpose, created_at, expires_at)
+		SELECT CAST(? AS `+d.dialect.BlobType+`), CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS BIGINT), CAST(? AS BIGINT)
+		WHERE EXISTS (SELECT 1 FROM users WHERE email = ?)`,
+		token.TokenHash, token.Email, token.Purpose, token.CreatedAt, token.ExpiresAt, token.Email)
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return fmt.Errorf("%w: token already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating user token: %w", err)
+	}
+
+	return requireUserAffected(res)
+}
+
+// ConsumeUserToken deletes the token with the specified hash and purpose and
+// the other tokens of the user with the same purpose, and returns it.
+// Implements db.DataStore.
+func (d *DB) ConsumeUserToken(tokenHash []byte, purpose string, timestamp int64) (*db.UserToken, error) {
+	tx, err := d.begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	token := &db.UserToken{TokenHash: tokenHash, Purpose: purpose}
+	err = tx.queryRow(`DELETE FROM user_tokens WHERE token_hash = ? AND purpose = ? AND expires_at > ?
+		RETURNING email, created_at, expires_at`, tokenHash, purpose, timestamp).
+		Scan(&token.Email, &token.CreatedAt, &token.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: token does not exist or has expired", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error consuming user token: %w", err)
+	}
+
+	_, err = tx.exec("DELETE FROM user_tokens WHERE email = ? AND purpose = ?", token.Email, purpose)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting user tokens: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return token, nil
+}
+
+// DeleteExpiredUserTokens deletes all user tokens that expired before the
+// specified unix timestamp and returns the number of tokens that were deleted.
+// Implements db.DataStore.
+func (d *DB) DeleteExpiredUserTokens(timestamp int64) (int64, error) {
+	res, err := d.exec("DELETE FROM user_tokens WHERE expires_at < ?", timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired user tokens: %w", err)
+	}
+
+	return res.RowsAffected()
+}
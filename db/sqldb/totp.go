@@ -0,0 +1,165 @@
+package sqldb
+
+import (
+	"fmt"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// SetUserTOTPSecret saves a new TOTP secret for the user with the specified
+// email, replacing a secret that was not enabled. Implements db.DataStore.
+func (d *DB) SetUserTOTPSecret(email string, secret []byte) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("%w: secret is required", db.ErrorBadRequest)
+	}
+
+	res, err := d.exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE email = ? AND totp_enabled = FALSE",
+		secret, email)
+	if err != nil {
+		return fmt.Errorf("error saving TOTP secret: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking updated users: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: user does not exist or TOTP is enabled", db.ErrorBadRequest)
+	}
+
+	return nil
+}
+
+// RetrieveUserTOTP fetches the TOTP settings of the user with the specified
+// email. Implements db.DataStore.
+func (d *DB) RetrieveUserTOTP(email string) (*db.UserTOTP, error) {
+	totp := new(db.UserTOTP)
+	err := d.queryRow(`SELECT totp_secret, totp_enabled, totp_last_step,
+		(SELECT COUNT(*) FROM recovery_codes WHERE email = users.email) FROM users WHERE email = ?`, email).
+		Scan(&totp.Secret, &totp.Enabled, &totp.LastStep, &totp.RecoveryCodes)
+	if err != nil {
+		return nil, handleUserError(err)
+	}
+
+	if len(totp.Secret) == 0 {
+		return nil, fmt.Errorf("%w: TOTP is not set up", db.ErrorNotFound)
+	}
+
+	return totp, nil
+}
+
+// EnableUserTOTP enables TOTP two-factor authentication for the user with the
+// specified email and replaces the user's recovery codes. Implements
+// db.DataStore.
+func (d *DB) EnableUserTOTP(email string, recoveryCodeHashes [][]byte) error {
+	tx, err := d.begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.exec("UPDATE users SET totp_enabled = TRUE WHERE email = ? AND totp_secret IS NOT NULL", email)
+	if err != nil {
+		return fmt.Errorf("error enabling TOTP: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking updated users: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: user does not exist or has no TOTP secret", db.ErrorBadRequest)
+	}
+
+	if _, err := tx.exec("DELETE FROM recovery_codes WHERE email = ?", email); err != nil {
+		return fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.exec("INSERT INTO recovery_codes (email, code_hash) VALUES (?, ?)", email, hash); err != nil {
+			if d.isUniqueViolation(err) {
+				return fmt.Errorf("%w: duplicate recovery code", db.ErrorBadRequest)
+			}
+
+			return fmt.Errorf("error saving recovery code: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// UseUserTOTPStep records that a TOTP code of the specified time step was
+// used by the user with the specified email. Implements db.DataStore.
+func (d *DB) UseUserTOTPStep(email string, step int64) error {
+	res, err := d.exec("UPDATE users SET totp_last_step = ? WHERE email = ? AND totp_last_step < ?", step, email, step)
+	if err != nil {
+		return fmt.Errorf("error saving TOTP step: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking updated users: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: user does not exist or TOTP code was already used", db.ErrorBadRequest)
+	}
+
+	return nil
+}
+
+// ConsumeUserRecoveryCode deletes the recovery code with the specified hash of
+// the user with the specified email. Implements db.DataStore.
+func (d *DB) ConsumeUserRecoveryCode(email string, codeHash []byte) error {
+	res, err := d.exec("DELETE FROM recovery_codes WHERE email = ? AND code_hash = ?", email, codeHash)
+	if err != nil {
+		return fmt.Errorf("error consuming recovery code: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking deleted recovery codes: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: recovery code does not exist", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// DisableUserTOTP disables TOTP two-factor authentication for the user with
+// the specified email and deletes the TOTP secret and the recovery codes.
+// Implements db.DataStore.
+func (d *DB) DisableUserTOTP(email string) error {
+	tx, err := d.begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.exec("UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0 WHERE email = ?", email)
+	if err != nil {
+		return fmt.Errorf("error disabling TOTP: %w", err)
+	}
+
+	if err := requireUserAffected(res); err != nil {
+		return err
+	}
+
+	if _, err := tx.exec("DELETE FROM recovery_codes WHERE email = ?", email); err != nil {
+		return fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,578 @@
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// urlColumns are the columns selected for a db.ShortURLInfo. See scanURL.
+const urlColumns = "owner_id, short_url, original_url, timestamp, clicks, disabled, expires_at, expired, password_hash, max_clicks, active_from, active_until"
+
+// clickColumns are the columns selected for a db.ShortURLClick. See scanClick.
+const clickColumns = "ip, browser, device, device_type, timestamp, referrer, country, referrer_domain, utm_source, utm_medium, utm_campaign, utm_term, utm_content, region, city"
+
+const (
+	// clickInsertColumns is the number of columns inserted for a click, the
+	// short URL and clickColumns. See clickArgs.
+	clickInsertColumns = 16
+	// maxClicksPerInsert is the maximum number of clicks inserted by a single
+	// statement.
+	maxClicksPerInsert = 500
+)
+
+// CreateNewShortURL creates a new short URL. "userID" is the user's email if
+// they are logged in, otherwise it is the unique identifier for the guest user.
+// Implements db.DataStore.
+func (d *DB) CreateNewShortURL(userID, longURL, customShortURL string, isGuest bool, opts *db.ShortURLOptions) (*db.ShortURLInfo, error) {
+	if userID == "" || longURL == "" {
+		return nil, fmt.Errorf("%w: id and url are required", db.ErrorBadRequest)
+	}
+
+	if !isGuest && !db.IsValidEmail(userID) && !db.IsWorkspaceID(userID) {
+		return nil, fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	}
+
+	if isGuest {
+		// Check if they have reached the maximum number of URLs.
+		var count int
+		if err := d.queryRow("SELECT COUNT(*) FROM urls WHERE owner_id = ?", userID).Scan(&count); err != nil {
+			return nil, fmt.Errorf("error counting guest URLs: %w", err)
+		}
+
+		if count >= db.MaxGuestURLs {
+			return nil, fmt.Errorf("%w: maximum number of URLs reached", db.ErrorBadRequest)
+		}
+	} else if db.IsWorkspaceID(userID) {
+		if _, err := d.RetrieveWorkspace(userID); err != nil {
+			if errors.Is(err, db.ErrorNotFound) {
+				return nil, fmt.Errorf("%w: workspace does not exist", db.ErrorBadRequest)
+			}
+			return nil, err
+		}
+	} else if _, _, err := d.user(userID); err != nil { // Check if user exists.
+		return nil, err
+	}
+
+	now := time.Now()
+	var expiresAt int64
+	if opts != nil && opts.ExpiresAt != nil {
+		expiresAt = *opts.ExpiresAt
+	}
+	expired := expiresAt > 0 && expiresAt <= now.Unix()
+
+	passwordHash, err := opts.PasswordHash()
+	if err != nil {
+		return nil, err
+	}
+
+	var maxClicks int32
+	var activeFrom, activeUntil int64
+	if opts != nil {
+		if opts.MaxClicks != nil {
+			maxClicks = *opts.MaxClicks
+		}
+		if opts.ActiveFrom != nil {
+			activeFrom = *opts.ActiveFrom
+		}
+		if opts.ActiveUntil != nil {
+			activeUntil = *opts.ActiveUntil
+		}
+	}
+
+	insertURL := func(shortURL string) error {
+		_, err := d.exec("INSERT INTO urls (short_url, owner_id, original_url, timestamp, is_guest, expires_at, expired, password_hash, max_clicks, active_from, active_until) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			shortURL, userID, longURL, now.Unix(), isGuest, expiresAt, expired, passwordHash, maxClicks, activeFrom, activeUntil)
+		return err
+	}
+
+	customShortURL = strings.TrimSpace(customShortURL)
+	if customShortURL != "" {
+		if err := insertURL(customShortURL); err != nil {
+			if d.isUniqueViolation(err) {
+				return nil, fmt.Errorf("%w: custom short URL already exists", db.ErrorBadRequest)
+			}
+			return nil, fmt.Errorf("error saving URL: %w", err)
+		}
+
+		return d.RetrieveURLInfo(customShortURL)
+	}
+
+	// Check if an unexpired short URL for the long URL already exists for this
+	// user. Short URLs with settings are never reused and never returned.
+	if opts.IsZero() {
+		oldURLInfo, err := scanURL(d.queryRow("SELECT "+urlColumns+" FROM urls WHERE owner_id = ? AND original_url = ? AND NOT expired AND (expires_at = 0 OR expires_at > ?) AND NOT disabled AND (password_hash IS NULL OR length(password_hash) = 0) AND max_clicks = 0 AND active_from = 0 AND active_until = 0",
+			userID, longURL, now.Unix()))
+		if err == nil {
+			return oldURLInfo, nil
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("error retrieving URL info: %w", err)
+		}
+	}
+
+	// Create the short URL.
+	url := longURL
+	for maxTries := 5; maxTries > 0; maxTries-- {
+		shortURL := db.GenerateShortURL(url)
+		err := insertURL(shortURL)
+		if err == nil {
+			return d.RetrieveURLInfo(shortURL)
+		}
+
+		if !d.isUniqueViolation(err) {
+			return nil, fmt.Errorf("error saving URL: %w", err)
+		}
+
+		randomStr, err := db.RandomString(db.URLLength)
+		if err != nil {
+			return nil, fmt.Errorf("error generating random string: %w", err)
+		}
+
+		url = longURL + randomStr
+	}
+
+	return nil, errors.New("failed to save new URL")
+}
+
+// RetrieveURLInfo fetches information about a short URL using the shortened
+// URL. Implements db.DataStore.
+func (d *DB) RetrieveURLInfo(shortURL string) (*db.ShortURLInfo, error) {
+	if shortURL == "" {
+		return nil, fmt.Errorf("%w: short URL is empty", db.ErrorBadRequest)
+	}
+
+	urlInfo, err := scanURL(d.queryRow("SELECT "+urlColumns+" FROM urls WHERE short_url = ?", shortURL))
+	if err != nil {
+		return nil, handleURLError(err)
+	}
+
+	return urlInfo, nil
+}
+
+// RetrieveUserURLInfo fetches information about a short URL owned by the
+// specified user. Implements db.DataStore.
+func (d *DB) RetrieveUserURLInfo(ownerID, shortURL string) (*db.ShortURLInfo, error) {
+	if ownerID == "" || shortURL == "" {
+		return nil, fmt.Errorf("%w: owner ID and short URL are required", db.ErrorBadRequest)
+	}
+
+	urlInfo, err := scanURL(d.queryRow("SELECT "+urlColumns+" FROM urls WHERE short_url = ?", shortURL))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: short URL does not exist", db.ErrorNotFound)
+		}
+		return nil, fmt.Errorf("error retrieving URL info: %w", err)
+	}
+
+	if urlInfo.OwnerID != ownerID {
+		return nil, fmt.Errorf("%w: short URL belongs to another user", db.ErrorForbidden)
+	}
+
+	return urlInfo, nil
+}
+
+// RetrieveUserURLs fetches all the shorted URLs owned by the specified user
+// email or workspace ID. Implements db.DataStore.
+func (d *DB) RetrieveUserURLs(ownerID string) ([]*db.ShortURLInfo, error) {
+	rows, err := d.query("SELECT "+urlColumns+" FROM urls WHERE owner_id = ?", ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving user URLs: %w", err)
+	}
+	defer rows.Close()
+
+	var urls []*db.ShortURLInfo
+	for rows.Next() {
+		urlInfo, err := scanURL(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding user URL: %w", err)
+		}
+
+		urls = append(urls, urlInfo)
+	}
+
+	return urls, rows.Err()
+}
+
+// UpdateShortURL updates the information for the specified short URL. This
+// method is used for click update and link editing. Implements db.DataStore.
+func (d *DB) UpdateShortURL(shortURL, newLongURL string, click *db.ShortURLClick) error {
+	if shortURL == "" {
+		return fmt.Errorf("%w: short URL is empty", db.ErrorBadRequest)
+	}
+
+	if click == nil && newLongURL == "" {
+		return fmt.Errorf("%w: nothing to update", db.ErrorBadRequest)
+	}
+
+	tx, err := d.begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var res sql.Result
+	if click != nil {
+		// Only count the click if the short URL is active and has clicks
+		// left.
+		now := time.Now().Unix()
+		res, err = tx.exec("UPDATE urls SET clicks = clicks + 1 WHERE short_url = ? AND (max_clicks = 0 OR clicks < max_clicks) AND active_from <= ? AND (active_until = 0 OR active_until > ?)",
+			shortURL, now, now)
+	} else {
+		res, err = tx.exec("UPDATE urls SET original_url = ? WHERE short_url = ?", newLongURL, shortURL)
+	}
+	if err != nil {
+		return fmt.Errorf("error updating short URL: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error updating short URL: %w", err)
+	} else if n == 0 {
+		if click == nil {
+			return fmt.Errorf("%w: short URL does not exist", db.ErrorBadRequest)
+		}
+
+		var exists bool
+		if err := tx.queryRow("SELECT EXISTS (SELECT 1 FROM urls WHERE short_url = ?)", shortURL).Scan(&exists); err != nil {
+			return fmt.Errorf("error retrieving URL info: %w", err)
+		} else if !exists {
+			return fmt.Errorf("%w: short URL does not exist", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("%w: short URL is not active", db.ErrorInactive)
+	}
+
+	if click != nil {
+		if err := d.insertClicks(tx, shortURL, []*db.ShortURLClick{click}); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RecordShortURLClicks records a batch of clicks keyed by short URL and
+// increments the click count of each short URL by its number of clicks.
+// Implements db.DataStore.
+func (d *DB) RecordShortURLClicks(clicks map[string][]*db.ShortURLClick) error {
+	tx, err := d.begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for shortURL, urlClicks := range clicks {
+		if len(urlClicks) == 0 {
+			continue
+		}
+
+		res, err := tx.exec("UPDATE urls SET clicks = clicks + ? WHERE short_url = ?", len(urlClicks), shortURL)
+		if err != nil {
+			return fmt.Errorf("error updating short URL clicks: %w", err)
+		}
+
+		if n, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("error updating short URL clicks: %w", err)
+		} else if n == 0 {
+			continue // short URL no longer exists
+		}
+
+		if err := d.insertClicks(tx, shortURL, urlClicks); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpdateUserShortURL changes the original URL and/or the settings in opts of a
+// short URL owned by the specified user. Implements db.DataStore.
+func (d *DB) UpdateUserShortURL(ownerID, shortURL, newLongURL string, opts *db.ShortURLOptions) error {
+	if ownerID == "" || shortURL == "" {
+		return fmt.Errorf("%w: owner ID and short URL are required", db.ErrorBadRequest)
+	}
+
+	if newLongURL == "" && opts.IsZero() {
+		return fmt.Errorf("%w: nothing to update", db.ErrorBadRequest)
+	}
+
+	var columns []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		columns = append(columns, column+" = ?")
+	}
+
+	if newLongURL != "" {
+		set("original_url", newLongURL)
+	}
+
+	if opts != nil && opts.ExpiresAt != nil {
+		expiresAt := *opts.ExpiresAt
+		set("expires_at", expiresAt)
+		set("expired", expiresAt > 0 && expiresAt <= time.Now().Unix())
+	}
+
+	if opts != nil && opts.Password != nil {
+		passwordHash, err := opts.PasswordHash()
+		if err != nil {
+			return err
+		}
+		set("password_hash", passwordHash)
+	}
+
+	if opts != nil {
+		if opts.MaxClicks != nil {
+			set("max_clicks", *opts.MaxClicks)
+		}
+		if opts.ActiveFrom != nil {
+			set("active_from", *opts.ActiveFrom)
+		}
+		if opts.ActiveUntil != nil {
+			set("active_until", *opts.ActiveUntil)
+		}
+	}
+
+	return d.updateUserURL(ownerID, shortURL, strings.Join(columns, ", "), args...)
+}
+
+// RetrieveShortURLClicks returns a list of complete click information for a
+// short URL owned by the specified user. Implements db.DataStore.
+func (d *DB) RetrieveShortURLClicks(ownerID, shortURL string) ([]*db.ShortURLClick, error) {
+	// Confirm link exists and is owned by ownerID.
+	if _, err := d.RetrieveUserURLInfo(ownerID, shortURL); err != nil {
+		return nil, err
+	}
+
+	rows, err := d.query("SELECT "+clickColumns+" FROM url_clicks WHERE short_url = ? ORDER BY timestamp, "+d.dialect.ClickOrder, shortURL)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving link clicks: %w", err)
+	}
+	defer rows.Close()
+
+	var urlClicks []*db.ShortURLClick
+	for rows.Next() {
+		click, err := scanClick(rows)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan error: %w", err)
+		}
+		urlClicks = append(urlClicks, click)
+	}
+
+	return urlClicks, rows.Err()
+}
+
+// ToggleShortLinkStatus enables/disables a short link owned by the specified
+// user. Implements db.DataStore.
+func (d *DB) ToggleShortLinkStatus(ownerID, shortURL string, disable bool) error {
+	if ownerID == "" || shortURL == "" {
+		return fmt.Errorf("%w: owner ID and short URL are required", db.ErrorBadRequest)
+	}
+
+	return d.updateUserURL(ownerID, shortURL, "disabled = ?", disable)
+}
+
+// MarkExpiredShortURLs marks all short URLs whose expiry time has passed as
+// expired and returns the number of short URLs that were marked. Implements
+// db.DataStore.
+func (d *DB) MarkExpiredShortURLs() (int64, error) {
+	res, err := d.exec("UPDATE urls SET expired = TRUE WHERE NOT expired AND expires_at > 0 AND expires_at <= ?", time.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("error marking expired short URLs: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteShortURLClicksBefore deletes all short URL clicks recorded before the
+// specified unix timestamp and returns the number of clicks that were deleted.
+// Implements db.DataStore.
+func (d *DB) DeleteShortURLClicksBefore(timestamp int64) (int64, error) {
+	res, err := d.exec("DELETE FROM url_clicks WHERE timestamp < ?", timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting old clicks: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// RetrieveShortURLClickStats returns aggregated statistics about the clicks
+// on a short URL owned by the specified user within the time range [from, to).
+// Implements db.DataStore.
+func (d *DB) RetrieveShortURLClickStats(ownerID, shortURL string, from, to int64, interval db.StatsInterval) (*db.ShortURLClickStats, error) {
+	if err := db.ValidateStatsRange(from, to, interval); err != nil {
+		return nil, err
+	}
+
+	// Confirm link exists and is owned by ownerID.
+	if _, err := d.RetrieveUserURLInfo(ownerID, shortURL); err != nil {
+		return nil, err
+	}
+
+	counts := db.NewClickStatsCounts()
+	// See db.StatsInterval.Offset.
+	rows, err := d.query("SELECT timestamp - ((timestamp - ?) % ?) AS bucket, COUNT(*) FROM url_clicks WHERE short_url = ? AND timestamp >= ? AND timestamp < ? GROUP BY bucket",
+		interval.Offset(), interval.Seconds(), shortURL, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating link clicks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bucket, clicks int64
+		if err := rows.Scan(&bucket, &clicks); err != nil {
+			return nil, fmt.Errorf("rows.Scan error: %w", err)
+		}
+		counts.Buckets[bucket] += clicks
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error aggregating link clicks: %w", err)
+	}
+
+	breakdowns := []struct {
+		column string
+		counts map[string]int64
+	}{
+		{"browser", counts.Browsers},
+		{"device", counts.Devices},
+		{"device_type", counts.DeviceTypes},
+		{"referrer", counts.Referrers},
+		{"referrer_domain", counts.ReferrerDomains},
+		{"utm_source", counts.UTMSources},
+		{"utm_medium", counts.UTMMediums},
+		{"utm_campaign", counts.UTMCampaigns},
+		{"country", counts.Countries},
+	}
+
+	for _, b := range breakdowns {
+		if err := d.clickBreakdown(b.column, b.counts, shortURL, from, to); err != nil {
+			return nil, err
+		}
+	}
+
+	return counts.Stats(from, to, interval), nil
+}
+
+// clickBreakdown adds the number of clicks for every value of column within
+// the time range [from, to) to counts. column must not be user input.
+func (d *DB) clickBreakdown(column string, counts map[string]int64, shortURL string, from, to int64) error {
+	rows, err := d.query("SELECT "+column+", COUNT(*) FROM url_clicks WHERE short_url = ? AND timestamp >= ? AND timestamp < ? GROUP BY "+column,
+		shortURL, from, to)
+	if err != nil {
+		return fmt.Errorf("error aggregating link clicks by %s: %w", column, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value string
+		var clicks int64
+		if err := rows.Scan(&value, &clicks); err != nil {
+			return fmt.Errorf("rows.Scan error: %w", err)
+		}
+		counts[value] += clicks
+	}
+
+	return rows.Err()
+}
+
+// updateUserURL applies the set clause to a short URL owned by ownerID.
+// db.ErrorNotFound or db.ErrorForbidden is returned if no short URL was
+// updated.
+func (d *DB) updateUserURL(ownerID, shortURL, setClause string, args ...interface{}) error {
+	args = append(args, shortURL, ownerID)
+	res, err := d.exec("UPDATE urls SET "+setClause+" WHERE short_url = ? AND owner_id = ?", args...)
+	if err != nil {
+		return fmt.Errorf("error updating short URL: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error updating short URL: %w", err)
+	} else if n == 0 {
+		_, err = d.RetrieveUserURLInfo(ownerID, shortURL)
+		return err
+	}
+
+	return nil
+}
+
+// insertClicks inserts clicks on shortURL in batches of at most
+// maxClicksPerInsert rows.
+func (d *DB) insertClicks(tx *txn, shortURL string, clicks []*db.ShortURLClick) error {
+	row := "(" + strings.Repeat("?, ", clickInsertColumns-1) + "?)"
+	for len(clicks) > 0 {
+		n := len(clicks)
+		if n > maxClicksPerInsert {
+			n = maxClicksPerInsert
+		}
+
+		rows := make([]string, n)
+		args := make([]interface{}, 0, n*clickInsertColumns)
+		for i, click := range clicks[:n] {
+			rows[i] = row
+			args = append(args, clickArgs(shortURL, click)...)
+		}
+
+		if _, err := tx.exec("INSERT INTO url_clicks (short_url, "+clickColumns+") VALUES "+strings.Join(rows, ", "), args...); err != nil {
+			return fmt.Errorf("error inserting new clicks: %w", err)
+		}
+
+		clicks = clicks[n:]
+	}
+
+	return nil
+}
+
+// clickArgs returns the values inserted for a click on shortURL. See
+// clickColumns.
+func clickArgs(shortURL string, click *db.ShortURLClick) []interface{} {
+	return []interface{}{shortURL, click.IP, click.Browser, click.Device, click.DeviceType, click.Timestamp, click.Referrer, click.Country,
+		click.ReferrerDomain, click.UTMSource, click.UTMMedium, click.UTMCampaign, click.UTMTerm, click.UTMContent,
+		click.Region, click.City}
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanURL reads a db.ShortURLInfo selected with urlColumns from row.
+func scanURL(row rowScanner) (*db.ShortURLInfo, error) {
+	urlInfo := new(db.ShortURLInfo)
+	err := row.Scan(&urlInfo.OwnerID, &urlInfo.ShortURL, &urlInfo.OriginalURL, &urlInfo.Timestamp, &urlInfo.Clicks, &urlInfo.Disabled,
+		&urlInfo.ExpiresAt, &urlInfo.Expired, &urlInfo.PasswordHash, &urlInfo.MaxClicks, &urlInfo.ActiveFrom, &urlInfo.ActiveUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	urlInfo.PasswordProtected = len(urlInfo.PasswordHash) > 0
+
+	return urlInfo, nil
+}
+
+// scanClick reads a db.ShortURLClick selected with clickColumns from row.
+func scanClick(row rowScanner) (*db.ShortURLClick, error) {
+	click := new(db.ShortURLClick)
+	err := row.Scan(&click.IP, &click.Browser, &click.Device, &click.DeviceType, &click.Timestamp, &click.Referrer, &click.Country,
+		&click.ReferrerDomain, &click.UTMSource, &click.UTMMedium, &click.UTMCampaign, &click.UTMTerm, &click.UTMContent,
+		&click.Region, &click.City)
+	if err != nil {
+		return nil, err
+	}
+
+	return click, nil
+}
+
+// handleURLError handles errors that occur when retrieving URL information.
+func handleURLError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: URL does not exist", db.ErrorNotFound)
+	}
+
+	return fmt.Errorf("error retrieving URL info: %w", err)
+}
@@ -0,0 +1,309 @@
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// UsernameExists checks if a username exists in the database. Implements
+// db.DataStore.
+func (d *DB) UsernameExists(username string) (bool, error) {
+	var exists bool
+	err := d.queryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking username: %w", err)
+	}
+
+	return exists, nil
+}
+
+// CreateUser adds a new user to the database. The username must be unique and
+// email must be unique. The password is hashed before being stored. Implements
+// db.DataStore.
+func (d *DB) CreateUser(username, email string, password []byte) error {
+	if username == "" || email == "" || password == nil {
+		return fmt.Errorf("%w: username, email, and password are required", db.ErrorBadRequest)
+	}
+
+	if !db.IsValidEmail(email) {
+		return fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	}
+
+	hashedPassword, err := d.hasher.Hash(password)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+
+	_, err = d.exec("INSERT INTO users (email, username, password, timestamp) VALUES (?, ?, ?, ?)",
+		email, username, hashedPassword, time.Now().Unix())
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return fmt.Errorf("%w: username or email already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating user: %w", err)
+	}
+
+	return nil
+}
+
+// RetrieveUserInfo fetches information about a user using the email. Implements
+// db.DataStore.
+func (d *DB) RetrieveUserInfo(email string) (*db.UserInfo, error) {
+	if !db.IsValidEmail(email) {
+		return nil, fmt.Errorf("%w: a valid email is required", db.ErrorBadRequest)
+	}
+
+	userInfo, _, err := d.user(email)
+	if err != nil {
+		return nil, err
+	}
+
+	return userInfo, nil
+}
+
+// LoginUser logs a user in and returns a nil error if the user exists and the
+// password is correct. Implements db.DataStore.
+func (d *DB) LoginUser(email string, password []byte) (*db.UserInfo, error) {
+	if !db.IsValidEmail(email) {
+		return nil, fmt.Errorf("%w: a valid email is required", db.ErrorBadRequest)
+	}
+
+	if len(password) == 0 {
+		return nil, fmt.Errorf("%w: password is required", db.ErrorBadRequest)
+	}
+
+	userInfo, hashedPassword, err := d.user(email)
+	if err != nil {
+		if errors.Is(err, db.ErrorBadRequest) {
+			db.CompareDummyPassword(d.hasher, password)
+		}
+		return nil, err
+	}
+
+	ok, needsRehash := d.hasher.Verify(hashedPassword, password)
+	if !ok {
+		return nil, fmt.Errorf("%w: incorrect password", db.ErrorBadRequest)
+	}
+
+	// Hashes with outdated algorithms or parameters are replaced. The login
+	// does not fail if the hash cannot be replaced, it is tried again on the
+	// next login. The old hash is matched so that a password changed in the
+	// meantime is kept.
+	if needsRehash {
+		if newHash, err := d.hasher.Hash(password); err == nil {
+			_, _ = d.exec("UPDATE users SET password = ? WHERE email = ? AND password = ?", newHash, email, hashedPassword)
+		}
+	}
+
+	return userInfo, nil
+}
+
+// user fetches the information and hashed password of the user with the
+// specified email. The user's total links are also set.
+func (d *DB) user(email string) (*db.UserInfo, []byte, error) {
+	userInfo := new(db.UserInfo)
+	var hashedPassword []byte
+	err := d.queryRow(`SELECT username, email, timestamp, password, email_verified, totp_enabled,
+		(SELECT COUNT(*) FROM urls WHERE owner_id = users.email) FROM users WHERE email = ?`, email).
+		Scan(&userInfo.Username, &userInfo.Email, &userInfo.Timestamp, &hashedPassword, &userInfo.EmailVerified, &userInfo.TOTPEnabled, &userInfo.TotalLinks)
+	if err != nil {
+		return nil, nil, handleUserError(err)
+	}
+
+	userInfo.HasPassword = len(hashedPassword) > 0
+	return userInfo, hashedPassword, nil
+}
+
+// handleUserError handles errors that occur when retrieving a user.
+func handleUserError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	return fmt.Errorf("error retrieving user: %w", err)
+}
+
+// SetEmailVerified marks the email of the user with the specified email as
+// verified. Implements db.DataStore.
+func (d *DB) SetEmailVerified(email string) error {
+	res, err := d.exec("UPDATE users SET email_verified = TRUE WHERE email = ?", email)
+	if err != nil {
+		return fmt.Errorf("error verifying email: %w", err)
+	}
+
+	return requireUserAffected(res)
+}
+
+// ResetUserPassword replaces the password of the user with the specified
+// email. The password is hashed before being stored. Implements db.DataStore.
+func (d *DB) ResetUserPassword(email string, password []byte) error {
+	if len(password) == 0 {
+		return fmt.Errorf("%w: password is required", db.ErrorBadRequest)
+	}
+
+	hashedPassword, err := d.hasher.Hash(password)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+
+	res, err := d.exec("UPDATE users SET password = ? WHERE email = ?", hashedPassword, email)
+	if err != nil {
+		return fmt.Errorf("error resetting password: %w", err)
+	}
+
+	return requireUserAffected(res)
+}
+
+// UpdateUsername changes the username of the user with the specified email.
+// Implements db.DataStore.
+func (d *DB) UpdateUsername(email, username string) error {
+	if username == "" {
+		return fmt.Errorf("%w: username is required", db.ErrorBadRequest)
+	}
+
+	res, err := d.exec("UPDATE users SET username = ? WHERE email = ?", username, email)
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return fmt.Errorf("%w: username already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error updating username: %w", err)
+	}
+
+	return requireUserAffected(res)
+}
+
+// ChangeUserEmail changes the email of the user with the specified email to
+// newEmail and moves the user's short URLs, sessions, API keys, identities and
+// workspace memberships to it. Implements db.DataStore.
+func (d *DB) ChangeUserEmail(email, newEmail string) error {
+	if !db.IsValidEmail(newEmail) {
+		return fmt.Errorf("%w: invalid email", db.ErrorBadRequest)
+	}
+
+	tx, err := d.begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.exec("UPDATE users SET email = ?, email_verified = FALSE WHERE email = ?", newEmail, email)
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return fmt.Errorf("%w: email already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error changing email: %w", err)
+	}
+
+	if err := requireUserAffected(res); err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		"UPDATE urls SET owner_id = ? WHERE owner_id = ?",
+		"UPDATE sessions SET email = ? WHERE email = ?",
+		"UPDATE api_keys SET email = ? WHERE email = ?",
+		"UPDATE user_identities SET email = ? WHERE email = ?",
+		"UPDATE recovery_codes SET email = ? WHERE email = ?",
+		"UPDATE workspace_members SET email = ? WHERE email = ?",
+	} {
+		if _, err := tx.exec(query, newEmail, email); err != nil {
+			return fmt.Errorf("error changing email: %w", err)
+		}
+	}
+
+	// Tokens sent to the old email must not be used for the new one.
+	if _, err := tx.exec("DELETE FROM user_tokens WHERE email = ?", email); err != nil {
+		return fmt.Errorf("error deleting user tokens: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteUser deletes the user with the specified email together with the
+// user's short URLs and their clicks, sessions, API keys, identities, user
+// tokens and workspace memberships, and returns the deleted short URLs.
+// Implements db.DataStore.
+func (d *DB) DeleteUser(email string) ([]string, error) {
+	tx, err := d.begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.exec("DELETE FROM users WHERE email = ?", email)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting user: %w", err)
+	}
+
+	if err := requireUserAffected(res); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.exec("DELETE FROM url_clicks WHERE short_url IN (SELECT short_url FROM urls WHERE owner_id = ?)", email)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting clicks: %w", err)
+	}
+
+	rows, err := tx.query("DELETE FROM urls WHERE owner_id = ? RETURNING short_url", email)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting short URLs: %w", err)
+	}
+	defer rows.Close()
+
+	var shortURLs []string
+	for rows.Next() {
+		var shortURL string
+		if err := rows.Scan(&shortURL); err != nil {
+			return nil, fmt.Errorf("error scanning short URL: %w", err)
+		}
+		shortURLs = append(shortURLs, shortURL)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error deleting short URLs: %w", err)
+	}
+	rows.Close()
+
+	for _, query := range []string{
+		"DELETE FROM sessions WHERE email = ?",
+		"DELETE FROM api_keys WHERE email = ?",
+		"DELETE FROM user_identities WHERE email = ?",
+		"DELETE FROM user_tokens WHERE email = ?",
+		"DELETE FROM recovery_codes WHERE email = ?",
+		"DELETE FROM workspace_members WHERE email = ?",
+	} {
+		if _, err := tx.exec(query, email); err != nil {
+			return nil, fmt.Errorf("error deleting user data: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return shortURLs, nil
+}
+
+// requireUserAffected returns an error if no user was affected by res.
+func requireUserAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking updated users: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: user does not exist", db.ErrorBadRequest)
+	}
+
+	return nil
+}
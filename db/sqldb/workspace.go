@@ -0,0 +1,445 @@
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// workspaceInvitationColumns are the columns scanned by
+// scanWorkspaceInvitation.
+const workspaceInvitationColumns = "id, workspace_id, email, role, invited_by, token_hash, created_at, expires_at"
+
+// CreateWorkspace adds a new workspace to the database with the user with the
+// specified email as its owner. Implements db.DataStore.
+func (d *DB) CreateWorkspace(workspace *db.Workspace, ownerEmail string) error {
+	if !db.IsWorkspaceID(workspace.ID) || workspace.Name == "" {
+		return fmt.Errorf("%w: workspace ID and name are required", db.ErrorBadRequest)
+	}
+
+	tx, err := d.begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.exec("INSERT INTO workspaces (id, name, created_at) VALUES (?, ?, ?)",
+		workspace.ID, workspace.Name, workspace.CreatedAt)
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return fmt.Errorf("%w: workspace already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating workspace: %w", err)
+	}
+
+	res, err := tx.exec(`INSERT INTO workspace_members (workspace_id, email, role, joined_at)
+		SELECT CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS BIGINT)
+		WHERE EXISTS (SELECT 1 FROM users WHERE email = ?)`,
+		workspace.ID, ownerEmail, db.WorkspaceRoleOwner, workspace.CreatedAt, ownerEmail)
+	if err != nil {
+		return fmt.Errorf("error adding workspace owner: %w", err)
+	}
+
+	if err := requireUserAffected(res); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// RetrieveWorkspace fetches the workspace with the specified ID. Implements
+// db.DataStore.
+func (d *DB) RetrieveWorkspace(id string) (*db.Workspace, error) {
+	workspace := new(db.Workspace)
+	err := d.queryRow("SELECT id, name, created_at FROM workspaces WHERE id = ?", id).
+		Scan(&workspace.ID, &workspace.Name, &workspace.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: workspace does not exist", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error retrieving workspace: %w", err)
+	}
+
+	return workspace, nil
+}
+
+// RetrieveUserWorkspaces fetches the workspaces the user with the specified
+// email is a member of, oldest first, with the role of the user. Implements
+// db.DataStore.
+func (d *DB) RetrieveUserWorkspaces(email string) ([]*db.Workspace, error) {
+	rows, err := d.query(`SELECT w.id, w.name, w.created_at, m.role FROM workspace_members m
+		JOIN workspaces w ON w.id = m.workspace_id WHERE m.email = ? ORDER BY w.created_at, w.id`, email)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving workspaces: %w", err)
+	}
+	defer rows.Close()
+
+	var workspaces []*db.Workspace
+	for rows.Next() {
+		workspace := new(db.Workspace)
+		if err := rows.Scan(&workspace.ID, &workspace.Name, &workspace.CreatedAt, &workspace.Role); err != nil {
+			return nil, fmt.Errorf("error reading workspace: %w", err)
+		}
+		workspaces = append(workspaces, workspace)
+	}
+
+	return workspaces, rows.Err()
+}
+
+// DeleteWorkspace deletes the workspace with the specified ID together with
+// its members, invitations, short URLs and their clicks, and returns the
+// deleted short URLs. Implements db.DataStore.
+func (d *DB) DeleteWorkspace(id string) ([]string, error) {
+	tx, err := d.begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.exec("DELETE FROM workspaces WHERE id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting workspace: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, fmt.Errorf("error deleting workspace: %w", err)
+	} else if n == 0 {
+		return nil, fmt.Errorf("%w: workspace does not exist", db.ErrorNotFound)
+	}
+
+	_, err = tx.exec("DELETE FROM url_clicks WHERE short_url IN (SELECT short_url FROM urls WHERE owner_id = ?)", id)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting clicks: %w", err)
+	}
+
+	rows, err := tx.query("DELETE FROM urls WHERE owner_id = ? RETURNING short_url", id)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting short URLs: %w", err)
+	}
+	defer rows.Close()
+
+	var shortURLs []string
+	for rows.Next() {
+		var shortURL string
+		if err := rows.Scan(&shortURL); err != nil {
+			return nil, fmt.Errorf("error scanning short URL: %w", err)
+		}
+		shortURLs = append(shortURLs, shortURL)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error deleting short URLs: %w", err)
+	}
+	rows.Close()
+
+	for _, query := range []string{
+		"DELETE FROM workspace_members WHERE workspace_id = ?",
+		"DELETE FROM workspace_invitations WHERE workspace_id = ?",
+	} {
+		if _, err := tx.exec(query, id); err != nil {
+			return nil, fmt.Errorf("error deleting workspace data: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return shortURLs, nil
+}
+
+// RetrieveWorkspaceMember fetches the membership of the user with the
+// specified email in the workspace with the specified ID. Implements
+// db.DataStore.
+func (d *DB) RetrieveWorkspaceMember(workspaceID, email string) (*db.WorkspaceMember, error) {
+	row := d.queryRow("SELECT workspace_id, email, role, joined_at FROM workspace_members WHERE workspace_id = ? AND email = ?", workspaceID, email)
+	member, err := scanWorkspaceMember(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: user is not a member of the workspace", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error retrieving workspace member: %w", err)
+	}
+
+	return member, nil
+}
+
+// RetrieveWorkspaceMembers fetches the members of the workspace with the
+// specified ID, oldest first. Implements db.DataStore.
+func (d *DB) RetrieveWorkspaceMembers(workspaceID string) ([]*db.WorkspaceMember, error) {
+	rows, err := d.query("SELECT workspace_id, email, role, joined_at FROM workspace_members WHERE workspace_id = ? ORDER BY joined_at, email", workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving workspace members: %w", err)
+	}
+	defer rows.Close()
+
+	var members []*db.WorkspaceMember
+	for rows.Next() {
+		member, err := scanWorkspaceMember(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading workspace member: %w", err)
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// UpdateWorkspaceMemberRole changes the role of the user with the specified
+// email in the workspace with the specified ID. Implements db.DataStore.
+func (d *DB) UpdateWorkspaceMemberRole(workspaceID, email, role string) error {
+	if !db.IsValidWorkspaceRole(role) {
+		return fmt.Errorf("%w: invalid workspace role", db.ErrorBadRequest)
+	}
+
+	tx, err := d.begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if role != db.WorkspaceRoleOwner {
+		if err := d.requireOtherWorkspaceOwner(tx, workspaceID, email); err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.exec("UPDATE workspace_members SET role = ? WHERE workspace_id = ? AND email = ?", role, workspaceID, email)
+	if err != nil {
+		return fmt.Errorf("error updating workspace member: %w", err)
+	}
+
+	if err := requireWorkspaceMemberAffected(res); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveWorkspaceMember removes the user with the specified email from the
+// workspace with the specified ID. Implements db.DataStore.
+func (d *DB) RemoveWorkspaceMember(workspaceID, email string) error {
+	tx, err := d.begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := d.requireOtherWorkspaceOwner(tx, workspaceID, email); err != nil {
+		return err
+	}
+
+	res, err := tx.exec("DELETE FROM workspace_members WHERE workspace_id = ? AND email = ?", workspaceID, email)
+	if err != nil {
+		return fmt.Errorf("error removing workspace member: %w", err)
+	}
+
+	if err := requireWorkspaceMemberAffected(res); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// requireOtherWorkspaceOwner returns db.ErrorBadRequest if the user with the
+// specified email is the only owner of the workspace with the specified ID.
+// The owners are locked until tx ends so that concurrent changes cannot leave
+// the workspace without an owner.
+func (d *DB) requireOtherWorkspaceOwner(tx *txn, workspaceID, email string) error {
+	rows, err := tx.query("SELECT email FROM workspace_members WHERE workspace_id = ? AND role = ?"+d.dialect.LockRows,
+		workspaceID, db.WorkspaceRoleOwner)
+	if err != nil {
+		return fmt.Errorf("error checking workspace owners: %w", err)
+	}
+	defer rows.Close()
+
+	var isOwner, hasOtherOwner bool
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return fmt.Errorf("error checking workspace owners: %w", err)
+		}
+		isOwner = isOwner || owner == email
+		hasOtherOwner = hasOtherOwner || owner != email
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error checking workspace owners: %w", err)
+	}
+
+	if isOwner && !hasOtherOwner {
+		return fmt.Errorf("%w: a workspace must have an owner", db.ErrorBadRequest)
+	}
+	return nil
+}
+
+// CreateWorkspaceInvitation adds a new invitation to join a workspace to the
+// database. Implements db.DataStore.
+func (d *DB) CreateWorkspaceInvitation(invitation *db.WorkspaceInvitation) error {
+	if invitation.ID == "" || len(invitation.TokenHash) == 0 || !db.IsValidWorkspaceRole(invitation.Role) {
+		return fmt.Errorf("%w: invitation ID, token hash and role are required", db.ErrorBadRequest)
+	}
+
+	res, err := d.exec("INSERT INTO workspace_invitations ("+workspaceInvitationColumns+`)
+		SELECT CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS TEXT),
+			CAST(? AS `+d.dialect.BlobType+`), CAST(? AS BIGINT), CAST(? AS BIGINT)
+		WHERE EXISTS (SELECT 1 FROM workspaces WHERE id = ?)`,
+		invitation.ID, invitation.WorkspaceID, invitation.Email, invitation.Role, invitation.InvitedBy, invitation.TokenHash,
+		invitation.CreatedAt, invitation.ExpiresAt, invitation.WorkspaceID)
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return fmt.Errorf("%w: invitation already exists", db.ErrorBadRequest)
+		}
+
+		return fmt.Errorf("error creating invitation: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error creating invitation: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: workspace does not exist", db.ErrorBadRequest)
+	}
+
+	return nil
+}
+
+// RetrieveWorkspaceInvitations fetches the invitations of the workspace with
+// the specified ID that have not been accepted, oldest first. Implements
+// db.DataStore.
+func (d *DB) RetrieveWorkspaceInvitations(workspaceID string) ([]*db.WorkspaceInvitation, error) {
+	rows, err := d.query("SELECT "+workspaceInvitationColumns+" FROM workspace_invitations WHERE workspace_id = ? ORDER BY created_at, id", workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving invitations: %w", err)
+	}
+	defer rows.Close()
+
+	var invitations []*db.WorkspaceInvitation
+	for rows.Next() {
+		invitation, err := scanWorkspaceInvitation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading invitation: %w", err)
+		}
+		invitations = append(invitations, invitation)
+	}
+
+	return invitations, rows.Err()
+}
+
+// DeleteWorkspaceInvitation deletes the invitation with the specified ID of
+// the workspace with the specified ID. Implements db.DataStore.
+func (d *DB) DeleteWorkspaceInvitation(workspaceID, id string) error {
+	res, err := d.exec("DELETE FROM workspace_invitations WHERE id = ? AND workspace_id = ?", id, workspaceID)
+	if err != nil {
+		return fmt.Errorf("error deleting invitation: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error deleting invitation: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: invitation does not exist", db.ErrorNotFound)
+	}
+
+	return nil
+}
+
+// AcceptWorkspaceInvitation deletes the invitation with the specified token
+// hash sent to the specified email and adds the user with that email to the
+// workspace with the role of the invitation. Implements db.DataStore.
+func (d *DB) AcceptWorkspaceInvitation(tokenHash []byte, email string, timestamp int64) (*db.WorkspaceMember, error) {
+	tx, err := d.begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	member := &db.WorkspaceMember{Email: email, JoinedAt: timestamp}
+	err = tx.queryRow(`DELETE FROM workspace_invitations WHERE token_hash = ? AND email = ? AND expires_at > ?
+		RETURNING workspace_id, role`, tokenHash, email, timestamp).Scan(&member.WorkspaceID, &member.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: invitation does not exist or has expired", db.ErrorNotFound)
+		}
+
+		return nil, fmt.Errorf("error accepting invitation: %w", err)
+	}
+
+	res, err := tx.exec(`INSERT INTO workspace_members (workspace_id, email, role, joined_at)
+		SELECT CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS BIGINT)
+		WHERE EXISTS (SELECT 1 FROM users WHERE email = ?)`,
+		member.WorkspaceID, member.Email, member.Role, member.JoinedAt, email)
+	if err != nil {
+		if d.isUniqueViolation(err) {
+			return nil, fmt.Errorf("%w: user is already a member of the workspace", db.ErrorBadRequest)
+		}
+
+		return nil, fmt.Errorf("error adding workspace member: %w", err)
+	}
+
+	if err := requireUserAffected(res); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return member, nil
+}
+
+// DeleteExpiredWorkspaceInvitations deletes all workspace invitations that
+// expired before the specified unix timestamp and returns the number of
+// invitations that were deleted. Implements db.DataStore.
+func (d *DB) DeleteExpiredWorkspaceInvitations(timestamp int64) (int64, error) {
+	res, err := d.exec("DELETE FROM workspace_invitations WHERE expires_at < ?", timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired invitations: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// scanWorkspaceMember scans a row of workspace_id, email, role and joined_at.
+func scanWorkspaceMember(row rowScanner) (*db.WorkspaceMember, error) {
+	member := new(db.WorkspaceMember)
+	if err := row.Scan(&member.WorkspaceID, &member.Email, &member.Role, &member.JoinedAt); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// scanWorkspaceInvitation scans a row of workspaceInvitationColumns.
+func scanWorkspaceInvitation(row rowScanner) (*db.WorkspaceInvitation, error) {
+	invitation := new(db.WorkspaceInvitation)
+	err := row.Scan(&invitation.ID, &invitation.WorkspaceID, &invitation.Email, &invitation.Role,
+		&invitation.InvitedBy, &invitation.TokenHash, &invitation.CreatedAt, &invitation.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// requireWorkspaceMemberAffected returns db.ErrorNotFound if res affected no
+// workspace member.
+func requireWorkspaceMemberAffected(res sql.Result) error {
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error updating workspace member: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: user is not a member of the workspace", db.ErrorNotFound)
+	}
+	return nil
+}
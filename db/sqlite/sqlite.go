@@ -0,0 +1,274 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/db/sqldb"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// migrations are the statements used to create and upgrade the database
+// schema. They are applied in order and the index of the last applied
+// migration (+1) is saved as the database's user_version. Existing entries
+// must never be modified, new schema changes must be appended.
+var migrations = []string{
+	// 1: users, urls and url_clicks tables. The unique indexes mirror the ones
+	// created by mongodb.Connect.
+	`CREATE TABLE users (
+		email TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		password BLOB NOT NULL,
+		timestamp INTEGER NOT NULL
+	);
+	CREATE UNIQUE INDEX users_username_email_idx ON users (username, email);
+
+	CREATE TABLE urls (
+		short_url TEXT NOT NULL,
+		owner_id TEXT NOT NULL,
+		original_url TEXT NOT NULL,
+		timestamp INTEGER NOT NULL,
+		clicks INTEGER NOT NULL DEFAULT 0,
+		disabled INTEGER NOT NULL DEFAULT 0,
+		is_guest INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE UNIQUE INDEX urls_short_url_idx ON urls (short_url);
+	CREATE INDEX urls_owner_id_idx ON urls (owner_id);
+
+	CREATE TABLE url_clicks (
+		short_url TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		browser TEXT NOT NULL,
+		device TEXT NOT NULL,
+		device_type TEXT NOT NULL,
+		timestamp INTEGER NOT NULL
+	);
+	CREATE INDEX url_clicks_short_url_idx ON url_clicks (short_url);`,
+	// 2: usernames must be unique on their own.
+	`CREATE UNIQUE INDEX users_username_idx ON users (username);`,
+	// 3: short URL expiry.
+	`ALTER TABLE urls ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE urls ADD COLUMN expired INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX urls_expires_at_idx ON urls (expires_at) WHERE expires_at > 0;`,
+	// 4: short URL passwords.
+	`ALTER TABLE urls ADD COLUMN password_hash BLOB;`,
+	// 5: short URL click budget and active window.
+	`ALTER TABLE urls ADD COLUMN max_clicks INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE urls ADD COLUMN active_from INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE urls ADD COLUMN active_until INTEGER NOT NULL DEFAULT 0;`,
+	// 6: click referrer and country for click statistics.
+	`ALTER TABLE url_clicks ADD COLUMN referrer TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_clicks ADD COLUMN country TEXT NOT NULL DEFAULT '';
+	CREATE INDEX url_clicks_short_url_timestamp_idx ON url_clicks (short_url, timestamp);
+	DROP INDEX url_clicks_short_url_idx;`,
+	// 7: click referrer domain and UTM parameters.
+	`ALTER TABLE url_clicks ADD COLUMN referrer_domain TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_clicks ADD COLUMN utm_source TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_clicks ADD COLUMN utm_medium TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_clicks ADD COLUMN utm_campaign TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_clicks ADD COLUMN utm_term TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_clicks ADD COLUMN utm_content TEXT NOT NULL DEFAULT '';`,
+	// 8: click region and city.
+	`ALTER TABLE url_clicks ADD COLUMN region TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_clicks ADD COLUMN city TEXT NOT NULL DEFAULT '';`,
+	// 9: login sessions.
+	`CREATE TABLE sessions (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		refresh_token_hash BLOB NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		revoked_at INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX sessions_email_idx ON sessions (email);
+	CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);`,
+	// 10: personal API keys. Scopes are stored comma separated.
+	`CREATE TABLE api_keys (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash BLOB NOT NULL,
+		scopes TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE UNIQUE INDEX api_keys_key_hash_idx ON api_keys (key_hash);
+	CREATE INDEX api_keys_email_idx ON api_keys (email);`,
+	// 11: identities of users at external identity providers.
+	`CREATE TABLE user_identities (
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		email TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (provider, subject)
+	);
+	CREATE INDEX user_identities_email_idx ON user_identities (email);`,
+	// 12: email verification and single-use user tokens.
+	`ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE user_tokens (
+		token_hash BLOB PRIMARY KEY,
+		email TEXT NOT NULL,
+		purpose TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX user_tokens_email_purpose_idx ON user_tokens (email, purpose);
+	CREATE INDEX user_tokens_expires_at_idx ON user_tokens (expires_at);`,
+	// 13: TOTP two-factor authentication and recovery codes.
+	`ALTER TABLE users ADD COLUMN totp_secret BLOB;
+	ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE recovery_codes (
+		email TEXT NOT NULL,
+		code_hash BLOB NOT NULL,
+		PRIMARY KEY (email, code_hash)
+	);`,
+	// 14: failed login attempts and lockouts.
+	`CREATE TABLE login_attempts (
+		key TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL,
+		last_failure INTEGER NOT NULL,
+		locked_until INTEGER NOT NULL DEFAULT 0
+	);`,
+	// 15: workspaces, their members and invitations.
+	`CREATE TABLE workspaces (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE workspace_members (
+		workspace_id TEXT NOT NULL,
+		email TEXT NOT NULL,
+		role TEXT NOT NULL,
+		joined_at INTEGER NOT NULL,
+		PRIMARY KEY (workspace_id, email)
+	);
+	CREATE INDEX workspace_members_email_idx ON workspace_members (email);
+	CREATE TABLE workspace_invitations (
+		id TEXT PRIMARY KEY,
+		workspace_id TEXT NOT NULL,
+		email TEXT NOT NULL,
+		role TEXT NOT NULL,
+		invited_by TEXT NOT NULL,
+		token_hash BLOB NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX workspace_invitations_workspace_id_idx ON workspace_invitations (workspace_id);
+	CREATE INDEX workspace_invitations_expires_at_idx ON workspace_invitations (expires_at);`,
+}
+
+// Config is the configuration for the SQLite database.
+type Config struct {
+	// Path is the path to the database file. The file is created if it does
+	// not exist.
+	Path string `long:"path" env:"SQLITE_PATH" description:"SQLite database file path"`
+	// PasswordHasher hashes the passwords of users. db.DefaultPasswordHasher
+	// is used if it is nil.
+	PasswordHasher db.PasswordHasher `no-flag:"true"`
+}
+
+// SQLite is the database handler for SQLite. Implements db.DataStore.
+type SQLite struct {
+	*sqldb.DB
+}
+
+// SQLite implements the db.DataStore interface.
+var _ db.DataStore = (*SQLite)(nil)
+
+// dialect describes the SQL of SQLite. SQLite allows a single writer at a
+// time, so rows do not need to be locked.
+var dialect = &sqldb.Dialect{
+	BlobType:          "BLOB",
+	ClickOrder:        "rowid",
+	IsUniqueViolation: isUniqueConstraintError,
+}
+
+// Connect opens the database file, applies any pending schema migrations and
+// returns a new *SQLite instance.
+func Connect(ctx context.Context, cfg Config) (*SQLite, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("missing required configuration for SQLite")
+	}
+
+	params := url.Values{}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	// The path is escaped so that characters like "?" and "#" in it are not
+	// read as part of the URI.
+	dsn := &url.URL{Scheme: "file", Opaque: (&url.URL{Path: cfg.Path}).EscapedPath(), RawQuery: params.Encode()}
+	sqlDB, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// SQLite allows a single writer at a time, serialize access to the file
+	// instead of failing with SQLITE_BUSY under load.
+	sqlDB.SetMaxOpenConns(1)
+
+	if err := sqlDB.PingContext(ctx); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := migrate(ctx, sqlDB); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+
+	return &SQLite{sqldb.New(ctx, sqlDB, dialect, cfg.PasswordHasher)}, nil
+}
+
+// migrate applies all migrations that have not been applied to the database.
+func migrate(ctx context.Context, sqlDB *sql.DB) error {
+	var version int
+	if err := sqlDB.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := sqlDB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", i+1, err)
+		}
+
+		if _, err = tx.ExecContext(ctx, migrations[i]); err == nil {
+			// PRAGMA statements do not support placeholders.
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// isUniqueConstraintError checks if err was caused by a unique or primary key
+// constraint violation.
+func isUniqueConstraintError(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	code := sqliteErr.Code()
+	return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
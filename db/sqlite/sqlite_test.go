@@ -0,0 +1,63 @@
+package sqlite
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/db/dbtest"
+)
+
+func TestSQLite(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T, hasher db.PasswordHasher) db.DataStore {
+		s, err := Connect(context.Background(), Config{Path: filepath.Join(t.TempDir(), "bob.db"), PasswordHasher: hasher})
+		if err != nil {
+			t.Fatalf("Connect error: %v", err)
+		}
+		return s
+	})
+}
+
+func TestSQLite_reopen(t *testing.T) {
+	cfg := Config{Path: filepath.Join(t.TempDir(), "bob.db")}
+	s, err := Connect(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Connect error: %v", err)
+	}
+
+	if err := s.CreateUser("fibrealz", "fibrealz@example.com", []byte("password")); err != nil {
+		t.Fatalf("CreateUser error: %v", err)
+	}
+	s.Close()
+
+	// Reopening the file must not reapply migrations or lose data.
+	s, err = Connect(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Connect error: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.LoginUser("fibrealz@example.com", []byte("password")); err != nil {
+		t.Fatalf("LoginUser error: %v", err)
+	}
+}
+
+func TestSQLite_path(t *testing.T) {
+	// URI characters in the path must not change how the file is opened.
+	path := filepath.Join(t.TempDir(), "bob?mode=memory#1 %20.db")
+	s, err := Connect(context.Background(), Config{Path: path})
+	if err != nil {
+		t.Fatalf("Connect error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.CreateUser("fibrealz", "fibrealz@example.com", []byte("password")); err != nil {
+		t.Fatalf("CreateUser error: %v", err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the database file at %q: %v", path, err)
+	}
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// StatsInterval is the length of the time series buckets of short URL click
+// statistics.
+type StatsInterval string
+
+const (
+	StatsIntervalHour StatsInterval = "hour"
+	StatsIntervalDay  StatsInterval = "day"
+	StatsIntervalWeek StatsInterval = "week"
+)
+
+// weekStartOffset is the number of seconds between the unix epoch, a
+// Thursday, and the following Monday. Weekly buckets start on Mondays.
+const weekStartOffset = 4 * 24 * 60 * 60
+
+// UnknownStatsValue is the breakdown value used for clicks without the
+// information being broken down.
+const UnknownStatsValue = "unknown"
+
+// IsValid checks if i is a supported interval.
+func (i StatsInterval) IsValid() bool {
+	switch i {
+	case StatsIntervalHour, StatsIntervalDay, StatsIntervalWeek:
+		return true
+	default:
+		return false
+	}
+}
+
+// Seconds returns the length of the interval in seconds.
+func (i StatsInterval) Seconds() int64 {
+	switch i {
+	case StatsIntervalHour:
+		return int64(time.Hour.Seconds())
+	case StatsIntervalWeek:
+		return int64(7 * 24 * time.Hour.Seconds())
+	default:
+		return int64(24 * time.Hour.Seconds())
+	}
+}
+
+// Offset returns the number of seconds after the unix epoch at which the
+// buckets of the interval are aligned. A bucket starts at
+// timestamp - (timestamp - offset) % seconds.
+func (i StatsInterval) Offset() int64 {
+	if i == StatsIntervalWeek {
+		return weekStartOffset
+	}
+	return 0
+}
+
+// BucketStart returns the start of the UTC bucket that contains timestamp.
+func (i StatsInterval) BucketStart(timestamp int64) int64 {
+	seconds := i.Seconds()
+	rem := (timestamp - i.Offset()) % seconds
+	if rem < 0 {
+		rem += seconds
+	}
+	return timestamp - rem
+}
+
+// ValidateStatsRange checks the time range and interval of a click statistics
+// request.
+func ValidateStatsRange(from, to int64, interval StatsInterval) error {
+	if from >= to {
+		return fmt.Errorf("%w: from must be before to", ErrorBadRequest)
+	}
+
+	if !interval.IsValid() {
+		return fmt.Errorf("%w: invalid interval %q", ErrorBadRequest, interval)
+	}
+
+	return nil
+}
+
+// ShortURLClickStats are aggregated statistics about the clicks on a short URL
+// within a time range.
+type ShortURLClickStats struct {
+	From     int64         `json:"from"`
+	To       int64         `json:"to"`
+	Interval StatsInterval `json:"interval"`
+	// Total is the number of clicks within the time range.
+	Total int64 `json:"total"`
+	// TimeSeries is the number of clicks in every bucket of the time range,
+	// including empty buckets.
+	TimeSeries []*ClickTimeBucket `json:"timeSeries"`
+	// The breakdowns are sorted by the number of clicks in descending order.
+	Browsers        []*ClickBreakdown `json:"browsers"`
+	Devices         []*ClickBreakdown `json:"devices"`
+	DeviceTypes     []*ClickBreakdown `json:"deviceTypes"`
+	Referrers       []*ClickBreakdown `json:"referrers"`
+	ReferrerDomains []*ClickBreakdown `json:"referrerDomains"`
+	UTMSources      []*ClickBreakdown `json:"utmSources"`
+	UTMMediums      []*ClickBreakdown `json:"utmMediums"`
+	UTMCampaigns    []*ClickBreakdown `json:"utmCampaigns"`
+	Countries       []*ClickBreakdown `json:"countries"`
+}
+
+// ClickTimeBucket is the number of clicks within a time series bucket.
+type ClickTimeBucket struct {
+	// Timestamp is the unix timestamp at which the bucket starts.
+	Timestamp int64 `json:"timestamp"`
+	Clicks    int64 `json:"clicks"`
+}
+
+// ClickBreakdown is the number of clicks with the same value for a click
+// field.
+type ClickBreakdown struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
+}
+
+// ClickStatsCounts are the click counts used to build ShortURLClickStats.
+// DataStore implementations fill it from their own queries.
+type ClickStatsCounts struct {
+	// Buckets are the click counts keyed by bucket start.
+	Buckets         map[int64]int64
+	Browsers        map[string]int64
+	Devices         map[string]int64
+	DeviceTypes     map[string]int64
+	Referrers       map[string]int64
+	ReferrerDomains map[string]int64
+	UTMSources      map[string]int64
+	UTMMediums      map[string]int64
+	UTMCampaigns    map[string]int64
+	Countries       map[string]int64
+}
+
+// NewClickStatsCounts returns an empty *ClickStatsCounts.
+func NewClickStatsCounts() *ClickStatsCounts {
+	return &ClickStatsCounts{
+		Buckets:         make(map[int64]int64),
+		Browsers:        make(map[string]int64),
+		Devices:         make(map[string]int64),
+		DeviceTypes:     make(map[string]int64),
+		Referrers:       make(map[string]int64),
+		ReferrerDomains: make(map[string]int64),
+		UTMSources:      make(map[string]int64),
+		UTMMediums:      make(map[string]int64),
+		UTMCampaigns:    make(map[string]int64),
+		Countries:       make(map[string]int64),
+	}
+}
+
+// Add counts a single click.
+func (c *ClickStatsCounts) Add(click *ShortURLClick, interval StatsInterval) {
+	c.Buckets[interval.BucketStart(click.Timestamp)]++
+	c.Browsers[click.Browser]++
+	c.Devices[click.Device]++
+	c.DeviceTypes[click.DeviceType]++
+	c.Referrers[click.Referrer]++
+	c.ReferrerDomains[click.ReferrerDomain]++
+	c.UTMSources[click.UTMSource]++
+	c.UTMMediums[click.UTMMedium]++
+	c.UTMCampaigns[click.UTMCampaign]++
+	c.Countries[click.Country]++
+}
+
+// Stats builds the statistics for the time range [from, to).
+func (c *ClickStatsCounts) Stats(from, to int64, interval StatsInterval) *ShortURLClickStats {
+	stats := &ShortURLClickStats{
+		From:            from,
+		To:              to,
+		Interval:        interval,
+		Browsers:        clickBreakdown(c.Browsers),
+		Devices:         clickBreakdown(c.Devices),
+		DeviceTypes:     clickBreakdown(c.DeviceTypes),
+		Referrers:       clickBreakdown(c.Referrers),
+		ReferrerDomains: clickBreakdown(c.ReferrerDomains),
+		UTMSources:      clickBreakdown(c.UTMSources),
+		UTMMediums:      clickBreakdown(c.UTMMediums),
+		UTMCampaigns:    clickBreakdown(c.UTMCampaigns),
+		Countries:       clickBreakdown(c.Countries),
+	}
+
+	for bucket := interval.BucketStart(from); bucket < to; bucket += interval.Seconds() {
+		stats.Total += c.Buckets[bucket]
+		stats.TimeSeries = append(stats.TimeSeries, &ClickTimeBucket{
+			Timestamp: bucket,
+			Clicks:    c.Buckets[bucket],
+		})
+	}
+
+	return stats
+}
+
+// clickBreakdown returns the counts sorted by the number of clicks in
+// descending order. Empty values are counted as UnknownStatsValue.
+func clickBreakdown(counts map[string]int64) []*ClickBreakdown {
+	merged := make(map[string]int64, len(counts))
+	for value, clicks := range counts {
+		if value == "" {
+			value = UnknownStatsValue
+		}
+		merged[value] += clicks
+	}
+
+	breakdown := make([]*ClickBreakdown, 0, len(merged))
+	for value, clicks := range merged {
+		breakdown = append(breakdown, &ClickBreakdown{Value: value, Clicks: clicks})
+	}
+
+	sort.Slice(breakdown, func(i, j int) bool {
+		if breakdown[i].Clicks != breakdown[j].Clicks {
+			return breakdown[i].Clicks > breakdown[j].Clicks
+		}
+		return breakdown[i].Value < breakdown[j].Value
+	})
+
+	return breakdown
+}
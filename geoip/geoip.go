@@ -0,0 +1,119 @@
+// Package geoip resolves the geographical location of IP addresses offline
+// from a local MaxMind DB (.mmdb) file, e.g. GeoLite2-City or
+// GeoLite2-Country.
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Location is the geographical location of an IP address. Fields are empty if
+// they are unknown.
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country.
+	Country string
+	// Region is the English name of the first level subdivision, e.g. a
+	// state or province.
+	Region string
+	// City is the English name of the city.
+	City string
+}
+
+// Resolver resolves the location of IP addresses.
+type Resolver interface {
+	// Lookup returns the location of ip. A nil *Location is returned if the
+	// location is unknown.
+	Lookup(ip net.IP) (*Location, error)
+	// Close releases the resources held by the resolver.
+	Close() error
+}
+
+// New returns a Resolver that reads the MaxMind DB file at path. A Resolver
+// that does not know any location is returned if path is empty.
+func New(path string) (Resolver, error) {
+	if path == "" {
+		return Noop{}, nil
+	}
+	return Open(path)
+}
+
+// Noop is a Resolver that does not know the location of any IP address.
+type Noop struct{}
+
+// Lookup implements Resolver.
+func (Noop) Lookup(net.IP) (*Location, error) {
+	return nil, nil
+}
+
+// Close implements Resolver.
+func (Noop) Close() error {
+	return nil
+}
+
+// MMDB is a Resolver backed by a MaxMind DB file.
+type MMDB struct {
+	reader *maxminddb.Reader
+}
+
+// MMDB implements the Resolver interface.
+var _ Resolver = (*MMDB)(nil)
+
+// Open opens the MaxMind DB file at path.
+func Open(path string) (*MMDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening GeoIP database %s: %w", path, err)
+	}
+
+	return &MMDB{reader: reader}, nil
+}
+
+// mmdbRecord is the subset of a GeoIP2/GeoLite2 City or Country record used
+// to build a Location.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// Lookup implements Resolver.
+func (m *MMDB) Lookup(ip net.IP) (*Location, error) {
+	if ip == nil {
+		return nil, errors.New("invalid IP address")
+	}
+
+	var record mmdbRecord
+	_, found, err := m.reader.LookupNetwork(ip, &record)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up %s: %w", ip, err)
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	loc := &Location{
+		Country: record.Country.ISOCode,
+		City:    record.City.Names["en"],
+	}
+	if len(record.Subdivisions) > 0 {
+		loc.Region = record.Subdivisions[0].Names["en"]
+	}
+
+	return loc, nil
+}
+
+// Close implements Resolver.
+func (m *MMDB) Close() error {
+	return m.reader.Close()
+}
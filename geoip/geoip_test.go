@@ -0,0 +1,78 @@
+package geoip
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testDB is a small MaxMind DB file with GeoIP2-City shaped records for
+// 81.2.69.0/24 and 2a02:c7c::/32.
+var testDB = filepath.Join("testdata", "test-city.mmdb")
+
+func TestMMDB_Lookup(t *testing.T) {
+	r, err := Open(testDB)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer r.Close()
+
+	tests := []struct {
+		name    string
+		ip      net.IP
+		wantLoc *Location
+		wantErr bool
+	}{{
+		name:    "city record",
+		ip:      net.ParseIP("81.2.69.160"),
+		wantLoc: &Location{Country: "GB", Region: "England", City: "London"},
+	}, {
+		name:    "country only record",
+		ip:      net.ParseIP("2a02:c7c::1"),
+		wantLoc: &Location{Country: "NG"},
+	}, {
+		name: "unknown IP",
+		ip:   net.ParseIP("127.0.0.1"),
+	}, {
+		name:    "invalid IP",
+		ip:      net.ParseIP("not-an-ip"),
+		wantErr: true,
+	}}
+
+	for _, test := range tests {
+		loc, err := r.Lookup(test.ip)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("%s: expected error %v but got %v", test.name, test.wantErr, err)
+		}
+
+		if !reflect.DeepEqual(loc, test.wantLoc) {
+			t.Fatalf("%s: expected location %+v but got %+v", test.name, test.wantLoc, loc)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	r, err := New("")
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	if loc, err := r.Lookup(net.ParseIP("81.2.69.160")); loc != nil || err != nil {
+		t.Fatalf("Expected no location without a database but got %+v (%v)", loc, err)
+	}
+
+	if _, err := New(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Fatal("Expected an error for a missing database file")
+	}
+
+	r, err = New(testDB)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	defer r.Close()
+
+	if _, ok := r.(*MMDB); !ok {
+		t.Fatalf("Expected *MMDB but got %T", r)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ukane-philemon/bob/webserver"
+)
+
+// runRotateJWTKey runs the "rotate-jwt-key" command. A new key is added to the
+// JWT key file and the current signing key is retired once the new key
+// becomes active.
+func runRotateJWTKey(cfg Config) error {
+	keyFile := cfg.WebServerCfg.JWTKeyFile
+	if keyFile == "" {
+		return errors.New("rotate-jwt-key: a JWT key file is required")
+	}
+
+	kid, activeAt, err := webserver.RotateJWTKey(keyFile, cfg.RotateJWTKey.Algorithm, cfg.RotateJWTKey.Delay, cfg.WebServerCfg.JWTKeyGracePeriod)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added %s key %s, it signs tokens from %s\n", cfg.RotateJWTKey.Algorithm, kid, activeAt.Format(time.RFC3339))
+	return nil
+}
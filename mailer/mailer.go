@@ -0,0 +1,200 @@
+// Package mailer sends the emails of B.O.B, e.g. email verification and
+// password reset emails, through an SMTP server or writes them to a log or a
+// file during development.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	// To is the address of the recipient.
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails.
+type Mailer interface {
+	// Send sends msg. It returns when the message has been handed over or
+	// ctx is canceled.
+	Send(ctx context.Context, msg *Message) error
+	// Close releases the resources held by the mailer.
+	Close() error
+}
+
+// Config is the configuration for sending emails.
+type Config struct {
+	// SMTPHost is the host name of the SMTP server. Emails are written to
+	// File or logged if it is empty.
+	SMTPHost string `long:"smtphost" env:"MAILER_SMTP_HOST" description:"Host name of the SMTP server used to send emails, emails are written to the mailer file or logged if not set"`
+	// SMTPPort is the port of the SMTP server. Port 465 uses implicit TLS,
+	// other ports use STARTTLS if the server supports it.
+	SMTPPort int `long:"smtpport" env:"MAILER_SMTP_PORT" default:"587" description:"Port of the SMTP server, 465 uses implicit TLS and other ports use STARTTLS if supported"`
+	// SMTPUsername and SMTPPassword are the PLAIN auth credentials. Emails
+	// are sent without auth if SMTPUsername is empty.
+	SMTPUsername string `long:"smtpusername" env:"MAILER_SMTP_USERNAME" description:"Username used to authenticate with the SMTP server"`
+	SMTPPassword string `long:"smtppassword" env:"MAILER_SMTP_PASSWORD" description:"Password used to authenticate with the SMTP server"`
+	// From is the sender address of emails.
+	From string `long:"from" env:"MAILER_FROM" default:"B.O.B <noreply@localhost>" description:"Sender address of emails"`
+	// File is the path of a file emails are appended to instead of being
+	// sent. It is ignored if SMTPHost is set.
+	File string `long:"file" env:"MAILER_FILE" description:"Path of a file emails are appended to instead of being sent, ignored if an SMTP host is set"`
+}
+
+// New returns a Mailer for cfg. Emails are sent through the SMTP server if
+// cfg.SMTPHost is set, appended to cfg.File if it is set and logged to stdout
+// otherwise.
+func New(cfg Config) (Mailer, error) {
+	var m Mailer
+	var err error
+	switch {
+	case cfg.SMTPHost != "":
+		m, err = NewSMTP(cfg)
+	case cfg.File != "":
+		m, err = OpenFile(cfg.File, cfg.From)
+	default:
+		m, err = NewWriter(os.Stdout, cfg.From)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseFrom parses the sender address of emails.
+func parseFrom(from string) (*mail.Address, error) {
+	if from == "" {
+		return nil, errors.New("a sender address is required")
+	}
+
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", from, err)
+	}
+
+	return addr, nil
+}
+
+// headers returns the headers of msg.
+func (msg *Message) headers(from *mail.Address, date time.Time) ([][2]string, error) {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient address %q: %w", msg.To, err)
+	}
+
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return nil, errors.New("the subject must not contain line breaks")
+	}
+
+	return [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+	}, nil
+}
+
+// bytes returns msg as an RFC 5322 message with a quoted-printable body.
+func (msg *Message) bytes(from *mail.Address, date time.Time) ([]byte, error) {
+	headers, err := msg.headers(from, date)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h[0], h[1])
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	if _, err := w.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// Writer is a Mailer that writes emails to an io.Writer in a readable form
+// instead of sending them. It is meant for development, the emails contain
+// secrets such as password reset tokens.
+type Writer struct {
+	mtx    sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	from   *mail.Address
+}
+
+// Writer implements the Mailer interface.
+var _ Mailer = (*Writer)(nil)
+
+// NewWriter creates a *Writer that writes emails to w.
+func NewWriter(w io.Writer, from string) (*Writer, error) {
+	fromAddr, err := parseFrom(from)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{w: w, from: fromAddr}, nil
+}
+
+// OpenFile creates a *Writer that appends emails to the file at path. The file
+// is created if it does not exist.
+func OpenFile(path, from string) (*Writer, error) {
+	fromAddr, err := parseFrom(from)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mailer file: %w", err)
+	}
+
+	return &Writer{w: f, closer: f, from: fromAddr}, nil
+}
+
+// Send writes msg. Implements Mailer.
+func (mw *Writer) Send(_ context.Context, msg *Message) error {
+	headers, err := msg.headers(mw.from, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\n", h[0], h[1])
+	}
+	fmt.Fprintf(&b, "\n%s\n\n", strings.TrimRight(msg.Body, "\n"))
+
+	mw.mtx.Lock()
+	defer mw.mtx.Unlock()
+	_, err = mw.w.Write(b.Bytes())
+	return err
+}
+
+// Close closes the file of a *Writer created with OpenFile. Implements Mailer.
+func (mw *Writer) Close() error {
+	if mw.closer == nil {
+		return nil
+	}
+	return mw.closer.Close()
+}
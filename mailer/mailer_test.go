@@ -0,0 +1,202 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tSMTPServer is a minimal SMTP server without TLS that records the messages
+// it receives.
+type tSMTPServer struct {
+	ln       net.Listener
+	auth     string
+	messages chan *tSMTPMessage
+}
+
+// tSMTPMessage is a message received by tSMTPServer.
+type tSMTPMessage struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+func newTSMTPServer(t *testing.T) *tSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+
+	s := &tSMTPServer{ln: ln, messages: make(chan *tSMTPMessage, 1)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *tSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 localhost ESMTP")
+	msg := new(tSMTPMessage)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.TrimRight(line, "\r\n")
+		switch verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0]); verb {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			msg.auth = strings.TrimPrefix(cmd, "AUTH PLAIN ")
+			reply("235 Authenticated")
+		case "MAIL":
+			msg.from = cmd
+			reply("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, cmd)
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			msg.data = data.String()
+			s.messages <- msg
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("500 Unknown command")
+		}
+	}
+}
+
+func TestSMTP_Send(t *testing.T) {
+	server := newTSMTPServer(t)
+	_, port, _ := net.SplitHostPort(server.ln.Addr().String())
+
+	cfg := Config{
+		SMTPHost:     "127.0.0.1",
+		SMTPUsername: "user",
+		SMTPPassword: "password",
+		From:         "B.O.B <noreply@example.com>",
+	}
+	cfg.SMTPPort, _ = net.LookupPort("tcp", port)
+
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	defer m.Close()
+
+	body := "Hello,\n\nUse this link: https://example.com/api/email/verify?token=" + strings.Repeat("a", 80) + "\n"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Send(ctx, &Message{To: "user@example.com", Subject: "Verify your email ✓", Body: body}); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+
+	msg := <-server.messages
+	wantAuth := base64.StdEncoding.EncodeToString([]byte("\x00user\x00password"))
+	if msg.auth != wantAuth || msg.from != "MAIL FROM:<noreply@example.com>" || len(msg.to) != 1 || msg.to[0] != "RCPT TO:<user@example.com>" {
+		t.Fatalf("Unexpected envelope %+v", msg)
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(msg.data))
+	if err != nil {
+		t.Fatalf("mail.ReadMessage error: %v", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || subject != "Verify your email ✓" {
+		t.Fatalf("Unexpected subject %q (%v)", subject, err)
+	}
+
+	if parsed.Header.Get("To") != "<user@example.com>" || parsed.Header.Get("From") != `"B.O.B" <noreply@example.com>` {
+		t.Fatalf("Unexpected headers %v", parsed.Header)
+	}
+
+	decoded, err := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatalf("quotedprintable error: %v", err)
+	}
+
+	if got := strings.ReplaceAll(string(decoded), "\r\n", "\n"); got != body {
+		t.Fatalf("Unexpected body %q", got)
+	}
+
+	// Invalid recipients and subjects are rejected before connecting.
+	if err := m.Send(ctx, &Message{To: "invalid", Subject: "Subject", Body: body}); err == nil {
+		t.Fatal("Expected an invalid recipient to be rejected")
+	}
+	if err := m.Send(ctx, &Message{To: "user@example.com", Subject: "Subject\r\nBcc: other@example.com", Body: body}); err == nil {
+		t.Fatal("Expected a subject with line breaks to be rejected")
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emails.log")
+	m, err := New(Config{File: path, From: "noreply@example.com"})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+
+	for _, to := range []string{"first@example.com", "second@example.com"} {
+		if err := m.Send(context.Background(), &Message{To: to, Subject: "Reset your password", Body: "token: abc\n"}); err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile error: %v", err)
+	}
+
+	content := string(b)
+	if strings.Count(content, "token: abc\n") != 2 || !strings.Contains(content, "To: <second@example.com>\n") ||
+		!strings.Contains(content, "Subject: Reset your password\n") {
+		t.Fatalf("Unexpected file content %q", content)
+	}
+
+	if _, err := New(Config{From: "invalid"}); err == nil {
+		t.Fatal("Expected an invalid sender address to be rejected")
+	}
+}
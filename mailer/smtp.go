@@ -0,0 +1,140 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+const (
+	// implicitTLSPort is the SMTP submission port that uses implicit TLS.
+	implicitTLSPort = 465
+	// defaultSendTimeout is the timeout of sending an email if the context
+	// has no deadline.
+	defaultSendTimeout = 30 * time.Second
+)
+
+// SMTP is a Mailer that sends emails through an SMTP server.
+type SMTP struct {
+	host        string
+	addr        string
+	implicitTLS bool
+	auth        smtp.Auth
+	from        *mail.Address
+}
+
+// SMTP implements the Mailer interface.
+var _ Mailer = (*SMTP)(nil)
+
+// NewSMTP creates an *SMTP mailer from cfg.
+func NewSMTP(cfg Config) (*SMTP, error) {
+	if cfg.SMTPHost == "" || cfg.SMTPPort <= 0 {
+		return nil, errors.New("an SMTP host and port are required")
+	}
+
+	from, err := parseFrom(cfg.From)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SMTP{
+		host:        cfg.SMTPHost,
+		addr:        net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+		implicitTLS: cfg.SMTPPort == implicitTLSPort,
+		from:        from,
+	}
+
+	// PlainAuth refuses to send the credentials without TLS, except to
+	// localhost.
+	if cfg.SMTPUsername != "" {
+		s.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+
+	return s, nil
+}
+
+// Send sends msg through the SMTP server. Implements Mailer.
+func (s *SMTP) Send(ctx context.Context, msg *Message) error {
+	data, err := msg.bytes(s.from, time.Now())
+	if err != nil {
+		return err
+	}
+
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address %q: %w", msg.To, err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultSendTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{ServerName: s.host}
+	if s.implicitTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		return fmt.Errorf("SMTP handshake failed: %w", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && !s.implicitTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("SMTP STARTTLS failed: %w", err)
+		}
+	}
+
+	if s.auth != nil {
+		if err := c.Auth(s.auth); err != nil {
+			return fmt.Errorf("SMTP auth failed: %w", err)
+		}
+	}
+
+	if err := c.Mail(s.from.Address); err != nil {
+		return fmt.Errorf("SMTP MAIL command failed: %w", err)
+	}
+
+	if err := c.Rcpt(to.Address); err != nil {
+		return fmt.Errorf("SMTP RCPT command failed: %w", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA command failed: %w", err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return c.Quit()
+}
+
+// Close implements Mailer. Connections are not reused, so there is nothing to
+// release.
+func (s *SMTP) Close() error {
+	return nil
+}
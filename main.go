@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/ukane-philemon/bob/db"
 	"github.com/ukane-philemon/bob/db/mem"
 	"github.com/ukane-philemon/bob/db/mongodb"
+	"github.com/ukane-philemon/bob/db/postgres"
+	"github.com/ukane-philemon/bob/db/sqlite"
+	"github.com/ukane-philemon/bob/mailer"
 	"github.com/ukane-philemon/bob/webserver"
 )
 
@@ -41,25 +45,84 @@ func main() {
 	}
 
 	var cfg Config
-	err := parseCLIConfig(&cfg)
+	command, err := parseCLIConfig(&cfg)
 	if err != nil {
 		exitWithErr(err)
 	}
 
-	if cfg.MongoDBCfg.ConnectionURL == "" && !cfg.DevMode {
-		exitWithErr(fmt.Errorf("MongoDB connection URL is required"))
+	switch command {
+	case "migrate":
+		if err := runMigrate(ctx, cfg); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case "rotate-jwt-key":
+		if err := runRotateJWTKey(cfg); err != nil {
+			exitWithErr(err)
+		}
+		return
+	}
+
+	cfg.WebServerCfg.Clicks = cfg.ClicksCfg
+	cfg.WebServerCfg.OIDC = cfg.OIDCCfg
+	cfg.WebServerCfg.Policy = cfg.PolicyCfg
+	cfg.MongoDBCfg.ClickRetention = time.Duration(cfg.ClicksCfg.Retention)
+
+	hasher, err := db.NewPasswordHasher(cfg.PasswordCfg)
+	if err != nil {
+		exitWithErr(err)
+	}
+	cfg.MongoDBCfg.PasswordHasher = hasher
+	cfg.PostgresCfg.PasswordHasher = hasher
+	cfg.SQLiteCfg.PasswordHasher = hasher
+
+	if cfg.MongoDBCfg.ConnectionURL == "" && cfg.PostgresCfg.ConnectionURL == "" && cfg.SQLiteCfg.Path == "" && !cfg.DevMode {
+		exitWithErr(fmt.Errorf("a MongoDB connection URL, PostgreSQL connection URL or SQLite database path is required"))
 	}
 
+	// The database outlives ctx so that queued clicks can be recorded while
+	// the web server is stopping.
+	dbCtx, cancelDB := context.WithCancel(context.Background())
+	defer cancelDB()
+
 	var db db.DataStore
-	if cfg.MongoDBCfg.ConnectionURL != "" {
-		db, err = mongodb.Connect(ctx, cfg.MongoDBCfg)
+	var mdb *mongodb.MongoDB
+	switch {
+	case cfg.MongoDBCfg.ConnectionURL != "":
+		mdb, err = mongodb.Connect(dbCtx, cfg.MongoDBCfg)
+		db = mdb
+	case cfg.PostgresCfg.ConnectionURL != "":
+		db, err = postgres.Connect(dbCtx, cfg.PostgresCfg)
+	case cfg.SQLiteCfg.Path != "":
+		db, err = sqlite.Connect(dbCtx, cfg.SQLiteCfg)
+	default:
+		memDB := mem.New()
+		memDB.SetPasswordHasher(hasher)
+		db = memDB
+	}
+	if err != nil {
+		exitWithErr(err)
+	}
+	defer db.Close()
+
+	// Edits of short URLs are propagated to the other instances through
+	// MongoDB. Other databases are only supported with a single instance.
+	if mdb != nil {
+		cacheBus, err := mdb.NewCacheBus()
 		if err != nil {
-			exitWithErr(err)
+			fmt.Printf("Cross-instance cache invalidation is disabled: %v\n", err)
+		} else {
+			defer cacheBus.Close()
+			cfg.WebServerCfg.CacheBus = cacheBus
 		}
-	} else {
-		db = mem.New()
 	}
-	defer db.Close()
+
+	appMailer, err := mailer.New(cfg.MailerCfg)
+	if err != nil {
+		exitWithErr(err)
+	}
+	defer appMailer.Close()
+	cfg.WebServerCfg.Mailer = appMailer
 
 	r, err := webserver.New(ctx, cfg.WebServerCfg, db)
 	if err != nil {
@@ -67,7 +130,9 @@ func main() {
 		exitWithErr(err)
 	}
 
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		<-ctx.Done()
 		fmt.Println("Shutting down web server...")
 		if err := r.Stop(); err != nil {
@@ -75,5 +140,11 @@ func main() {
 		}
 	}()
 
-	r.Start()
+	if err := r.Start(); err != nil {
+		fmt.Printf("HTTP server error: %v\n", err)
+		cancel()
+	}
+
+	// Wait for queued clicks to be recorded before closing the database.
+	<-stopped
 }
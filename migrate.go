@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ukane-philemon/bob/db/postgres"
+)
+
+// runMigrate runs the "migrate" command. Pending PostgreSQL migrations are
+// applied unless cfg.Migrate.Status is set, in which case the migrations are
+// listed together with the time each one was applied.
+func runMigrate(ctx context.Context, cfg Config) error {
+	if cfg.PostgresCfg.ConnectionURL == "" {
+		return errors.New("migrate: a PostgreSQL connection URL is required")
+	}
+
+	if cfg.Migrate.Status {
+		migrations, err := postgres.Migrations(ctx, cfg.PostgresCfg)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			status := "pending"
+			if m.AppliedAt > 0 {
+				status = "applied " + time.Unix(m.AppliedAt, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%04d %-30s %s\n", m.Version, m.Name, status)
+		}
+		return nil
+	}
+
+	applied, err := postgres.Migrate(ctx, cfg.PostgresCfg)
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		fmt.Println("Database schema is up to date.")
+		return nil
+	}
+
+	for _, m := range applied {
+		fmt.Printf("Applied migration %04d %s\n", m.Version, m.Name)
+	}
+	return nil
+}
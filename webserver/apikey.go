@@ -0,0 +1,258 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db"
+)
+
+// API key scopes. Endpoints that can be used with API keys require one of
+// them, see requireScope.
+const (
+	// scopeLinksRead allows reading short URLs.
+	scopeLinksRead = "links:read"
+	// scopeLinksWrite allows creating and updating short URLs.
+	scopeLinksWrite = "links:write"
+	// scopeStatsRead allows reading short URL clicks and statistics.
+	scopeStatsRead = "stats:read"
+)
+
+// apiKeyScopes are the scopes that can be granted to API keys.
+var apiKeyScopes = []string{scopeLinksRead, scopeLinksWrite, scopeStatsRead}
+
+const (
+	// apiKeyHeader is the header API keys can be sent in instead of the
+	// Authorization header.
+	apiKeyHeader = "X-API-Key"
+	// apiKeyAuthScheme is the Authorization header scheme for API keys.
+	apiKeyAuthScheme = "ApiKey"
+	// apiKeyPrefix is the start of every API key. It makes leaked keys easy to
+	// recognize.
+	apiKeyPrefix = "bob_"
+	// apiKeySecretLength is the number of random bytes in an API key.
+	apiKeySecretLength = 32
+	// apiKeyIDLength is the number of random bytes in an API key ID.
+	apiKeyIDLength = 8
+	// apiKeyDisplayLength is the length of the start of an API key that is
+	// stored and shown to help users tell their keys apart.
+	apiKeyDisplayLength = len(apiKeyPrefix) + 8
+	// maxAPIKeyNameLength is the maximum length of an API key name.
+	maxAPIKeyNameLength = 64
+	// maxAPIKeysPerUser is the maximum number of API keys a user can have.
+	maxAPIKeysPerUser = 25
+	// apiKeyLastUsedInterval is how often the last used time of an API key is
+	// updated, so that busy keys do not write to the database on every
+	// request.
+	apiKeyLastUsedInterval = time.Minute
+)
+
+// hashAPIKey returns the SHA-256 hash of an API key.
+func hashAPIKey(key string) []byte {
+	hash := sha256.Sum256([]byte(key))
+	return hash[:]
+}
+
+// newAPIKey generates a new API key for the user with the specified email and
+// returns it with its database entry.
+func newAPIKey(email, name string, scopes []string) (string, *db.APIKey, error) {
+	id, err := randomBytes(apiKeyIDLength)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := randomBytes(apiKeySecretLength)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	return key, &db.APIKey{
+		ID:        hex.EncodeToString(id),
+		Email:     email,
+		Name:      name,
+		Prefix:    key[:apiKeyDisplayLength],
+		KeyHash:   hashAPIKey(key),
+		Scopes:    scopes,
+		CreatedAt: time.Now().Unix(),
+	}, nil
+}
+
+// validateAPIKeyScopes checks that scopes are known and returns them without
+// duplicates.
+func validateAPIKeyScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, errBadRequest(fmt.Sprintf("at least one scope is required (%s)", strings.Join(apiKeyScopes, ", ")))
+	}
+
+	var validScopes []string
+	for _, scope := range scopes {
+		known := false
+		for _, s := range apiKeyScopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, errBadRequest(fmt.Sprintf("unknown scope %q, supported scopes are %s", scope, strings.Join(apiKeyScopes, ", ")))
+		}
+
+		duplicate := false
+		for _, s := range validScopes {
+			duplicate = duplicate || s == scope
+		}
+		if !duplicate {
+			validScopes = append(validScopes, scope)
+		}
+	}
+
+	return validScopes, nil
+}
+
+// authenticateAPIKey finds the API key and records that it was used.
+func (s *WebServer) authenticateAPIKey(key string) (*db.APIKey, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, errUnauthorized("Invalid API key")
+	}
+
+	apiKey, err := s.db.RetrieveAPIKey(hashAPIKey(key))
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return nil, errUnauthorized("Invalid API key")
+		}
+
+		appLog.Printf("\ndb.RetrieveAPIKey error: %v\n", err)
+		return nil, errInternal(err)
+	}
+
+	now := time.Now()
+	if now.Sub(time.Unix(apiKey.LastUsedAt, 0)) >= apiKeyLastUsedInterval {
+		if err := s.db.UpdateAPIKeyLastUsed(apiKey.ID, now.Unix()); err != nil {
+			appLog.Printf("\ndb.UpdateAPIKeyLastUsed error: %v\n", err)
+		}
+	}
+
+	return apiKey, nil
+}
+
+// requireScope returns a middleware handler that lets requests authenticated
+// with an API key through if the key has scope. The user of the key is only
+// set in the context by this handler, so API keys are not accepted by
+// endpoints that do not require a scope.
+func (s *WebServer) requireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		apiKey, ok := c.Context().UserValue(ctxAPIKey).(*db.APIKey)
+		if !ok {
+			return c.Next()
+		}
+
+		if !apiKey.HasScope(scope) {
+			return errForbidden(fmt.Sprintf("API key does not have the %s scope", scope))
+		}
+
+		c.Context().SetUserValue(ctxID, apiKey.Email)
+		return c.Next()
+	}
+}
+
+// handleCreateAPIKey handles the "POST /api/keys" endpoint and creates a new
+// API key. The key is only returned in the response, it cannot be retrieved
+// later.
+func (s *WebServer) handleCreateAPIKey(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(createAPIKeyRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	name := strings.TrimSpace(form.Name)
+	if name == "" || len(name) > maxAPIKeyNameLength {
+		return errBadRequest(fmt.Sprintf("a name of at most %d characters is required", maxAPIKeyNameLength))
+	}
+
+	scopes, err := validateAPIKeyScopes(form.Scopes)
+	if err != nil {
+		return err
+	}
+
+	keys, err := s.db.RetrieveUserAPIKeys(email)
+	if err != nil {
+		appLog.Printf("\ndb.RetrieveUserAPIKeys error: %v\n", err)
+		return errInternal(err)
+	}
+
+	if len(keys) >= maxAPIKeysPerUser {
+		return errBadRequest(fmt.Sprintf("you can have at most %d API keys, delete unused keys first", maxAPIKeysPerUser))
+	}
+
+	key, apiKey, err := newAPIKey(email, strings.Clone(name), scopes)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	if err := s.db.CreateAPIKey(apiKey); err != nil {
+		appLog.Printf("\ndb.CreateAPIKey error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	resp := &apiKeyResponse{
+		APIResponse: newAPIResponse(true, codeOk, "API Key Created. Copy the key now, it will not be shown again."),
+		Data:        apiKey,
+		Key:         key,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleGetAPIKeys handles the "GET /api/keys" endpoint and returns the API
+// keys of the user.
+func (s *WebServer) handleGetAPIKeys(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	keys, err := s.db.RetrieveUserAPIKeys(email)
+	if err != nil {
+		appLog.Printf("\ndb.RetrieveUserAPIKeys error: %v\n", err)
+		return errInternal(err)
+	}
+
+	if keys == nil {
+		keys = []*db.APIKey{}
+	}
+
+	resp := &apiKeysResponse{
+		APIResponse: newAPIResponse(true, codeOk, "API Keys Retrieved."),
+		Data:        keys,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleDeleteAPIKey handles the "DELETE /api/keys/:id" endpoint and deletes
+// an API key of the user. Requests with the key are rejected immediately.
+func (s *WebServer) handleDeleteAPIKey(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	if err := s.db.DeleteAPIKey(email, c.Params("id")); err != nil {
+		if !errors.Is(err, db.ErrorNotFound) {
+			appLog.Printf("\ndb.DeleteAPIKey error: %v\n", err)
+		}
+		return translateDBError(err)
+	}
+
+	resp := newAPIResponse(true, codeOk, "API Key Deleted.")
+	return c.Status(resp.Code).JSON(resp)
+}
@@ -0,0 +1,220 @@
+package webserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// tCreateAPIKey creates an API key with the specified scopes using headers.
+func tCreateAPIKey(t *testing.T, s *tServer, headers map[string]string, scopes ...string) *apiKeyResponse {
+	t.Helper()
+	var resp *apiKeyResponse
+	req := createAPIKeyRequest{Name: "ci", Scopes: scopes}
+	if err := s.sendRequest(fiber.MethodPost, "api/keys", req, &resp, headers); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp.Code != codeOk || !strings.HasPrefix(resp.Key, apiKeyPrefix) || resp.Data == nil || !strings.HasPrefix(resp.Key, resp.Data.Prefix) {
+		t.Fatalf("Unexpected create API key response %+v", resp)
+	}
+
+	return resp
+}
+
+func TestWebServer_handleCreateAPIKey(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	headers := s.authHeaders(t, "test@email.com")
+	tests := []struct {
+		name     string
+		req      createAPIKeyRequest
+		headers  map[string]string
+		wantCode int
+	}{{
+		name:     "success",
+		req:      createAPIKeyRequest{Name: "ci", Scopes: []string{scopeLinksWrite, scopeLinksWrite}},
+		headers:  headers,
+		wantCode: codeOk,
+	}, {
+		name:     "unauthorized",
+		req:      createAPIKeyRequest{Name: "ci", Scopes: []string{scopeLinksWrite}},
+		wantCode: codeUnauthorized,
+	}, {
+		name:     "missing name",
+		req:      createAPIKeyRequest{Name: " ", Scopes: []string{scopeLinksWrite}},
+		headers:  headers,
+		wantCode: codeBadRequest,
+	}, {
+		name:     "missing scopes",
+		req:      createAPIKeyRequest{Name: "ci"},
+		headers:  headers,
+		wantCode: codeBadRequest,
+	}, {
+		name:     "unknown scope",
+		req:      createAPIKeyRequest{Name: "ci", Scopes: []string{"admin"}},
+		headers:  headers,
+		wantCode: codeBadRequest,
+	}}
+
+	for _, tt := range tests {
+		var resp *apiKeyResponse
+		if err := s.sendRequest(fiber.MethodPost, "api/keys", tt.req, &resp, tt.headers); err != nil {
+			t.Fatalf("%s: s.sendRequest error: %s", tt.name, err)
+		}
+
+		if resp.Code != tt.wantCode {
+			t.Fatalf("%s: Expected code %d but got %d (%s)", tt.name, tt.wantCode, resp.Code, resp.Message)
+		}
+
+		if resp.Ok && (resp.Key == "" || len(resp.Data.Scopes) != 1) {
+			t.Fatalf("%s: Unexpected API key %+v", tt.name, resp.Data)
+		}
+	}
+
+	// API keys cannot be used to create API keys.
+	created := tCreateAPIKey(t, s, headers, scopeLinksRead, scopeLinksWrite, scopeStatsRead)
+	var resp *apiKeyResponse
+	req := createAPIKeyRequest{Name: "ci", Scopes: []string{scopeLinksRead}}
+	if err := s.sendRequest(fiber.MethodPost, "api/keys", req, &resp, map[string]string{apiKeyHeader: created.Key}); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp.Code != codeUnauthorized {
+		t.Fatalf("Expected API keys to be rejected but got %d", resp.Code)
+	}
+}
+
+func TestWebServer_apiKeyAuth(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerHeaders, _ := tURLOwners(t, s, "owner@email.com", "other@email.com", "ownedurl")
+	readKey := tCreateAPIKey(t, s, ownerHeaders, scopeLinksRead)
+	writeKey := tCreateAPIKey(t, s, ownerHeaders, scopeLinksWrite)
+	maxClicks := int32(10)
+
+	tests := []struct {
+		name     string
+		method   string
+		endpoint string
+		req      interface{}
+		headers  map[string]string
+		wantCode int
+	}{{
+		name:     "X-API-Key header",
+		method:   fiber.MethodGet,
+		endpoint: "api/url/ownedurl",
+		headers:  map[string]string{apiKeyHeader: readKey.Key},
+		wantCode: codeOk,
+	}, {
+		name:     "Authorization header",
+		method:   fiber.MethodGet,
+		endpoint: "api/url",
+		headers:  map[string]string{fiber.HeaderAuthorization: fmt.Sprintf("ApiKey %s", readKey.Key)},
+		wantCode: codeOk,
+	}, {
+		name:     "write scope",
+		method:   fiber.MethodPatch,
+		endpoint: "api/url?shortUrl=ownedurl",
+		req:      updateShortURLRequest{MaxClicks: &maxClicks},
+		headers:  map[string]string{apiKeyHeader: writeKey.Key},
+		wantCode: codeOk,
+	}, {
+		name:     "missing scope",
+		method:   fiber.MethodPost,
+		endpoint: "api/url",
+		req:      createShortURLRequest{LongURL: "https://example.com"},
+		headers:  map[string]string{apiKeyHeader: readKey.Key},
+		wantCode: codeForbidden,
+	}, {
+		name:     "missing stats scope",
+		method:   fiber.MethodGet,
+		endpoint: "api/url/ownedurl/stats",
+		headers:  map[string]string{apiKeyHeader: readKey.Key},
+		wantCode: codeForbidden,
+	}, {
+		name:     "endpoint without scope",
+		method:   fiber.MethodGet,
+		endpoint: "api/user",
+		headers:  map[string]string{apiKeyHeader: readKey.Key},
+		wantCode: codeUnauthorized,
+	}, {
+		name:     "invalid key",
+		method:   fiber.MethodGet,
+		endpoint: "api/url",
+		headers:  map[string]string{apiKeyHeader: readKey.Key + "x"},
+		wantCode: codeUnauthorized,
+	}, {
+		name:     "both headers",
+		method:   fiber.MethodGet,
+		endpoint: "api/url",
+		headers:  map[string]string{apiKeyHeader: readKey.Key, fiber.HeaderAuthorization: ownerHeaders[fiber.HeaderAuthorization]},
+		wantCode: codeBadRequest,
+	}}
+
+	for _, tt := range tests {
+		var resp *APIResponse
+		if err := s.sendRequest(tt.method, tt.endpoint, tt.req, &resp, tt.headers); err != nil {
+			t.Fatalf("%s: s.sendRequest error: %s", tt.name, err)
+		}
+
+		if resp.Code != tt.wantCode {
+			t.Fatalf("%s: Expected code %d but got %d (%s)", tt.name, tt.wantCode, resp.Code, resp.Message)
+		}
+	}
+
+	// API keys act on behalf of their owner.
+	urlInfo, err := s.db.RetrieveUserURLInfo("owner@email.com", "ownedurl")
+	if err != nil {
+		t.Fatalf("s.db.RetrieveUserURLInfo error: %v", err)
+	}
+
+	if urlInfo.MaxClicks != maxClicks {
+		t.Fatalf("Expected max clicks %d but got %d", maxClicks, urlInfo.MaxClicks)
+	}
+
+	var keysResp *apiKeysResponse
+	if err := s.sendRequest(fiber.MethodGet, "api/keys", nil, &keysResp, ownerHeaders); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if len(keysResp.Data) != 2 {
+		t.Fatalf("Expected 2 API keys but got %d", len(keysResp.Data))
+	}
+
+	for _, key := range keysResp.Data {
+		if key.ID == readKey.Data.ID && key.LastUsedAt == 0 {
+			t.Fatal("Expected the last used time of the API key to be set")
+		}
+	}
+
+	// Deleted keys are rejected.
+	var resp *APIResponse
+	if err := s.sendRequest(fiber.MethodDelete, "api/keys/"+readKey.Data.ID, nil, &resp, ownerHeaders); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp.Code != codeOk {
+		t.Fatalf("Expected OK got %d (%s)", resp.Code, resp.Message)
+	}
+
+	if err := s.sendRequest(fiber.MethodGet, "api/url", nil, &resp, map[string]string{apiKeyHeader: readKey.Key}); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp.Code != codeUnauthorized {
+		t.Fatalf("Expected the deleted API key to be rejected but got %d", resp.Code)
+	}
+
+	if err := s.sendRequest(fiber.MethodDelete, "api/keys/"+readKey.Data.ID, nil, &resp, ownerHeaders); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp.Code != codeNotFound {
+		t.Fatalf("Expected not found error got %d", resp.Code)
+	}
+}
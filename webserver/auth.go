@@ -1,31 +1,80 @@
 package webserver
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db"
 )
 
-// validateIfLoggedIn is a middleware handle that validates a user token, if
-// present. Each endpoint will reject the request if use login is required.
+// validateIfLoggedIn is a middleware handle that validates a user token or an
+// API key, if present. Each endpoint will reject the request if use login is
+// required. API keys are only accepted by endpoints that require a scope, see
+// requireScope.
 func (s *WebServer) validateIfLoggedIn(c *fiber.Ctx) error {
+	apiKey := c.Get(apiKeyHeader)
 	authHeader := c.Get(fiber.HeaderAuthorization)
-	if authHeader == "" {
+	if authHeader == "" && apiKey == "" {
 		return c.Next() // No auth header, so no user is logged in.
 	}
 
-	authTokenParts := strings.Split(authHeader, " ")
-	if len(authTokenParts) != 2 || !strings.EqualFold(authTokenParts[0], "Bearer") || authTokenParts[1] == "" {
-		return errUnauthorized("Invalid authorization header")
+	if authHeader != "" && apiKey != "" {
+		return errBadRequest(fmt.Sprintf("Send either the %s or the %s header", fiber.HeaderAuthorization, apiKeyHeader))
 	}
 
-	// Get the auth token and validated it.
-	token, ok := s.authenticator.validateAuthToken(strings.TrimSpace(authTokenParts[1]))
+	if authHeader != "" {
+		authTokenParts := strings.Split(authHeader, " ")
+		if len(authTokenParts) != 2 || authTokenParts[1] == "" {
+			return errUnauthorized("Invalid authorization header")
+		}
+
+		switch {
+		case strings.EqualFold(authTokenParts[0], "Bearer"):
+			return s.validateAuthToken(c, strings.TrimSpace(authTokenParts[1]))
+		case strings.EqualFold(authTokenParts[0], apiKeyAuthScheme):
+			apiKey = authTokenParts[1]
+		default:
+			return errUnauthorized("Invalid authorization header")
+		}
+	}
+
+	key, err := s.authenticateAPIKey(strings.TrimSpace(apiKey))
+	if err != nil {
+		return err
+	}
+
+	c.Context().SetUserValue(ctxAPIKey, key)
+	return c.Next()
+}
+
+// validateAuthToken validates a user auth token and sets the user email and
+// session ID in the context.
+func (s *WebServer) validateAuthToken(c *fiber.Ctx, authToken string) error {
+	token, ok := s.authenticator.validateAuthToken(authToken, jwtAudienceUser)
 	if !ok {
 		return errUnauthorized("Invalid authorization token")
 	}
 
-	// Set the user email in the context.
-	c.Context().SetUserValue(ctxID, token.ID)
+	// The token ID is the ID of the session it was issued for, reject tokens
+	// of sessions that were logged out.
+	session, err := s.db.RetrieveSession(token.ID)
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return errUnauthorized("Invalid authorization token")
+		}
+
+		appLog.Printf("\ndb.RetrieveSession error: %v\n", err)
+		return errInternal(err)
+	}
+
+	if session.RevokedAt != 0 || session.Email != token.Subject {
+		return errUnauthorized("Invalid authorization token")
+	}
+
+	// Set the user email and session ID in the context.
+	c.Context().SetUserValue(ctxID, session.Email)
+	c.Context().SetUserValue(ctxSessionID, session.ID)
 	return c.Next()
 }
@@ -0,0 +1,287 @@
+package webserver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+	"golang.org/x/sync/singleflight"
+)
+
+// Defaults for the redirect cache settings in Config.
+const (
+	defaultURLCacheSize        = 100000 // ~500 bytes * 100,000 = 50MB
+	defaultURLCacheTTL         = 10 * time.Minute
+	defaultURLCacheNegativeTTL = 30 * time.Second
+)
+
+// cacheInvalidationTimeout is the maximum time spent publishing a cache
+// invalidation.
+const cacheInvalidationTimeout = 5 * time.Second
+
+// urlCacheEntry is a cached short URL lookup.
+type urlCacheEntry struct {
+	shortURL string
+	// info is nil if the short URL was not found.
+	info *db.ShortURLInfo
+	// err is the error returned when the short URL was not found.
+	err       error
+	expiresAt time.Time
+}
+
+// urlCache is a size bounded LRU cache of short URL information with a TTL.
+// Lookups of short URLs that do not exist are cached for a shorter time.
+// Cached information is copied in and out of the cache so callers never
+// share it.
+type urlCache struct {
+	capacity    int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mtx     sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	// invalidations is incremented when entries are removed so that loads
+	// that started before do not cache stale information.
+	invalidations uint64
+
+	group singleflight.Group
+
+	hits         atomic.Uint64
+	negativeHits atomic.Uint64
+	misses       atomic.Uint64
+	evictions    atomic.Uint64
+}
+
+// urlCacheStats are the metrics of a urlCache.
+type urlCacheStats struct {
+	Size     int `json:"size"`
+	Capacity int `json:"capacity"`
+	// Hits is the number of lookups answered with a cached short URL.
+	Hits uint64 `json:"hits"`
+	// NegativeHits is the number of lookups answered with a cached "not
+	// found" result.
+	NegativeHits uint64 `json:"negativeHits"`
+	// Misses is the number of lookups that were not cached.
+	Misses uint64 `json:"misses"`
+	// Evictions is the number of entries removed to make room for new ones.
+	Evictions uint64 `json:"evictions"`
+}
+
+// newURLCache creates a *urlCache. Zero settings are replaced with defaults.
+func newURLCache(capacity int, ttl, negativeTTL time.Duration) *urlCache {
+	if capacity <= 0 {
+		capacity = defaultURLCacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultURLCacheTTL
+	}
+	if negativeTTL <= 0 {
+		negativeTTL = defaultURLCacheNegativeTTL
+	}
+
+	return &urlCache{
+		capacity:    capacity,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// load returns the information about shortURL from the cache or from fetch if
+// it is not cached. Concurrent loads of the same short URL share a single
+// fetch. Only db.ErrorNotFound errors from fetch are cached.
+func (c *urlCache) load(shortURL string, fetch func() (*db.ShortURLInfo, error)) (*db.ShortURLInfo, error) {
+	if entry, found := c.get(shortURL); found {
+		if entry.info == nil {
+			c.negativeHits.Add(1)
+			return nil, entry.err
+		}
+		c.hits.Add(1)
+		return entry.info, nil
+	}
+
+	c.misses.Add(1)
+	// shortURL may be backed by the request buffer, e.g. if it was returned
+	// by fiber.Ctx.Params. The cache keeps its own copy.
+	shortURL = strings.Clone(shortURL)
+	v, err, _ := c.group.Do(shortURL, func() (interface{}, error) {
+		c.mtx.Lock()
+		invalidations := c.invalidations
+		c.mtx.Unlock()
+
+		urlInfo, err := fetch()
+		if err != nil {
+			if errors.Is(err, db.ErrorNotFound) {
+				c.store(&urlCacheEntry{shortURL: shortURL, err: err}, invalidations)
+			}
+			return nil, err
+		}
+
+		c.store(&urlCacheEntry{shortURL: shortURL, info: copyURLInfo(urlInfo)}, invalidations)
+		return urlInfo, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return copyURLInfo(v.(*db.ShortURLInfo)), nil
+}
+
+// get returns a copy of the unexpired entry for shortURL.
+func (c *urlCache) get(shortURL string) (*urlCacheEntry, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	elem, found := c.entries[shortURL]
+	if !found {
+		return nil, false
+	}
+
+	entry := elem.Value.(*urlCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return &urlCacheEntry{
+		shortURL: entry.shortURL,
+		info:     copyURLInfo(entry.info),
+		err:      entry.err,
+	}, true
+}
+
+// set caches a copy of urlInfo, replacing any cached result for the short
+// URL.
+func (c *urlCache) set(urlInfo *db.ShortURLInfo) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.put(&urlCacheEntry{shortURL: urlInfo.ShortURL, info: copyURLInfo(urlInfo)})
+}
+
+// update applies fn to the cached information about shortURL if it is cached.
+func (c *urlCache) update(shortURL string, fn func(urlInfo *db.ShortURLInfo)) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if elem, found := c.entries[shortURL]; found {
+		if entry := elem.Value.(*urlCacheEntry); entry.info != nil {
+			fn(entry.info)
+		}
+	}
+}
+
+// remove removes shortURL from the cache. Loads of the short URL that are in
+// progress do not cache their result.
+func (c *urlCache) remove(shortURL string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.invalidations++
+	if elem, found := c.entries[shortURL]; found {
+		c.removeElement(elem)
+	}
+}
+
+// clear removes every short URL from the cache. Loads that are in progress do
+// not cache their result.
+func (c *urlCache) clear() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.invalidations++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// stats returns the current metrics of the cache.
+func (c *urlCache) stats() *urlCacheStats {
+	c.mtx.Lock()
+	size := c.lru.Len()
+	c.mtx.Unlock()
+
+	return &urlCacheStats{
+		Size:         size,
+		Capacity:     c.capacity,
+		Hits:         c.hits.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Misses:       c.misses.Load(),
+		Evictions:    c.evictions.Load(),
+	}
+}
+
+// store caches entry unless the cache was invalidated after invalidations
+// was read.
+func (c *urlCache) store(entry *urlCacheEntry, invalidations uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.invalidations != invalidations {
+		return
+	}
+	c.put(entry)
+}
+
+// put adds entry to the cache and evicts the least recently used entries if
+// the cache is full. The cache mutex must be held.
+func (c *urlCache) put(entry *urlCacheEntry) {
+	ttl := c.ttl
+	if entry.info == nil {
+		ttl = c.negativeTTL
+	}
+	entry.expiresAt = time.Now().Add(ttl)
+
+	if elem, found := c.entries[entry.shortURL]; found {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[entry.shortURL] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		c.removeElement(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// removeElement removes elem from the cache. The cache mutex must be held.
+func (c *urlCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*urlCacheEntry).shortURL)
+}
+
+// invalidateCachedURL removes shortURL from the redirect cache of this and
+// every other instance of the server. It is used after a short URL is changed.
+func (s *WebServer) invalidateCachedURL(shortURL string) {
+	// The next redirect reloads the short URL from the database.
+	s.urlCache.remove(shortURL)
+
+	ctx, cancel := context.WithTimeout(s.ctx, cacheInvalidationTimeout)
+	defer cancel()
+	if err := s.cacheBus.Publish(ctx, shortURL); err != nil {
+		appLog.Printf("\ncacheBus.Publish error: %v\n", err)
+	}
+}
+
+// handleCacheInvalidation removes short URLs invalidated by any instance of
+// the server from the redirect cache. An empty shortURL clears the cache.
+func (s *WebServer) handleCacheInvalidation(shortURL string) {
+	if shortURL == "" {
+		s.urlCache.clear()
+		return
+	}
+	s.urlCache.remove(shortURL)
+}
+
+// copyURLInfo returns a copy of urlInfo.
+func copyURLInfo(urlInfo *db.ShortURLInfo) *db.ShortURLInfo {
+	if urlInfo == nil {
+		return nil
+	}
+
+	urlInfoCopy := *urlInfo
+	urlInfoCopy.PasswordHash = append([]byte(nil), urlInfo.PasswordHash...)
+	return &urlInfoCopy
+}
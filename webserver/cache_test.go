@@ -0,0 +1,251 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/cachebus"
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/db/mem"
+)
+
+func TestURLCache_lru(t *testing.T) {
+	c := newURLCache(2, time.Hour, time.Hour)
+	for _, shortURL := range []string{"first", "second"} {
+		c.set(&db.ShortURLInfo{ShortURL: shortURL})
+	}
+
+	// Reading "first" makes "second" the least recently used.
+	if _, found := c.get("first"); !found {
+		t.Fatal("Expected first to be cached")
+	}
+	c.set(&db.ShortURLInfo{ShortURL: "third"})
+
+	if _, found := c.get("second"); found {
+		t.Fatal("Expected second to be evicted")
+	}
+	for _, shortURL := range []string{"first", "third"} {
+		if _, found := c.get(shortURL); !found {
+			t.Fatalf("Expected %s to be cached", shortURL)
+		}
+	}
+
+	if stats := c.stats(); stats.Size != 2 || stats.Capacity != 2 || stats.Evictions != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestURLCache_load(t *testing.T) {
+	c := newURLCache(10, time.Hour, time.Hour)
+
+	var fetches int
+	fetch := func() (*db.ShortURLInfo, error) {
+		fetches++
+		return &db.ShortURLInfo{ShortURL: "shorturl", Clicks: 1, PasswordHash: []byte("hash")}, nil
+	}
+
+	urlInfo, err := c.load("shorturl", fetch)
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+
+	// Callers get copies of the cached information.
+	urlInfo.Clicks = 100
+	urlInfo.PasswordHash[0] = 'x'
+
+	urlInfo, err = c.load("shorturl", fetch)
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+
+	if fetches != 1 || urlInfo.Clicks != 1 || string(urlInfo.PasswordHash) != "hash" {
+		t.Fatalf("Unexpected cached short URL %+v after %d fetches", urlInfo, fetches)
+	}
+
+	c.update("shorturl", func(urlInfo *db.ShortURLInfo) {
+		urlInfo.Clicks++
+	})
+	if urlInfo, _ = c.load("shorturl", fetch); urlInfo.Clicks != 2 {
+		t.Fatalf("Expected 2 clicks but got %d", urlInfo.Clicks)
+	}
+
+	c.remove("shorturl")
+	if _, err = c.load("shorturl", fetch); err != nil || fetches != 2 {
+		t.Fatalf("Expected a removed short URL to be fetched again (%d fetches, %v)", fetches, err)
+	}
+
+	if stats := c.stats(); stats.Hits != 2 || stats.Misses != 2 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestURLCache_ttl(t *testing.T) {
+	c := newURLCache(10, 20*time.Millisecond, 10*time.Millisecond)
+
+	var fetches int
+	notFound := func() (*db.ShortURLInfo, error) {
+		fetches++
+		return nil, fmt.Errorf("%w: short URL not found", db.ErrorNotFound)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.load("missing", notFound); !errors.Is(err, db.ErrorNotFound) {
+			t.Fatalf("Expected db.ErrorNotFound but got %v", err)
+		}
+	}
+
+	if stats := c.stats(); fetches != 1 || stats.NegativeHits != 1 {
+		t.Fatalf("Expected a cached not found result (%d fetches, %+v)", fetches, stats)
+	}
+
+	c.set(&db.ShortURLInfo{ShortURL: "shorturl"})
+	time.Sleep(30 * time.Millisecond)
+
+	if _, found := c.get("shorturl"); found {
+		t.Fatal("Expected shorturl to expire")
+	}
+
+	if _, err := c.load("missing", notFound); err == nil || fetches != 2 {
+		t.Fatalf("Expected an expired not found result to be fetched again (%d fetches, %v)", fetches, err)
+	}
+
+	// Other errors are not cached.
+	failures := 0
+	for _, fetchErr := range []error{errors.New("database is down"), fmt.Errorf("%w: short URL is empty", db.ErrorBadRequest)} {
+		for i := 0; i < 2; i++ {
+			c.load("failing", func() (*db.ShortURLInfo, error) {
+				failures++
+				return nil, fetchErr
+			})
+		}
+	}
+	if failures != 4 {
+		t.Fatalf("Expected 4 failed fetches but got %d", failures)
+	}
+}
+
+func TestURLCache_singleflight(t *testing.T) {
+	c := newURLCache(10, time.Hour, time.Hour)
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func() (*db.ShortURLInfo, error) {
+		fetches.Add(1)
+		<-release
+		return &db.ShortURLInfo{ShortURL: "shorturl"}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.load("shorturl", fetch); err != nil {
+				t.Errorf("load error: %v", err)
+			}
+		}()
+	}
+
+	// Wait for all loads to miss the cache.
+	for i := 0; i < 100 && c.stats().Misses != 10; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("Expected 1 fetch but got %d", n)
+	}
+}
+
+func TestURLCache_removeDuringLoad(t *testing.T) {
+	c := newURLCache(10, time.Hour, time.Hour)
+
+	// A short URL updated while it is being fetched is not cached with the
+	// information read before the update.
+	_, err := c.load("shorturl", func() (*db.ShortURLInfo, error) {
+		c.remove("shorturl")
+		return &db.ShortURLInfo{ShortURL: "shorturl"}, nil
+	})
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+
+	if _, found := c.get("shorturl"); found {
+		t.Fatal("Expected shorturl not to be cached")
+	}
+}
+
+func TestWebServer_redirectCache(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerEmail := "owner@email.com"
+	tURLOwners(t, s, ownerEmail, "other@email.com", "ownedurl")
+	// Short URLs read from the database are cached.
+	s.urlCache.remove("ownedurl")
+
+	for _, shortURL := range []string{"ownedurl", "ownedurl", "missingurl", "missingurl"} {
+		s.activeShortURL(shortURL)
+	}
+
+	stats := s.urlCache.stats()
+	if stats.Hits != 1 || stats.NegativeHits != 1 || stats.Misses != 2 {
+		t.Fatalf("Unexpected cache stats %+v", stats)
+	}
+}
+
+func TestWebServer_cacheInvalidation(t *testing.T) {
+	// Two servers sharing a database and a cache bus behave like two
+	// instances behind a load balancer.
+	appDB, cacheBus := mem.New(), cachebus.NewInProcess()
+	s1 := startTServer(t, Config{CacheBus: cacheBus}, appDB)
+	defer s1.Stop()
+	s2 := startTServer(t, Config{CacheBus: cacheBus}, appDB)
+	defer s2.Stop()
+
+	ownerHeaders, _ := tURLOwners(t, s1, "owner@email.com", "other@email.com", "ownedurl")
+
+	// Cache the short URL on the second server.
+	if _, err := s2.activeShortURL("ownedurl"); err != nil {
+		t.Fatalf("activeShortURL error: %v", err)
+	}
+
+	var resp *APIResponse
+	req := updateShortURLRequest{LongURL: "https://example.org"}
+	if err := s1.sendRequest(fiber.MethodPatch, "api/url?shortUrl=ownedurl", req, &resp, ownerHeaders); err != nil || !resp.Ok {
+		t.Fatalf("Failed to update short URL: %v, %+v", err, resp)
+	}
+
+	urlInfo, err := s2.activeShortURL("ownedurl")
+	if err != nil {
+		t.Fatalf("activeShortURL error: %v", err)
+	}
+
+	if urlInfo.OriginalURL != "https://example.org" {
+		t.Fatalf("Expected the updated long URL but got %s", urlInfo.OriginalURL)
+	}
+
+	disable := true
+	req = updateShortURLRequest{Disable: &disable}
+	if err := s1.sendRequest(fiber.MethodPatch, "api/url?shortUrl=ownedurl", req, &resp, ownerHeaders); err != nil || !resp.Ok {
+		t.Fatalf("Failed to disable short URL: %v, %+v", err, resp)
+	}
+
+	if _, err := s2.activeShortURL("ownedurl"); err == nil {
+		t.Fatal("Expected the disabled short URL to be rejected")
+	}
+
+	// An empty short URL clears the cache.
+	s2.activeShortURL("ownedurl")
+	cacheBus.Publish(context.Background(), "")
+	if stats := s2.urlCache.stats(); stats.Size != 0 {
+		t.Fatalf("Expected an empty cache but got %+v", stats)
+	}
+}
@@ -0,0 +1,188 @@
+package webserver
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+)
+
+// Defaults for the click ingestion settings in ClicksConfig.
+const (
+	defaultClickQueueSize     = 10000
+	defaultClickBatchSize     = 500
+	defaultClickFlushInterval = time.Second
+	defaultClickWorkers       = 2
+)
+
+// queuedClick is a click waiting to be recorded.
+type queuedClick struct {
+	shortURL string
+	click    *db.ShortURLClick
+}
+
+// clickIngester records clicks in the background. Clicks are queued in a
+// bounded queue and workers record them in batches with
+// db.DataStore.RecordShortURLClicks, which increments the click count of each
+// short URL once per batch. A batch is recorded when it is full or when the
+// flush interval has passed. Clicks are dropped when the queue is full.
+type clickIngester struct {
+	db            db.DataStore
+	batchSize     int
+	flushInterval time.Duration
+
+	// closeMtx guards queue against sends after close.
+	closeMtx sync.RWMutex
+	closed   bool
+	queue    chan *queuedClick
+	wg       sync.WaitGroup
+
+	enqueued atomic.Uint64
+	dropped  atomic.Uint64
+	recorded atomic.Uint64
+	failed   atomic.Uint64
+	batches  atomic.Uint64
+}
+
+// clickIngestionStats are the metrics of a clickIngester.
+type clickIngestionStats struct {
+	// Queued is the number of clicks waiting in the queue.
+	Queued        int `json:"queued"`
+	QueueCapacity int `json:"queueCapacity"`
+	// Enqueued is the number of clicks added to the queue.
+	Enqueued uint64 `json:"enqueued"`
+	// Dropped is the number of clicks dropped because the queue was full.
+	Dropped uint64 `json:"dropped"`
+	// Recorded is the number of clicks written to the database.
+	Recorded uint64 `json:"recorded"`
+	// Failed is the number of clicks that could not be written to the
+	// database.
+	Failed uint64 `json:"failed"`
+	// Batches is the number of batches written to the database.
+	Batches uint64 `json:"batches"`
+}
+
+// newClickIngester creates a *clickIngester with the click ingestion settings
+// in cfg and starts its workers. Zero settings are replaced with defaults.
+func newClickIngester(appDB db.DataStore, cfg ClicksConfig) *clickIngester {
+	queueSize, batchSize, flushInterval, workers := cfg.QueueSize, cfg.BatchSize, cfg.FlushInterval, cfg.Workers
+	if queueSize <= 0 {
+		queueSize = defaultClickQueueSize
+	}
+	if batchSize <= 0 {
+		batchSize = defaultClickBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultClickFlushInterval
+	}
+	if workers <= 0 {
+		workers = defaultClickWorkers
+	}
+
+	ci := &clickIngester{
+		db:            appDB,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		queue:         make(chan *queuedClick, queueSize),
+	}
+
+	ci.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go ci.run()
+	}
+
+	return ci
+}
+
+// enqueue queues a click on shortURL without blocking. It returns false if
+// the click was dropped because the queue is full or the ingester is stopped.
+func (ci *clickIngester) enqueue(shortURL string, click *db.ShortURLClick) bool {
+	ci.closeMtx.RLock()
+	defer ci.closeMtx.RUnlock()
+	if ci.closed {
+		ci.dropped.Add(1)
+		return false
+	}
+
+	select {
+	case ci.queue <- &queuedClick{shortURL: shortURL, click: click}:
+		ci.enqueued.Add(1)
+		return true
+	default:
+		ci.dropped.Add(1)
+		return false
+	}
+}
+
+// run records queued clicks in batches until the queue is closed and
+// drained.
+func (ci *clickIngester) run() {
+	defer ci.wg.Done()
+
+	tick := time.NewTicker(ci.flushInterval)
+	defer tick.Stop()
+
+	batch := make(map[string][]*db.ShortURLClick)
+	var n int
+	flush := func() {
+		if n == 0 {
+			return
+		}
+
+		if err := ci.db.RecordShortURLClicks(batch); err != nil {
+			appLog.Printf("\ndb.RecordShortURLClicks error: %v\n", err)
+			ci.failed.Add(uint64(n))
+		} else {
+			ci.recorded.Add(uint64(n))
+			ci.batches.Add(1)
+		}
+
+		batch = make(map[string][]*db.ShortURLClick)
+		n = 0
+	}
+
+	for {
+		select {
+		case qc, ok := <-ci.queue:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch[qc.shortURL] = append(batch[qc.shortURL], qc.click)
+			n++
+			if n >= ci.batchSize {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// stop stops accepting clicks and waits for the workers to record all queued
+// clicks.
+func (ci *clickIngester) stop() {
+	ci.closeMtx.Lock()
+	if !ci.closed {
+		ci.closed = true
+		close(ci.queue)
+	}
+	ci.closeMtx.Unlock()
+
+	ci.wg.Wait()
+}
+
+// stats returns the current metrics of the ingester.
+func (ci *clickIngester) stats() *clickIngestionStats {
+	return &clickIngestionStats{
+		Queued:        len(ci.queue),
+		QueueCapacity: cap(ci.queue),
+		Enqueued:      ci.enqueued.Load(),
+		Dropped:       ci.dropped.Load(),
+		Recorded:      ci.recorded.Load(),
+		Failed:        ci.failed.Load(),
+		Batches:       ci.batches.Load(),
+	}
+}
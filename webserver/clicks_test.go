@@ -0,0 +1,173 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/db/mem"
+)
+
+// tClickDB creates an in-memory database with a short URL owned by
+// ownerEmail.
+func tClickDB(t *testing.T, ownerEmail string) (*mem.MemDB, string) {
+	memDB := mem.New()
+	if err := memDB.CreateUser("owner", ownerEmail, []byte(dummyUserPassword)); err != nil {
+		t.Fatalf("memDB.CreateUser error: %v", err)
+	}
+
+	urlInfo, err := memDB.CreateNewShortURL(ownerEmail, "https://example.com", "", false, nil)
+	if err != nil {
+		t.Fatalf("memDB.CreateNewShortURL error: %v", err)
+	}
+
+	return memDB, urlInfo.ShortURL
+}
+
+func TestClickIngester_batches(t *testing.T) {
+	ownerEmail := "owner@email.com"
+	memDB, shortURL := tClickDB(t, ownerEmail)
+
+	ci := newClickIngester(memDB, ClicksConfig{BatchSize: 3, FlushInterval: time.Hour, Workers: 1})
+	defer ci.stop()
+
+	for i := 0; i < 3; i++ {
+		if !ci.enqueue(shortURL, &db.ShortURLClick{IP: "127.0.0.1", Timestamp: int64(i)}) {
+			t.Fatal("Expected click to be queued")
+		}
+	}
+	// Clicks on short URLs that no longer exist are dropped by the database.
+	ci.enqueue("unknown", &db.ShortURLClick{IP: "127.0.0.1"})
+
+	// A full batch is recorded without waiting for the flush interval.
+	for i := 0; i < 100 && ci.stats().Batches == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := ci.stats()
+	if stats.Batches != 1 || stats.Recorded != 3 || stats.Enqueued != 4 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	urlInfo, err := memDB.RetrieveURLInfo(shortURL)
+	if err != nil {
+		t.Fatalf("memDB.RetrieveURLInfo error: %v", err)
+	}
+
+	if urlInfo.Clicks != 3 {
+		t.Fatalf("Expected 3 clicks but got %d", urlInfo.Clicks)
+	}
+}
+
+func TestClickIngester_stop(t *testing.T) {
+	ownerEmail := "owner@email.com"
+	memDB, shortURL := tClickDB(t, ownerEmail)
+
+	ci := newClickIngester(memDB, ClicksConfig{BatchSize: 100, FlushInterval: time.Hour, Workers: 4})
+	for i := 0; i < 250; i++ {
+		ci.enqueue(shortURL, &db.ShortURLClick{IP: "127.0.0.1", Timestamp: int64(i)})
+	}
+
+	// Stopping records the queued clicks.
+	ci.stop()
+
+	clicks, err := memDB.RetrieveShortURLClicks(ownerEmail, shortURL)
+	if err != nil {
+		t.Fatalf("memDB.RetrieveShortURLClicks error: %v", err)
+	}
+
+	if len(clicks) != 250 {
+		t.Fatalf("Expected 250 clicks but got %d", len(clicks))
+	}
+
+	if stats := ci.stats(); stats.Recorded != 250 || stats.Queued != 0 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	if ci.enqueue(shortURL, &db.ShortURLClick{IP: "127.0.0.1"}) {
+		t.Fatal("Expected click to be dropped after stop")
+	}
+
+	// Stopping again is a no-op.
+	ci.stop()
+}
+
+func TestClickIngester_dropsWhenFull(t *testing.T) {
+	// An ingester without workers keeps queued clicks.
+	ci := &clickIngester{queue: make(chan *queuedClick, 2)}
+	for i := 0; i < 5; i++ {
+		ci.enqueue("shorturl", &db.ShortURLClick{IP: "127.0.0.1"})
+	}
+
+	stats := ci.stats()
+	if stats.Enqueued != 2 || stats.Dropped != 3 || stats.Queued != 2 || stats.QueueCapacity != 2 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+// tFailingClickDB is a db.DataStore that fails to record clicks.
+type tFailingClickDB struct {
+	db.DataStore
+}
+
+func (tFailingClickDB) RecordShortURLClicks(map[string][]*db.ShortURLClick) error {
+	return errors.New("database is down")
+}
+
+func TestClickIngester_failedBatch(t *testing.T) {
+	ci := newClickIngester(tFailingClickDB{mem.New()}, ClicksConfig{BatchSize: 100, FlushInterval: time.Hour, Workers: 1})
+	ci.enqueue("shorturl", &db.ShortURLClick{IP: "127.0.0.1"})
+	ci.enqueue("shorturl", &db.ShortURLClick{IP: "127.0.0.1"})
+	ci.stop()
+
+	if stats := ci.stats(); stats.Failed != 2 || stats.Recorded != 0 || stats.Batches != 0 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestWebServer_handleMetrics(t *testing.T) {
+	disabled := newTServer(t)
+	disabled.Stop()
+	if disabled.metrics != nil {
+		t.Fatal("Expected metrics to not be served by default")
+	}
+
+	s := startTServer(t, Config{MetricsAddr: "127.0.0.1:0"}, mem.New())
+	defer s.Stop()
+
+	ownerEmail := "owner@email.com"
+	tURLOwners(t, s, ownerEmail, "other@email.com", "ownedurl")
+	s.clicks.enqueue("ownedurl", &db.ShortURLClick{IP: "127.0.0.1"})
+	s.waitForClicks(t, ownerEmail, "ownedurl", 1)
+
+	// Metrics are only served by the metrics listener.
+	res, err := s.Test(httptest.NewRequest(fiber.MethodGet, "/api/metrics", nil))
+	if err != nil {
+		t.Fatalf("s.Test error: %v", err)
+	}
+	if res.StatusCode != codeNotFound {
+		t.Fatalf("Expected code %d from the public listener but got %d", codeNotFound, res.StatusCode)
+	}
+
+	res, err = s.metrics.Test(httptest.NewRequest(fiber.MethodGet, "/api/metrics", nil))
+	if err != nil {
+		t.Fatalf("s.metrics.Test error: %v", err)
+	}
+	defer res.Body.Close()
+
+	var resp struct {
+		APIResponse
+		Clicks *clickIngestionStats `json:"clicks"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("json.Decode error: %v", err)
+	}
+
+	if !resp.Ok || resp.Clicks == nil || resp.Clicks.Enqueued != 1 || resp.Clicks.Recorded != 1 || resp.Clicks.QueueCapacity != defaultClickQueueSize {
+		t.Fatalf("Unexpected metrics response %+v (%+v)", resp, resp.Clicks)
+	}
+}
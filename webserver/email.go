@@ -0,0 +1,412 @@
+package webserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/mailer"
+)
+
+const (
+	// emailVerificationExpiry is how long an email verification token is
+	// valid.
+	emailVerificationExpiry = 48 * time.Hour
+	// passwordResetExpiry is how long a password reset token is valid.
+	passwordResetExpiry = time.Hour
+	// userTokenLength is the number of random bytes in email verification
+	// and password reset tokens.
+	userTokenLength = 32
+	// sendEmailTimeout is the timeout of sending an email.
+	sendEmailTimeout = 30 * time.Second
+	// maxEmailRequests is the number of requests that send an email a client
+	// can make within emailRequestWindow.
+	maxEmailRequests   = 5
+	emailRequestWindow = 15 * time.Minute
+	// forgotPasswordMessage is the response of the forgot password endpoint.
+	// It is the same whether or not the account exists.
+	forgotPasswordMessage = "If an account with this email exists, a password reset email has been sent."
+)
+
+// verifyEmailTmpl is the page served for the links in email verification
+// emails. The email is only verified once its form is submitted, so that mail
+// scanners that prefetch links do not use up the token.
+var verifyEmailTmpl = template.Must(template.New("verifyEmail").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Verify your email - {{.AppName}}</title>
+</head>
+<body>
+{{if .Token}}<form method="post" action="{{.Action}}">
+<p>Confirm that you want to verify the email of your {{.AppName}} account.</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Verify email</button>
+</form>{{else}}<p role="alert">{{.Message}}</p>{{end}}
+</body>
+</html>
+`))
+
+// emailLimiter limits the requests that send an email per client, so they
+// cannot be used to flood inboxes.
+func emailLimiter() fiber.Handler {
+	return limiter.New(limiter.Config{
+		Max:        maxEmailRequests,
+		Expiration: emailRequestWindow,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.IP()
+		},
+	})
+}
+
+// newUserToken generates a single-use token for the user with the specified
+// email and stores its hash. The token is returned.
+func (s *WebServer) newUserToken(email, purpose string, expiry time.Duration) (string, error) {
+	b, err := randomBytes(userTokenLength)
+	if err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	err = s.db.CreateUserToken(&db.UserToken{
+		TokenHash: hashUserToken(token),
+		Email:     email,
+		Purpose:   purpose,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(expiry).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// hashUserToken returns the SHA-256 hash of a user token.
+func hashUserToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// consumeUserToken uses up a token for purpose and returns it.
+func (s *WebServer) consumeUserToken(token, purpose string) (*db.UserToken, error) {
+	if token == "" {
+		return nil, errBadRequest("token is required")
+	}
+
+	userToken, err := s.db.ConsumeUserToken(hashUserToken(token), purpose, time.Now().Unix())
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return nil, errBadRequest("invalid or expired token")
+		}
+
+		appLog.Printf("\ndb.ConsumeUserToken error: %v\n", err)
+		return nil, errInternal(err)
+	}
+
+	return userToken, nil
+}
+
+// tokenLink returns baseURL with token as the "token" query parameter, or an
+// empty string if baseURL is empty.
+func tokenLink(baseURL, token string) string {
+	if baseURL == "" {
+		return ""
+	}
+
+	sep := "?"
+	if strings.Contains(baseURL, "?") {
+		sep = "&"
+	}
+	return baseURL + sep + url.Values{"token": {token}}.Encode()
+}
+
+// sendEmail sends msg in the background so the response does not wait for
+// the mail server and does not reveal whether an email was sent. Errors are
+// logged.
+func (s *WebServer) sendEmail(msg *mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(s.ctx, sendEmailTimeout)
+		defer cancel()
+		if err := s.mailer.Send(ctx, msg); err != nil {
+			appLog.Printf("\nmailer.Send error: %v\n", err)
+		}
+	}()
+}
+
+// sendVerificationEmail sends an email verification token to the user with
+// the specified email.
+func (s *WebServer) sendVerificationEmail(email string) error {
+	token, err := s.newUserToken(email, db.UserTokenVerifyEmail, emailVerificationExpiry)
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if s.publicURL != "" {
+		link = tokenLink(s.publicURL+"/api/email/verify", token)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Welcome to %s!\n\n", AppName)
+	if link != "" {
+		fmt.Fprintf(&body, "Open this link to verify your email:\n\n%s\n\n", link)
+	} else {
+		fmt.Fprintf(&body, "Use this token to verify your email:\n\n%s\n\n", token)
+	}
+	fmt.Fprintf(&body, "The %s expires in %d hours. If you did not create an account, ignore this email.\n", tokenNoun(link), int(emailVerificationExpiry.Hours()))
+
+	s.sendEmail(&mailer.Message{To: email, Subject: "Verify your " + AppName + " email", Body: body.String()})
+	return nil
+}
+
+// sendPasswordResetEmail sends a password reset token to the user with the
+// specified email.
+func (s *WebServer) sendPasswordResetEmail(email string) error {
+	token, err := s.newUserToken(email, db.UserTokenResetPassword, passwordResetExpiry)
+	if err != nil {
+		return err
+	}
+
+	link := tokenLink(s.passwordResetURL, token)
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Someone asked to reset the password of your %s account.\n\n", AppName)
+	if link != "" {
+		fmt.Fprintf(&body, "Open this link to choose a new password:\n\n%s\n\n", link)
+	} else {
+		fmt.Fprintf(&body, "Use this token to choose a new password:\n\n%s\n\n", token)
+	}
+	fmt.Fprintf(&body, "The %s expires in %d minutes and can only be used once. If you did not ask to reset your password, ignore this email.\n", tokenNoun(link), int(passwordResetExpiry.Minutes()))
+
+	s.sendEmail(&mailer.Message{To: email, Subject: "Reset your " + AppName + " password", Body: body.String()})
+	return nil
+}
+
+// sendEmailChangedEmail tells the user at oldEmail that the email of their
+// account was changed to newEmail.
+func (s *WebServer) sendEmailChangedEmail(oldEmail, newEmail string) {
+	body := fmt.Sprintf("The email of your %s account was changed to %s.\n\nIf you did not change it, someone else has access to your account.\n", AppName, newEmail)
+	s.sendEmail(&mailer.Message{To: oldEmail, Subject: "Your " + AppName + " email was changed", Body: body})
+}
+
+// tokenNoun returns how an email refers to its token.
+func tokenNoun(link string) string {
+	if link != "" {
+		return "link"
+	}
+	return "token"
+}
+
+// requireVerifiedEmail returns an error if the email of the user with the
+// specified email must be verified and is not.
+func (s *WebServer) requireVerifiedEmail(email string) error {
+	if !s.emailVerificationRequired {
+		return nil
+	}
+
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	if !user.EmailVerified {
+		return errForbidden("verify your email to use this feature")
+	}
+
+	return nil
+}
+
+// handleVerifyEmailPage handles the "GET /api/email/verify?token=" endpoint
+// linked in email verification emails. It serves a form that posts the token
+// to "POST /api/email/verify" and does not use up the token itself.
+func (s *WebServer) handleVerifyEmailPage(c *fiber.Ctx) error {
+	token := c.Query("token")
+	if token == "" {
+		return errBadRequest("token is required")
+	}
+
+	return renderVerifyEmailPage(c, codeOk, token, "")
+}
+
+// handleVerifyEmail handles the "POST /api/email/verify" endpoint and
+// verifies the email of the user of an email verification token. Submissions
+// of the verification page get a page in response.
+func (s *WebServer) handleVerifyEmail(c *fiber.Ctx) error {
+	form := new(userTokenRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	isPage := strings.HasPrefix(string(c.Request().Header.ContentType()), fiber.MIMEApplicationForm)
+	userToken, err := s.consumeUserToken(form.Token, db.UserTokenVerifyEmail)
+	if err != nil {
+		var resp *APIResponse
+		if isPage && errors.As(err, &resp) {
+			return renderVerifyEmailPage(c, resp.Code, "", "This link is invalid or has expired.")
+		}
+		return err
+	}
+
+	if err := s.db.SetEmailVerified(userToken.Email); err != nil {
+		appLog.Printf("\ndb.SetEmailVerified error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	if isPage {
+		return renderVerifyEmailPage(c, codeOk, "", "Your email is verified.")
+	}
+
+	resp := newAPIResponse(true, codeOk, "Email Verified.")
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// renderVerifyEmailPage responds with the email verification page. The page
+// has a form that submits token if it is not empty, otherwise it shows msg.
+func renderVerifyEmailPage(c *fiber.Ctx, code int, token, msg string) error {
+	var b bytes.Buffer
+	err := verifyEmailTmpl.Execute(&b, map[string]string{
+		"AppName": AppName,
+		"Action":  c.Path(),
+		"Token":   token,
+		"Message": msg,
+	})
+	if err != nil {
+		return errInternal(err)
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Status(code).Send(b.Bytes())
+}
+
+// handleResendVerificationEmail handles the "POST /api/email/verify/resend"
+// endpoint and sends a new email verification token to the logged in user.
+func (s *WebServer) handleResendVerificationEmail(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	if user.EmailVerified {
+		return errBadRequest("your email is already verified")
+	}
+
+	if err := s.sendVerificationEmail(email); err != nil {
+		appLog.Printf("\nerror sending verification email: %v\n", err)
+		return errInternal(err)
+	}
+
+	resp := newAPIResponse(true, codeOk, "Verification Email Sent.")
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleForgotPassword handles the "POST /api/password/forgot" endpoint and
+// sends a password reset token to the email of an account. The response does
+// not reveal whether the account exists.
+func (s *WebServer) handleForgotPassword(c *fiber.Ctx) error {
+	form := new(forgotPasswordRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	if !isValidEmail(form.Email) {
+		return errBadRequest("a valid email is required")
+	}
+
+	// Look up the account in the background so the response time does not
+	// reveal whether it exists.
+	email := form.Email
+	go func() {
+		if _, err := s.db.RetrieveUserInfo(email); err != nil {
+			if !errors.Is(err, db.ErrorBadRequest) {
+				appLog.Printf("\ndb.RetrieveUserInfo error: %v\n", err)
+			}
+			return
+		}
+
+		if err := s.sendPasswordResetEmail(email); err != nil {
+			appLog.Printf("\nerror sending password reset email: %v\n", err)
+		}
+	}()
+
+	resp := newAPIResponse(true, codeOk, forgotPasswordMessage)
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleResetPassword handles the "POST /api/password/reset" endpoint and sets
+// a new password for the user of a password reset token. Every session of the
+// user is logged out and the failed logins of the account are forgotten.
+func (s *WebServer) handleResetPassword(c *fiber.Ctx) error {
+	form := new(resetPasswordRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	// The rules that do not depend on the user are checked before the token
+	// is used up.
+	password := passwordBytes(form.Password)
+	defer password.Zero()
+	if violations := s.policy.validatePassword(password); len(violations) > 0 {
+		return errPolicy(violations)
+	}
+
+	userToken, err := s.consumeUserToken(form.Token, db.UserTokenResetPassword)
+	if err != nil {
+		return err
+	}
+
+	email := userToken.Email
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	if violations := s.policy.validatePassword(password, user.Username, email); len(violations) > 0 {
+		// Restore the token so that the user can choose another password.
+		if err := s.db.CreateUserToken(userToken); err != nil {
+			appLog.Printf("\ndb.CreateUserToken error: %v\n", err)
+		}
+		return errPolicy(violations)
+	}
+
+	if err := s.db.ResetUserPassword(email, password.Bytes()); err != nil {
+		appLog.Printf("\ndb.ResetUserPassword error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	// The user proved that they own the email.
+	if err := s.db.SetEmailVerified(email); err != nil {
+		appLog.Printf("\ndb.SetEmailVerified error: %v\n", err)
+	}
+
+	if _, err := s.db.RevokeUserSessions(email); err != nil {
+		appLog.Printf("\ndb.RevokeUserSessions error: %v\n", err)
+		return errInternal(err)
+	}
+
+	// The user proved that they own the email, failed logins of others must
+	// not keep them out.
+	s.clearLoginAttempts(accountLoginKey(email))
+
+	resp := newAPIResponse(true, codeOk, "Password Reset. Log in with your new password.")
+	return c.Status(resp.Code).JSON(resp)
+}
@@ -0,0 +1,297 @@
+package webserver
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db/mem"
+	"github.com/ukane-philemon/bob/mailer"
+)
+
+// tMailer is a mailer.Mailer that records the emails it sends.
+type tMailer struct {
+	messages chan *mailer.Message
+}
+
+func newTMailer() *tMailer {
+	return &tMailer{messages: make(chan *mailer.Message, 10)}
+}
+
+func (m *tMailer) Send(_ context.Context, msg *mailer.Message) error {
+	m.messages <- msg
+	return nil
+}
+
+func (m *tMailer) Close() error {
+	return nil
+}
+
+// nextEmail waits for the next email sent to the specified address and
+// returns its token.
+func (m *tMailer) nextEmail(t *testing.T, to string) (*mailer.Message, string) {
+	t.Helper()
+	select {
+	case msg := <-m.messages:
+		if msg.To != to {
+			t.Fatalf("Expected an email to %s but got one to %s", to, msg.To)
+		}
+
+		match := regexp.MustCompile(`https?://\S+`).FindString(msg.Body)
+		link, err := url.Parse(match)
+		if err != nil || link.Query().Get("token") == "" {
+			t.Fatalf("Expected a link with a token in %q", msg.Body)
+		}
+		return msg, link.Query().Get("token")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an email to %s", to)
+		return nil, ""
+	}
+}
+
+// requireNoEmail fails the test if an email is sent shortly.
+func (m *tMailer) requireNoEmail(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-m.messages:
+		t.Fatalf("Unexpected email to %s", msg.To)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebServer_handleVerifyEmail(t *testing.T) {
+	m := newTMailer()
+	cfg := Config{
+		Mailer:               m,
+		PublicURL:            "https://bob.test/",
+		RequireVerifiedEmail: true,
+	}
+	s := startTServer(t, cfg, mem.New())
+	defer s.Stop()
+
+	const email = "test@email.com"
+	var resp *APIResponse
+	req := createAccountRequest{Username: "fibrealz", Email: email, Password: dummyUserPassword}
+	if err := s.sendRequest(fiber.MethodPost, "api/user", req, &resp, nil); err != nil || resp.Code != codeOk {
+		t.Fatalf("Expected the account to be created: %v %+v", err, resp)
+	}
+
+	msg, token := m.nextEmail(t, email)
+	if !regexp.MustCompile(`https://bob\.test/api/email/verify\?token=`).MatchString(msg.Body) {
+		t.Fatalf("Unexpected verification email %q", msg.Body)
+	}
+
+	headers := s.authHeaders(t, email)
+	createURL := func() int {
+		t.Helper()
+		var resp *shortURLResponse
+		req := createShortURLRequest{LongURL: "https://example.com"}
+		if err := s.sendRequest(fiber.MethodPost, "api/url", req, &resp, headers); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		return resp.Code
+	}
+
+	if code := createURL(); code != codeForbidden {
+		t.Fatalf("Expected an unverified user to be forbidden from creating short URLs but got %d", code)
+	}
+
+	// A new token can be requested and every unused token verifies the
+	// email.
+	if err := s.sendRequest(fiber.MethodPost, "api/email/verify/resend", nil, &resp, headers); err != nil || resp.Code != codeOk {
+		t.Fatalf("Expected a new verification email: %v %+v", err, resp)
+	}
+	_, newToken := m.nextEmail(t, email)
+
+	// The link serves a page that posts the token and does not use it up.
+	verifyPage := func(method, query string, body io.Reader) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(method, "/api/email/verify"+query, body)
+		if body != nil {
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		}
+		res, err := s.Test(req)
+		if err != nil {
+			t.Fatalf("s.Test error: %v", err)
+		}
+		defer res.Body.Close()
+		page, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("io.ReadAll error: %v", err)
+		}
+		return res.StatusCode, string(page)
+	}
+
+	if code, _ := verifyPage(fiber.MethodGet, "", nil); code != codeBadRequest {
+		t.Fatalf("Expected a link without a token to be rejected but got %d", code)
+	}
+
+	code, page := verifyPage(fiber.MethodGet, "?token="+url.QueryEscape(token), nil)
+	if code != codeOk || !strings.Contains(page, `method="post"`) || !strings.Contains(page, token) {
+		t.Fatalf("Expected the verification form but got %d: %s", code, page)
+	}
+
+	if user, err := s.db.RetrieveUserInfo(email); err != nil || user.EmailVerified {
+		t.Fatalf("Expected the email to be unverified after opening the link: %v %+v", err, user)
+	}
+
+	for _, invalidToken := range []string{"", "invalid"} {
+		if err := s.sendRequest(fiber.MethodPost, "api/email/verify", userTokenRequest{Token: invalidToken}, &resp, nil); err != nil || resp.Code != codeBadRequest {
+			t.Fatalf("Expected token %q to be rejected: %v %+v", invalidToken, err, resp)
+		}
+	}
+
+	if code, page := verifyPage(fiber.MethodPost, "", strings.NewReader("token=invalid")); code != codeBadRequest || !strings.Contains(page, "invalid or has expired") {
+		t.Fatalf("Expected the form to reject an invalid token but got %d: %s", code, page)
+	}
+
+	if code, page := verifyPage(fiber.MethodPost, "", strings.NewReader(url.Values{"token": {newToken}}.Encode())); code != codeOk || !strings.Contains(page, "Your email is verified.") {
+		t.Fatalf("Expected the form to verify the email but got %d: %s", code, page)
+	}
+
+	// Verifying the email uses up every verification token.
+	if err := s.sendRequest(fiber.MethodPost, "api/email/verify", userTokenRequest{Token: token}, &resp, nil); err != nil || resp.Code != codeBadRequest {
+		t.Fatalf("Expected the old token to be rejected: %v %+v", err, resp)
+	}
+
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil || !user.EmailVerified {
+		t.Fatalf("Expected the email to be verified: %v %+v", err, user)
+	}
+
+	// The URL is not reachable from the test environment, so only check that
+	// the request is no longer forbidden.
+	if code := createURL(); code == codeForbidden {
+		t.Fatal("Expected a verified user to be allowed to create short URLs")
+	}
+
+	if err := s.sendRequest(fiber.MethodPost, "api/email/verify/resend", nil, &resp, headers); err != nil || resp.Code != codeBadRequest {
+		t.Fatalf("Expected no email for a verified user: %v %+v", err, resp)
+	}
+	m.requireNoEmail(t)
+}
+
+func TestWebServer_handleResetPassword(t *testing.T) {
+	m := newTMailer()
+	s := startTServer(t, Config{Mailer: m, PasswordResetURL: "https://app.test/reset?lang=en"}, mem.New())
+	defer s.Stop()
+
+	const email = "test@email.com"
+	login := tLogin(t, s, email)
+
+	forgot := func(email string) {
+		t.Helper()
+		var resp *APIResponse
+		if err := s.sendRequest(fiber.MethodPost, "api/password/forgot", forgotPasswordRequest{Email: email}, &resp, nil); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		if resp.Code != codeOk || resp.Message != forgotPasswordMessage {
+			t.Fatalf("Unexpected forgot password response %+v", resp)
+		}
+	}
+
+	reset := func(token, password string) *APIResponse {
+		t.Helper()
+		var resp *APIResponse
+		if err := s.sendRequest(fiber.MethodPost, "api/password/reset", resetPasswordRequest{Token: token, Password: password}, &resp, nil); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		return resp
+	}
+
+	// The response is the same for unknown accounts but no email is sent.
+	forgot("unknown@email.com")
+	m.requireNoEmail(t)
+
+	forgot(email)
+	msg, oldToken := m.nextEmail(t, email)
+	if !regexp.MustCompile(`https://app\.test/reset\?lang=en&token=`).MatchString(msg.Body) {
+		t.Fatalf("Unexpected password reset email %q", msg.Body)
+	}
+
+	forgot(email)
+	_, token := m.nextEmail(t, email)
+
+	// Lock the account. Resetting the password unlocks it.
+	for i := 0; i < accountLockThreshold; i++ {
+		var resp *loginResponse
+		req := loginRequest{Email: email, Password: "wrong password"}
+		if err := s.sendRequest(fiber.MethodPost, "api/login", req, &resp, nil); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+	}
+
+	const newPassword = "new password"
+	if resp := reset(token, "short"); resp.Code != codeBadRequest {
+		t.Fatalf("Expected a short password to be rejected but got %d", resp.Code)
+	}
+
+	if resp := reset("invalid", newPassword); resp.Code != codeBadRequest {
+		t.Fatalf("Expected an invalid token to be rejected but got %d", resp.Code)
+	}
+
+	if resp := reset(token, newPassword); resp.Code != codeOk {
+		t.Fatalf("Expected the password to be reset but got %d (%s)", resp.Code, resp.Message)
+	}
+
+	// Tokens can only be used once and resetting the password uses up the
+	// other reset tokens.
+	for _, token := range []string{token, oldToken} {
+		if resp := reset(token, "another password"); resp.Code != codeBadRequest {
+			t.Fatalf("Expected a used token to be rejected but got %d", resp.Code)
+		}
+	}
+
+	// Resetting the password logs out every session and verifies the email.
+	tRequireAuthCode(t, s, "session before reset", login.AuthToken, codeUnauthorized)
+
+	user, err := s.db.LoginUser(email, []byte(newPassword))
+	if err != nil || !user.EmailVerified {
+		t.Fatalf("Expected to log in with the new password and a verified email: %v %+v", err, user)
+	}
+
+	if _, err := s.db.LoginUser(email, []byte(dummyUserPassword)); err == nil {
+		t.Fatal("Expected the old password to be rejected")
+	}
+
+	var loginResp *loginResponse
+	req := loginRequest{Email: email, Password: newPassword}
+	if err := s.sendRequest(fiber.MethodPost, "api/login", req, &loginResp, nil); err != nil || loginResp.Code != codeOk {
+		t.Fatalf("Expected the reset to unlock the account: %v %+v", err, loginResp)
+	}
+}
+
+func TestWebServer_handleResetPasswordPolicy(t *testing.T) {
+	m := newTMailer()
+	s := startTServer(t, Config{Mailer: m, PasswordResetURL: "https://app.test/reset", Policy: PolicyConfig{MinPasswordStrength: 3}}, mem.New())
+	defer s.Stop()
+
+	const email = "test@email.com"
+	if err := s.db.CreateUser("fibrealz", email, []byte(dummyUserPassword)); err != nil {
+		t.Fatalf("s.db.CreateUser error: %s", err)
+	}
+
+	var resp *APIResponse
+	if err := s.sendRequest(fiber.MethodPost, "api/password/forgot", forgotPasswordRequest{Email: email}, &resp, nil); err != nil || resp.Code != codeOk {
+		t.Fatalf("Expected a password reset email: %v %+v", err, resp)
+	}
+	_, token := m.nextEmail(t, email)
+
+	// A password that is only weak because it contains the username is
+	// rejected and the token can still be used.
+	req := resetPasswordRequest{Token: token, Password: "Fibrealz#2023"}
+	if err := s.sendRequest(fiber.MethodPost, "api/password/reset", req, &resp, nil); err != nil || resp.Code != codeBadRequest {
+		t.Fatalf("Expected a password with the username to be rejected: %v %+v", err, resp)
+	}
+
+	req.Password = "Kx9#mPq2$vLw"
+	if err := s.sendRequest(fiber.MethodPost, "api/password/reset", req, &resp, nil); err != nil || resp.Code != codeOk {
+		t.Fatalf("Expected the password to be reset: %v %+v", err, resp)
+	}
+}
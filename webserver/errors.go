@@ -2,6 +2,7 @@ package webserver
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -9,8 +10,11 @@ import (
 // errorHandler handles all errors returned by route handlers.
 func errorHandler(c *fiber.Ctx, err error) error {
 	var r *APIResponse
+	var p *policyErrorResponse
 	var e *fiber.Error
 	switch {
+	case errors.As(err, &p):
+		return c.Status(p.Code).JSON(p)
 	case errors.As(err, &r):
 		return c.Status(r.Code).JSON(r)
 	case errors.As(err, &e):
@@ -31,6 +35,40 @@ func errUnauthorized(msg string) error {
 	return newAPIResponse(false, codeUnauthorized, msg)
 }
 
+// errForbidden returns a forbidden error.
+func errForbidden(msg string) error {
+	return newAPIResponse(false, codeForbidden, msg)
+}
+
+// errNotFound returns a not found error.
+func errNotFound(msg string) error {
+	return newAPIResponse(false, codeNotFound, msg)
+}
+
+// errGone returns a gone error.
+func errGone(msg string) error {
+	return newAPIResponse(false, codeGone, msg)
+}
+
+// errTooManyRequests returns a too many requests error.
+func errTooManyRequests(msg string) error {
+	return newAPIResponse(false, codeTooMany, msg)
+}
+
+// errPolicy returns a bad request error with the account policy rules that a
+// username or password breaks. The message joins the messages of violations.
+func errPolicy(violations []*policyViolation) error {
+	msgs := make([]string, 0, len(violations))
+	for _, v := range violations {
+		msgs = append(msgs, v.Message)
+	}
+
+	return &policyErrorResponse{
+		APIResponse: newAPIResponse(false, codeBadRequest, strings.Join(msgs, "; ")),
+		Violations:  violations,
+	}
+}
+
 // errInternal returns a server error.
 func errInternal(err error) error {
 	return newAPIResponse(false, codeInternal, "Something unexpected happened. Please try again later.")
@@ -1,7 +1,10 @@
 package webserver
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/cristalhq/jwt/v4"
@@ -10,51 +13,162 @@ import (
 const (
 	// jwtIssuer is the JWT issuer.
 	jwtIssuer = "B.O.B"
-	// jwtAlg is the JWT algorithm to use.
-	jwtAlg = jwt.HS256
 	// jwtAudienceUser is the JWT audience for user authentication.
 	jwtAudienceUser = "jwt-user"
-	// tokenExpiry is the default JWT token expiry.
-	tokenExpiry = 24 * time.Hour
+	// jwtAudienceLinkUnlock is the JWT audience for unlocked password
+	// protected short URLs.
+	jwtAudienceLinkUnlock = "link-unlock"
+	// jwtAudienceOIDCLogin is the JWT audience for OIDC logins in progress.
+	jwtAudienceOIDCLogin = "oidc-login"
+	// jwtAudienceMFAPending is the JWT audience for logins that wait for a
+	// two-factor authentication code.
+	jwtAudienceMFAPending = "mfa-pending"
+	// minJWTSecretLength is the minimum length of HS256 secrets.
+	minJWTSecretLength = 32
+	// jwtKeyReloadInterval is how often the JWT key file is checked for
+	// changes.
+	jwtKeyReloadInterval = time.Minute
 )
 
 // jwtAudience is the JWT audience type.
 type jwtAudience string
 
 // jwtAuthenticator is the JWT authenticator. It is used to generate and
-// validate JWT tokens.
+// validate JWT tokens. Tokens are signed with the active key and carry its key
+// ID, so tokens signed with keys that were rotated out are still accepted
+// during the grace period.
 type jwtAuthenticator struct {
-	builder  *jwt.Builder
-	verifier jwt.Verifier
+	// keyFile is the path to the PEM file the keys were loaded from. It is
+	// empty if the keys are not loaded from a file.
+	keyFile     string
+	gracePeriod time.Duration
+
+	mtx  sync.RWMutex
+	keys []*jwtKey
+	// keyFileInfo is the info of the key file the keys were loaded from.
+	keyFileInfo os.FileInfo
 }
 
-// newJWTAuthenticator creates a new *jwtAuthenticator.
-func newJWTAuthenticator(alg jwt.Algorithm) (*jwtAuthenticator, error) {
-	jwtSecret, err := randomBytes(32)
-	if err != nil {
-		return nil, fmt.Errorf("RandomBytes error: %w", err)
+// newJWTAuthenticator creates a new *jwtAuthenticator with the signing keys
+// from the JWT key file or the JWT secret in cfg. A random HS256 secret is
+// generated if neither is set.
+func newJWTAuthenticator(cfg Config) (*jwtAuthenticator, error) {
+	jwtAuth := &jwtAuthenticator{
+		keyFile:     cfg.JWTKeyFile,
+		gracePeriod: cfg.JWTKeyGracePeriod,
+	}
+
+	switch {
+	case cfg.JWTKeyFile != "":
+		if _, err := jwtAuth.reloadKeys(); err != nil {
+			return nil, err
+		}
+	case cfg.JWTSecret != "":
+		if len(cfg.JWTSecret) < minJWTSecretLength {
+			return nil, fmt.Errorf("JWT secret must be at least %d bytes long", minJWTSecretLength)
+		}
+
+		key, err := newJWTKey([]byte(cfg.JWTSecret))
+		if err != nil {
+			return nil, err
+		}
+		jwtAuth.keys = []*jwtKey{key}
+	default:
+		appLog.Println("No JWT key file or secret is configured, generating a random secret. Auth tokens must be refreshed when the server restarts.")
+		jwtSecret, err := randomBytes(minJWTSecretLength)
+		if err != nil {
+			return nil, fmt.Errorf("RandomBytes error: %w", err)
+		}
+
+		key, err := newJWTKey(jwtSecret)
+		if err != nil {
+			return nil, err
+		}
+		jwtAuth.keys = []*jwtKey{key}
 	}
 
-	signer, err := jwt.NewSignerHS(alg, jwtSecret)
+	return jwtAuth, nil
+}
+
+// reloadKeys loads the keys from the key file if it was modified or replaced
+// since the keys were last loaded. The current keys are kept if the file is
+// invalid.
+func (jwtAuth *jwtAuthenticator) reloadKeys() (bool, error) {
+	info, err := os.Stat(jwtAuth.keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("jwt.NewSignerHS error: %w", err)
+		return false, fmt.Errorf("failed to read JWT key file: %w", err)
+	}
+
+	jwtAuth.mtx.RLock()
+	// RotateJWTKey replaces the file, which is detected even if the new file
+	// has the same modification time.
+	prevInfo := jwtAuth.keyFileInfo
+	modified := prevInfo == nil || !os.SameFile(info, prevInfo) || !info.ModTime().Equal(prevInfo.ModTime())
+	jwtAuth.mtx.RUnlock()
+	if !modified {
+		return false, nil
 	}
 
-	verifier, err := jwt.NewVerifierHS(alg, jwtSecret[:])
+	keys, err := readJWTKeyFile(jwtAuth.keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("jwt.NewVerifierHS error: %w", err)
+		return false, err
 	}
 
-	authenticator := &jwtAuthenticator{
-		builder:  jwt.NewBuilder(signer),
-		verifier: verifier,
+	if activeJWTKey(keys, time.Now()) == nil {
+		return false, errors.New("JWT key file has no active signing key")
 	}
 
-	return authenticator, nil
+	jwtAuth.mtx.Lock()
+	jwtAuth.keys = keys
+	jwtAuth.keyFileInfo = info
+	jwtAuth.mtx.Unlock()
+
+	return true, nil
+}
+
+// signingKey returns the key used to sign new tokens.
+func (jwtAuth *jwtAuthenticator) signingKey() *jwtKey {
+	jwtAuth.mtx.RLock()
+	defer jwtAuth.mtx.RUnlock()
+	return activeJWTKey(jwtAuth.keys, time.Now())
+}
+
+// verificationKey returns the key with the specified ID if tokens signed with
+// it are accepted.
+func (jwtAuth *jwtAuthenticator) verificationKey(kid string) *jwtKey {
+	jwtAuth.mtx.RLock()
+	defer jwtAuth.mtx.RUnlock()
+	now := time.Now()
+	for _, key := range jwtAuth.keys {
+		if key.id == kid && key.acceptedAt(now, jwtAuth.gracePeriod) {
+			return key
+		}
+	}
+	return nil
+}
+
+// publicKeys returns the JWKs of the asymmetric keys whose tokens are or will
+// be accepted.
+func (jwtAuth *jwtAuthenticator) publicKeys() []*jwk {
+	jwtAuth.mtx.RLock()
+	defer jwtAuth.mtx.RUnlock()
+	now := time.Now()
+	keys := make([]*jwk, 0, len(jwtAuth.keys))
+	for _, key := range jwtAuth.keys {
+		if key.public != nil && key.acceptedAt(now, jwtAuth.gracePeriod) {
+			keys = append(keys, key.public)
+		}
+	}
+	return keys
 }
 
 // generateAuthToken generates a new JWT token.
 func (jwtAuth *jwtAuthenticator) generateAuthToken(id, subject string, audience jwtAudience, expiry time.Duration) (string, error) {
+	key := jwtAuth.signingKey()
+	if key == nil {
+		return "", errors.New("no active JWT signing key")
+	}
+
 	claims := &jwt.RegisteredClaims{
 		ID:        id,
 		Audience:  []string{string(audience)},
@@ -64,7 +178,7 @@ func (jwtAuth *jwtAuthenticator) generateAuthToken(id, subject string, audience
 		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiry)),
 	}
 
-	token, err := jwtAuth.builder.Build(claims)
+	token, err := key.builder.Build(claims)
 	if err != nil {
 		return "", fmt.Errorf("jwtAuthenticator.builder.Build error: %w", err)
 	}
@@ -72,18 +186,28 @@ func (jwtAuth *jwtAuthenticator) generateAuthToken(id, subject string, audience
 	return token.String(), nil
 }
 
-// validateAuthToken validates the given JWT token.
-func (jwtAuth *jwtAuthenticator) validateAuthToken(token string) (*jwt.RegisteredClaims, bool) {
+// validateAuthToken validates the given JWT token for the specified audience.
+func (jwtAuth *jwtAuthenticator) validateAuthToken(token string, audience jwtAudience) (*jwt.RegisteredClaims, bool) {
+	parsedToken, err := jwt.ParseNoVerify([]byte(token))
+	if err != nil {
+		return nil, false
+	}
+
+	key := jwtAuth.verificationKey(parsedToken.Header().KeyID)
+	if key == nil || key.verifier.Verify(parsedToken) != nil {
+		return nil, false
+	}
+
 	jwtClaims := new(jwt.RegisteredClaims)
-	err := jwt.ParseClaims([]byte(token), jwtAuth.verifier, jwtClaims)
-	if err != nil || !isValidJWTClaims(jwtClaims) {
+	if err := parsedToken.DecodeClaims(jwtClaims); err != nil || !isValidJWTClaims(jwtClaims, audience) {
 		return nil, false
 	}
 
 	return jwtClaims, true
 }
 
-// isValidJWTClaims checks if the given JWT claims are valid.
-func isValidJWTClaims(jwtClaims *jwt.RegisteredClaims) bool {
-	return jwtClaims.IsIssuer(jwtIssuer) && jwtClaims.IsValidAt(time.Now()) && jwtClaims.IsForAudience(jwtAudienceUser)
+// isValidJWTClaims checks if the given JWT claims are valid for the specified
+// audience.
+func isValidJWTClaims(jwtClaims *jwt.RegisteredClaims, audience jwtAudience) bool {
+	return jwtClaims.IsIssuer(jwtIssuer) && jwtClaims.IsValidAt(time.Now()) && jwtClaims.IsForAudience(string(audience))
 }
@@ -0,0 +1,184 @@
+package webserver
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cristalhq/jwt/v4"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db/mem"
+)
+
+// tTokenHeader returns the header of token.
+func tTokenHeader(t *testing.T, token string) jwt.Header {
+	parsedToken, err := jwt.ParseNoVerify([]byte(token))
+	if err != nil {
+		t.Fatalf("jwt.ParseNoVerify error: %v", err)
+	}
+	return parsedToken.Header()
+}
+
+func TestJWTAuthenticator_secret(t *testing.T) {
+	if _, err := newJWTAuthenticator(Config{JWTSecret: "too short"}); err == nil {
+		t.Fatal("Expected an error for a short secret")
+	}
+
+	// Servers configured with the same secret accept each other's tokens.
+	cfg := Config{JWTSecret: strings.Repeat("s", minJWTSecretLength)}
+	first, err := newJWTAuthenticator(cfg)
+	if err != nil {
+		t.Fatalf("newJWTAuthenticator error: %v", err)
+	}
+
+	second, err := newJWTAuthenticator(cfg)
+	if err != nil {
+		t.Fatalf("newJWTAuthenticator error: %v", err)
+	}
+
+	token, err := first.generateAuthToken("user@email.com", "user", jwtAudienceUser, accessTokenExpiry)
+	if err != nil {
+		t.Fatalf("generateAuthToken error: %v", err)
+	}
+
+	if _, ok := second.validateAuthToken(token, jwtAudienceUser); !ok {
+		t.Fatal("Expected the token to be valid")
+	}
+
+	if header := tTokenHeader(t, token); header.Algorithm != jwt.HS256 || header.KeyID == "" {
+		t.Fatalf("Unexpected token header %+v", header)
+	}
+
+	random, err := newJWTAuthenticator(Config{})
+	if err != nil {
+		t.Fatalf("newJWTAuthenticator error: %v", err)
+	}
+
+	if _, ok := random.validateAuthToken(token, jwtAudienceUser); ok {
+		t.Fatal("Expected the token to be rejected with a different key")
+	}
+}
+
+func TestJWTAuthenticator_rotation(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "jwt.pem")
+	kid, _, err := RotateJWTKey(keyFile, "EdDSA", time.Hour, accessTokenExpiry)
+	if err != nil {
+		t.Fatalf("RotateJWTKey error: %v", err)
+	}
+
+	cfg := Config{JWTKeyFile: keyFile, JWTKeyGracePeriod: accessTokenExpiry}
+	jwtAuth, err := newJWTAuthenticator(cfg)
+	if err != nil {
+		t.Fatalf("newJWTAuthenticator error: %v", err)
+	}
+
+	oldToken, err := jwtAuth.generateAuthToken("user@email.com", "user", jwtAudienceUser, accessTokenExpiry)
+	if err != nil {
+		t.Fatalf("generateAuthToken error: %v", err)
+	}
+
+	if header := tTokenHeader(t, oldToken); header.Algorithm != jwt.EdDSA || header.KeyID != kid {
+		t.Fatalf("Unexpected token header %+v", header)
+	}
+
+	// A key added with a delay is published but does not sign tokens yet.
+	delayedKID, _, err := RotateJWTKey(keyFile, "RS256", time.Hour, accessTokenExpiry)
+	if err != nil {
+		t.Fatalf("RotateJWTKey error: %v", err)
+	}
+
+	if reloaded, err := jwtAuth.reloadKeys(); err != nil || !reloaded {
+		t.Fatalf("Expected the keys to be reloaded (%v)", err)
+	}
+
+	if key := jwtAuth.signingKey(); key.id != kid {
+		t.Fatalf("Expected key %s to sign tokens but got %s", kid, key.id)
+	}
+
+	if jwks := jwtAuth.publicKeys(); len(jwks) != 2 || jwks[0].KeyID != delayedKID || jwks[0].Algorithm != "RS256" || jwks[0].N == "" {
+		t.Fatalf("Unexpected public keys %+v", jwks)
+	}
+
+	// Rotating without a delay retires both keys.
+	newKID, _, err := RotateJWTKey(keyFile, "EdDSA", 0, accessTokenExpiry)
+	if err != nil {
+		t.Fatalf("RotateJWTKey error: %v", err)
+	}
+
+	if _, err := jwtAuth.reloadKeys(); err != nil {
+		t.Fatalf("reloadKeys error: %v", err)
+	}
+
+	newToken, err := jwtAuth.generateAuthToken("user@email.com", "user", jwtAudienceUser, accessTokenExpiry)
+	if err != nil {
+		t.Fatalf("generateAuthToken error: %v", err)
+	}
+
+	if header := tTokenHeader(t, newToken); header.KeyID != newKID {
+		t.Fatalf("Expected the token to be signed with key %s but got %s", newKID, header.KeyID)
+	}
+
+	// Tokens signed with retired keys are accepted for the grace period.
+	for _, token := range []string{oldToken, newToken} {
+		if _, ok := jwtAuth.validateAuthToken(token, jwtAudienceUser); !ok {
+			t.Fatal("Expected the token to be valid")
+		}
+	}
+
+	cfg.JWTKeyGracePeriod = 0
+	noGrace, err := newJWTAuthenticator(cfg)
+	if err != nil {
+		t.Fatalf("newJWTAuthenticator error: %v", err)
+	}
+
+	if _, ok := noGrace.validateAuthToken(oldToken, jwtAudienceUser); ok {
+		t.Fatal("Expected the token signed with a retired key to be rejected")
+	}
+
+	// Keys whose grace period ended are removed on the next rotation.
+	if _, _, err := RotateJWTKey(keyFile, "HS256", 0, 0); err != nil {
+		t.Fatalf("RotateJWTKey error: %v", err)
+	}
+
+	keys, err := readJWTKeyFile(keyFile)
+	if err != nil {
+		t.Fatalf("readJWTKeyFile error: %v", err)
+	}
+
+	if len(keys) != 1 || keys[0].alg != jwt.HS256 {
+		t.Fatalf("Expected only the new key to be kept but got %d keys", len(keys))
+	}
+}
+
+func TestWebServer_handleJWKS(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "jwt.pem")
+	kid, _, err := RotateJWTKey(keyFile, "EdDSA", 0, accessTokenExpiry)
+	if err != nil {
+		t.Fatalf("RotateJWTKey error: %v", err)
+	}
+
+	// HMAC keys are never published.
+	if _, _, err := RotateJWTKey(keyFile, "HS256", time.Hour, accessTokenExpiry); err != nil {
+		t.Fatalf("RotateJWTKey error: %v", err)
+	}
+
+	s := startTServer(t, Config{JWTKeyFile: keyFile, JWTKeyGracePeriod: accessTokenExpiry}, mem.New())
+	defer s.Stop()
+
+	var resp struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := s.sendRequest(fiber.MethodGet, ".well-known/jwks.json", nil, &resp, nil); err != nil {
+		t.Fatalf("sendRequest error: %v", err)
+	}
+
+	if len(resp.Keys) != 1 {
+		t.Fatalf("Expected 1 key but got %d", len(resp.Keys))
+	}
+
+	key := resp.Keys[0]
+	if key.KeyID != kid || key.KeyType != "OKP" || key.Curve != "Ed25519" || key.Algorithm != "EdDSA" || key.Use != "sig" || key.X == "" {
+		t.Fatalf("Unexpected key %+v", key)
+	}
+}
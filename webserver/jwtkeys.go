@@ -0,0 +1,353 @@
+package webserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cristalhq/jwt/v4"
+	"github.com/gofiber/fiber/v2"
+)
+
+// PEM block types and headers of the JWT key file.
+const (
+	// pemTypePrivateKey is a PKCS #8 Ed25519 or RSA private key.
+	pemTypePrivateKey = "PRIVATE KEY"
+	// pemTypeRSAPrivateKey is a PKCS #1 RSA private key.
+	pemTypeRSAPrivateKey = "RSA PRIVATE KEY"
+	// pemTypeHMACKey is a raw HS256 secret.
+	pemTypeHMACKey = "HMAC KEY"
+	// pemHeaderNotBefore is the RFC 3339 time from which a key signs tokens.
+	pemHeaderNotBefore = "Not-Before"
+	// pemHeaderRetiredAt is the RFC 3339 time from which a key no longer
+	// signs tokens. Tokens signed with it are accepted for the grace period
+	// after that time.
+	pemHeaderRetiredAt = "Retired-At"
+)
+
+const (
+	// minRSAKeyBits is the minimum size of RS256 keys.
+	minRSAKeyBits = 2048
+	// jwksMaxAge is how long clients may cache the JWKS, in seconds.
+	jwksMaxAge = 300
+)
+
+// jwtKey is a key used to sign and verify JWT tokens.
+type jwtKey struct {
+	// id is the RFC 7638 JWK thumbprint of the key. It is the "kid" header
+	// of the tokens signed with the key.
+	id       string
+	alg      jwt.Algorithm
+	builder  *jwt.Builder
+	verifier jwt.Verifier
+	// public is the public JWK of asymmetric keys. It is nil for HS256 keys.
+	public *jwk
+	// privateKey is an ed25519.PrivateKey, *rsa.PrivateKey or the []byte
+	// secret of an HS256 key.
+	privateKey interface{}
+	// notBefore and retiredAt are zero if they are not set.
+	notBefore time.Time
+	retiredAt time.Time
+}
+
+// jwk is a public JSON Web Key, see RFC 7517.
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// Curve and X are the members of Ed25519 keys.
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	// N and E are the members of RSA keys.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// newJWTKey creates a *jwtKey from privateKey, which must be an
+// ed25519.PrivateKey (EdDSA), *rsa.PrivateKey (RS256) or []byte secret
+// (HS256).
+func newJWTKey(privateKey interface{}) (*jwtKey, error) {
+	var key *jwtKey
+	var signer jwt.Signer
+	var err error
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch privateKey := privateKey.(type) {
+	case ed25519.PrivateKey:
+		publicKey := privateKey.Public().(ed25519.PublicKey)
+		key = &jwtKey{alg: jwt.EdDSA}
+		key.public = &jwk{KeyType: "OKP", Curve: "Ed25519", X: b64(publicKey)}
+		key.id = jwkThumbprint(fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, key.public.X))
+		if signer, err = jwt.NewSignerEdDSA(privateKey); err == nil {
+			key.verifier, err = jwt.NewVerifierEdDSA(publicKey)
+		}
+	case *rsa.PrivateKey:
+		if privateKey.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA keys must have at least %d bits", minRSAKeyBits)
+		}
+		key = &jwtKey{alg: jwt.RS256}
+		key.public = &jwk{KeyType: "RSA", N: b64(privateKey.N.Bytes()), E: b64(big.NewInt(int64(privateKey.E)).Bytes())}
+		key.id = jwkThumbprint(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, key.public.E, key.public.N))
+		if signer, err = jwt.NewSignerRS(jwt.RS256, privateKey); err == nil {
+			key.verifier, err = jwt.NewVerifierRS(jwt.RS256, &privateKey.PublicKey)
+		}
+	case []byte:
+		if len(privateKey) < minJWTSecretLength {
+			return nil, fmt.Errorf("HMAC keys must be at least %d bytes long", minJWTSecretLength)
+		}
+		key = &jwtKey{alg: jwt.HS256}
+		key.id = jwkThumbprint(fmt.Sprintf(`{"k":"%s","kty":"oct"}`, b64(privateKey)))
+		if signer, err = jwt.NewSignerHS(jwt.HS256, privateKey); err == nil {
+			key.verifier, err = jwt.NewVerifierHS(jwt.HS256, privateKey)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT key type %T", privateKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s signer: %w", key.alg, err)
+	}
+
+	if key.public != nil {
+		key.public.KeyID = key.id
+		key.public.Use = "sig"
+		key.public.Algorithm = key.alg.String()
+	}
+	key.privateKey = privateKey
+	key.builder = jwt.NewBuilder(signer, jwt.WithKeyID(key.id))
+	return key, nil
+}
+
+// jwkThumbprint returns the RFC 7638 thumbprint of the JWK with the required
+// members in canonical JSON form.
+func jwkThumbprint(canonicalJWK string) string {
+	sum := sha256.Sum256([]byte(canonicalJWK))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// acceptedAt checks if tokens signed with the key are accepted at now.
+func (key *jwtKey) acceptedAt(now time.Time, gracePeriod time.Duration) bool {
+	return key.retiredAt.IsZero() || now.Before(key.retiredAt.Add(gracePeriod))
+}
+
+// activeJWTKey returns the first key in keys that signs tokens at now.
+func activeJWTKey(keys []*jwtKey, now time.Time) *jwtKey {
+	for _, key := range keys {
+		if !now.Before(key.notBefore) && (key.retiredAt.IsZero() || now.Before(key.retiredAt)) {
+			return key
+		}
+	}
+	return nil
+}
+
+// readJWTKeyFile reads the keys in the PEM file at path.
+func readJWTKeyFile(path string) ([]*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT key file: %w", err)
+	}
+
+	var keys []*jwtKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		key, err := parseJWTKeyBlock(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %d in JWT key file: %w", len(keys)+1, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys found in JWT key file")
+	}
+
+	return keys, nil
+}
+
+// parseJWTKeyBlock parses a key of the JWT key file.
+func parseJWTKeyBlock(block *pem.Block) (*jwtKey, error) {
+	var privateKey interface{}
+	var err error
+	switch block.Type {
+	case pemTypePrivateKey:
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case pemTypeRSAPrivateKey:
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case pemTypeHMACKey:
+		privateKey = block.Bytes
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newJWTKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for header, t := range map[string]*time.Time{pemHeaderNotBefore: &key.notBefore, pemHeaderRetiredAt: &key.retiredAt} {
+		if value, found := block.Headers[header]; found {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return nil, fmt.Errorf("invalid %s header: %w", header, err)
+			}
+		}
+	}
+
+	return key, nil
+}
+
+// encodeJWTKeyBlock encodes key as a block of the JWT key file.
+func encodeJWTKeyBlock(key *jwtKey) (*pem.Block, error) {
+	block := &pem.Block{Type: pemTypePrivateKey, Headers: make(map[string]string)}
+	if secret, ok := key.privateKey.([]byte); ok {
+		block.Type, block.Bytes = pemTypeHMACKey, secret
+	} else {
+		var err error
+		if block.Bytes, err = x509.MarshalPKCS8PrivateKey(key.privateKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if !key.notBefore.IsZero() {
+		block.Headers[pemHeaderNotBefore] = key.notBefore.UTC().Format(time.RFC3339)
+	}
+	if !key.retiredAt.IsZero() {
+		block.Headers[pemHeaderRetiredAt] = key.retiredAt.UTC().Format(time.RFC3339)
+	}
+
+	return block, nil
+}
+
+// generateJWTKey generates a new private key for alg.
+func generateJWTKey(alg string) (interface{}, error) {
+	switch jwt.Algorithm(alg) {
+	case jwt.EdDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	case jwt.RS256:
+		return rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	case jwt.HS256:
+		return randomBytes(minJWTSecretLength)
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+}
+
+// RotateJWTKey adds a new alg key to the JWT key file at path and returns its
+// key ID and the time from which it signs tokens. The file is created with the
+// new key as the active key if it does not exist. Otherwise the new key signs
+// tokens once delay has passed, which gives every server and every client of the
+// JWKS time to learn the new key, and the current signing key is retired at
+// that time. Keys whose grace period ended are removed from the file.
+func RotateJWTKey(path, alg string, delay, gracePeriod time.Duration) (string, time.Time, error) {
+	var keys []*jwtKey
+	if _, err := os.Stat(path); err == nil {
+		if keys, err = readJWTKeyFile(path); err != nil {
+			return "", time.Time{}, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", time.Time{}, fmt.Errorf("failed to read JWT key file: %w", err)
+	}
+
+	privateKey, err := generateJWTKey(alg)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	newKey, err := newJWTKey(privateKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	activeAt := now.Add(delay).Truncate(time.Second)
+	if len(keys) > 0 {
+		newKey.notBefore = activeAt
+	} else {
+		activeAt = now
+	}
+
+	var blocks []byte
+	keys = append([]*jwtKey{newKey}, keys...)
+	for _, key := range keys[1:] {
+		if key.retiredAt.IsZero() || key.retiredAt.After(activeAt) {
+			key.retiredAt = activeAt
+		}
+	}
+
+	for _, key := range keys {
+		if !key.acceptedAt(now, gracePeriod) {
+			continue
+		}
+
+		block, err := encodeJWTKeyBlock(key)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		blocks = append(blocks, pem.EncodeToMemory(block)...)
+	}
+
+	// Replace the file atomically so that servers never read a partial file.
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(blocks); err != nil {
+		tmpFile.Close()
+		return "", time.Time{}, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return newKey.id, activeAt, nil
+}
+
+// handleJWKS handles the "GET /.well-known/jwks.json" endpoint and returns the
+// public keys used to verify auth tokens signed with EdDSA or RS256.
+func (s *WebServer) handleJWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", jwksMaxAge))
+	return c.Status(codeOk).JSON(fiber.Map{"keys": s.authenticator.publicKeys()})
+}
+
+// reloadJWTKeys periodically reloads the JWT key file when it is modified
+// until the server context is canceled.
+func (s *WebServer) reloadJWTKeys() {
+	tick := time.NewTicker(jwtKeyReloadInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-tick.C:
+			reloaded, err := s.authenticator.reloadKeys()
+			if err != nil {
+				appLog.Printf("\nauthenticator.reloadKeys error: %v\n", err)
+			} else if reloaded {
+				appLog.Println("Reloaded JWT keys")
+			}
+		}
+	}
+}
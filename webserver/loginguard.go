@@ -0,0 +1,132 @@
+package webserver
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// accountLockThreshold is the number of failed logins after which an
+	// account is locked.
+	accountLockThreshold = 5
+	// clientLockThreshold is the number of failed logins and sign ups after
+	// which a client IP is locked. It is higher than accountLockThreshold
+	// because an IP can be shared by many users.
+	clientLockThreshold = 20
+	// minLoginLock is how long logins are locked once a threshold is reached.
+	// Every further failure doubles the lock, up to maxLoginLock.
+	minLoginLock = time.Minute
+	maxLoginLock = time.Hour
+	// loginFailureWindow is how long failed logins are remembered after the
+	// last one.
+	loginFailureWindow = 24 * time.Hour
+)
+
+// loginKey identifies the failed logins of an account or a client.
+type loginKey struct {
+	key string
+	// lockThreshold is the number of failures after which key is locked.
+	lockThreshold int
+}
+
+// accountLoginKey returns the loginKey of the account with the specified
+// email. It is used whether or not the account exists, so locks do not reveal
+// which emails have an account.
+func accountLoginKey(email string) loginKey {
+	return loginKey{key: "account:" + strings.ToLower(email), lockThreshold: accountLockThreshold}
+}
+
+// clientLoginKey returns the loginKey of the client with the specified IP.
+func clientLoginKey(ip string) loginKey {
+	return loginKey{key: "ip:" + ip, lockThreshold: clientLockThreshold}
+}
+
+// loginLockDuration returns how long logins are locked after the specified
+// number of failures. Zero is returned if failures is below threshold.
+func loginLockDuration(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	lock := minLoginLock
+	for i := threshold; i < failures && lock < maxLoginLock; i++ {
+		lock *= 2
+	}
+
+	if lock > maxLoginLock {
+		return maxLoginLock
+	}
+	return lock
+}
+
+// errInvalidLogin is returned for every failed password login, so that the
+// response does not reveal whether the account exists.
+func errInvalidLogin() error {
+	return errBadRequest("invalid email or password")
+}
+
+// errLoginLocked is returned while an account or a client is locked.
+func errLoginLocked() error {
+	return errTooManyRequests("too many failed attempts, please try again later")
+}
+
+// checkLoginLock returns an error and sets the Retry-After header if any of
+// keys is locked. Failed logins older than loginFailureWindow are forgotten.
+func (s *WebServer) checkLoginLock(c *fiber.Ctx, keys ...loginKey) error {
+	now := time.Now().Unix()
+	for _, k := range keys {
+		attempts, err := s.db.RetrieveLoginAttempts(k.key)
+		if err != nil {
+			appLog.Printf("\ndb.RetrieveLoginAttempts error: %v\n", err)
+			return errInternal(err)
+		}
+
+		if attempts.LockedUntil > now {
+			c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(attempts.LockedUntil-now, 10))
+			return errLoginLocked()
+		}
+
+		if attempts.Failures > 0 && attempts.LastFailure < now-int64(loginFailureWindow.Seconds()) {
+			s.clearLoginAttempts(k)
+		}
+	}
+
+	return nil
+}
+
+// recordFailedLogin records a failed login for keys and locks the keys that
+// reached their threshold. Lockouts are logged to the audit log.
+func (s *WebServer) recordFailedLogin(c *fiber.Ctx, keys ...loginKey) {
+	now := time.Now()
+	for _, k := range keys {
+		attempts, err := s.db.RecordFailedLogin(k.key, now.Unix())
+		if err != nil {
+			appLog.Printf("\ndb.RecordFailedLogin error: %v\n", err)
+			continue
+		}
+
+		lock := loginLockDuration(attempts.Failures, k.lockThreshold)
+		if lock == 0 {
+			continue
+		}
+
+		until := now.Add(lock)
+		if err := s.db.LockLogin(k.key, until.Unix()); err != nil {
+			appLog.Printf("\ndb.LockLogin error: %v\n", err)
+			continue
+		}
+
+		auditLog.Printf("event=login_locked key=%s ip=%s failures=%d until=%s",
+			k.key, c.IP(), attempts.Failures, until.UTC().Format(time.RFC3339))
+	}
+}
+
+// clearLoginAttempts forgets the failed logins and lock of k.
+func (s *WebServer) clearLoginAttempts(k loginKey) {
+	if err := s.db.ClearLoginAttempts(k.key); err != nil {
+		appLog.Printf("\ndb.ClearLoginAttempts error: %v\n", err)
+	}
+}
@@ -0,0 +1,200 @@
+package webserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestLoginLockDuration(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{accountLockThreshold - 1, 0},
+		{accountLockThreshold, minLoginLock},
+		{accountLockThreshold + 1, 2 * minLoginLock},
+		{accountLockThreshold + 3, 8 * minLoginLock},
+		{accountLockThreshold + 100, maxLoginLock},
+	}
+
+	for _, tt := range tests {
+		if got := loginLockDuration(tt.failures, accountLockThreshold); got != tt.want {
+			t.Fatalf("Expected a %s lock after %d failures but got %s", tt.want, tt.failures, got)
+		}
+	}
+}
+
+func TestWebServer_loginLockout(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	const email, otherEmail = "test@email.com", "other@email.com"
+	tLogin(t, s, email)
+	if err := s.db.CreateUser("other", otherEmail, []byte(dummyUserPassword)); err != nil {
+		t.Fatalf("s.db.CreateUser error: %s", err)
+	}
+
+	login := func(email, password string) *loginResponse {
+		t.Helper()
+		var resp *loginResponse
+		req := loginRequest{Email: email, Password: password}
+		if err := s.sendRequest(fiber.MethodPost, "api/login", req, &resp, nil); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		return resp
+	}
+
+	// A successful login forgets the failed logins of the account.
+	for i := 0; i < accountLockThreshold-1; i++ {
+		login(email, "wrong password")
+	}
+	if resp := login(email, dummyUserPassword); resp.Code != codeOk {
+		t.Fatalf("Expected the login to succeed but got %d (%s)", resp.Code, resp.Message)
+	}
+
+	for i := 0; i < accountLockThreshold; i++ {
+		if resp := login(email, "wrong password"); resp.Code != codeBadRequest || resp.Message != "invalid email or password" {
+			t.Fatalf("Unexpected failed login response %+v", resp.APIResponse)
+		}
+	}
+
+	// The correct password is refused while the account is locked.
+	resp := login(email, dummyUserPassword)
+	if resp.Code != codeTooMany {
+		t.Fatalf("Expected the account to be locked but got %d (%s)", resp.Code, resp.Message)
+	}
+
+	attempts, err := s.db.RetrieveLoginAttempts(accountLoginKey(email).key)
+	if err != nil {
+		t.Fatalf("s.db.RetrieveLoginAttempts error: %s", err)
+	}
+	if lock := time.Until(time.Unix(attempts.LockedUntil, 0)); lock <= 0 || lock > minLoginLock {
+		t.Fatalf("Expected a lock of at most %s but got %s", minLoginLock, lock)
+	}
+
+	// Emails without an account are locked the same way.
+	for i := 0; i < accountLockThreshold; i++ {
+		if resp := login("unknown@email.com", dummyUserPassword); resp.Code != codeBadRequest || resp.Message != "invalid email or password" {
+			t.Fatalf("Unexpected failed login response %+v", resp.APIResponse)
+		}
+	}
+	if resp := login("UNKNOWN@email.com", dummyUserPassword); resp.Code != codeTooMany || resp.Message != errLoginLocked().Error() {
+		t.Fatalf("Expected the unknown email to be locked but got %d (%s)", resp.Code, resp.Message)
+	}
+
+	// Other accounts can still log in from the same client.
+	if resp := login(otherEmail, dummyUserPassword); resp.Code != codeOk {
+		t.Fatalf("Expected the other account to log in but got %d (%s)", resp.Code, resp.Message)
+	}
+
+	// Every failure after the lock expires doubles the lock.
+	if err := s.db.LockLogin(accountLoginKey(email).key, time.Now().Add(-time.Second).Unix()); err != nil {
+		t.Fatalf("s.db.LockLogin error: %s", err)
+	}
+	login(email, "wrong password")
+	attempts, err = s.db.RetrieveLoginAttempts(accountLoginKey(email).key)
+	if err != nil {
+		t.Fatalf("s.db.RetrieveLoginAttempts error: %s", err)
+	}
+	if lock := time.Until(time.Unix(attempts.LockedUntil, 0)); lock <= minLoginLock || lock > 2*minLoginLock {
+		t.Fatalf("Expected a lock between %s and %s but got %s", minLoginLock, 2*minLoginLock, lock)
+	}
+}
+
+func TestWebServer_clientLockout(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	const email = "test@email.com"
+	tLogin(t, s, email)
+
+	// Failed logins of many accounts and sign ups with taken emails lock the
+	// client.
+	for i := 0; i < clientLockThreshold-1; i++ {
+		var resp *loginResponse
+		req := loginRequest{Email: fmt.Sprintf("user%d@email.com", i), Password: dummyUserPassword}
+		if err := s.sendRequest(fiber.MethodPost, "api/login", req, &resp, nil); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+	}
+
+	signUp := func() *APIResponse {
+		t.Helper()
+		var resp *APIResponse
+		req := createAccountRequest{Username: "another", Email: email, Password: dummyUserPassword}
+		if err := s.sendRequest(fiber.MethodPost, "api/user", req, &resp, nil); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		return resp
+	}
+
+	if resp := signUp(); resp.Code != codeBadRequest {
+		t.Fatalf("Expected the sign up to fail but got %d (%s)", resp.Code, resp.Message)
+	}
+
+	if resp := signUp(); resp.Code != codeTooMany {
+		t.Fatalf("Expected the client to be locked but got %d (%s)", resp.Code, resp.Message)
+	}
+
+	var resp *loginResponse
+	req := loginRequest{Email: email, Password: dummyUserPassword}
+	if err := s.sendRequest(fiber.MethodPost, "api/login", req, &resp, nil); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+	if resp.Code != codeTooMany {
+		t.Fatalf("Expected logins of the locked client to be refused but got %d (%s)", resp.Code, resp.Message)
+	}
+}
+
+func TestWebServer_currentPasswordLockout(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	const email = "test@email.com"
+	tLogin(t, s, email)
+	headers := s.authHeaders(t, email)
+
+	// Every endpoint that checks the current password counts failures towards
+	// the lock of the account.
+	requests := []struct {
+		method, endpoint string
+		req              interface{}
+	}{
+		{fiber.MethodPatch, "api/user", updateUserRequest{Email: "new@email.com", Password: "wrong password"}},
+		{fiber.MethodPost, "api/user/password", changePasswordRequest{CurrentPassword: "wrong password", NewPassword: "new password"}},
+		{fiber.MethodDelete, "api/user", deleteUserRequest{Password: "wrong password"}},
+	}
+
+	for i := 0; i < accountLockThreshold; i++ {
+		r := requests[i%len(requests)]
+		var resp *APIResponse
+		if err := s.sendRequest(r.method, r.endpoint, r.req, &resp, headers); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		if resp.Code != codeBadRequest || resp.Message != "incorrect password" {
+			t.Fatalf("%s %s: unexpected response %+v", r.method, r.endpoint, resp)
+		}
+	}
+
+	// The correct password is refused while the account is locked.
+	var resp *APIResponse
+	req := changePasswordRequest{CurrentPassword: dummyUserPassword, NewPassword: "new password"}
+	if err := s.sendRequest(fiber.MethodPost, "api/user/password", req, &resp, headers); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+	if resp.Code != codeTooMany || resp.Message != errLoginLocked().Error() {
+		t.Fatalf("Expected the account to be locked but got %d (%s)", resp.Code, resp.Message)
+	}
+
+	loginReq := loginRequest{Email: email, Password: dummyUserPassword}
+	if err := s.sendRequest(fiber.MethodPost, "api/login", loginReq, &resp, nil); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+	if resp.Code != codeTooMany {
+		t.Fatalf("Expected logins to be locked too but got %d (%s)", resp.Code, resp.Message)
+	}
+}
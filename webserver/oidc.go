@@ -0,0 +1,427 @@
+package webserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcCookieName is the name of the cookie that ties the callback of an
+	// OIDC login to the browser that started it.
+	oidcCookieName = "bob_oidc"
+	// oidcCookiePath is the path of the OIDC login cookie.
+	oidcCookiePath = "/api/auth/oidc"
+	// oidcLoginExpiry is how long a user has to log in with the provider.
+	oidcLoginExpiry = 10 * time.Minute
+	// oidcStateLength is the number of random bytes in the state of an OIDC
+	// login.
+	oidcStateLength = 16
+	// oidcRequestTimeout is the timeout of requests to the provider.
+	oidcRequestTimeout = 10 * time.Second
+	// oidcUsernameSuffixChar is the maximum length of the random number
+	// added to usernames derived from ID token claims that are taken.
+	oidcUsernameSuffixChar = 5
+	// maxOIDCUsernameAttempts is how many usernames are tried for a new
+	// user before giving up.
+	maxOIDCUsernameAttempts = 5
+)
+
+// OIDCConfig is the configuration for logging in with an OpenID Connect
+// provider. OIDC login is disabled if Issuer is empty.
+type OIDCConfig struct {
+	// Issuer is the issuer URL of the provider. The provider configuration is
+	// discovered from it.
+	Issuer       string `long:"issuer" env:"OIDC_ISSUER" description:"Issuer URL of the OpenID Connect provider, OIDC login is disabled if not set"`
+	ClientID     string `long:"clientid" env:"OIDC_CLIENT_ID" description:"Client ID registered with the OpenID Connect provider"`
+	ClientSecret string `long:"clientsecret" env:"OIDC_CLIENT_SECRET" description:"Client secret registered with the OpenID Connect provider"`
+	// RedirectURL is the public URL of the "GET /api/auth/oidc/callback"
+	// endpoint.
+	RedirectURL string `long:"redirecturl" env:"OIDC_REDIRECT_URL" description:"Public URL of the /api/auth/oidc/callback endpoint registered with the OpenID Connect provider"`
+	// Scopes are the scopes requested from the provider. The "openid" scope
+	// is always requested.
+	Scopes []string `long:"scope" env:"OIDC_SCOPES" env-delim:"," default:"openid" default:"email" default:"profile" description:"Scopes requested from the OpenID Connect provider"`
+	// AllowedDomains restricts logins to users whose email is in one of
+	// these domains. Every domain is allowed if it is empty.
+	AllowedDomains []string `long:"alloweddomain" env:"OIDC_ALLOWED_DOMAINS" env-delim:"," description:"Email domains allowed to log in with OpenID Connect, every domain is allowed if not set"`
+	// SuccessRedirectURL is where users are redirected after logging in, with
+	// the auth tokens in the URL fragment. The tokens are returned as JSON if
+	// it is empty.
+	SuccessRedirectURL string `long:"successredirecturl" env:"OIDC_SUCCESS_REDIRECT_URL" description:"URL users are redirected to after logging in with OpenID Connect, with the auth tokens in the URL fragment, the tokens are returned as JSON if not set"`
+}
+
+// oidcClaims are the ID token claims used to find or create a user.
+type oidcClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// oidcLogin logs users in with an OpenID Connect provider. The provider
+// configuration is discovered on first use so the server starts when the
+// provider is unreachable.
+type oidcLogin struct {
+	cfg OIDCConfig
+
+	mtx      sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// newOIDCLogin creates an *oidcLogin from cfg. It returns nil if OIDC login is
+// not configured.
+func newOIDCLogin(cfg OIDCConfig) (*oidcLogin, error) {
+	if cfg.Issuer == "" {
+		return nil, nil
+	}
+
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("an OIDC client ID and redirect URL are required")
+	}
+
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range cfg.Scopes {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+	cfg.Scopes = scopes
+
+	for i, domain := range cfg.AllowedDomains {
+		cfg.AllowedDomains[i] = strings.ToLower(strings.TrimSpace(domain))
+	}
+
+	return &oidcLogin{cfg: cfg}, nil
+}
+
+// client returns the OAuth2 configuration and ID token verifier of the
+// provider, discovering the provider configuration if needed.
+func (o *oidcLogin) client(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if o.oauth2 != nil {
+		return o.oauth2, o.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, o.cfg.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+
+	o.oauth2 = &oauth2.Config{
+		ClientID:     o.cfg.ClientID,
+		ClientSecret: o.cfg.ClientSecret,
+		RedirectURL:  o.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       o.cfg.Scopes,
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.cfg.ClientID})
+	return o.oauth2, o.verifier, nil
+}
+
+// isAllowedEmail checks if users with email are allowed to log in.
+func (o *oidcLogin) isAllowedEmail(email string) bool {
+	if len(o.cfg.AllowedDomains) == 0 {
+		return true
+	}
+
+	_, domain, _ := strings.Cut(strings.ToLower(email), "@")
+	for _, allowed := range o.cfg.AllowedDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcNonce derives the nonce of an OIDC login from its state and PKCE
+// verifier, so it does not need to be stored.
+func oidcNonce(state, verifier string) string {
+	sum := sha256.Sum256([]byte(state + "." + verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// handleOIDCStart handles the "GET /api/auth/oidc/start" endpoint and
+// redirects the user to the OIDC provider to log in.
+func (s *WebServer) handleOIDCStart(c *fiber.Ctx) error {
+	if s.oidc == nil {
+		return errNotFound("OIDC login is not enabled")
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, oidcRequestTimeout)
+	defer cancel()
+
+	oauth2Cfg, _, err := s.oidc.client(ctx)
+	if err != nil {
+		appLog.Printf("\noidc.client error: %v\n", err)
+		return errInternal(err)
+	}
+
+	b, err := randomBytes(oidcStateLength)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	state := base64.RawURLEncoding.EncodeToString(b)
+	verifier := oauth2.GenerateVerifier()
+
+	// The state and PKCE verifier are kept in a signed cookie until the
+	// provider redirects back to the callback.
+	token, err := s.authenticator.generateAuthToken(state, verifier, jwtAudienceOIDCLogin, oidcLoginExpiry)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcCookieName,
+		Value:    token,
+		Path:     oidcCookiePath,
+		MaxAge:   int(oidcLoginExpiry.Seconds()),
+		Secure:   s.secureCookies,
+		HTTPOnly: true,
+		// Lax cookies are sent on the top-level redirect from the provider.
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	authURL := oauth2Cfg.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(oidcNonce(state, verifier)))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Redirect(authURL, codeFound)
+}
+
+// handleOIDCCallback handles the "GET /api/auth/oidc/callback" endpoint. It
+// verifies the ID token issued by the OIDC provider, creates or links the
+// user of the token and starts a new session for the user.
+func (s *WebServer) handleOIDCCallback(c *fiber.Ctx) error {
+	if s.oidc == nil {
+		return errNotFound("OIDC login is not enabled")
+	}
+
+	// The login cookie can only be used once.
+	loginToken := c.Cookies(oidcCookieName)
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcCookieName,
+		Path:     oidcCookiePath,
+		Expires:  time.Unix(0, 0),
+		Secure:   s.secureCookies,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	if providerErr := c.Query("error"); providerErr != "" {
+		return errUnauthorized(fmt.Sprintf("OIDC login failed: %s", providerErr))
+	}
+
+	claims, ok := s.authenticator.validateAuthToken(loginToken, jwtAudienceOIDCLogin)
+	state := c.Query("state")
+	if !ok || state == "" || subtle.ConstantTimeCompare([]byte(claims.ID), []byte(state)) != 1 {
+		return errUnauthorized("Invalid or expired OIDC login, please try again")
+	}
+
+	code := c.Query("code")
+	if code == "" {
+		return errBadRequest("authorization code is required")
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, oidcRequestTimeout)
+	defer cancel()
+
+	oauth2Cfg, verifier, err := s.oidc.client(ctx)
+	if err != nil {
+		appLog.Printf("\noidc.client error: %v\n", err)
+		return errInternal(err)
+	}
+
+	oauth2Token, err := oauth2Cfg.Exchange(ctx, code, oauth2.VerifierOption(claims.Subject))
+	if err != nil {
+		appLog.Printf("\noauth2.Exchange error: %v\n", err)
+		return errUnauthorized("Invalid authorization code")
+	}
+
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		return errUnauthorized("OIDC provider did not return an ID token")
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		appLog.Printf("\noidc.Verify error: %v\n", err)
+		return errUnauthorized("Invalid ID token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(oidcNonce(claims.ID, claims.Subject))) != 1 {
+		return errUnauthorized("Invalid ID token")
+	}
+
+	var idClaims oidcClaims
+	if err := idToken.Claims(&idClaims); err != nil {
+		return errUnauthorized("Invalid ID token")
+	}
+
+	if !isValidEmail(idClaims.Email) || !idClaims.EmailVerified {
+		return errForbidden("a verified email is required to log in")
+	}
+
+	if !s.oidc.isAllowedEmail(idClaims.Email) {
+		return errForbidden("your email domain is not allowed to log in")
+	}
+
+	user, err := s.oidcUser(idToken, &idClaims)
+	if err != nil {
+		var resp *APIResponse
+		if errors.As(err, &resp) {
+			return err
+		}
+
+		appLog.Printf("\nerror retrieving OIDC user: %v\n", err)
+		return errInternal(err)
+	}
+
+	// The identity provider does not replace the two-factor authentication
+	// of the user.
+	if user.TOTPEnabled {
+		mfaToken, err := s.newMFAToken(user.Email)
+		if err != nil {
+			appLog.Printf("\nerror creating MFA token: %v\n", err)
+			return errInternal(err)
+		}
+
+		if s.oidc.cfg.SuccessRedirectURL != "" {
+			fragment := url.Values{"mfaToken": {mfaToken}}
+			return c.Redirect(s.oidc.cfg.SuccessRedirectURL+"#"+fragment.Encode(), codeSeeOther)
+		}
+
+		return c.Status(codeOk).JSON(mfaRequiredResponse(mfaToken))
+	}
+
+	tokens, err := s.createSession(user.Email)
+	if err != nil {
+		appLog.Printf("\nerror creating session: %v\n", err)
+		return errInternal(err)
+	}
+
+	if s.oidc.cfg.SuccessRedirectURL != "" {
+		fragment := url.Values{
+			"authToken":       {tokens.AuthToken},
+			"authTokenExpiry": {strconv.FormatInt(tokens.AuthTokenExpiry, 10)},
+			"refreshToken":    {tokens.RefreshToken},
+		}
+		return c.Redirect(s.oidc.cfg.SuccessRedirectURL+"#"+fragment.Encode(), codeSeeOther)
+	}
+
+	userInfo := userInfoResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Login Successful."),
+		Data:        user,
+	}
+
+	return c.Status(userInfo.Code).JSON(loginResponse{userInfoResponse: userInfo, authTokens: *tokens})
+}
+
+// oidcUser returns the user of a verified ID token. The identity is linked to
+// the user with the same email if it is not linked yet, otherwise a new user
+// without a password is created. Users that have not verified their email are
+// never linked, since anyone could have signed up with it and still log in
+// with their own password after the owner of the email linked the account.
+func (s *WebServer) oidcUser(idToken *oidc.IDToken, claims *oidcClaims) (*db.UserInfo, error) {
+	user, err := s.db.RetrieveIdentityUser(idToken.Issuer, idToken.Subject)
+	if err == nil || !errors.Is(err, db.ErrorNotFound) {
+		return user, err
+	}
+
+	identity := &db.UserIdentity{
+		Provider:  idToken.Issuer,
+		Subject:   idToken.Subject,
+		Email:     claims.Email,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	user, err = s.db.RetrieveUserInfo(claims.Email)
+	switch {
+	case err == nil && !user.EmailVerified:
+		return nil, errForbidden("an account with your email exists but its email is not verified, reset its password to verify the email and try again")
+	case err == nil:
+		err = s.db.LinkUserIdentity(identity)
+	case errors.Is(err, db.ErrorBadRequest): // user does not exist
+		err = s.createOIDCUser(claims, identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.db.RetrieveIdentityUser(identity.Provider, identity.Subject)
+}
+
+// createOIDCUser creates a user for identity with a username derived from the
+// ID token claims. Usernames that are taken or break the account policy are
+// retried with a random number added.
+func (s *WebServer) createOIDCUser(claims *oidcClaims, identity *db.UserIdentity) error {
+	minLength := s.policy.minUsernameLength
+	maxLength := s.policy.maxUsernameLength - oidcUsernameSuffixChar
+	if maxLength < minLength {
+		maxLength = minLength
+	}
+
+	base := oidcUsername(claims.PreferredUsername)
+	if len(base) < minLength {
+		localPart, _, _ := strings.Cut(claims.Email, "@")
+		base = oidcUsername(localPart)
+	}
+	for len(base) < minLength {
+		base += "_"
+	}
+	if len(base) > maxLength {
+		base = base[:maxLength]
+	}
+
+	username := base
+	for i := 0; i < maxOIDCUsernameAttempts; i++ {
+		if i > 0 {
+			b, err := randomBytes(2)
+			if err != nil {
+				return err
+			}
+			username = fmt.Sprintf("%s%d", base, int(b[0])<<8|int(b[1]))
+		}
+
+		if violations := s.policy.validateUsername(username); len(violations) > 0 {
+			continue
+		}
+
+		exists, err := s.db.UsernameExists(username)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return s.db.CreateIdentityUser(username, identity)
+		}
+	}
+
+	return fmt.Errorf("no available username for %q", base)
+}
+
+// oidcUsername returns name without the characters that are not letters,
+// digits, ".", "_" or "-".
+func oidcUsername(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return -1
+	}, name)
+}
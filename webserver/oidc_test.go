@@ -0,0 +1,398 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/db/mem"
+)
+
+// tOIDCProvider is a mock OpenID Connect provider that issues ID tokens for
+// the authorization codes created with authorize.
+type tOIDCProvider struct {
+	*httptest.Server
+	key *jwtKey
+
+	mtx   sync.Mutex
+	codes map[string]*tOIDCCode
+}
+
+// tOIDCCode is an authorization code issued by tOIDCProvider.
+type tOIDCCode struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newTOIDCProvider(t *testing.T) *tOIDCProvider {
+	privateKey, err := generateJWTKey("RS256")
+	if err != nil {
+		t.Fatalf("generateJWTKey error: %v", err)
+	}
+
+	key, err := newJWTKey(privateKey)
+	if err != nil {
+		t.Fatalf("newJWTKey error: %v", err)
+	}
+
+	p := &tOIDCProvider{key: key, codes: make(map[string]*tOIDCCode)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []*jwk{p.key.public}})
+	})
+	mux.HandleFunc("/token", p.handleToken)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// authorize mimics a user logging in with the provider after being redirected
+// to authURL and returns the authorization code for the callback. claims are
+// added to the claims of the ID token.
+func (p *tOIDCProvider) authorize(t *testing.T, authURL string, claims map[string]interface{}) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("url.Parse error: %v", err)
+	}
+
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("client_id") != "bob" || query.Get("response_type") != "code" ||
+		query.Get("code_challenge_method") != "S256" || query.Get("redirect_uri") != "http://bob.test/api/auth/oidc/callback" {
+		t.Fatalf("Unexpected authorization URL %s", authURL)
+	}
+
+	idClaims := map[string]interface{}{
+		"iss":   p.URL,
+		"aud":   "bob",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for k, v := range claims {
+		idClaims[k] = v
+	}
+
+	b, _ := randomBytes(8)
+	code := hex.EncodeToString(b)
+	p.mtx.Lock()
+	p.codes[code] = &tOIDCCode{challenge: query.Get("code_challenge"), claims: idClaims}
+	p.mtx.Unlock()
+	return code
+}
+
+// handleToken exchanges an authorization code for an ID token. Codes can only
+// be used once.
+func (p *tOIDCProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	p.mtx.Lock()
+	code := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	p.mtx.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if code == nil || base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := p.key.builder.Build(code.claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken.String(),
+	})
+}
+
+// tOIDCGet sends a GET request to the server without following redirects.
+func tOIDCGet(t *testing.T, s *tServer, endpoint string, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/%s", s.addr, endpoint), nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest error: %v", err)
+	}
+
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do error: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// tOIDCStart starts an OIDC login and returns the authorization URL and the
+// login cookie.
+func tOIDCStart(t *testing.T, s *tServer) (*url.URL, *http.Cookie) {
+	t.Helper()
+	resp := tOIDCGet(t, s, "api/auth/oidc/start", nil)
+	if resp.StatusCode != codeFound {
+		t.Fatalf("Expected code %d but got %d", codeFound, resp.StatusCode)
+	}
+
+	authURL, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("url.Parse error: %v", err)
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == oidcCookieName {
+			if cookie.Secure != s.secureCookies {
+				t.Fatalf("Expected a login cookie with Secure %t", s.secureCookies)
+			}
+			return authURL, cookie
+		}
+	}
+
+	t.Fatal("Expected a login cookie")
+	return nil, nil
+}
+
+func TestWebServer_handleOIDCLogin(t *testing.T) {
+	disabled := newTServer(t)
+	resp := tOIDCGet(t, disabled, "api/auth/oidc/start", nil)
+	disabled.Stop()
+	if resp.StatusCode != codeNotFound {
+		t.Fatalf("Expected code %d when OIDC login is disabled but got %d", codeNotFound, resp.StatusCode)
+	}
+
+	provider := newTOIDCProvider(t)
+	defer provider.Close()
+
+	cfg := Config{OIDC: OIDCConfig{
+		Issuer:         provider.URL,
+		ClientID:       "bob",
+		ClientSecret:   "secret",
+		RedirectURL:    "http://bob.test/api/auth/oidc/callback",
+		AllowedDomains: []string{"example.com"},
+	}}
+	s := startTServer(t, cfg, mem.New())
+	defer s.Stop()
+
+	const passwordUserEmail, unverifiedUserEmail = "password@example.com", "squatter@example.com"
+	for username, email := range map[string]string{"passworduser": passwordUserEmail, "squatter": unverifiedUserEmail} {
+		if err := s.db.CreateUser(username, email, []byte(dummyUserPassword)); err != nil {
+			t.Fatalf("s.db.CreateUser error: %s", err)
+		}
+	}
+	if err := s.db.SetEmailVerified(passwordUserEmail); err != nil {
+		t.Fatalf("s.db.SetEmailVerified error: %s", err)
+	}
+
+	login := func(claims map[string]interface{}) (*loginResponse, int) {
+		t.Helper()
+		authURL, cookie := tOIDCStart(t, s)
+		code := provider.authorize(t, authURL.String(), claims)
+		resp := tOIDCGet(t, s, fmt.Sprintf("api/auth/oidc/callback?code=%s&state=%s", code, authURL.Query().Get("state")), cookie)
+
+		var loginResp *loginResponse
+		if err := json.NewDecoder(resp.Body).Decode(&loginResp); err != nil {
+			t.Fatalf("json.Decode error: %v", err)
+		}
+		return loginResp, resp.StatusCode
+	}
+
+	claims := func(sub, email string, extra ...interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": sub, "email": email, "email_verified": true}
+		for i := 0; i < len(extra); i += 2 {
+			c[extra[i].(string)] = extra[i+1]
+		}
+		return c
+	}
+
+	tests := []struct {
+		name         string
+		claims       map[string]interface{}
+		wantCode     int
+		wantUsername string
+		wantEmail    string
+	}{{
+		name:         "new user",
+		claims:       claims("sub-1", "sso@example.com", "preferred_username", "SSO User!"),
+		wantCode:     codeOk,
+		wantUsername: "SSOUser",
+		wantEmail:    "sso@example.com",
+	}, {
+		name:         "returning user",
+		claims:       claims("sub-1", "sso@example.com"),
+		wantCode:     codeOk,
+		wantUsername: "SSOUser",
+		wantEmail:    "sso@example.com",
+	}, {
+		name:      "new user with taken username",
+		claims:    claims("sub-2", "other@example.com", "preferred_username", "SSOUser"),
+		wantCode:  codeOk,
+		wantEmail: "other@example.com",
+	}, {
+		name:         "new user without preferred username",
+		claims:       claims("sub-3", "jo@example.com"),
+		wantCode:     codeOk,
+		wantUsername: "jo_",
+		wantEmail:    "jo@example.com",
+	}, {
+		name:         "linked to password user",
+		claims:       claims("sub-4", passwordUserEmail),
+		wantCode:     codeOk,
+		wantUsername: "passworduser",
+		wantEmail:    passwordUserEmail,
+	}, {
+		name:     "password user with unverified email",
+		claims:   claims("sub-9", unverifiedUserEmail),
+		wantCode: codeForbidden,
+	}, {
+		name:     "unverified email",
+		claims:   claims("sub-5", "unverified@example.com", "email_verified", false),
+		wantCode: codeForbidden,
+	}, {
+		name:     "email domain not allowed",
+		claims:   claims("sub-6", "sso@other.com"),
+		wantCode: codeForbidden,
+	}, {
+		name:     "nonce mismatch",
+		claims:   claims("sub-7", "nonce@example.com", "nonce", "other"),
+		wantCode: codeUnauthorized,
+	}, {
+		name:     "wrong audience",
+		claims:   claims("sub-8", "aud@example.com", "aud", "other"),
+		wantCode: codeUnauthorized,
+	}}
+
+	for _, test := range tests {
+		resp, code := login(test.claims)
+		if code != test.wantCode {
+			t.Fatalf("%s: Expected code %d but got %d (%s)", test.name, test.wantCode, code, resp.Message)
+		}
+
+		if test.wantCode != codeOk {
+			continue
+		}
+
+		if resp.Data.Email != test.wantEmail || (test.wantUsername != "" && resp.Data.Username != test.wantUsername) {
+			t.Fatalf("%s: Unexpected user %+v", test.name, resp.Data)
+		}
+		tRequireAuthCode(t, s, test.name, resp.AuthToken, codeOk)
+	}
+
+	// The user of a taken username gets a suffixed username.
+	user, err := s.db.RetrieveUserInfo("other@example.com")
+	if err != nil {
+		t.Fatalf("s.db.RetrieveUserInfo error: %s", err)
+	}
+	if user.Username == "SSOUser" || len(user.Username) <= len("SSOUser") || user.Username[:len("SSOUser")] != "SSOUser" {
+		t.Fatalf("Unexpected username %q", user.Username)
+	}
+
+	// Identities are not linked to users that have not verified their email.
+	if _, err := s.db.RetrieveIdentityUser(provider.URL, "sub-9"); !errors.Is(err, db.ErrorNotFound) {
+		t.Fatalf("Expected the identity to not be linked but got %v", err)
+	}
+
+	// Users created for an identity cannot log in with a password.
+	if _, err := s.db.LoginUser("sso@example.com", nil); err == nil {
+		t.Fatal("Expected password login of an OIDC user to fail")
+	}
+
+	// The callback requires the cookie and state of the login.
+	authURL, cookie := tOIDCStart(t, s)
+	state := authURL.Query().Get("state")
+	for name, test := range map[string]struct {
+		state  string
+		cookie *http.Cookie
+	}{
+		"no cookie":      {state, nil},
+		"state mismatch": {"other", cookie},
+		"no state":       {"", cookie},
+		"invalid cookie": {state, &http.Cookie{Name: oidcCookieName, Value: "invalid"}},
+	} {
+		code := provider.authorize(t, authURL.String(), claims("sub-1", "sso@example.com"))
+		resp := tOIDCGet(t, s, fmt.Sprintf("api/auth/oidc/callback?code=%s&state=%s", code, test.state), test.cookie)
+		if resp.StatusCode != codeUnauthorized {
+			t.Fatalf("%s: Expected code %d but got %d", name, codeUnauthorized, resp.StatusCode)
+		}
+	}
+
+	// Authorization codes can only be used once and require the PKCE
+	// verifier of the login.
+	code := provider.authorize(t, authURL.String(), claims("sub-1", "sso@example.com"))
+	endpoint := fmt.Sprintf("api/auth/oidc/callback?code=%s&state=%s", code, state)
+	if resp := tOIDCGet(t, s, endpoint, cookie); resp.StatusCode != codeOk {
+		t.Fatalf("Expected code %d but got %d", codeOk, resp.StatusCode)
+	}
+	if resp := tOIDCGet(t, s, endpoint, cookie); resp.StatusCode != codeUnauthorized {
+		t.Fatalf("Expected a reused code to be rejected but got %d", resp.StatusCode)
+	}
+
+	otherAuthURL, _ := tOIDCStart(t, s)
+	code = provider.authorize(t, otherAuthURL.String(), claims("sub-1", "sso@example.com"))
+	resp = tOIDCGet(t, s, fmt.Sprintf("api/auth/oidc/callback?code=%s&state=%s", code, state), cookie)
+	if resp.StatusCode != codeUnauthorized {
+		t.Fatalf("Expected a code of another login to be rejected but got %d", resp.StatusCode)
+	}
+}
+
+func TestWebServer_handleOIDCCallbackRedirect(t *testing.T) {
+	provider := newTOIDCProvider(t)
+	defer provider.Close()
+
+	// Cookies must be sent over plain HTTP for this redirect URL.
+	cfg := Config{InsecureCookies: true, OIDC: OIDCConfig{
+		Issuer:             provider.URL,
+		ClientID:           "bob",
+		RedirectURL:        "http://bob.test/api/auth/oidc/callback",
+		SuccessRedirectURL: "http://app.test/login",
+	}}
+	s := startTServer(t, cfg, mem.New())
+	defer s.Stop()
+
+	authURL, cookie := tOIDCStart(t, s)
+	code := provider.authorize(t, authURL.String(), map[string]interface{}{"sub": "sub-1", "email": "sso@example.com", "email_verified": true})
+	resp := tOIDCGet(t, s, fmt.Sprintf("api/auth/oidc/callback?code=%s&state=%s", code, authURL.Query().Get("state")), cookie)
+	if resp.StatusCode != codeSeeOther {
+		t.Fatalf("Expected code %d but got %d", codeSeeOther, resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("url.Parse error: %v", err)
+	}
+
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatalf("url.ParseQuery error: %v", err)
+	}
+
+	if location.Host != "app.test" || fragment.Get("refreshToken") == "" || fragment.Get("authTokenExpiry") == "" {
+		t.Fatalf("Unexpected redirect %s", location)
+	}
+	tRequireAuthCode(t, s, "redirect", fragment.Get("authToken"), codeOk)
+}
@@ -0,0 +1,387 @@
+package webserver
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultMinUsernameLength = 3
+	defaultMaxUsernameLength = 32
+	defaultUsernameCharset   = "a-zA-Z0-9._-"
+	defaultMinPasswordLength = 8
+	defaultMaxPasswordLength = 128
+	// maxPasswordStrength is the score of the strongest passwords, see
+	// passwordStrength.
+	maxPasswordStrength = 4
+)
+
+// defaultReservedUsernames are the usernames that cannot be taken if no
+// reserved usernames are configured.
+var defaultReservedUsernames = []string{"admin", "administrator", "root", "system", "support", "help", "api", "bob", "security", "abuse", "postmaster", "noreply"}
+
+// These are the rules of the account policy. They identify the rule a
+// username or password breaks in policy errors.
+const (
+	ruleMinLength = "min_length"
+	ruleMaxLength = "max_length"
+	ruleCharset   = "charset"
+	ruleReserved  = "reserved"
+	ruleLowercase = "lowercase"
+	ruleUppercase = "uppercase"
+	ruleDigit     = "digit"
+	ruleSymbol    = "symbol"
+	ruleBreached  = "breached"
+	ruleStrength  = "strength"
+)
+
+// PolicyConfig is the configuration of the rules usernames and passwords must
+// follow. Zero lengths and an empty charset use the defaults. Existing
+// usernames and passwords are not checked again when the policy changes.
+type PolicyConfig struct {
+	MinUsernameLength int `long:"minusernamelength" env:"POLICY_MIN_USERNAME_LENGTH" default:"3" description:"Minimum number of characters of usernames"`
+	MaxUsernameLength int `long:"maxusernamelength" env:"POLICY_MAX_USERNAME_LENGTH" default:"32" description:"Maximum number of characters of usernames"`
+	// UsernameCharset is the content of the regular expression bracket
+	// expression matching the characters allowed in usernames.
+	UsernameCharset string `long:"usernamecharset" env:"POLICY_USERNAME_CHARSET" default:"a-zA-Z0-9._-" description:"Characters allowed in usernames, as the content of a regular expression bracket expression"`
+	// ReservedUsernames cannot be taken by users, they are compared case
+	// insensitively. defaultReservedUsernames are used if it is empty.
+	ReservedUsernames []string `long:"reservedusername" env:"POLICY_RESERVED_USERNAMES" env-delim:"," description:"Usernames that cannot be taken, compared case insensitively, a list of common administrative names is used if not set"`
+	MinPasswordLength int      `long:"minpasswordlength" env:"POLICY_MIN_PASSWORD_LENGTH" default:"8" description:"Minimum number of characters of passwords"`
+	MaxPasswordLength int      `long:"maxpasswordlength" env:"POLICY_MAX_PASSWORD_LENGTH" default:"128" description:"Maximum number of characters of passwords"`
+	RequireLowercase  bool     `long:"requirelowercase" env:"POLICY_REQUIRE_LOWERCASE" description:"Require passwords to contain a lowercase letter"`
+	RequireUppercase  bool     `long:"requireuppercase" env:"POLICY_REQUIRE_UPPERCASE" description:"Require passwords to contain an uppercase letter"`
+	RequireDigit      bool     `long:"requiredigit" env:"POLICY_REQUIRE_DIGIT" description:"Require passwords to contain a digit"`
+	RequireSymbol     bool     `long:"requiresymbol" env:"POLICY_REQUIRE_SYMBOL" description:"Require passwords to contain a character that is not a letter or a digit"`
+	// BreachedPasswordsFile is the path to a list of passwords that cannot be
+	// used, with one password or hex encoded SHA-1 hash of a password per
+	// line. Lines of SHA-1 hashes can end with ":<count>", as in the Pwned
+	// Passwords downloads. The list is loaded in memory on startup.
+	BreachedPasswordsFile string `long:"breachedpasswordsfile" env:"POLICY_BREACHED_PASSWORDS_FILE" description:"Path to a file of breached passwords or SHA-1 hashes of passwords, one per line, that cannot be used"`
+	// MinPasswordStrength is the minimum passwordStrength score of passwords,
+	// from 0 to 4. 0 accepts every password.
+	MinPasswordStrength int `long:"minpasswordstrength" env:"POLICY_MIN_PASSWORD_STRENGTH" default:"0" description:"Minimum strength score of passwords from 0 (any password) to 4 (very strong)"`
+}
+
+// policyViolation is a rule of the account policy that a username or password
+// breaks.
+type policyViolation struct {
+	// Field is "username" or "password".
+	Field string `json:"field"`
+	// Rule is one of the rule constants, e.g. ruleMinLength.
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// accountPolicy checks usernames and passwords against the rules of a
+// PolicyConfig.
+type accountPolicy struct {
+	minUsernameLength int
+	maxUsernameLength int
+	usernameRegEx     *regexp.Regexp
+	// reservedUsernames are lowercase.
+	reservedUsernames map[string]struct{}
+
+	minPasswordLength   int
+	maxPasswordLength   int
+	requireLowercase    bool
+	requireUppercase    bool
+	requireDigit        bool
+	requireSymbol       bool
+	minPasswordStrength int
+	// breachedPasswords are the SHA-1 hashes of breached passwords.
+	breachedPasswords map[[sha1.Size]byte]struct{}
+}
+
+// newAccountPolicy creates an accountPolicy from cfg. The breached passwords
+// file is loaded if it is configured.
+func newAccountPolicy(cfg PolicyConfig) (*accountPolicy, error) {
+	p := &accountPolicy{
+		minUsernameLength:   cfg.MinUsernameLength,
+		maxUsernameLength:   cfg.MaxUsernameLength,
+		reservedUsernames:   make(map[string]struct{}),
+		minPasswordLength:   cfg.MinPasswordLength,
+		maxPasswordLength:   cfg.MaxPasswordLength,
+		requireLowercase:    cfg.RequireLowercase,
+		requireUppercase:    cfg.RequireUppercase,
+		requireDigit:        cfg.RequireDigit,
+		requireSymbol:       cfg.RequireSymbol,
+		minPasswordStrength: cfg.MinPasswordStrength,
+	}
+
+	if p.minUsernameLength <= 0 {
+		p.minUsernameLength = defaultMinUsernameLength
+	}
+	if p.maxUsernameLength <= 0 {
+		p.maxUsernameLength = defaultMaxUsernameLength
+	}
+	if p.minUsernameLength > p.maxUsernameLength {
+		return nil, fmt.Errorf("minimum username length %d is greater than the maximum %d", p.minUsernameLength, p.maxUsernameLength)
+	}
+
+	if p.minPasswordLength <= 0 {
+		p.minPasswordLength = defaultMinPasswordLength
+	}
+	if p.maxPasswordLength <= 0 {
+		p.maxPasswordLength = defaultMaxPasswordLength
+	}
+	if p.minPasswordLength > p.maxPasswordLength {
+		return nil, fmt.Errorf("minimum password length %d is greater than the maximum %d", p.minPasswordLength, p.maxPasswordLength)
+	}
+
+	if p.minPasswordStrength < 0 || p.minPasswordStrength > maxPasswordStrength {
+		return nil, fmt.Errorf("invalid minimum password strength %d, it must be between 0 and %d", p.minPasswordStrength, maxPasswordStrength)
+	}
+
+	charset := cfg.UsernameCharset
+	if charset == "" {
+		charset = defaultUsernameCharset
+	}
+	var err error
+	if p.usernameRegEx, err = regexp.Compile("^[" + charset + "]*$"); err != nil {
+		return nil, fmt.Errorf("invalid username charset %q: %w", charset, err)
+	}
+
+	reserved := cfg.ReservedUsernames
+	if len(reserved) == 0 {
+		reserved = defaultReservedUsernames
+	}
+	for _, name := range reserved {
+		if name = strings.TrimSpace(name); name != "" {
+			p.reservedUsernames[strings.ToLower(name)] = struct{}{}
+		}
+	}
+
+	if cfg.BreachedPasswordsFile != "" {
+		if p.breachedPasswords, err = loadBreachedPasswords(cfg.BreachedPasswordsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// loadBreachedPasswords reads the SHA-1 hashes of the passwords listed in the
+// file at path, see PolicyConfig.BreachedPasswordsFile.
+func loadBreachedPasswords(path string) (map[[sha1.Size]byte]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening breached passwords file: %w", err)
+	}
+	defer f.Close()
+
+	hashes := make(map[[sha1.Size]byte]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		hexHash, _, _ := strings.Cut(line, ":")
+		var hash [sha1.Size]byte
+		if len(hexHash) == 2*sha1.Size {
+			if _, err := hex.Decode(hash[:], []byte(hexHash)); err == nil {
+				hashes[hash] = struct{}{}
+				continue
+			}
+		}
+
+		hashes[sha1.Sum([]byte(line))] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading breached passwords file: %w", err)
+	}
+
+	return hashes, nil
+}
+
+// validateUsername returns the rules that username breaks.
+func (p *accountPolicy) validateUsername(username string) []*policyViolation {
+	var violations []*policyViolation
+	violate := func(rule, msg string) {
+		violations = append(violations, &policyViolation{Field: "username", Rule: rule, Message: msg})
+	}
+
+	length := utf8.RuneCountInString(username)
+	if length < p.minUsernameLength {
+		violate(ruleMinLength, fmt.Sprintf("username with at least %d characters is required", p.minUsernameLength))
+	}
+	if length > p.maxUsernameLength {
+		violate(ruleMaxLength, fmt.Sprintf("username must be at most %d characters", p.maxUsernameLength))
+	}
+
+	if !p.usernameRegEx.MatchString(username) {
+		violate(ruleCharset, "username contains characters that are not allowed")
+	}
+
+	if _, ok := p.reservedUsernames[strings.ToLower(username)]; ok {
+		violate(ruleReserved, "username is reserved")
+	}
+
+	return violations
+}
+
+// validatePassword returns the rules that password breaks. userInputs, e.g.
+// the username and email of the user, weaken passwords that contain them.
+func (p *accountPolicy) validatePassword(password []byte, userInputs ...string) []*policyViolation {
+	var violations []*policyViolation
+	violate := func(rule, msg string) {
+		violations = append(violations, &policyViolation{Field: "password", Rule: rule, Message: msg})
+	}
+
+	length := utf8.RuneCount(password)
+	if length < p.minPasswordLength {
+		violate(ruleMinLength, fmt.Sprintf("password must be a minimum of %d characters", p.minPasswordLength))
+	}
+	if length > p.maxPasswordLength {
+		violate(ruleMaxLength, fmt.Sprintf("password must be at most %d characters", p.maxPasswordLength))
+	}
+
+	classes := passwordCharClasses(password)
+	if p.requireLowercase && classes&charClassLower == 0 {
+		violate(ruleLowercase, "password must contain a lowercase letter")
+	}
+	if p.requireUppercase && classes&charClassUpper == 0 {
+		violate(ruleUppercase, "password must contain an uppercase letter")
+	}
+	if p.requireDigit && classes&charClassDigit == 0 {
+		violate(ruleDigit, "password must contain a digit")
+	}
+	if p.requireSymbol && classes&(charClassSymbol|charClassOther) == 0 {
+		violate(ruleSymbol, "password must contain a symbol")
+	}
+
+	if p.isBreachedPassword(password) {
+		violate(ruleBreached, "password has appeared in a data breach, choose another password")
+	}
+
+	if p.minPasswordStrength > 0 && passwordStrength(password, userInputs...) < p.minPasswordStrength {
+		violate(ruleStrength, "password is too easy to guess, use a longer password or more kinds of characters")
+	}
+
+	return violations
+}
+
+// isBreachedPassword returns true if password or its lowercase version is in
+// the breached passwords list.
+func (p *accountPolicy) isBreachedPassword(password []byte) bool {
+	if len(p.breachedPasswords) == 0 {
+		return false
+	}
+
+	if _, ok := p.breachedPasswords[sha1.Sum(password)]; ok {
+		return true
+	}
+
+	_, ok := p.breachedPasswords[sha1.Sum([]byte(strings.ToLower(string(password))))]
+	return ok
+}
+
+// These are the kinds of characters of passwords.
+const (
+	charClassLower = 1 << iota
+	charClassUpper
+	charClassDigit
+	charClassSymbol
+	charClassOther
+)
+
+// passwordCharClasses returns the kinds of characters in password.
+func passwordCharClasses(password []byte) int {
+	var classes int
+	for _, r := range string(password) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			classes |= charClassLower
+		case r >= 'A' && r <= 'Z':
+			classes |= charClassUpper
+		case r >= '0' && r <= '9':
+			classes |= charClassDigit
+		case r < utf8.RuneSelf:
+			classes |= charClassSymbol
+		case unicode.IsLower(r):
+			classes |= charClassLower
+		case unicode.IsUpper(r):
+			classes |= charClassUpper
+		default:
+			classes |= charClassOther
+		}
+	}
+	return classes
+}
+
+// passwordStrength scores how hard password is to guess from 0 (very weak) to
+// maxPasswordStrength (very strong). The score is based on an estimate of the
+// entropy of password: each character adds the bits of the pool of characters
+// password is made of, and characters that repeat or continue a sequence of
+// the previous character, e.g. "aaa" or "abc", only add one bit. userInputs
+// found in password only count as one character.
+func passwordStrength(password []byte, userInputs ...string) int {
+	s := string(password)
+	lower := strings.ToLower(s)
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+		if utf8.RuneCountInString(input) < 3 {
+			continue
+		}
+		// Offsets in lower only match s if lowercasing kept every length.
+		if i := strings.Index(lower, input); i >= 0 && len(lower) == len(s) {
+			s = s[:i] + "!" + s[i+len(input):]
+			lower = strings.ToLower(s)
+		}
+	}
+
+	var pool int
+	classes := passwordCharClasses([]byte(s))
+	if classes&charClassLower != 0 {
+		pool += 26
+	}
+	if classes&charClassUpper != 0 {
+		pool += 26
+	}
+	if classes&charClassDigit != 0 {
+		pool += 10
+	}
+	if classes&charClassSymbol != 0 {
+		pool += 33
+	}
+	if classes&charClassOther != 0 {
+		pool += 100
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	charBits := math.Log2(float64(pool))
+	var bits float64
+	prev := rune(-1)
+	for _, r := range s {
+		if d := r - prev; d >= -1 && d <= 1 {
+			bits++
+		} else {
+			bits += charBits
+		}
+		prev = r
+	}
+
+	switch {
+	case bits < 28:
+		return 0
+	case bits < 36:
+		return 1
+	case bits < 60:
+		return 2
+	case bits < 80:
+		return 3
+	}
+	return maxPasswordStrength
+}
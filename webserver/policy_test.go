@@ -0,0 +1,215 @@
+package webserver
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db/mem"
+)
+
+// violationRules returns the fields and rules of violations, e.g.
+// "username:min_length".
+func violationRules(violations []*policyViolation) string {
+	rules := make([]string, 0, len(violations))
+	for _, v := range violations {
+		rules = append(rules, v.Field+":"+v.Rule)
+	}
+	return strings.Join(rules, ",")
+}
+
+func TestAccountPolicy_validateUsername(t *testing.T) {
+	p, err := newAccountPolicy(PolicyConfig{})
+	if err != nil {
+		t.Fatalf("newAccountPolicy error: %v", err)
+	}
+
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"fibrealz", ""},
+		{"fi.b_r-3", ""},
+		{"fi", "username:min_length"},
+		{strings.Repeat("a", defaultMaxUsernameLength+1), "username:max_length"},
+		{"fib realz", "username:charset"},
+		{"fïbrealz", "username:charset"},
+		{"<b>", "username:charset"},
+		{"Admin", "username:reserved"},
+		{"", "username:min_length"},
+	}
+
+	for _, tt := range tests {
+		if got := violationRules(p.validateUsername(tt.username)); got != tt.want {
+			t.Fatalf("%q: expected violations %q but got %q", tt.username, tt.want, got)
+		}
+	}
+
+	p, err = newAccountPolicy(PolicyConfig{
+		MinUsernameLength: 2,
+		MaxUsernameLength: 4,
+		UsernameCharset:   "a-z",
+		ReservedUsernames: []string{"Bob"},
+	})
+	if err != nil {
+		t.Fatalf("newAccountPolicy error: %v", err)
+	}
+
+	for username, want := range map[string]string{
+		"ab":     "",
+		"admin":  "username:max_length",
+		"AB":     "username:charset",
+		"bob":    "username:reserved",
+		"b0b_b0": "username:max_length,username:charset",
+	} {
+		if got := violationRules(p.validateUsername(username)); got != want {
+			t.Fatalf("%q: expected violations %q but got %q", username, want, got)
+		}
+	}
+}
+
+func TestAccountPolicy_validatePassword(t *testing.T) {
+	breachedFile := filepath.Join(t.TempDir(), "breached.txt")
+	hash := sha1.Sum([]byte("Tr0ub4dor&3"))
+	breached := "123456\r\nqwertyuiop\n\n" + strings.ToUpper(hex.EncodeToString(hash[:])) + ":42\n"
+	if err := os.WriteFile(breachedFile, []byte(breached), 0600); err != nil {
+		t.Fatalf("os.WriteFile error: %v", err)
+	}
+
+	p, err := newAccountPolicy(PolicyConfig{
+		MinPasswordLength:     10,
+		MaxPasswordLength:     40,
+		RequireLowercase:      true,
+		RequireUppercase:      true,
+		RequireDigit:          true,
+		RequireSymbol:         true,
+		BreachedPasswordsFile: breachedFile,
+		MinPasswordStrength:   3,
+	})
+	if err != nil {
+		t.Fatalf("newAccountPolicy error: %v", err)
+	}
+
+	tests := []struct {
+		password string
+		want     string
+	}{
+		{"Kx9#mPq2$vLw", ""},
+		{"Ünïcödé-Pässwörd-9", ""},
+		{"Kx9#mPq2", "password:min_length,password:strength"},
+		{"Kx9#mPq2$vLw" + strings.Repeat("a", 40), "password:max_length"},
+		{"kx9#mpq2$vlw", "password:uppercase"},
+		{"KX9#MPQ2$VLW", "password:lowercase"},
+		{"Kxt#mPqz$vLw", "password:digit"},
+		{"Kx9amPq2bvLw", "password:symbol"},
+		{"Tr0ub4dor&3", "password:breached"},
+		{"QWERTYUIOP", "password:lowercase,password:digit,password:symbol,password:breached,password:strength"},
+		{"Aaaaaaaaaaaaaaa1!", "password:strength"},
+		{"Abcdefghijklmn1!", "password:strength"},
+		{"", "password:min_length,password:lowercase,password:uppercase,password:digit,password:symbol,password:strength"},
+	}
+
+	for _, tt := range tests {
+		if got := violationRules(p.validatePassword([]byte(tt.password))); got != tt.want {
+			t.Fatalf("%q: expected violations %q but got %q", tt.password, tt.want, got)
+		}
+	}
+
+	// A password made of the username is too easy to guess.
+	if got := violationRules(p.validatePassword([]byte("Fibrealz#2023"), "fibrealz")); got != "password:strength" {
+		t.Fatalf("expected a strength violation but got %q", got)
+	}
+}
+
+func TestPasswordStrength(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"aaaaaaaaaaaa", 0},
+		{"123456789", 0},
+		{"password", 1},
+		{"passw0rd", 2},
+		{"Kx9#mPq2", 2},
+		{"Kx9#mPq2$vLw", 3},
+		{"Kx9#mPq2$vLw@7Zt", 4},
+		{"correct horse battery staple", 4},
+	}
+
+	for _, tt := range tests {
+		if got := passwordStrength([]byte(tt.password)); got != tt.want {
+			t.Fatalf("%q: expected strength %d but got %d", tt.password, tt.want, got)
+		}
+	}
+}
+
+func TestNewAccountPolicy(t *testing.T) {
+	invalid := map[string]PolicyConfig{
+		"username lengths":      {MinUsernameLength: 10, MaxUsernameLength: 5},
+		"password lengths":      {MinPasswordLength: 20, MaxPasswordLength: 10},
+		"strength":              {MinPasswordStrength: maxPasswordStrength + 1},
+		"charset":               {UsernameCharset: "z-a"},
+		"breached file missing": {BreachedPasswordsFile: filepath.Join(t.TempDir(), "missing.txt")},
+	}
+
+	for name, cfg := range invalid {
+		if _, err := newAccountPolicy(cfg); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestWebServer_policyViolations(t *testing.T) {
+	s := startTServer(t, Config{Policy: PolicyConfig{RequireDigit: true}}, mem.New())
+	defer s.Stop()
+
+	var resp *policyErrorResponse
+	req := createAccountRequest{Username: "admin", Email: "test@email.com", Password: "pass"}
+	if err := s.sendRequest(fiber.MethodPost, "api/user", req, &resp, nil); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp.Code != codeBadRequest {
+		t.Fatalf("Expected a bad request but got %d (%s)", resp.Code, resp.Message)
+	}
+	if got, want := violationRules(resp.Violations), "username:reserved,password:min_length,password:digit"; got != want {
+		t.Fatalf("Expected violations %q but got %q", want, got)
+	}
+	if want := "username is reserved; password must be a minimum of 8 characters; password must contain a digit"; resp.Message != want {
+		t.Fatalf("Expected message %q but got %q", want, resp.Message)
+	}
+
+	login := tLogin(t, s, "test@email.com")
+	headers := map[string]string{fiber.HeaderAuthorization: "Bearer " + login.AuthToken}
+	var changeResp *policyErrorResponse
+	changeReq := changePasswordRequest{CurrentPassword: dummyUserPassword, NewPassword: "longpassword"}
+	if err := s.sendRequest(fiber.MethodPost, "api/user/password", changeReq, &changeResp, headers); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+	if got := violationRules(changeResp.Violations); got != "password:digit" {
+		t.Fatalf("Expected a digit violation but got %q (%s)", got, changeResp.Message)
+	}
+}
+
+func TestWebServer_changePasswordPolicy(t *testing.T) {
+	s := startTServer(t, Config{Policy: PolicyConfig{MinPasswordStrength: 3}}, mem.New())
+	defer s.Stop()
+
+	login := tLogin(t, s, "test@email.com")
+	headers := map[string]string{fiber.HeaderAuthorization: "Bearer " + login.AuthToken}
+
+	// The new password is checked against the username too.
+	var resp *policyErrorResponse
+	req := changePasswordRequest{CurrentPassword: dummyUserPassword, NewPassword: "Fibrealz#2023"}
+	if err := s.sendRequest(fiber.MethodPost, "api/user/password", req, &resp, headers); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+	if got := violationRules(resp.Violations); got != "password:strength" {
+		t.Fatalf("Expected a strength violation but got %q (%s)", got, resp.Message)
+	}
+}
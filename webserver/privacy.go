@@ -0,0 +1,142 @@
+package webserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Privacy modes for the IP addresses of clicks.
+const (
+	// privacyModeOff stores IP addresses as they are.
+	privacyModeOff = "off"
+	// privacyModeTruncate stores the /24 network of IPv4 addresses and the /48
+	// network of IPv6 addresses.
+	privacyModeTruncate = "truncate"
+	// privacyModeHash stores a salted hash of IP addresses.
+	privacyModeHash = "hash"
+)
+
+const (
+	// truncatedIPv4Bits and truncatedIPv6Bits are the number of leading bits
+	// of IP addresses kept in privacyModeTruncate.
+	truncatedIPv4Bits = 24
+	truncatedIPv6Bits = 48
+	// clickRetentionSweepInterval is how often clicks older than the
+	// retention period are deleted.
+	clickRetentionSweepInterval = time.Hour
+)
+
+// ClicksConfig is the configuration for how clicks are stored.
+type ClicksConfig struct {
+	// Privacy is how the IP addresses of clicks are stored, one of "off",
+	// "truncate" or "hash".
+	Privacy string `long:"privacy" env:"CLICKS_PRIVACY" default:"off" choice:"off" choice:"truncate" choice:"hash" description:"How click IP addresses are stored: off keeps them, truncate keeps the /24 (IPv4) or /48 (IPv6) network and hash keeps a salted hash"`
+	// HashSalt is the secret salt used in privacyModeHash. A random salt is
+	// used if it is empty, so hashes change when the server restarts.
+	HashSalt string `long:"hashsalt" env:"CLICKS_HASH_SALT" description:"Secret salt for hashed click IP addresses, a random salt is generated on startup if not set"`
+	// Retention is how long clicks are kept. Zero keeps them forever. The
+	// click counters of short URLs are kept.
+	Retention Duration `long:"retention" env:"CLICKS_RETENTION" default:"0" description:"How long clicks are kept before they are deleted, e.g. 90d or 720h, 0 keeps them forever"`
+	// QueueSize is the maximum number of clicks waiting to be recorded.
+	// Clicks are dropped when the queue is full.
+	QueueSize int `long:"queuesize" env:"CLICKS_QUEUE_SIZE" default:"10000" description:"Maximum number of clicks waiting to be recorded, further clicks are dropped"`
+	// BatchSize is the maximum number of clicks recorded at once.
+	BatchSize int `long:"batchsize" env:"CLICKS_BATCH_SIZE" default:"500" description:"Maximum number of clicks recorded in a single batch"`
+	// FlushInterval is how long clicks wait to fill a batch before they are
+	// recorded.
+	FlushInterval time.Duration `long:"flushinterval" env:"CLICKS_FLUSH_INTERVAL" default:"1s" description:"How often queued clicks are recorded when a batch is not full"`
+	// Workers is the number of goroutines recording clicks.
+	Workers int `long:"workers" env:"CLICKS_WORKERS" default:"2" description:"Number of workers recording clicks"`
+}
+
+// Duration is a time.Duration that can also be specified as a whole number of
+// days, e.g. "90d".
+type Duration time.Duration
+
+// UnmarshalFlag implements flags.Unmarshaler.
+func (d *Duration) UnmarshalFlag(value string) error {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*d = Duration(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalFlag implements flags.Marshaler.
+func (d Duration) MarshalFlag() (string, error) {
+	return time.Duration(d).String(), nil
+}
+
+// ipAnonymizer applies a privacy mode to the IP addresses of clicks.
+type ipAnonymizer struct {
+	mode string
+	salt []byte
+}
+
+// newIPAnonymizer creates an *ipAnonymizer from cfg.
+func newIPAnonymizer(cfg ClicksConfig) (*ipAnonymizer, error) {
+	a := &ipAnonymizer{mode: cfg.Privacy}
+	switch cfg.Privacy {
+	case "":
+		a.mode = privacyModeOff
+	case privacyModeOff, privacyModeTruncate:
+	case privacyModeHash:
+		a.salt = []byte(cfg.HashSalt)
+		if len(a.salt) == 0 {
+			appLog.Println("No click IP hash salt is configured, generating a random salt. IP hashes will change when the server restarts.")
+			a.salt = make([]byte, 32)
+			if _, err := rand.Read(a.salt); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid click privacy mode %q", cfg.Privacy)
+	}
+
+	return a, nil
+}
+
+// anonymize returns the IP address to store for a click from ip.
+func (a *ipAnonymizer) anonymize(ip string) string {
+	switch a.mode {
+	case privacyModeTruncate:
+		parsedIP := net.ParseIP(ip)
+		if parsedIP == nil {
+			return ""
+		}
+		if ipv4 := parsedIP.To4(); ipv4 != nil {
+			return ipv4.Mask(net.CIDRMask(truncatedIPv4Bits, 8*net.IPv4len)).String()
+		}
+		return parsedIP.Mask(net.CIDRMask(truncatedIPv6Bits, 8*net.IPv6len)).String()
+	case privacyModeHash:
+		if ip == "" {
+			return ""
+		}
+		mac := hmac.New(sha256.New, a.salt)
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	default:
+		return ip
+	}
+}
@@ -0,0 +1,128 @@
+package webserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestDuration_UnmarshalFlag(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "90d", want: 90 * 24 * time.Hour},
+		{value: "720h", want: 720 * time.Hour},
+		{value: "0", want: 0},
+		{value: "1.5d", wantErr: true},
+		{value: "-1d", wantErr: true},
+		{value: "-1h", wantErr: true},
+		{value: "ninety days", wantErr: true},
+	}
+
+	for _, test := range tests {
+		var d Duration
+		err := d.UnmarshalFlag(test.value)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("%s: expected error %v but got %v", test.value, test.wantErr, err)
+		}
+
+		if time.Duration(d) != test.want {
+			t.Fatalf("%s: expected %s but got %s", test.value, test.want, time.Duration(d))
+		}
+	}
+}
+
+func TestIPAnonymizer(t *testing.T) {
+	if _, err := newIPAnonymizer(ClicksConfig{Privacy: "scramble"}); err == nil {
+		t.Fatal("Expected an error for an invalid privacy mode")
+	}
+
+	off, err := newIPAnonymizer(ClicksConfig{})
+	if err != nil {
+		t.Fatalf("newIPAnonymizer error: %v", err)
+	}
+
+	if ip := off.anonymize("203.0.113.77"); ip != "203.0.113.77" {
+		t.Fatalf("Expected the IP address to be kept but got %s", ip)
+	}
+
+	truncate, err := newIPAnonymizer(ClicksConfig{Privacy: privacyModeTruncate})
+	if err != nil {
+		t.Fatalf("newIPAnonymizer error: %v", err)
+	}
+
+	for ip, want := range map[string]string{
+		"203.0.113.77":           "203.0.113.0",
+		"2001:db8:85a3:8d3::370": "2001:db8:85a3::",
+		"::ffff:203.0.113.77":    "203.0.113.0",
+		"not-an-ip":              "",
+	} {
+		if got := truncate.anonymize(ip); got != want {
+			t.Fatalf("Expected %s to be truncated to %q but got %q", ip, want, got)
+		}
+	}
+
+	hash, err := newIPAnonymizer(ClicksConfig{Privacy: privacyModeHash, HashSalt: "salt"})
+	if err != nil {
+		t.Fatalf("newIPAnonymizer error: %v", err)
+	}
+
+	hashed := hash.anonymize("203.0.113.77")
+	if hashed == "203.0.113.77" || len(hashed) != 32 || hashed != hash.anonymize("203.0.113.77") {
+		t.Fatalf("Expected a stable hash but got %s", hashed)
+	}
+
+	otherSalt, err := newIPAnonymizer(ClicksConfig{Privacy: privacyModeHash, HashSalt: "pepper"})
+	if err != nil {
+		t.Fatalf("newIPAnonymizer error: %v", err)
+	}
+
+	if otherSalt.anonymize("203.0.113.77") == hashed {
+		t.Fatal("Expected hashes with different salts to differ")
+	}
+
+	randomSalt, err := newIPAnonymizer(ClicksConfig{Privacy: privacyModeHash})
+	if err != nil {
+		t.Fatalf("newIPAnonymizer error: %v", err)
+	}
+
+	if len(randomSalt.salt) == 0 {
+		t.Fatal("Expected a random salt to be generated")
+	}
+}
+
+func TestWebServer_clickPrivacy(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerEmail := "owner@email.com"
+	tURLOwners(t, s, ownerEmail, "other@email.com", "ownedurl")
+
+	s.geoIP = tResolver{"127.0.0.1": {Country: "GB"}}
+	s.ipAnonymizer = &ipAnonymizer{mode: privacyModeTruncate}
+
+	a := fiber.AcquireAgent()
+	defer fiber.ReleaseAgent(a)
+
+	req := a.Request()
+	req.SetRequestURI(fmt.Sprintf("http://%s/ownedurl", s.addr))
+	req.Header.SetMethod(fiber.MethodGet)
+	if err := a.Parse(); err != nil {
+		t.Fatalf("a.Parse error: %s", err)
+	}
+
+	if code, _, errs := a.Bytes(); len(errs) > 0 || code != codeFound {
+		t.Fatalf("Expected code %d but got %d (%v)", codeFound, code, errs)
+	}
+
+	clicks := s.waitForClicks(t, ownerEmail, "ownedurl", 1)
+
+	// The click is located from the full IP address.
+	if clicks[0].IP != "127.0.0.0" || clicks[0].Country != "GB" {
+		t.Fatalf("Unexpected clicks %+v", clicks)
+	}
+}
@@ -0,0 +1,207 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db"
+)
+
+const (
+	// accessTokenExpiry is how long the auth tokens issued to users are
+	// valid. They are short-lived because revoking a session is only checked
+	// when a token is used, and a new one is obtained with the refresh token.
+	accessTokenExpiry = 15 * time.Minute
+	// refreshTokenExpiry is how long a session can be refreshed after its
+	// refresh token was issued.
+	refreshTokenExpiry = 30 * 24 * time.Hour
+	// sessionIDLength is the number of random bytes in a session ID.
+	sessionIDLength = 16
+	// refreshTokenSecretLength is the number of random bytes in the secret
+	// part of a refresh token.
+	refreshTokenSecretLength = 32
+)
+
+// authTokens are the tokens issued to a user when they log in or refresh
+// their session.
+type authTokens struct {
+	AuthToken string `json:"authToken"`
+	// AuthTokenExpiry is the unix timestamp at which AuthToken expires.
+	AuthTokenExpiry int64 `json:"authTokenExpiry"`
+	// RefreshToken can be used once to get new tokens, see
+	// handleRefreshToken.
+	RefreshToken string `json:"refreshToken"`
+}
+
+// newRefreshToken generates a refresh token for the session with the specified
+// ID and returns it with its hash. The session ID is part of the token so the
+// session can be found without storing the token itself.
+func newRefreshToken(sessionID string) (string, []byte, error) {
+	secret, err := randomBytes(refreshTokenSecretLength)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := sessionID + "." + base64.RawURLEncoding.EncodeToString(secret)
+	return token, hashRefreshToken(token), nil
+}
+
+// hashRefreshToken returns the SHA-256 hash of a refresh token.
+func hashRefreshToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// sessionIDFromRefreshToken returns the session ID of a refresh token.
+func sessionIDFromRefreshToken(token string) (string, bool) {
+	sessionID, _, found := strings.Cut(token, ".")
+	return sessionID, found && sessionID != ""
+}
+
+// createSession creates a new session for the user with the specified email
+// and returns the tokens for the session.
+func (s *WebServer) createSession(email string) (*authTokens, error) {
+	id, err := randomBytes(sessionIDLength)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID := hex.EncodeToString(id)
+	refreshToken, refreshTokenHash, err := newRefreshToken(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &db.Session{
+		ID:               sessionID,
+		Email:            email,
+		RefreshTokenHash: refreshTokenHash,
+		CreatedAt:        now.Unix(),
+		ExpiresAt:        now.Add(refreshTokenExpiry).Unix(),
+	}
+	if err := s.db.CreateSession(session); err != nil {
+		return nil, err
+	}
+
+	return s.sessionTokens(session, refreshToken)
+}
+
+// sessionTokens generates an auth token for session and returns it with
+// refreshToken.
+func (s *WebServer) sessionTokens(session *db.Session, refreshToken string) (*authTokens, error) {
+	authToken, err := s.authenticator.generateAuthToken(session.ID, session.Email, jwtAudienceUser, accessTokenExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authTokens{
+		AuthToken:       authToken,
+		AuthTokenExpiry: time.Now().Add(accessTokenExpiry).Unix(),
+		RefreshToken:    refreshToken,
+	}, nil
+}
+
+// handleRefreshToken handles the "POST /api/token/refresh" endpoint and
+// exchanges a refresh token for a new auth token and refresh token. A refresh
+// token can only be used once.
+func (s *WebServer) handleRefreshToken(c *fiber.Ctx) error {
+	form := new(refreshTokenRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	const invalidTokenMsg = "Invalid or expired refresh token"
+	sessionID, ok := sessionIDFromRefreshToken(form.RefreshToken)
+	if !ok {
+		return errUnauthorized(invalidTokenMsg)
+	}
+
+	session, err := s.db.RetrieveSession(sessionID)
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return errUnauthorized(invalidTokenMsg)
+		}
+
+		appLog.Printf("\ndb.RetrieveSession error: %v\n", err)
+		return errInternal(err)
+	}
+
+	if !session.IsActive(time.Now()) {
+		return errUnauthorized(invalidTokenMsg)
+	}
+
+	refreshToken, refreshTokenHash, err := newRefreshToken(session.ID)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	expiresAt := time.Now().Add(refreshTokenExpiry).Unix()
+	err = s.db.RotateSessionRefreshToken(session.ID, hashRefreshToken(form.RefreshToken), refreshTokenHash, expiresAt)
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			// The refresh token was already used or is not for this session.
+			return errUnauthorized(invalidTokenMsg)
+		}
+
+		appLog.Printf("\ndb.RotateSessionRefreshToken error: %v\n", err)
+		return errInternal(err)
+	}
+
+	tokens, err := s.sessionTokens(session, refreshToken)
+	if err != nil {
+		appLog.Printf("\nerror generating auth token: %v\n", err)
+		return errInternal(err)
+	}
+
+	resp := &authTokensResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Token Refreshed."),
+		authTokens:  *tokens,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleLogout handles the "POST /api/logout" endpoint and revokes the session
+// of the auth token used for the request.
+func (s *WebServer) handleLogout(c *fiber.Ctx) error {
+	sessionID, ok := c.Context().UserValue(ctxSessionID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	if err := s.db.RevokeSession(sessionID); err != nil {
+		appLog.Printf("\ndb.RevokeSession error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	resp := newAPIResponse(true, codeOk, "Logout Successful.")
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleLogoutAll handles the "POST /api/logout/all" endpoint and revokes all
+// the sessions of the user, including the one used for the request.
+func (s *WebServer) handleLogoutAll(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	n, err := s.db.RevokeUserSessions(email)
+	if err != nil {
+		appLog.Printf("\ndb.RevokeUserSessions error: %v\n", err)
+		return errInternal(err)
+	}
+
+	resp := &logoutAllResponse{
+		APIResponse: newAPIResponse(true, codeOk, "All Sessions Logged Out."),
+		Revoked:     n,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
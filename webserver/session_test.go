@@ -0,0 +1,158 @@
+package webserver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// tLogin creates a user with the specified email and logs them in.
+func tLogin(t *testing.T, s *tServer, email string) *loginResponse {
+	t.Helper()
+	if err := s.db.CreateUser("fibrealz", email, []byte(dummyUserPassword)); err != nil {
+		t.Fatalf("s.db.CreateUser error: %s", err)
+	}
+
+	var resp *loginResponse
+	req := loginRequest{Email: email, Password: dummyUserPassword}
+	if err := s.sendRequest(fiber.MethodPost, "api/login", req, &resp, nil); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp.Code != codeOk || resp.AuthToken == "" || resp.RefreshToken == "" || resp.AuthTokenExpiry == 0 {
+		t.Fatalf("Unexpected login response %+v", resp)
+	}
+
+	return resp
+}
+
+// tRequireAuthCode sends a GET /api/user request with authToken and fails the
+// test if the response code is not wantCode.
+func tRequireAuthCode(t *testing.T, s *tServer, name, authToken string, wantCode int) {
+	t.Helper()
+	var resp *userInfoResponse
+	headers := map[string]string{fiber.HeaderAuthorization: fmt.Sprintf("Bearer %s", authToken)}
+	if err := s.sendRequest(fiber.MethodGet, "api/user", nil, &resp, headers); err != nil {
+		t.Fatalf("%s: s.sendRequest error: %s", name, err)
+	}
+
+	if resp.Code != wantCode {
+		t.Fatalf("%s: Expected code %d but got %d (%s)", name, wantCode, resp.Code, resp.Message)
+	}
+}
+
+func TestWebServer_handleRefreshToken(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	login := tLogin(t, s, "test@email.com")
+
+	refresh := func(refreshToken string) *authTokensResponse {
+		t.Helper()
+		var resp *authTokensResponse
+		req := refreshTokenRequest{RefreshToken: refreshToken}
+		if err := s.sendRequest(fiber.MethodPost, "api/token/refresh", req, &resp, nil); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		return resp
+	}
+
+	for _, refreshToken := range []string{"", "invalid", "unknown.token", login.RefreshToken + "x"} {
+		if resp := refresh(refreshToken); resp.Code != codeUnauthorized {
+			t.Fatalf("Expected refresh token %q to be rejected but got %d", refreshToken, resp.Code)
+		}
+	}
+
+	// The refresh token is replaced on every refresh.
+	refreshed := refresh(login.RefreshToken)
+	if refreshed.Code != codeOk || refreshed.AuthToken == "" || refreshed.RefreshToken == login.RefreshToken {
+		t.Fatalf("Unexpected refresh response %+v", refreshed)
+	}
+	tRequireAuthCode(t, s, "refreshed token", refreshed.AuthToken, codeOk)
+
+	// Refresh tokens can only be used once.
+	if resp := refresh(login.RefreshToken); resp.Code != codeUnauthorized {
+		t.Fatalf("Expected the reused refresh token to be rejected but got %d", resp.Code)
+	}
+
+	if resp := refresh(refreshed.RefreshToken); resp.Code != codeOk {
+		t.Fatalf("Expected the new refresh token to be accepted but got %d", resp.Code)
+	}
+
+	// Auth tokens issued before a refresh remain valid until they expire.
+	tRequireAuthCode(t, s, "previous auth token", login.AuthToken, codeOk)
+}
+
+func TestWebServer_handleLogout(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	userEmail := "test@email.com"
+	login := tLogin(t, s, userEmail)
+	other := s.authHeaders(t, userEmail)
+
+	var resp *APIResponse
+	if err := s.sendRequest(fiber.MethodPost, "api/logout", nil, &resp, nil); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp.Code != codeUnauthorized {
+		t.Fatalf("Expected unauthorized error got %v", resp.Code)
+	}
+
+	headers := map[string]string{fiber.HeaderAuthorization: fmt.Sprintf("Bearer %s", login.AuthToken)}
+	if err := s.sendRequest(fiber.MethodPost, "api/logout", nil, &resp, headers); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp.Code != codeOk {
+		t.Fatalf("Expected OK got %v", resp.Code)
+	}
+
+	// Only the session of the auth token is logged out.
+	tRequireAuthCode(t, s, "logged out session", login.AuthToken, codeUnauthorized)
+	tRequireAuthCode(t, s, "other session", other[fiber.HeaderAuthorization][len("Bearer "):], codeOk)
+
+	var refreshResp *authTokensResponse
+	req := refreshTokenRequest{RefreshToken: login.RefreshToken}
+	if err := s.sendRequest(fiber.MethodPost, "api/token/refresh", req, &refreshResp, nil); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if refreshResp.Code != codeUnauthorized {
+		t.Fatalf("Expected the refresh token of a logged out session to be rejected but got %d", refreshResp.Code)
+	}
+}
+
+func TestWebServer_handleLogoutAll(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	userEmail := "test@email.com"
+	login := tLogin(t, s, userEmail)
+	other := s.authHeaders(t, userEmail)
+	otherUser := s.authHeaders(t, "other@email.com")
+
+	var resp *logoutAllResponse
+	if err := s.sendRequest(fiber.MethodPost, "api/logout/all", nil, &resp, other); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp.Code != codeOk || resp.Revoked != 2 {
+		t.Fatalf("Unexpected logout response %+v", resp)
+	}
+
+	tRequireAuthCode(t, s, "logged out session", login.AuthToken, codeUnauthorized)
+	tRequireAuthCode(t, s, "logged out session", other[fiber.HeaderAuthorization][len("Bearer "):], codeUnauthorized)
+
+	// Sessions of other users are not logged out.
+	var userResp *APIResponse
+	if err := s.sendRequest(fiber.MethodPost, "api/logout", nil, &userResp, otherUser); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if userResp.Code != codeOk {
+		t.Fatalf("Expected the session of another user to be active but got %d", userResp.Code)
+	}
+}
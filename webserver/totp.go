@@ -0,0 +1,458 @@
+package webserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	qrcode "github.com/skip2/go-qrcode"
+	"github.com/ukane-philemon/bob/db"
+)
+
+const (
+	// totpPeriod is the number of seconds a TOTP code is valid for.
+	totpPeriod = 30
+	// totpDigits is the number of digits of a TOTP code and totpModulus is
+	// 10^totpDigits.
+	totpDigits  = 6
+	totpModulus = 1000000
+	// totpSkew is the number of time steps before and after the current one
+	// that are accepted to allow for clock drift.
+	totpSkew = 1
+	// totpSecretLength is the number of random bytes in a TOTP secret.
+	totpSecretLength = 20
+	// totpQRCodeSize is the size of TOTP provisioning QR codes in pixels.
+	totpQRCodeSize = 256
+	// recoveryCodeCount is the number of recovery codes a user gets when
+	// enabling two-factor authentication.
+	recoveryCodeCount = 10
+	// recoveryCodeLength is the number of random bytes in a recovery code.
+	recoveryCodeLength = 6
+	// mfaTokenExpiry is how long a user has to enter a two-factor
+	// authentication code after entering their password.
+	mfaTokenExpiry = 5 * time.Minute
+	// maxMFAAttempts is the number of two-factor authentication codes a client
+	// can try within mfaAttemptWindow.
+	maxMFAAttempts   = 10
+	mfaAttemptWindow = 5 * time.Minute
+)
+
+// totpEncoding is the base32 encoding of TOTP secrets and recovery codes.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// mfaLimiter limits the two-factor authentication codes a client can try, so
+// that codes cannot be guessed.
+func mfaLimiter() fiber.Handler {
+	return limiter.New(limiter.Config{
+		Max:        maxMFAAttempts,
+		Expiration: mfaAttemptWindow,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.IP()
+		},
+	})
+}
+
+// totpCode returns the RFC 6238 TOTP code of secret for the specified time
+// step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%totpModulus)
+}
+
+// totpStep returns the TOTP time step of t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// isTOTPCode returns true if code looks like a TOTP code rather than a
+// recovery code.
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateTOTP checks code against the TOTP codes of secret around now and
+// returns the time step of the matching code.
+func validateTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	if !isTOTPCode(code) {
+		return 0, false
+	}
+
+	step := totpStep(now)
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step+i)), []byte(code)) == 1 {
+			return step + i, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI authenticator apps use to add secret for
+// the account with the specified email.
+func totpURI(secret []byte, email string) string {
+	params := url.Values{
+		"secret":    {totpEncoding.EncodeToString(secret)},
+		"issuer":    {AppName},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(AppName+":"+email) + "?" + params.Encode()
+}
+
+// newRecoveryCodes generates recoveryCodeCount recovery codes and returns
+// them with their hashes.
+func newRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([][]byte, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b, err := randomBytes(recoveryCodeLength)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		code = code[:len(code)/2] + "-" + code[len(code)/2:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the SHA-256 hash of a recovery code. Case and
+// dashes are ignored.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(code, "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// normalizeMFACode removes the spaces users may copy with a code.
+func normalizeMFACode(code string) string {
+	return strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+}
+
+// errInvalidMFACode is returned for incorrect, used or expired two-factor
+// authentication codes.
+func errInvalidMFACode() error {
+	return errBadRequest("invalid two-factor authentication code")
+}
+
+// checkTOTPCode returns an error if code is not a valid TOTP code of totp.
+// Valid codes are recorded so that they cannot be used again.
+func (s *WebServer) checkTOTPCode(email string, totp *db.UserTOTP, code string) error {
+	step, ok := validateTOTP(totp.Secret, normalizeMFACode(code), time.Now())
+	if !ok || step <= totp.LastStep {
+		return errInvalidMFACode()
+	}
+
+	if err := s.db.UseUserTOTPStep(email, step); err != nil {
+		if errors.Is(err, db.ErrorBadRequest) {
+			return errInvalidMFACode()
+		}
+
+		appLog.Printf("\ndb.UseUserTOTPStep error: %v\n", err)
+		return errInternal(err)
+	}
+
+	return nil
+}
+
+// verifySecondFactor returns an error if code is neither a valid TOTP code nor
+// an unused recovery code of the user with the specified email. Recovery
+// codes are used up.
+func (s *WebServer) verifySecondFactor(email, code string) error {
+	totp, err := s.db.RetrieveUserTOTP(email)
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return errBadRequest("two-factor authentication is not enabled")
+		}
+
+		return translateDBError(err)
+	}
+
+	if !totp.Enabled {
+		return errBadRequest("two-factor authentication is not enabled")
+	}
+
+	code = normalizeMFACode(code)
+	if isTOTPCode(code) {
+		return s.checkTOTPCode(email, totp, code)
+	}
+
+	if code == "" {
+		return errInvalidMFACode()
+	}
+
+	if err := s.db.ConsumeUserRecoveryCode(email, hashRecoveryCode(code)); err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return errInvalidMFACode()
+		}
+
+		appLog.Printf("\ndb.ConsumeUserRecoveryCode error: %v\n", err)
+		return errInternal(err)
+	}
+
+	return nil
+}
+
+// newMFAToken returns a token that proves that the user with the specified
+// email entered their password, to be exchanged for a session with a
+// two-factor authentication code.
+func (s *WebServer) newMFAToken(email string) (string, error) {
+	id, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+
+	return s.authenticator.generateAuthToken(hex.EncodeToString(id), email, jwtAudienceMFAPending, mfaTokenExpiry)
+}
+
+// mfaRequiredResponse returns the login response of users that must enter a
+// two-factor authentication code. It has no user information or auth tokens.
+func mfaRequiredResponse(mfaToken string) loginResponse {
+	return loginResponse{
+		userInfoResponse: userInfoResponse{
+			APIResponse: newAPIResponse(true, codeOk, "Two-Factor Authentication Required."),
+		},
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	}
+}
+
+// handleLoginMFA handles the "POST /api/login/2fa" endpoint and finishes the
+// login of a user with two-factor authentication. It starts a new session if
+// the MFA token of the password login and the TOTP or recovery code are
+// valid. Invalid codes count as failed logins.
+func (s *WebServer) handleLoginMFA(c *fiber.Ctx) error {
+	form := new(mfaLoginRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	claims, ok := s.authenticator.validateAuthToken(form.MFAToken, jwtAudienceMFAPending)
+	if !ok {
+		return errUnauthorized("Invalid or expired login, please log in again")
+	}
+
+	email := claims.Subject
+	keys := []loginKey{accountLoginKey(email), clientLoginKey(c.IP())}
+	if err := s.checkLoginLock(c, keys...); err != nil {
+		return err
+	}
+
+	if err := s.verifySecondFactor(email, form.Code); err != nil {
+		var resp *APIResponse
+		if errors.As(err, &resp) && resp.Code == codeBadRequest {
+			s.recordFailedLogin(c, keys...)
+		}
+		return err
+	}
+
+	s.clearLoginAttempts(keys[0])
+
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	tokens, err := s.createSession(email)
+	if err != nil {
+		appLog.Printf("\nerror creating session: %v\n", err)
+		return errInternal(err)
+	}
+
+	userInfo := userInfoResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Login Successful."),
+		Data:        user,
+	}
+
+	return c.Status(userInfo.Code).JSON(loginResponse{userInfoResponse: userInfo, authTokens: *tokens})
+}
+
+// handleSetupTOTP handles the "POST /api/2fa/totp" endpoint and generates a
+// new TOTP secret for the logged in user. Two-factor authentication is
+// enabled once a code of the secret is sent to "POST /api/2fa/totp/enable".
+func (s *WebServer) handleSetupTOTP(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	if user.TOTPEnabled {
+		return errBadRequest("two-factor authentication is already enabled")
+	}
+
+	secret, err := randomBytes(totpSecretLength)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	if err := s.db.SetUserTOTPSecret(email, secret); err != nil {
+		appLog.Printf("\ndb.SetUserTOTPSecret error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	uri := totpURI(secret, email)
+	png, err := qrcode.Encode(uri, qrcode.Medium, totpQRCodeSize)
+	if err != nil {
+		appLog.Printf("\nqrcode.Encode error: %v\n", err)
+		return errInternal(err)
+	}
+
+	resp := &totpSetupResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Add the secret to your authenticator app and enter a code to enable two-factor authentication."),
+		Secret:      totpEncoding.EncodeToString(secret),
+		URI:         uri,
+		QRCode:      base64.StdEncoding.EncodeToString(png),
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleEnableTOTP handles the "POST /api/2fa/totp/enable" endpoint and
+// enables two-factor authentication for the logged in user if the code of
+// the TOTP secret is valid. The recovery codes of the user are returned.
+func (s *WebServer) handleEnableTOTP(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(mfaCodeRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	totp, err := s.db.RetrieveUserTOTP(email)
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return errBadRequest("set up two-factor authentication first")
+		}
+
+		return translateDBError(err)
+	}
+
+	if totp.Enabled {
+		return errBadRequest("two-factor authentication is already enabled")
+	}
+
+	if err := s.checkTOTPCode(email, totp, form.Code); err != nil {
+		return err
+	}
+
+	return s.sendNewRecoveryCodes(c, email, "Two-Factor Authentication Enabled. Store the recovery codes in a safe place.")
+}
+
+// handleDisableTOTP handles the "POST /api/2fa/totp/disable" endpoint and
+// disables two-factor authentication for the logged in user. The password of
+// users that have one and a TOTP or recovery code are required.
+func (s *WebServer) handleDisableTOTP(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(disableTOTPRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	if user.HasPassword {
+		if err := s.checkPassword(c, email, form.Password); err != nil {
+			return err
+		}
+	}
+
+	if err := s.verifySecondFactor(email, form.Code); err != nil {
+		return err
+	}
+
+	if err := s.db.DisableUserTOTP(email); err != nil {
+		appLog.Printf("\ndb.DisableUserTOTP error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	resp := newAPIResponse(true, codeOk, "Two-Factor Authentication Disabled.")
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleRegenerateRecoveryCodes handles the "POST /api/2fa/recovery-codes"
+// endpoint and replaces the recovery codes of the logged in user if the TOTP
+// or recovery code is valid.
+func (s *WebServer) handleRegenerateRecoveryCodes(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(mfaCodeRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	if err := s.verifySecondFactor(email, form.Code); err != nil {
+		return err
+	}
+
+	return s.sendNewRecoveryCodes(c, email, "Recovery Codes Replaced. Store them in a safe place.")
+}
+
+// sendNewRecoveryCodes enables two-factor authentication for the user with
+// the specified email with new recovery codes and sends the codes.
+func (s *WebServer) sendNewRecoveryCodes(c *fiber.Ctx, email, message string) error {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return errInternal(err)
+	}
+
+	if err := s.db.EnableUserTOTP(email, hashes); err != nil {
+		appLog.Printf("\ndb.EnableUserTOTP error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	resp := &recoveryCodesResponse{
+		APIResponse:   newAPIResponse(true, codeOk, message),
+		RecoveryCodes: codes,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
@@ -0,0 +1,190 @@
+package webserver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// SHA-1 test vectors from RFC 6238 Appendix B, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		if got := totpCode(secret, totpStep(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Fatalf("Expected code %s at %d but got %s", tt.want, tt.unix, got)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	for _, tt := range []struct {
+		code string
+		ok   bool
+	}{
+		{totpCode(secret, totpStep(now)), true},
+		{totpCode(secret, totpStep(now)-1), true},
+		{totpCode(secret, totpStep(now)+1), true},
+		{totpCode(secret, totpStep(now)+2), false},
+		{"12345", false},
+		{"abcdef", false},
+	} {
+		if _, ok := validateTOTP(secret, tt.code, now); ok != tt.ok {
+			t.Fatalf("Expected code %q validity %v but got %v", tt.code, tt.ok, ok)
+		}
+	}
+}
+
+func TestWebServer_totp(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	email := "test@email.com"
+	login := tLogin(t, s, email)
+	headers := map[string]string{fiber.HeaderAuthorization: fmt.Sprintf("Bearer %s", login.AuthToken)}
+
+	send := func(endpoint string, req, resp interface{}) {
+		t.Helper()
+		if err := s.sendRequest(fiber.MethodPost, endpoint, req, resp, headers); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+	}
+
+	// Two-factor authentication cannot be enabled before it is set up.
+	var apiResp *APIResponse
+	send("api/2fa/totp/enable", mfaCodeRequest{Code: "123456"}, &apiResp)
+	if apiResp.Code != codeBadRequest {
+		t.Fatalf("Expected enabling without a secret to fail but got %d", apiResp.Code)
+	}
+
+	var setup *totpSetupResponse
+	send("api/2fa/totp", nil, &setup)
+	if setup.Code != codeOk || setup.Secret == "" || !strings.HasPrefix(setup.URI, "otpauth://totp/") || !strings.Contains(setup.URI, "secret="+setup.Secret) {
+		t.Fatalf("Unexpected setup response %+v", setup)
+	}
+
+	png, err := base64.StdEncoding.DecodeString(setup.QRCode)
+	if err != nil || !strings.HasPrefix(string(png), "\x89PNG") {
+		t.Fatalf("Expected a PNG QR code, err = %v", err)
+	}
+
+	secret, err := totpEncoding.DecodeString(setup.Secret)
+	if err != nil {
+		t.Fatalf("totpEncoding.DecodeString error: %s", err)
+	}
+
+	step := totpStep(time.Now())
+	send("api/2fa/totp/enable", mfaCodeRequest{Code: totpCode(secret, step+5)}, &apiResp)
+	if apiResp.Code != codeBadRequest {
+		t.Fatalf("Expected an invalid code to be rejected but got %d", apiResp.Code)
+	}
+
+	var codes *recoveryCodesResponse
+	send("api/2fa/totp/enable", mfaCodeRequest{Code: totpCode(secret, step)}, &codes)
+	if codes.Code != codeOk || len(codes.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Unexpected enable response %+v", codes)
+	}
+
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil || !user.TOTPEnabled {
+		t.Fatalf("Expected two-factor authentication to be enabled, err = %v", err)
+	}
+
+	// The password login now only returns an MFA token.
+	passwordLogin := func() string {
+		t.Helper()
+		var resp *loginResponse
+		req := loginRequest{Email: email, Password: dummyUserPassword}
+		if err := s.sendRequest(fiber.MethodPost, "api/login", req, &resp, nil); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		if resp.Code != codeOk || !resp.MFARequired || resp.MFAToken == "" || resp.AuthToken != "" || resp.Data != nil {
+			t.Fatalf("Unexpected login response %+v", resp)
+		}
+		return resp.MFAToken
+	}
+
+	mfaLogin := func(mfaToken, code string) *loginResponse {
+		t.Helper()
+		var resp *loginResponse
+		if err := s.sendRequest(fiber.MethodPost, "api/login/2fa", mfaLoginRequest{MFAToken: mfaToken, Code: code}, &resp, nil); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		return resp
+	}
+
+	mfaToken := passwordLogin()
+	tRequireAuthCode(t, s, "mfa token", mfaToken, codeUnauthorized)
+
+	if resp := mfaLogin(login.AuthToken, totpCode(secret, step+1)); resp.Code != codeUnauthorized {
+		t.Fatalf("Expected an auth token to be rejected as MFA token but got %d", resp.Code)
+	}
+
+	// The code used to enable two-factor authentication cannot be replayed.
+	if resp := mfaLogin(mfaToken, totpCode(secret, step)); resp.Code != codeBadRequest {
+		t.Fatalf("Expected a used code to be rejected but got %d", resp.Code)
+	}
+
+	resp := mfaLogin(mfaToken, totpCode(secret, step+1))
+	if resp.Code != codeOk || resp.AuthToken == "" || resp.Data == nil || !resp.Data.TOTPEnabled {
+		t.Fatalf("Unexpected 2fa login response %+v", resp)
+	}
+	tRequireAuthCode(t, s, "2fa auth token", resp.AuthToken, codeOk)
+
+	if resp := mfaLogin(passwordLogin(), totpCode(secret, step+1)); resp.Code != codeBadRequest {
+		t.Fatalf("Expected a replayed code to be rejected but got %d", resp.Code)
+	}
+
+	// Recovery codes can be used once.
+	recoveryCode := strings.ToUpper(codes.RecoveryCodes[0])
+	if resp := mfaLogin(passwordLogin(), recoveryCode); resp.Code != codeOk {
+		t.Fatalf("Expected the recovery code to be accepted but got %d (%s)", resp.Code, resp.Message)
+	}
+	if resp := mfaLogin(passwordLogin(), recoveryCode); resp.Code != codeBadRequest {
+		t.Fatalf("Expected a used recovery code to be rejected but got %d", resp.Code)
+	}
+
+	// Regenerating recovery codes invalidates the previous ones.
+	var newCodes *recoveryCodesResponse
+	send("api/2fa/recovery-codes", mfaCodeRequest{Code: codes.RecoveryCodes[1]}, &newCodes)
+	if newCodes.Code != codeOk || len(newCodes.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Unexpected recovery codes response %+v", newCodes)
+	}
+
+	send("api/2fa/totp/disable", disableTOTPRequest{Password: dummyUserPassword, Code: codes.RecoveryCodes[2]}, &apiResp)
+	if apiResp.Code != codeBadRequest {
+		t.Fatalf("Expected a replaced recovery code to be rejected but got %d", apiResp.Code)
+	}
+
+	send("api/2fa/totp/disable", disableTOTPRequest{Password: "wrong-password", Code: newCodes.RecoveryCodes[0]}, &apiResp)
+	if apiResp.Code != codeBadRequest {
+		t.Fatalf("Expected an incorrect password to be rejected but got %d", apiResp.Code)
+	}
+
+	send("api/2fa/totp/disable", disableTOTPRequest{Password: dummyUserPassword, Code: newCodes.RecoveryCodes[0]}, &apiResp)
+	if apiResp.Code != codeOk {
+		t.Fatalf("Expected two-factor authentication to be disabled but got %d (%s)", apiResp.Code, apiResp.Message)
+	}
+
+	var loginResp *loginResponse
+	req := loginRequest{Email: email, Password: dummyUserPassword}
+	if err := s.sendRequest(fiber.MethodPost, "api/login", req, &loginResp, nil); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+	if loginResp.Code != codeOk || loginResp.MFARequired || loginResp.AuthToken == "" {
+		t.Fatalf("Unexpected login response after disabling two-factor authentication %+v", loginResp)
+	}
+}
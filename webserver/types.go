@@ -34,6 +34,13 @@ func newAPIResponse(ok bool, code int, message string) *APIResponse {
 	}
 }
 
+// policyErrorResponse is returned when a username or password breaks the
+// account policy.
+type policyErrorResponse struct {
+	*APIResponse
+	Violations []*policyViolation `json:"violations"`
+}
+
 // passwordBytes is a byte slice that can be zeroed after use.
 type passwordBytes []byte
 
@@ -63,12 +70,72 @@ type loginRequest struct {
 	Password string `json:"password"`
 }
 
+// updateUserRequest is the request body for the PATCH /api/user endpoint.
+// Empty fields are not changed.
+type updateUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	// Password is the current password. It is required to change the email
+	// of users that have a password.
+	Password string `json:"password"`
+}
+
+// changePasswordRequest is the request body for the POST /api/user/password
+// endpoint.
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// deleteUserRequest is the request body for the DELETE /api/user endpoint.
+type deleteUserRequest struct {
+	// Password is the current password. It is required for users that have a
+	// password.
+	Password string `json:"password"`
+}
+
+// userTokenRequest is the request body for the POST /api/email/verify
+// endpoint.
+type userTokenRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+// forgotPasswordRequest is the request body for the POST /api/password/forgot
+// endpoint.
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// resetPasswordRequest is the request body for the POST /api/password/reset
+// endpoint.
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
 // createShortURLRequest is the request body for the "POST /api/url" endpoint
 type createShortURLRequest struct {
 	LongURL string `json:"longURL"`
 	// CustomShortURL is the preferred short URL used instead of generating a
 	// new one.
 	CustomShortURL string `json:"customShortURL"`
+	// ExpiresAt is an optional unix timestamp after which the short URL stops
+	// redirecting.
+	ExpiresAt int64 `json:"expiresAt"`
+	// Password is an optional password required to follow the short URL.
+	Password string `json:"password"`
+	// MaxClicks is an optional number of clicks after which the short URL
+	// stops redirecting.
+	MaxClicks int32 `json:"maxClicks"`
+	// ActiveFrom is an optional unix timestamp from which the short URL
+	// redirects.
+	ActiveFrom int64 `json:"activeFrom"`
+	// ActiveUntil is an optional unix timestamp after which the short URL
+	// stops redirecting.
+	ActiveUntil int64 `json:"activeUntil"`
+	// WorkspaceID is the optional workspace that owns the short URL instead of
+	// the user. The user must be an editor or owner of the workspace.
+	WorkspaceID string `json:"workspaceID"`
 }
 
 // usernameExitsResponse is the response returned by the GET
@@ -84,9 +151,168 @@ type userInfoResponse struct {
 	Data *db.UserInfo `json:"data"`
 }
 
+// loginResponse is the response returned by the POST /api/login endpoint and
+// the PATCH /api/user endpoint. PATCH /api/user only returns auth tokens when
+// the email is changed.
 type loginResponse struct {
 	userInfoResponse
-	AuthToken string `json:"authToken"`
+	authTokens
+	// MFARequired is true if the user has two-factor authentication enabled.
+	// No user information or auth tokens are returned then, MFAToken must be
+	// sent with a TOTP or recovery code to the POST /api/login/2fa endpoint.
+	MFARequired bool   `json:"mfaRequired,omitempty"`
+	MFAToken    string `json:"mfaToken,omitempty"`
+}
+
+// mfaLoginRequest is the request body for the POST /api/login/2fa endpoint.
+type mfaLoginRequest struct {
+	MFAToken string `json:"mfaToken"`
+	// Code is a TOTP code or a recovery code.
+	Code string `json:"code"`
+}
+
+// mfaCodeRequest is the request body for the POST /api/2fa/totp/enable and
+// POST /api/2fa/recovery-codes endpoints.
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// disableTOTPRequest is the request body for the POST /api/2fa/totp/disable
+// endpoint.
+type disableTOTPRequest struct {
+	Password string `json:"password"`
+	// Code is a TOTP code or a recovery code.
+	Code string `json:"code"`
+}
+
+// totpSetupResponse is the response returned by the POST /api/2fa/totp
+// endpoint.
+type totpSetupResponse struct {
+	*APIResponse
+	// Secret is the base32 encoded TOTP secret for manual entry.
+	Secret string `json:"secret"`
+	// URI is the otpauth URI of the secret.
+	URI string `json:"uri"`
+	// QRCode is a base64 encoded PNG QR code of URI.
+	QRCode string `json:"qrCode"`
+}
+
+// recoveryCodesResponse is the response returned by the POST
+// /api/2fa/totp/enable and POST /api/2fa/recovery-codes endpoints.
+type recoveryCodesResponse struct {
+	*APIResponse
+	// RecoveryCodes can each be used once instead of a TOTP code. They are
+	// only shown once.
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// createAPIKeyRequest is the request body for the POST /api/keys endpoint.
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// apiKeyResponse is the response returned by the POST /api/keys endpoint.
+type apiKeyResponse struct {
+	*APIResponse
+	Data *db.APIKey `json:"data"`
+	// Key is the API key. It is only returned when the key is created.
+	Key string `json:"key"`
+}
+
+// apiKeysResponse is the response returned by the GET /api/keys endpoint.
+type apiKeysResponse struct {
+	*APIResponse
+	Data []*db.APIKey `json:"data"`
+}
+
+// createWorkspaceRequest is the request body for the POST /api/workspaces
+// endpoint.
+type createWorkspaceRequest struct {
+	Name string `json:"name"`
+}
+
+// workspaceResponse is the response returned by the POST /api/workspaces
+// endpoint.
+type workspaceResponse struct {
+	*APIResponse
+	Data *db.Workspace `json:"data"`
+}
+
+// workspacesResponse is the response returned by the GET /api/workspaces
+// endpoint.
+type workspacesResponse struct {
+	*APIResponse
+	Data []*db.Workspace `json:"data"`
+}
+
+// workspaceMembersResponse is the response returned by the GET
+// /api/workspaces/:id/members endpoint.
+type workspaceMembersResponse struct {
+	*APIResponse
+	Data []*db.WorkspaceMember `json:"data"`
+}
+
+// workspaceMemberResponse is the response returned by the POST
+// /api/invitations/accept endpoint.
+type workspaceMemberResponse struct {
+	*APIResponse
+	Data *db.WorkspaceMember `json:"data"`
+}
+
+// updateWorkspaceMemberRequest is the request body for the PATCH
+// /api/workspaces/:id/members endpoint.
+type updateWorkspaceMemberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// createWorkspaceInvitationRequest is the request body for the POST
+// /api/workspaces/:id/invitations endpoint.
+type createWorkspaceInvitationRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// workspaceInvitationResponse is the response returned by the POST
+// /api/workspaces/:id/invitations endpoint.
+type workspaceInvitationResponse struct {
+	*APIResponse
+	Data *db.WorkspaceInvitation `json:"data"`
+}
+
+// workspaceInvitationsResponse is the response returned by the GET
+// /api/workspaces/:id/invitations endpoint.
+type workspaceInvitationsResponse struct {
+	*APIResponse
+	Data []*db.WorkspaceInvitation `json:"data"`
+}
+
+// acceptWorkspaceInvitationRequest is the request body for the POST
+// /api/invitations/accept endpoint.
+type acceptWorkspaceInvitationRequest struct {
+	Token string `json:"token"`
+}
+
+// refreshTokenRequest is the request body for the POST /api/token/refresh
+// endpoint.
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// authTokensResponse is the response returned by the POST /api/token/refresh
+// endpoint.
+type authTokensResponse struct {
+	*APIResponse
+	authTokens
+}
+
+// logoutAllResponse is the response returned by the POST /api/logout/all
+// endpoint.
+type logoutAllResponse struct {
+	*APIResponse
+	// Revoked is the number of sessions that were logged out.
+	Revoked int64 `json:"revoked"`
 }
 
 // shortURLResponse is the response returned by the POST /api/url endpoint and
@@ -126,4 +352,17 @@ func (ua userAgent) DeviceType() string {
 type updateShortURLRequest struct {
 	LongURL string `json:"longURL"`
 	Disable *bool  `json:"disable"`
+	// ExpiresAt is the new expiry unix timestamp. Zero removes the expiry.
+	ExpiresAt *int64 `json:"expiresAt"`
+	// Password is the new password of the short URL. An empty password
+	// removes the password protection.
+	Password *string `json:"password"`
+	// MaxClicks is the new click budget. Zero removes the limit.
+	MaxClicks *int32 `json:"maxClicks"`
+	// ActiveFrom is the new start of the active window. Zero activates the
+	// short URL immediately.
+	ActiveFrom *int64 `json:"activeFrom"`
+	// ActiveUntil is the new end of the active window. Zero removes the end of
+	// the active window.
+	ActiveUntil *int64 `json:"activeUntil"`
 }
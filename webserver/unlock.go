@@ -0,0 +1,132 @@
+package webserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db"
+)
+
+const (
+	// maxShortURLPasswordLength is the maximum length of a short URL password.
+	// bcrypt ignores bytes beyond this length.
+	maxShortURLPasswordLength = 72
+	// unlockCookieName is the name of the cookie set after the correct
+	// password for a short URL is provided.
+	unlockCookieName = "bob_unlock"
+	// unlockExpiry is how long a short URL remains unlocked after the correct
+	// password is provided.
+	unlockExpiry = 30 * time.Minute
+)
+
+// unlockFormTmpl is the form served for password protected short URLs.
+var unlockFormTmpl = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Protected link - {{.AppName}}</title>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+<p>This link is password protected.</p>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<input type="hidden" name="referrer" value="{{.Referrer}}">
+<input type="password" name="password" placeholder="Password" autocomplete="off" required autofocus>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// handleShortURLUnlock handles the "POST /{shortUrl}" endpoint and redirects
+// to the original URL of a password protected short URL if the correct
+// password is provided.
+func (s *WebServer) handleShortURLUnlock(c *fiber.Ctx) error {
+	urlInfo, err := s.activeShortURL(c.Params("shortUrl"))
+	if err != nil {
+		return err
+	}
+
+	if !urlInfo.PasswordProtected {
+		return s.redirectToOriginalURL(c, urlInfo, codeSeeOther)
+	}
+
+	password := passwordBytes(c.FormValue("password"))
+	defer password.Zero()
+	if !urlInfo.CheckPassword(password.Bytes()) {
+		return renderUnlockForm(c, codeUnauthorized, "Incorrect password")
+	}
+
+	token, err := s.authenticator.generateAuthToken(urlInfo.ShortURL, passwordFingerprint(urlInfo), jwtAudienceLinkUnlock, unlockExpiry)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     unlockCookieName,
+		Value:    token,
+		Path:     "/" + urlInfo.ShortURL,
+		MaxAge:   int(unlockExpiry.Seconds()),
+		Secure:   s.secureCookies,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return s.redirectToOriginalURL(c, urlInfo, codeSeeOther)
+}
+
+// isShortURLUnlocked checks if the request has a valid unlock cookie for the
+// password protected short URL.
+func (s *WebServer) isShortURLUnlocked(c *fiber.Ctx, urlInfo *db.ShortURLInfo) bool {
+	token := c.Cookies(unlockCookieName)
+	if token == "" {
+		return false
+	}
+
+	claims, ok := s.authenticator.validateAuthToken(token, jwtAudienceLinkUnlock)
+	return ok && claims.ID == urlInfo.ShortURL && claims.Subject == passwordFingerprint(urlInfo)
+}
+
+// passwordFingerprint returns an identifier for the current password of a
+// short URL. Unlock cookies are tied to it so that changing the password
+// locks the short URL again.
+func passwordFingerprint(urlInfo *db.ShortURLInfo) string {
+	sum := sha256.Sum256(urlInfo.PasswordHash)
+	return hex.EncodeToString(sum[:8])
+}
+
+// clickReferrer returns the referrer of a click on a short URL. The unlock form
+// carries the referrer of the original request since the Referer header of
+// the form submission is the short URL itself.
+func clickReferrer(c *fiber.Ctx) string {
+	if c.Method() == fiber.MethodPost {
+		return c.FormValue("referrer")
+	}
+	return c.Get(fiber.HeaderReferer)
+}
+
+// renderUnlockForm responds with the password form for a protected short URL.
+func renderUnlockForm(c *fiber.Ctx, code int, errMsg string) error {
+	var b bytes.Buffer
+	err := unlockFormTmpl.Execute(&b, map[string]string{
+		"AppName": AppName,
+		// Post to the requested URL to keep query parameters such as UTM
+		// parameters.
+		"Action":   c.OriginalURL(),
+		"Referrer": clickReferrer(c),
+		"Error":    errMsg,
+	})
+	if err != nil {
+		return errInternal(err)
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Status(code).Send(b.Bytes())
+}
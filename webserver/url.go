@@ -1,9 +1,11 @@
 package webserver
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -32,17 +34,67 @@ func (s *WebServer) handleCreateShortURL(c *fiber.Ctx) error {
 			return errBadRequest("Create an account to use custom short URL feature")
 		}
 
+		if form.Password != "" {
+			return errBadRequest("Create an account to use password protected short URL feature")
+		}
+
+		if form.WorkspaceID != "" {
+			return errBadRequest("Create an account to use workspaces")
+		}
+
 		userID = c.IP()
+	} else if err := s.requireVerifiedEmail(userID); err != nil {
+		return err
 	}
 
 	if userID == "" {
 		return errBadRequest("invalid request")
 	}
 
+	// Short URLs created for a workspace are owned by the workspace.
+	ownerID, isGuest := userID, !isValidEmail(userID)
+	if form.WorkspaceID != "" {
+		if _, err := s.requireWorkspaceRole(form.WorkspaceID, userID, db.WorkspaceRoleEditor); err != nil {
+			return err
+		}
+		ownerID = form.WorkspaceID
+	}
+
 	if form.CustomShortURL != "" && !customURLRegEx.MatchString(form.CustomShortURL) {
 		return errBadRequest("invalid custom short url")
 	}
 
+	opts := new(db.ShortURLOptions)
+	if form.ExpiresAt != 0 {
+		if form.ExpiresAt <= time.Now().Unix() {
+			return errBadRequest("expiry time must be in the future")
+		}
+		opts.ExpiresAt = &form.ExpiresAt
+	}
+
+	if form.Password != "" {
+		if len(form.Password) > maxShortURLPasswordLength {
+			return errBadRequest(fmt.Sprintf("password must not be longer than %d bytes", maxShortURLPasswordLength))
+		}
+		opts.Password = &form.Password
+	}
+
+	if err := validateActiveWindow(&form.MaxClicks, &form.ActiveFrom, &form.ActiveUntil); err != nil {
+		return err
+	}
+
+	if form.MaxClicks != 0 {
+		opts.MaxClicks = &form.MaxClicks
+	}
+
+	if form.ActiveFrom != 0 {
+		opts.ActiveFrom = &form.ActiveFrom
+	}
+
+	if form.ActiveUntil != 0 {
+		opts.ActiveUntil = &form.ActiveUntil
+	}
+
 	a := fiber.AcquireAgent()
 	defer fiber.ReleaseAgent(a)
 
@@ -71,28 +123,37 @@ func (s *WebServer) handleCreateShortURL(c *fiber.Ctx) error {
 		APIResponse: newAPIResponse(true, codeOk, "Request was successful"),
 	}
 
-	url, err := s.db.CreateNewShortURL(userID, form.LongURL, form.CustomShortURL, !isValidEmail(userID))
+	url, err := s.db.CreateNewShortURL(ownerID, form.LongURL, form.CustomShortURL, isGuest, opts)
 	if err != nil {
 		return translateDBError(err)
 	}
 
 	apiResp.Data = url
-	s.urlMtx.Lock()
-	s.urlCache[url.ShortURL] = url
-	s.urlMtx.Unlock()
+	// Other instances may have cached that a custom short URL does not exist.
+	s.invalidateCachedURL(url.ShortURL)
+	s.urlCache.set(url)
 
 	return c.Status(codeOk).JSON(apiResp)
 }
 
 // handleGetAllURL handles the "GET /api/url" endpoint and returns all the short
-// URLs for a validated user.
+// URLs for a validated user, or the short URLs of the workspace in the
+// optional "workspaceID" query parameter.
 func (s *WebServer) handleGetAllURL(c *fiber.Ctx) error {
 	email, ok := c.Context().UserValue(ctxID).(string)
 	if !ok {
 		return errUnauthorized("you are not unauthorized to access this resource")
 	}
 
-	urls, err := s.db.RetrieveUserURLs(email)
+	ownerID := email
+	if workspaceID := c.Query("workspaceID"); workspaceID != "" {
+		if _, err := s.requireWorkspaceRole(workspaceID, email, db.WorkspaceRoleViewer); err != nil {
+			return err
+		}
+		ownerID = workspaceID
+	}
+
+	urls, err := s.db.RetrieveUserURLs(ownerID)
 	if err != nil {
 		return translateDBError(err)
 	}
@@ -108,7 +169,8 @@ func (s *WebServer) handleGetAllURL(c *fiber.Ctx) error {
 // handleGetURL handles the "GET /url/{shortUrl} "endpoint and returns the full
 // information about a short URL for a validated user.
 func (s *WebServer) handleGetURL(c *fiber.Ctx) error {
-	if _, ok := c.Context().UserValue(ctxID).(string); !ok {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
 		return errUnauthorized("you are not unauthorized to access this resource")
 	}
 
@@ -117,7 +179,12 @@ func (s *WebServer) handleGetURL(c *fiber.Ctx) error {
 		return errBadRequest("invalid short URL")
 	}
 
-	urlInfo, err := s.db.RetrieveURLInfo(shortUrl)
+	ownerID, err := s.shortURLOwnerID(email, shortUrl, db.WorkspaceRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	urlInfo, err := s.db.RetrieveUserURLInfo(ownerID, shortUrl)
 	if err != nil {
 		return translateDBError(err)
 	}
@@ -133,7 +200,8 @@ func (s *WebServer) handleGetURL(c *fiber.Ctx) error {
 // handleCreateURLQR handles the "GET /api/url/{shortUrl}/qr" endpoint and returns
 // a QR code for the short URL.
 func (s *WebServer) handleCreateURLQR(c *fiber.Ctx) error {
-	if _, ok := c.Context().UserValue(ctxID).(string); !ok {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
 		return errUnauthorized("you are not unauthorized to access this resource")
 	}
 
@@ -142,7 +210,12 @@ func (s *WebServer) handleCreateURLQR(c *fiber.Ctx) error {
 		return errBadRequest("invalid short URL")
 	}
 
-	urlInfo, err := s.db.RetrieveURLInfo(shortUrl)
+	ownerID, err := s.shortURLOwnerID(email, shortUrl, db.WorkspaceRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	urlInfo, err := s.db.RetrieveUserURLInfo(ownerID, shortUrl)
 	if err != nil {
 		return translateDBError(err)
 	}
@@ -162,58 +235,117 @@ func (s *WebServer) handleCreateURLQR(c *fiber.Ctx) error {
 // handleShortUrlRedirect handles the "GET /{shortUrl}" endpoint and redirects to
 // the original URL.
 func (s *WebServer) handleShortUrlRedirect(c *fiber.Ctx) error {
-	shortUrl := c.Params("shortUrl")
+	urlInfo, err := s.activeShortURL(c.Params("shortUrl"))
+	if err != nil {
+		return err
+	}
+
+	if urlInfo.PasswordProtected && !s.isShortURLUnlocked(c, urlInfo) {
+		return renderUnlockForm(c, codeOk, "")
+	}
+
+	return s.redirectToOriginalURL(c, urlInfo, codeFound)
+}
+
+// activeShortURL returns the information about a short URL that can be
+// followed. An error is returned if the short URL does not exist, is disabled
+// or has expired.
+func (s *WebServer) activeShortURL(shortUrl string) (*db.ShortURLInfo, error) {
 	if shortUrl == "" {
-		return errBadRequest("invalid short URL")
+		return nil, errBadRequest("invalid short URL")
 	}
 
-	s.urlMtx.RLock()
-	urlInfo, found := s.urlCache[shortUrl]
-	s.urlMtx.RUnlock()
-	if !found {
-		var err error
-		urlInfo, err = s.db.RetrieveURLInfo(shortUrl)
-		if err != nil {
-			return translateDBError(err)
-		}
+	urlInfo, err := s.urlCache.load(shortUrl, func() (*db.ShortURLInfo, error) {
+		return s.db.RetrieveURLInfo(shortUrl)
+	})
+	if err != nil {
+		return nil, translateDBError(err)
 	}
 
 	if urlInfo.Disabled {
-		return errBadRequest("Link has been disabled")
+		return nil, errBadRequest("Link has been disabled")
 	}
 
-	userAgentBytes := c.Context().UserAgent()
-	ua := parseUserAgent(string(userAgentBytes))
-	// Update the short URL stats in the background.
-	click := &db.ShortURLClick{
-		IP:         c.IP(),
-		Browser:    ua.Name,
-		Device:     ua.Device,
-		DeviceType: ua.DeviceType(),
-		Timestamp:  time.Now().Unix(),
+	now := time.Now()
+	if urlInfo.HasExpired(now) {
+		return nil, errGone("Link has expired")
+	}
+
+	if urlInfo.ActiveFrom > now.Unix() {
+		return nil, errForbidden("Link is not active yet")
+	}
+
+	if !urlInfo.IsActive(now) {
+		return nil, errGone("Link is no longer active")
 	}
 
-	// Update cache
-	s.urlMtx.Lock()
-	if _, found = s.urlCache[shortUrl]; found {
-		s.urlCache[shortUrl].Clicks++
+	if urlInfo.ClicksExhausted() {
+		return nil, errGone("Link has reached its click limit")
 	}
-	s.urlMtx.Unlock()
 
-	defer func() {
+	return urlInfo, nil
+}
+
+// redirectToOriginalURL records a click on the short URL and redirects to the
+// original URL with the specified status code.
+func (s *WebServer) redirectToOriginalURL(c *fiber.Ctx, urlInfo *db.ShortURLInfo, code int) error {
+	shortUrl := urlInfo.ShortURL
+	userAgentBytes := c.Context().UserAgent()
+	ua := parseUserAgent(string(userAgentBytes))
+	// Request values are only valid until the handler returns and clicks
+	// may be recorded later, so they are copied.
+	referrer := strings.Clone(clickReferrer(c))
+	click := &db.ShortURLClick{
+		IP:             c.IP(),
+		Browser:        ua.Name,
+		Device:         ua.Device,
+		DeviceType:     ua.DeviceType(),
+		Timestamp:      time.Now().Unix(),
+		Referrer:       referrer,
+		ReferrerDomain: referrerDomain(referrer),
+		UTMSource:      strings.Clone(c.Query("utm_source")),
+		UTMMedium:      strings.Clone(c.Query("utm_medium")),
+		UTMCampaign:    strings.Clone(c.Query("utm_campaign")),
+		UTMTerm:        strings.Clone(c.Query("utm_term")),
+		UTMContent:     strings.Clone(c.Query("utm_content")),
+	}
+	// Locate the click before its IP address is anonymized.
+	s.locateClick(click)
+	click.IP = s.ipAnonymizer.anonymize(click.IP)
+
+	var recorded bool
+	if urlInfo.MaxClicks > 0 {
+		// Clicks on short URLs with a click budget are recorded right away
+		// so that the budget is enforced atomically. The budget and active
+		// window are checked again since the cached information may be
+		// stale.
 		err := s.db.UpdateShortURL(shortUrl, "", click)
+		if errors.Is(err, db.ErrorInactive) {
+			return translateDBError(err)
+		}
+
 		if err != nil {
 			appLog.Printf("\ndb.UpdateShortURL error: %v\n", err)
 		}
-	}()
+		recorded = err == nil
+	} else {
+		recorded = s.clicks.enqueue(shortUrl, click)
+	}
+
+	if recorded {
+		s.urlCache.update(shortUrl, func(urlInfo *db.ShortURLInfo) {
+			urlInfo.Clicks++
+		})
+	}
 
-	return c.Redirect(urlInfo.OriginalURL, codeFound)
+	return c.Redirect(urlInfo.OriginalURL, code)
 }
 
 // handleURLUpdate handles the "PATCH /api/url?shortUrl="short-url" endpoint and
 // updates the short URL in the query.
 func (s *WebServer) handleURLUpdate(c *fiber.Ctx) error {
-	if _, ok := c.Context().UserValue(ctxID).(string); !ok {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
 		return errUnauthorized("you are not unauthorized to access this resource")
 	}
 
@@ -227,39 +359,56 @@ func (s *WebServer) handleURLUpdate(c *fiber.Ctx) error {
 		return errBadRequest("invalid request body")
 	}
 
-	if form.Disable == nil && form.LongURL == "" {
+	opts := &db.ShortURLOptions{
+		ExpiresAt:   form.ExpiresAt,
+		Password:    form.Password,
+		MaxClicks:   form.MaxClicks,
+		ActiveFrom:  form.ActiveFrom,
+		ActiveUntil: form.ActiveUntil,
+	}
+	if form.Disable == nil && form.LongURL == "" && opts.IsZero() {
 		return errBadRequest("missing required fields")
 	}
 
-	if form.LongURL != "" {
-		longURL, err := url.ParseRequestURI(form.LongURL)
-		if err != nil || longURL.Scheme != "https" || longURL.Host == "" {
-			return errBadRequest("invalid URL, provide an absolute URL with a scheme (only https is allowed) and a host (e.g. https://example.com/path/to/resource))")
+	if form.Password != nil && len(*form.Password) > maxShortURLPasswordLength {
+		return errBadRequest(fmt.Sprintf("password must not be longer than %d bytes", maxShortURLPasswordLength))
+	}
+
+	if form.ExpiresAt != nil && *form.ExpiresAt != 0 && *form.ExpiresAt <= time.Now().Unix() {
+		return errBadRequest("expiry time must be in the future")
+	}
+
+	if err := validateActiveWindow(form.MaxClicks, form.ActiveFrom, form.ActiveUntil); err != nil {
+		return err
+	}
+
+	ownerID, err := s.shortURLOwnerID(email, shortURL, db.WorkspaceRoleEditor)
+	if err != nil {
+		return err
+	}
+
+	if form.LongURL != "" || !opts.IsZero() {
+		if form.LongURL != "" {
+			longURL, err := url.ParseRequestURI(form.LongURL)
+			if err != nil || longURL.Scheme != "https" || longURL.Host == "" {
+				return errBadRequest("invalid URL, provide an absolute URL with a scheme (only https is allowed) and a host (e.g. https://example.com/path/to/resource))")
+			}
 		}
 
-		if err := s.db.UpdateShortURL(shortURL, form.LongURL, nil); err != nil {
+		if err := s.db.UpdateUserShortURL(ownerID, shortURL, form.LongURL, opts); err != nil {
 			return translateDBError(err)
 		}
 
-		// Update cache
-		s.urlMtx.Lock()
-		if _, found := s.urlCache[shortURL]; found {
-			s.urlCache[shortURL].OriginalURL = form.LongURL
-		}
-		s.urlMtx.Unlock()
+		s.invalidateCachedURL(shortURL)
+	}
 
-	} else {
+	if form.Disable != nil {
 		disable := *form.Disable
-		if err := s.db.ToggleShortLinkStatus(shortURL, disable); err != nil {
-			translateDBError(err)
+		if err := s.db.ToggleShortLinkStatus(ownerID, shortURL, disable); err != nil {
+			return translateDBError(err)
 		}
 
-		// Update cache
-		s.urlMtx.Lock()
-		if _, found := s.urlCache[shortURL]; found {
-			s.urlCache[shortURL].Disabled = disable
-		}
-		s.urlMtx.Unlock()
+		s.invalidateCachedURL(shortURL)
 	}
 
 	return c.Status(codeOk).JSON(newAPIResponse(true, codeOk, "Short URL has been updated"))
@@ -268,7 +417,8 @@ func (s *WebServer) handleURLUpdate(c *fiber.Ctx) error {
 // handleGetShortURLClicks handles the "GET /api/url/clicks?shortUrl="short-url"
 // endpoint and return the full information for a short url clicks.
 func (s *WebServer) handleGetShortURLClicks(c *fiber.Ctx) error {
-	if _, ok := c.Context().UserValue(ctxID).(string); !ok {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
 		return errUnauthorized("you are not unauthorized to access this resource")
 	}
 
@@ -277,7 +427,12 @@ func (s *WebServer) handleGetShortURLClicks(c *fiber.Ctx) error {
 		return errBadRequest("invalid short URL")
 	}
 
-	clicks, err := s.db.RetrieveShortURLClicks(shortURL)
+	ownerID, err := s.shortURLOwnerID(email, shortURL, db.WorkspaceRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	clicks, err := s.db.RetrieveShortURLClicks(ownerID, shortURL)
 	if err != nil {
 		return translateDBError(err)
 	}
@@ -292,3 +447,69 @@ func (s *WebServer) handleGetShortURLClicks(c *fiber.Ctx) error {
 
 	return c.Status(codeOk).JSON(resp)
 }
+
+// handleGetShortURLStats handles the "GET /api/url/{shortUrl}/stats" endpoint
+// and returns aggregated click statistics for a short URL. The optional "from"
+// and "to" query parameters are unix timestamps and "interval" is one of
+// "hour", "day" or "week".
+func (s *WebServer) handleGetShortURLStats(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	shortURL := c.Params("shortUrl")
+	if shortURL == "" {
+		return errBadRequest("invalid short URL")
+	}
+
+	interval := db.StatsInterval(c.Query("interval", string(db.StatsIntervalDay)))
+	if !interval.IsValid() {
+		return errBadRequest("invalid interval, use one of hour, day or week")
+	}
+
+	// to is exclusive, include clicks recorded in the current second.
+	to := time.Now().Unix() + 1
+	if toStr := c.Query("to"); toStr != "" {
+		var err error
+		if to, err = strconv.ParseInt(toStr, 10, 64); err != nil {
+			return errBadRequest("invalid to time")
+		}
+	}
+
+	from := to - int64(defaultStatsRange.Seconds())
+	if fromStr := c.Query("from"); fromStr != "" {
+		var err error
+		if from, err = strconv.ParseInt(fromStr, 10, 64); err != nil {
+			return errBadRequest("invalid from time")
+		}
+	}
+
+	if from >= to {
+		return errBadRequest("from time must be before to time")
+	}
+
+	if (to-from)/interval.Seconds() > maxStatsBuckets {
+		return errBadRequest(fmt.Sprintf("time range is too long for a %s interval", interval))
+	}
+
+	ownerID, err := s.shortURLOwnerID(email, shortURL, db.WorkspaceRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	stats, err := s.db.RetrieveShortURLClickStats(ownerID, shortURL, from, to, interval)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	resp := &struct {
+		*APIResponse
+		Data *db.ShortURLClickStats `json:"data"`
+	}{
+		APIResponse: newAPIResponse(true, codeOk, "Short URL stats retrieved"),
+		Data:        stats,
+	}
+
+	return c.Status(codeOk).JSON(resp)
+}
@@ -0,0 +1,568 @@
+package webserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/geoip"
+	"github.com/valyala/fasthttp"
+)
+
+// tURLOwners creates a short URL owned by ownerEmail and returns auth headers
+// for the owner and for another user.
+func tURLOwners(t *testing.T, s *tServer, ownerEmail, otherEmail, shortURL string) (ownerHeaders, otherHeaders map[string]string) {
+	for _, email := range []string{ownerEmail, otherEmail} {
+		if err := s.db.CreateUser(strings.Split(email, "@")[0], email, []byte(dummyUserPassword)); err != nil {
+			t.Fatalf("s.db.CreateUser error: %s", err)
+		}
+	}
+
+	if _, err := s.db.CreateNewShortURL(ownerEmail, "https://example.com", shortURL, false, nil); err != nil {
+		t.Fatalf("s.db.CreateNewShortURL error: %s", err)
+	}
+
+	return s.authHeaders(t, ownerEmail), s.authHeaders(t, otherEmail)
+}
+
+func TestWebServer_handleGetURL(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerHeaders, otherHeaders := tURLOwners(t, s, "owner@email.com", "other@email.com", "ownedurl")
+
+	tests := []struct {
+		name     string
+		shortURL string
+		headers  map[string]string
+		wantCode int
+	}{{
+		name:     "success",
+		shortURL: "ownedurl",
+		headers:  ownerHeaders,
+		wantCode: codeOk,
+	}, {
+		name:     "unauthorized: missing auth token",
+		shortURL: "ownedurl",
+		wantCode: codeUnauthorized,
+	}, {
+		name:     "forbidden: not owner",
+		shortURL: "ownedurl",
+		headers:  otherHeaders,
+		wantCode: codeForbidden,
+	}, {
+		name:     "not found",
+		shortURL: "unknownurl",
+		headers:  ownerHeaders,
+		wantCode: codeNotFound,
+	}}
+
+	for _, tt := range tests {
+		var resp *shortURLResponse
+		if err := s.sendRequest(fiber.MethodGet, "api/url/"+tt.shortURL, nil, &resp, tt.headers); err != nil {
+			t.Fatalf("%s: s.sendRequest error: %s", tt.name, err)
+		}
+
+		if resp == nil || resp.APIResponse == nil {
+			t.Fatalf("%s: Expected an API response but got nothing", tt.name)
+		}
+
+		if resp.Code != tt.wantCode {
+			t.Fatalf("%s: Expected code %d got %d", tt.name, tt.wantCode, resp.Code)
+		}
+
+		if resp.Ok && resp.Data == nil {
+			t.Fatalf("%s: Expected URL info", tt.name)
+		}
+	}
+}
+
+func TestWebServer_handleURLUpdate(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerEmail := "owner@email.com"
+	ownerHeaders, otherHeaders := tURLOwners(t, s, ownerEmail, "other@email.com", "ownedurl")
+	disable := true
+
+	tests := []struct {
+		name     string
+		shortURL string
+		req      updateShortURLRequest
+		headers  map[string]string
+		wantCode int
+	}{{
+		name:     "forbidden: not owner updating URL",
+		shortURL: "ownedurl",
+		req:      updateShortURLRequest{LongURL: "https://example.org"},
+		headers:  otherHeaders,
+		wantCode: codeForbidden,
+	}, {
+		name:     "forbidden: not owner disabling URL",
+		shortURL: "ownedurl",
+		req:      updateShortURLRequest{Disable: &disable},
+		headers:  otherHeaders,
+		wantCode: codeForbidden,
+	}, {
+		name:     "not found",
+		shortURL: "unknownurl",
+		req:      updateShortURLRequest{Disable: &disable},
+		headers:  ownerHeaders,
+		wantCode: codeNotFound,
+	}, {
+		name:     "success",
+		shortURL: "ownedurl",
+		req:      updateShortURLRequest{Disable: &disable},
+		headers:  ownerHeaders,
+		wantCode: codeOk,
+	}}
+
+	for _, tt := range tests {
+		var resp *APIResponse
+		if err := s.sendRequest(fiber.MethodPatch, "api/url?shortUrl="+tt.shortURL, tt.req, &resp, tt.headers); err != nil {
+			t.Fatalf("%s: s.sendRequest error: %s", tt.name, err)
+		}
+
+		if resp == nil {
+			t.Fatalf("%s: Expected an API response but got nothing", tt.name)
+		}
+
+		if resp.Code != tt.wantCode {
+			t.Fatalf("%s: Expected code %d got %d", tt.name, tt.wantCode, resp.Code)
+		}
+	}
+
+	// Confirm the other user's requests did not modify the URL.
+	urlInfo, err := s.db.RetrieveUserURLInfo(ownerEmail, "ownedurl")
+	if err != nil {
+		t.Fatalf("s.db.RetrieveUserURLInfo error: %s", err)
+	}
+
+	if urlInfo.OriginalURL != "https://example.com" || !urlInfo.Disabled {
+		t.Fatalf("Unexpected URL info: %+v", urlInfo)
+	}
+}
+
+func TestWebServer_handleGetShortURLClicks(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerHeaders, otherHeaders := tURLOwners(t, s, "owner@email.com", "other@email.com", "ownedurl")
+
+	tests := []struct {
+		name     string
+		endpoint string
+		headers  map[string]string
+		wantCode int
+	}{{
+		name:     "success",
+		endpoint: "api/url/clicks?shortUrl=ownedurl",
+		headers:  ownerHeaders,
+		wantCode: codeOk,
+	}, {
+		name:     "forbidden: not owner",
+		endpoint: "api/url/clicks?shortUrl=ownedurl",
+		headers:  otherHeaders,
+		wantCode: codeForbidden,
+	}, {
+		name:     "not found",
+		endpoint: "api/url/clicks?shortUrl=unknownurl",
+		headers:  ownerHeaders,
+		wantCode: codeNotFound,
+	}}
+
+	for _, tt := range tests {
+		var resp *APIResponse
+		if err := s.sendRequest(fiber.MethodGet, tt.endpoint, nil, &resp, tt.headers); err != nil {
+			t.Fatalf("%s: s.sendRequest error: %s", tt.name, err)
+		}
+
+		if resp == nil {
+			t.Fatalf("%s: Expected an API response but got nothing", tt.name)
+		}
+
+		if resp.Code != tt.wantCode {
+			t.Fatalf("%s: Expected code %d got %d", tt.name, tt.wantCode, resp.Code)
+		}
+	}
+}
+
+func TestWebServer_handleGetShortURLStats(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerHeaders, otherHeaders := tURLOwners(t, s, "owner@email.com", "other@email.com", "ownedurl")
+	click := &db.ShortURLClick{Browser: "Chrome", Referrer: "https://example.net", Timestamp: time.Now().Unix()}
+	if err := s.db.UpdateShortURL("ownedurl", "", click); err != nil {
+		t.Fatalf("s.db.UpdateShortURL error: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		endpoint  string
+		headers   map[string]string
+		wantCode  int
+		wantTotal int64
+	}{{
+		name:      "success",
+		endpoint:  "api/url/ownedurl/stats",
+		headers:   ownerHeaders,
+		wantCode:  codeOk,
+		wantTotal: 1,
+	}, {
+		name:     "success: empty time range",
+		endpoint: "api/url/ownedurl/stats?from=0&to=3600&interval=hour",
+		headers:  ownerHeaders,
+		wantCode: codeOk,
+	}, {
+		name:     "unauthorized: missing auth token",
+		endpoint: "api/url/ownedurl/stats",
+		wantCode: codeUnauthorized,
+	}, {
+		name:     "forbidden: not owner",
+		endpoint: "api/url/ownedurl/stats",
+		headers:  otherHeaders,
+		wantCode: codeForbidden,
+	}, {
+		name:     "not found",
+		endpoint: "api/url/unknownurl/stats",
+		headers:  ownerHeaders,
+		wantCode: codeNotFound,
+	}, {
+		name:     "bad request: invalid interval",
+		endpoint: "api/url/ownedurl/stats?interval=month",
+		headers:  ownerHeaders,
+		wantCode: codeBadRequest,
+	}, {
+		name:     "bad request: from after to",
+		endpoint: "api/url/ownedurl/stats?from=3600&to=0",
+		headers:  ownerHeaders,
+		wantCode: codeBadRequest,
+	}, {
+		name:     "bad request: too many buckets",
+		endpoint: "api/url/ownedurl/stats?from=0&interval=hour",
+		headers:  ownerHeaders,
+		wantCode: codeBadRequest,
+	}}
+
+	for _, tt := range tests {
+		var resp *struct {
+			*APIResponse
+			Data *db.ShortURLClickStats `json:"data"`
+		}
+		if err := s.sendRequest(fiber.MethodGet, tt.endpoint, nil, &resp, tt.headers); err != nil {
+			t.Fatalf("%s: s.sendRequest error: %s", tt.name, err)
+		}
+
+		if resp == nil || resp.APIResponse == nil {
+			t.Fatalf("%s: Expected an API response but got nothing", tt.name)
+		}
+
+		if resp.Code != tt.wantCode {
+			t.Fatalf("%s: Expected code %d got %d", tt.name, tt.wantCode, resp.Code)
+		}
+
+		if resp.Ok && (resp.Data == nil || resp.Data.Total != tt.wantTotal) {
+			t.Fatalf("%s: Expected %d clicks but got %+v", tt.name, tt.wantTotal, resp.Data)
+		}
+	}
+}
+
+func TestWebServer_handleCreateURLQR(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	_, otherHeaders := tURLOwners(t, s, "owner@email.com", "other@email.com", "ownedurl")
+
+	var resp *APIResponse
+	if err := s.sendRequest(fiber.MethodGet, "api/url/ownedurl/qr", nil, &resp, otherHeaders); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp == nil || resp.Code != codeForbidden {
+		t.Fatalf("Expected a forbidden response but got %+v", resp)
+	}
+}
+
+func TestWebServer_handleShortUrlRedirect(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerEmail := "owner@email.com"
+	ownerHeaders, _ := tURLOwners(t, s, ownerEmail, "other@email.com", "disabledurl")
+	if err := s.db.ToggleShortLinkStatus(ownerEmail, "disabledurl", true); err != nil {
+		t.Fatalf("s.db.ToggleShortLinkStatus error: %s", err)
+	}
+
+	expiresAt := time.Now().Add(-time.Minute).Unix()
+	if _, err := s.db.CreateNewShortURL(ownerEmail, "https://example.org", "expiredurl", false, &db.ShortURLOptions{ExpiresAt: &expiresAt}); err != nil {
+		t.Fatalf("s.db.CreateNewShortURL error: %s", err)
+	}
+
+	activeFrom := time.Now().Add(time.Hour).Unix()
+	if _, err := s.db.CreateNewShortURL(ownerEmail, "https://example.org", "scheduledurl", false, &db.ShortURLOptions{ActiveFrom: &activeFrom}); err != nil {
+		t.Fatalf("s.db.CreateNewShortURL error: %s", err)
+	}
+
+	maxClicks := int32(1)
+	if _, err := s.db.CreateNewShortURL(ownerEmail, "https://example.org", "onetimeurl", false, &db.ShortURLOptions{MaxClicks: &maxClicks}); err != nil {
+		t.Fatalf("s.db.CreateNewShortURL error: %s", err)
+	}
+
+	if err := s.db.UpdateShortURL("onetimeurl", "", &db.ShortURLClick{Timestamp: time.Now().Unix()}); err != nil {
+		t.Fatalf("s.db.UpdateShortURL error: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		shortURL string
+		wantCode int
+	}{{
+		name:     "unknown short URL",
+		shortURL: "unknownurl",
+		wantCode: codeNotFound,
+	}, {
+		name:     "disabled short URL",
+		shortURL: "disabledurl",
+		wantCode: codeBadRequest,
+	}, {
+		name:     "expired short URL",
+		shortURL: "expiredurl",
+		wantCode: codeGone,
+	}, {
+		name:     "short URL not active yet",
+		shortURL: "scheduledurl",
+		wantCode: codeForbidden,
+	}, {
+		name:     "short URL click limit reached",
+		shortURL: "onetimeurl",
+		wantCode: codeGone,
+	}}
+
+	for _, tt := range tests {
+		var resp *APIResponse
+		if err := s.sendRequest(fiber.MethodGet, tt.shortURL, nil, &resp, nil); err != nil {
+			t.Fatalf("%s: s.sendRequest error: %s", tt.name, err)
+		}
+
+		if resp == nil || resp.Code != tt.wantCode {
+			t.Fatalf("%s: Expected code %d got %+v", tt.name, tt.wantCode, resp)
+		}
+	}
+
+	// Setting an expiry in the past is rejected.
+	req := updateShortURLRequest{ExpiresAt: &expiresAt}
+	var resp *APIResponse
+	if err := s.sendRequest(fiber.MethodPatch, "api/url?shortUrl=disabledurl", req, &resp, ownerHeaders); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp == nil || resp.Code != codeBadRequest {
+		t.Fatalf("Expected a bad request response but got %+v", resp)
+	}
+
+	// An active window that ends before it starts is rejected.
+	activeUntil := activeFrom - 1
+	req = updateShortURLRequest{ActiveFrom: &activeFrom, ActiveUntil: &activeUntil}
+	if err := s.sendRequest(fiber.MethodPatch, "api/url?shortUrl=scheduledurl", req, &resp, ownerHeaders); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp == nil || resp.Code != codeBadRequest {
+		t.Fatalf("Expected a bad request response but got %+v", resp)
+	}
+}
+
+func TestWebServer_handleShortURLUnlock(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerEmail := "owner@email.com"
+	ownerHeaders, _ := tURLOwners(t, s, ownerEmail, "other@email.com", "publicurl")
+	password := "secret"
+	if _, err := s.db.CreateNewShortURL(ownerEmail, "https://example.org", "lockedurl", false, &db.ShortURLOptions{Password: &password}); err != nil {
+		t.Fatalf("s.db.CreateNewShortURL error: %s", err)
+	}
+
+	// send sends a request to the locked short URL and returns the response
+	// status code, the response body and the unlock cookie, if any.
+	send := func(method, formPassword, cookie string) (int, string, string) {
+		a := fiber.AcquireAgent()
+		defer fiber.ReleaseAgent(a)
+
+		req := a.Request()
+		req.SetRequestURI(fmt.Sprintf("http://%s/lockedurl", s.addr))
+		req.Header.SetMethod(method)
+		if method == fiber.MethodPost {
+			req.Header.SetContentType(fiber.MIMEApplicationForm)
+			req.SetBodyString("password=" + formPassword)
+		}
+		if cookie != "" {
+			req.Header.SetCookie(unlockCookieName, cookie)
+		}
+
+		if err := a.Parse(); err != nil {
+			t.Fatalf("a.Parse error: %s", err)
+		}
+
+		resp := fiber.AcquireResponse()
+		defer fiber.ReleaseResponse(resp)
+		a.SetResponse(resp)
+		code, body, errs := a.Bytes()
+		if len(errs) > 0 {
+			t.Fatalf("a.Bytes error: %v", errs)
+		}
+
+		var unlockCookie string
+		resp.Header.VisitAllCookie(func(key, value []byte) {
+			if string(key) != unlockCookieName {
+				return
+			}
+
+			c := fasthttp.AcquireCookie()
+			defer fasthttp.ReleaseCookie(c)
+			if err := c.ParseBytes(value); err != nil {
+				t.Fatalf("c.ParseBytes error: %s", err)
+			}
+			if !c.Secure() {
+				t.Fatal("Expected the unlock cookie to be secure by default")
+			}
+			unlockCookie = string(c.Value())
+		})
+
+		return code, string(body), unlockCookie
+	}
+
+	code, body, _ := send(fiber.MethodGet, "", "")
+	if code != codeOk || !strings.Contains(body, `name="password"`) {
+		t.Fatalf("locked short URL: expected the unlock form but got %d %q", code, body)
+	}
+
+	code, _, cookie := send(fiber.MethodPost, "wrong", "")
+	if code != codeUnauthorized || cookie != "" {
+		t.Fatalf("wrong password: expected code %d without cookie but got %d %q", codeUnauthorized, code, cookie)
+	}
+
+	code, _, cookie = send(fiber.MethodPost, password, "")
+	if code != codeSeeOther || cookie == "" {
+		t.Fatalf("correct password: expected code %d with cookie but got %d %q", codeSeeOther, code, cookie)
+	}
+
+	if code, _, _ = send(fiber.MethodGet, "", cookie); code != codeFound {
+		t.Fatalf("unlocked short URL: expected code %d but got %d", codeFound, code)
+	}
+
+	if code, _, _ = send(fiber.MethodGet, "", "invalid"); code != codeOk {
+		t.Fatalf("invalid cookie: expected the unlock form but got %d", code)
+	}
+
+	// Changing the password locks the short URL again.
+	newPassword := "new-secret"
+	req := updateShortURLRequest{Password: &newPassword}
+	var resp *APIResponse
+	if err := s.sendRequest(fiber.MethodPatch, "api/url?shortUrl=lockedurl", req, &resp, ownerHeaders); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp == nil || resp.Code != codeOk {
+		t.Fatalf("Expected a successful response but got %+v", resp)
+	}
+
+	if code, _, _ = send(fiber.MethodGet, "", cookie); code != codeOk {
+		t.Fatalf("changed password: expected the unlock form but got %d", code)
+	}
+
+	// Guests cannot create password protected short URLs.
+	createReq := createShortURLRequest{LongURL: "https://example.com", Password: password}
+	if err := s.sendRequest(fiber.MethodPost, "api/url", createReq, &resp, nil); err != nil {
+		t.Fatalf("s.sendRequest error: %s", err)
+	}
+
+	if resp == nil || resp.Code != codeBadRequest {
+		t.Fatalf("guest password: expected a bad request response but got %+v", resp)
+	}
+}
+
+func TestWebServer_clickAttribution(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerEmail := "owner@email.com"
+	tURLOwners(t, s, ownerEmail, "other@email.com", "ownedurl")
+
+	a := fiber.AcquireAgent()
+	defer fiber.ReleaseAgent(a)
+
+	req := a.Request()
+	req.SetRequestURI(fmt.Sprintf("http://%s/ownedurl?utm_source=newsletter&utm_medium=email&utm_campaign=launch&utm_term=links&utm_content=footer", s.addr))
+	req.Header.SetMethod(fiber.MethodGet)
+	req.Header.Set(fiber.HeaderReferer, "https://WWW.Example.net/posts/1")
+	if err := a.Parse(); err != nil {
+		t.Fatalf("a.Parse error: %s", err)
+	}
+
+	if code, _, errs := a.Bytes(); len(errs) > 0 || code != codeFound {
+		t.Fatalf("Expected code %d but got %d (%v)", codeFound, code, errs)
+	}
+
+	clicks := s.waitForClicks(t, ownerEmail, "ownedurl", 1)
+
+	click := clicks[0]
+	if click.Referrer != "https://WWW.Example.net/posts/1" || click.ReferrerDomain != "example.net" {
+		t.Fatalf("Unexpected referrer %q (%q)", click.Referrer, click.ReferrerDomain)
+	}
+
+	if click.UTMSource != "newsletter" || click.UTMMedium != "email" || click.UTMCampaign != "launch" ||
+		click.UTMTerm != "links" || click.UTMContent != "footer" {
+		t.Fatalf("Unexpected UTM parameters %+v", click)
+	}
+
+	if domain := referrerDomain("not a url"); domain != "" {
+		t.Fatalf("Expected no domain for an invalid referrer but got %q", domain)
+	}
+}
+
+// tResolver is a geoip.Resolver that knows the location of the IP addresses
+// in its map.
+type tResolver map[string]*geoip.Location
+
+func (r tResolver) Lookup(ip net.IP) (*geoip.Location, error) {
+	return r[ip.String()], nil
+}
+
+func (r tResolver) Close() error {
+	return nil
+}
+
+func TestWebServer_clickLocation(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	ownerEmail := "owner@email.com"
+	tURLOwners(t, s, ownerEmail, "other@email.com", "ownedurl")
+
+	s.geoIP = tResolver{"127.0.0.1": {Country: "GB", Region: "England", City: "London"}}
+	a := fiber.AcquireAgent()
+	defer fiber.ReleaseAgent(a)
+
+	req := a.Request()
+	req.SetRequestURI(fmt.Sprintf("http://%s/ownedurl", s.addr))
+	req.Header.SetMethod(fiber.MethodGet)
+	if err := a.Parse(); err != nil {
+		t.Fatalf("a.Parse error: %s", err)
+	}
+
+	if code, _, errs := a.Bytes(); len(errs) > 0 || code != codeFound {
+		t.Fatalf("Expected code %d but got %d (%v)", codeFound, code, errs)
+	}
+
+	clicks := s.waitForClicks(t, ownerEmail, "ownedurl", 1)
+
+	if click := clicks[0]; click.Country != "GB" || click.Region != "England" || click.City != "London" {
+		t.Fatalf("Unexpected click location %q, %q, %q", click.Country, click.Region, click.City)
+	}
+}
@@ -2,25 +2,17 @@ package webserver
 
 import (
 	"errors"
-	"fmt"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/ukane-philemon/bob/db"
 )
 
-const (
-	// minUsernameChar is the minimum username character accepted.
-	minUsernameChar = 3
-	// minPasswordChar is the minimum password character accepted
-	minPasswordChar = 8
-)
-
 // handleUsernameExists handles the "GET /api/username-exists?username="name""
 // endpoint and checks if a username exists.
 func (s *WebServer) handleUsernameExists(c *fiber.Ctx) error {
 	username := c.Query("username")
-	if username == "" || len(username) < minUsernameChar {
-		return errBadRequest(fmt.Sprintf("username with at least %d characters is required", minUsernameChar))
+	if violations := s.policy.validateUsername(username); len(violations) > 0 {
+		return errPolicy(violations)
 	}
 
 	exists, err := s.db.UsernameExists(username)
@@ -37,36 +29,55 @@ func (s *WebServer) handleUsernameExists(c *fiber.Ctx) error {
 	return c.Status(resp.Code).JSON(resp)
 }
 
+// duplicateAccountMessage is returned for sign ups with a taken username or
+// email.
+const duplicateAccountMessage = "an account with this username or email already exists"
+
 // handleCreateAccount handles the "POST /api/user" endpoint and creates a new
-// user account.
+// user account. Every account policy rule broken by the username and password
+// is returned at once.
 func (s *WebServer) handleCreateAccount(c *fiber.Ctx) error {
 	form := new(createAccountRequest)
 	if err := c.BodyParser(form); err != nil {
 		return errBadRequest("invalid request body")
 	}
 
-	if form.Username == "" || len(form.Username) < minUsernameChar {
-		return errBadRequest(fmt.Sprintf("username with at least %d characters is required", minUsernameChar))
-	}
-
 	if !isValidEmail(form.Email) {
 		return errBadRequest("a valid email is required")
 	}
 
 	password := passwordBytes(form.Password)
-	if len(password) < 8 {
-		return errBadRequest(fmt.Sprintf("password must be a minimum of %d characters", minPasswordChar))
-	}
 	defer password.Zero()
 
+	violations := s.policy.validateUsername(form.Username)
+	violations = append(violations, s.policy.validatePassword(password, form.Username, form.Email)...)
+	if len(violations) > 0 {
+		return errPolicy(violations)
+	}
+
+	// Sign ups with taken usernames or emails count as failed logins of the
+	// client, so that they cannot be used to find accounts quickly.
+	client := clientLoginKey(c.IP())
+	if err := s.checkLoginLock(c, client); err != nil {
+		return err
+	}
+
 	if err := s.db.CreateUser(form.Username, form.Email, password.Bytes()); err != nil {
 		if errors.Is(err, db.ErrorBadRequest) {
-			return errBadRequest(err.Error())
+			s.recordFailedLogin(c, client)
+			// The message does not tell which of the two is taken.
+			return errBadRequest(duplicateAccountMessage)
 		}
 		return errInternal(err)
 	}
 
-	resp := newAPIResponse(true, codeOk, "Account Created.")
+	// The account is usable without a verified email, a new verification
+	// email can be requested if this one is not sent.
+	if err := s.sendVerificationEmail(form.Email); err != nil {
+		appLog.Printf("\nerror sending verification email: %v\n", err)
+	}
+
+	resp := newAPIResponse(true, codeOk, "Account Created. Check your email to verify it.")
 
 	return c.Status(resp.Code).JSON(resp)
 }
@@ -93,7 +104,9 @@ func (s *WebServer) handleGetUser(c *fiber.Ctx) error {
 }
 
 // handleLogin handles the "POST /api/login" endpoint, verifies the provided
-// auth credentials and generates an auth token for the user.
+// auth credentials and starts a new session for the user. Users with
+// two-factor authentication get an MFA token for "POST /api/login/2fa"
+// instead. Accounts and clients with too many failed logins are locked.
 func (s *WebServer) handleLogin(c *fiber.Ctx) error {
 	form := new(loginRequest)
 	if err := c.BodyParser(form); err != nil {
@@ -110,19 +123,39 @@ func (s *WebServer) handleLogin(c *fiber.Ctx) error {
 	}
 	defer password.Zero()
 
+	keys := []loginKey{accountLoginKey(form.Email), clientLoginKey(c.IP())}
+	if err := s.checkLoginLock(c, keys...); err != nil {
+		return err
+	}
+
 	user, err := s.db.LoginUser(form.Email, password.Bytes())
 	if err != nil {
 		if errors.Is(err, db.ErrorBadRequest) {
-			return errBadRequest(err.Error())
+			s.recordFailedLogin(c, keys...)
+			return errInvalidLogin()
 		}
 
 		appLog.Printf("\nerror logging in user: %v\n", err)
 		return errInternal(err)
 	}
 
-	authToken, err := s.authenticator.generateAuthToken(user.Email, user.Username, jwtAudienceUser, tokenExpiry)
+	// The failed logins of users with two-factor authentication are only
+	// forgotten once they entered a code, see handleLoginMFA.
+	if user.TOTPEnabled {
+		mfaToken, err := s.newMFAToken(user.Email)
+		if err != nil {
+			appLog.Printf("\nerror creating MFA token: %v\n", err)
+			return errInternal(err)
+		}
+
+		return c.Status(codeOk).JSON(mfaRequiredResponse(mfaToken))
+	}
+
+	s.clearLoginAttempts(keys[0])
+
+	tokens, err := s.createSession(user.Email)
 	if err != nil {
-		appLog.Printf("\nerror generating auth token: %v\n", err)
+		appLog.Printf("\nerror creating session: %v\n", err)
 		return errInternal(err)
 	}
 
@@ -131,5 +164,242 @@ func (s *WebServer) handleLogin(c *fiber.Ctx) error {
 		Data:        user,
 	}
 
-	return c.Status(userInfo.Code).JSON(loginResponse{userInfo, authToken})
+	return c.Status(userInfo.Code).JSON(loginResponse{userInfoResponse: userInfo, authTokens: *tokens})
+}
+
+// handleUpdateUser handles the "PATCH /api/user" endpoint and changes the
+// username or email of the logged in user. Changing the email requires the
+// current password, logs out every session and starts a new one because auth
+// tokens are issued for an email.
+func (s *WebServer) handleUpdateUser(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(updateUserRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	if form.Username == "" && form.Email == "" {
+		return errBadRequest("a new username or email is required")
+	}
+
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	// Both changes are validated before either is applied, so that a request
+	// is not left half done.
+	changeUsername := form.Username != "" && form.Username != user.Username
+	if changeUsername {
+		if violations := s.policy.validateUsername(form.Username); len(violations) > 0 {
+			return errPolicy(violations)
+		}
+
+		exists, err := s.db.UsernameExists(form.Username)
+		if err != nil {
+			appLog.Printf("\ndb.UsernameExists error: %v\n", err)
+			return errInternal(err)
+		}
+		if exists {
+			return errBadRequest("username already exists")
+		}
+	}
+
+	changeEmail := form.Email != "" && form.Email != user.Email
+	if changeEmail {
+		if !isValidEmail(form.Email) {
+			return errBadRequest("a valid email is required")
+		}
+
+		// An auth token alone must not be enough to take over the account.
+		// Users without a password have logged in with an identity provider.
+		if user.HasPassword {
+			if err := s.checkPassword(c, email, form.Password); err != nil {
+				return err
+			}
+		}
+	}
+
+	resp := loginResponse{userInfoResponse: userInfoResponse{APIResponse: newAPIResponse(true, codeOk, "User Updated.")}}
+	if changeEmail {
+		if err := s.db.ChangeUserEmail(email, form.Email); err != nil {
+			appLog.Printf("\ndb.ChangeUserEmail error: %v\n", err)
+			return translateDBError(err)
+		}
+		email = form.Email
+
+		// The auth tokens of the old email are rejected, so log out every
+		// session of the user and start a new one for this client.
+		if _, err := s.db.RevokeUserSessions(email); err != nil {
+			appLog.Printf("\ndb.RevokeUserSessions error: %v\n", err)
+			return errInternal(err)
+		}
+
+		tokens, err := s.createSession(email)
+		if err != nil {
+			appLog.Printf("\nerror creating session: %v\n", err)
+			return errInternal(err)
+		}
+		resp.authTokens = *tokens
+
+		if err := s.sendVerificationEmail(email); err != nil {
+			appLog.Printf("\nerror sending verification email: %v\n", err)
+		}
+		s.sendEmailChangedEmail(user.Email, email)
+	}
+
+	// The username is changed after the email because changing the email can
+	// still fail, e.g. if another user took it.
+	if changeUsername {
+		if err := s.db.UpdateUsername(email, form.Username); err != nil {
+			appLog.Printf("\ndb.UpdateUsername error: %v\n", err)
+			return translateDBError(err)
+		}
+	}
+
+	user, err = s.db.RetrieveUserInfo(email)
+	if err != nil {
+		return translateDBError(err)
+	}
+	resp.Data = user
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleChangePassword handles the "POST /api/user/password" endpoint and
+// changes the password of the logged in user. Every session of the user is
+// logged out and a new one is started for this client. Users without a
+// password must set one with a password reset.
+func (s *WebServer) handleChangePassword(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(changePasswordRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	// Users without a password have logged in with an identity provider and
+	// have no current password to check.
+	if !user.HasPassword {
+		return errBadRequest("your account has no password, use password reset to set one")
+	}
+
+	password := passwordBytes(form.NewPassword)
+	defer password.Zero()
+	if violations := s.policy.validatePassword(password, user.Username, email); len(violations) > 0 {
+		return errPolicy(violations)
+	}
+
+	if err := s.checkPassword(c, email, form.CurrentPassword); err != nil {
+		return err
+	}
+
+	if err := s.db.ResetUserPassword(email, password.Bytes()); err != nil {
+		appLog.Printf("\ndb.ResetUserPassword error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	if _, err := s.db.RevokeUserSessions(email); err != nil {
+		appLog.Printf("\ndb.RevokeUserSessions error: %v\n", err)
+		return errInternal(err)
+	}
+
+	tokens, err := s.createSession(email)
+	if err != nil {
+		appLog.Printf("\nerror creating session: %v\n", err)
+		return errInternal(err)
+	}
+
+	resp := &authTokensResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Password Changed."),
+		authTokens:  *tokens,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleDeleteUser handles the "DELETE /api/user" endpoint and deletes the
+// logged in user with their short URLs, clicks, sessions, API keys and
+// workspace memberships. Users that have a password must send it and the only
+// owner of a workspace cannot be deleted.
+func (s *WebServer) handleDeleteUser(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(deleteUserRequest)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(form); err != nil {
+			return errBadRequest("invalid request body")
+		}
+	}
+
+	user, err := s.db.RetrieveUserInfo(email)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	if user.HasPassword {
+		if err := s.checkPassword(c, email, form.Password); err != nil {
+			return err
+		}
+	}
+
+	if err := s.requireNotLastWorkspaceOwner(email); err != nil {
+		return err
+	}
+
+	shortURLs, err := s.db.DeleteUser(email)
+	if err != nil {
+		appLog.Printf("\ndb.DeleteUser error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	for _, shortURL := range shortURLs {
+		s.invalidateCachedURL(shortURL)
+	}
+
+	resp := newAPIResponse(true, codeOk, "Account Deleted.")
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// checkPassword returns an error if password is not the password of the user
+// with the specified email. Incorrect passwords count as failed logins of the
+// account and the client, like in handleLogin.
+func (s *WebServer) checkPassword(c *fiber.Ctx, email, password string) error {
+	p := passwordBytes(password)
+	defer p.Zero()
+	if len(p) == 0 {
+		return errBadRequest("your current password is required")
+	}
+
+	keys := []loginKey{accountLoginKey(email), clientLoginKey(c.IP())}
+	if err := s.checkLoginLock(c, keys...); err != nil {
+		return err
+	}
+
+	if _, err := s.db.LoginUser(email, p.Bytes()); err != nil {
+		if errors.Is(err, db.ErrorBadRequest) {
+			s.recordFailedLogin(c, keys...)
+			return errBadRequest("incorrect password")
+		}
+
+		appLog.Printf("\nerror checking password: %v\n", err)
+		return errInternal(err)
+	}
+
+	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/ukane-philemon/bob/db"
@@ -83,6 +84,22 @@ func TestWebServer_handleCreateAccount(t *testing.T) {
 			Password: dummyUserPassword,
 		},
 		messagePrefix: "Account Created",
+	}, {
+		name: "taken username",
+		req: createAccountRequest{
+			Username: "fibrealz",
+			Email:    "othermail@example.com",
+			Password: dummyUserPassword,
+		},
+		messagePrefix: duplicateAccountMessage,
+	}, {
+		name: "taken email",
+		req: createAccountRequest{
+			Username: "otheruser",
+			Email:    "testmail@example.com",
+			Password: dummyUserPassword,
+		},
+		messagePrefix: duplicateAccountMessage,
 	}, {
 		name: "invalid username",
 		req: createAccountRequest{
@@ -157,10 +174,11 @@ func TestWebServer_handleGetUser(t *testing.T) {
 
 	userEmail := "test@email.com"
 	userUsername := "fibrealz"
-	authToken, err := s.authenticator.generateAuthToken(userEmail, userUsername, jwtAudienceUser, tokenExpiry)
+	tokens, err := s.createSession(userEmail)
 	if err != nil {
-		t.Fatalf("s.authenticator.generateAuthToken error: %s", err)
+		t.Fatalf("s.createSession error: %s", err)
 	}
+	authToken := tokens.AuthToken
 
 	tests := []struct {
 		name             string
@@ -261,7 +279,14 @@ func TestWebServer_handleLogin(t *testing.T) {
 			Email:    "test@email.com",
 			Password: "incorrect password",
 		},
-		messagePrefix: "incorrect password",
+		messagePrefix: "invalid email or password",
+	}, {
+		name: "unknown user",
+		req: loginRequest{
+			Email:    "unknown@email.com",
+			Password: dummyUserPassword,
+		},
+		messagePrefix: "invalid email or password",
 	}, {
 		name: "server error",
 		req: loginRequest{
@@ -304,3 +329,194 @@ func TestWebServer_handleLogin(t *testing.T) {
 		}
 	}
 }
+
+func TestWebServer_handleUpdateUser(t *testing.T) {
+	m := newTMailer()
+	s := startTServer(t, Config{Mailer: m, PublicURL: "https://bob.test"}, mem.New())
+	defer s.Stop()
+
+	const email, newEmail = "test@email.com", "new@email.com"
+	login := tLogin(t, s, email)
+	if err := s.db.CreateUser("taken", "taken@email.com", []byte(dummyUserPassword)); err != nil {
+		t.Fatalf("s.db.CreateUser error: %s", err)
+	}
+
+	headers := map[string]string{fiber.HeaderAuthorization: fmt.Sprintf("Bearer %s", login.AuthToken)}
+	update := func(req updateUserRequest) *loginResponse {
+		t.Helper()
+		var resp *loginResponse
+		if err := s.sendRequest(fiber.MethodPatch, "api/user", req, &resp, headers); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		return resp
+	}
+
+	for _, tt := range []struct {
+		name string
+		req  updateUserRequest
+	}{
+		{"no changes", updateUserRequest{}},
+		{"short username", updateUserRequest{Username: "fi"}},
+		{"taken username", updateUserRequest{Username: "taken"}},
+		{"invalid email", updateUserRequest{Email: "invalid"}},
+		{"taken email", updateUserRequest{Email: "taken@email.com", Password: dummyUserPassword}},
+		{"email without password", updateUserRequest{Email: newEmail}},
+		{"email with incorrect password", updateUserRequest{Email: newEmail, Password: "incorrect password"}},
+		{"new username and taken email", updateUserRequest{Username: "newname", Email: "taken@email.com", Password: dummyUserPassword}},
+		{"taken username and new email", updateUserRequest{Username: "taken", Email: newEmail, Password: dummyUserPassword}},
+	} {
+		if resp := update(tt.req); resp.Code != codeBadRequest {
+			t.Fatalf("%s: Expected code %d but got %d (%s)", tt.name, codeBadRequest, resp.Code, resp.Message)
+		}
+
+		// Rejected requests change nothing.
+		user, err := s.db.RetrieveUserInfo(email)
+		if err != nil || user.Username != "fibrealz" {
+			t.Fatalf("%s: Expected the user to be unchanged: %v %+v", tt.name, err, user)
+		}
+	}
+
+	resp := update(updateUserRequest{Username: "newname"})
+	if resp.Code != codeOk || resp.Data.Username != "newname" || resp.Data.Email != email || resp.AuthToken != "" {
+		t.Fatalf("Unexpected update username response %+v", resp)
+	}
+	m.requireNoEmail(t)
+
+	if err := s.db.SetEmailVerified(email); err != nil {
+		t.Fatalf("s.db.SetEmailVerified error: %s", err)
+	}
+
+	resp = update(updateUserRequest{Email: newEmail, Password: dummyUserPassword})
+	if resp.Code != codeOk || resp.Data.Email != newEmail || resp.Data.EmailVerified || resp.AuthToken == "" || resp.RefreshToken == "" {
+		t.Fatalf("Unexpected update email response %+v", resp)
+	}
+
+	// The old email is told about the change and the new one must be
+	// verified.
+	recipients := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-m.messages:
+			recipients[msg.To] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected an email")
+		}
+	}
+	if !recipients[email] || !recipients[newEmail] {
+		t.Fatalf("Expected emails to %s and %s but got %v", email, newEmail, recipients)
+	}
+
+	// Only the new session is logged in.
+	tRequireAuthCode(t, s, "old session", login.AuthToken, codeUnauthorized)
+	tRequireAuthCode(t, s, "new session", resp.AuthToken, codeOk)
+}
+
+func TestWebServer_handleChangePassword(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	const email, newPassword = "test@email.com", "new password"
+	login := tLogin(t, s, email)
+
+	headers := map[string]string{fiber.HeaderAuthorization: fmt.Sprintf("Bearer %s", login.AuthToken)}
+	changePassword := func(currentPassword, newPassword string) *authTokensResponse {
+		t.Helper()
+		var resp *authTokensResponse
+		req := changePasswordRequest{CurrentPassword: currentPassword, NewPassword: newPassword}
+		if err := s.sendRequest(fiber.MethodPost, "api/user/password", req, &resp, headers); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		return resp
+	}
+
+	if resp := changePassword(dummyUserPassword, "short"); resp.Code != codeBadRequest {
+		t.Fatalf("Expected a short password to be rejected but got %d", resp.Code)
+	}
+
+	if resp := changePassword("incorrect password", newPassword); resp.Code != codeBadRequest || resp.Message != "incorrect password" {
+		t.Fatalf("Expected an incorrect password to be rejected but got %+v", resp.APIResponse)
+	}
+
+	resp := changePassword(dummyUserPassword, newPassword)
+	if resp.Code != codeOk || resp.AuthToken == "" {
+		t.Fatalf("Unexpected change password response %+v", resp)
+	}
+
+	tRequireAuthCode(t, s, "old session", login.AuthToken, codeUnauthorized)
+	tRequireAuthCode(t, s, "new session", resp.AuthToken, codeOk)
+
+	if _, err := s.db.LoginUser(email, []byte(dummyUserPassword)); err == nil {
+		t.Fatal("Expected the old password to be rejected")
+	}
+	if _, err := s.db.LoginUser(email, []byte(newPassword)); err != nil {
+		t.Fatalf("Expected the new password to be accepted: %v", err)
+	}
+
+	// Users without a password are told to reset it and their failed logins
+	// are not counted.
+	identity := &db.UserIdentity{Provider: "https://idp.test", Subject: "sub", Email: "sso@email.com"}
+	if err := s.db.CreateIdentityUser("ssouser", identity); err != nil {
+		t.Fatalf("s.db.CreateIdentityUser error: %s", err)
+	}
+	headers = s.authHeaders(t, identity.Email)
+	for i := 0; i < accountLockThreshold+1; i++ {
+		resp := changePassword("incorrect password", newPassword)
+		if resp.Code != codeBadRequest || resp.Message != "your account has no password, use password reset to set one" {
+			t.Fatalf("Expected the identity user to be told to reset the password but got %+v", resp.APIResponse)
+		}
+	}
+}
+
+func TestWebServer_handleDeleteUser(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	const email = "test@email.com"
+	login := tLogin(t, s, email)
+	urlInfo, err := s.db.CreateNewShortURL(email, "https://example.com", "", false, nil)
+	if err != nil {
+		t.Fatalf("s.db.CreateNewShortURL error: %s", err)
+	}
+	s.urlCache.set(urlInfo)
+
+	headers := map[string]string{fiber.HeaderAuthorization: fmt.Sprintf("Bearer %s", login.AuthToken)}
+	deleteUser := func(headers map[string]string, req interface{}) *APIResponse {
+		t.Helper()
+		var resp *APIResponse
+		if err := s.sendRequest(fiber.MethodDelete, "api/user", req, &resp, headers); err != nil {
+			t.Fatalf("s.sendRequest error: %s", err)
+		}
+		return resp
+	}
+
+	if resp := deleteUser(nil, nil); resp.Code != codeUnauthorized {
+		t.Fatalf("Expected a guest to be rejected but got %d", resp.Code)
+	}
+
+	for _, password := range []string{"", "incorrect password"} {
+		if resp := deleteUser(headers, deleteUserRequest{Password: password}); resp.Code != codeBadRequest {
+			t.Fatalf("Expected password %q to be rejected but got %d", password, resp.Code)
+		}
+	}
+
+	if resp := deleteUser(headers, deleteUserRequest{Password: dummyUserPassword}); resp.Code != codeOk {
+		t.Fatalf("Expected the user to be deleted but got %d (%s)", resp.Code, resp.Message)
+	}
+
+	if _, ok := s.urlCache.get(urlInfo.ShortURL); ok {
+		t.Fatal("Expected the short URL of the deleted user to be removed from the cache")
+	}
+	if _, err := s.db.RetrieveURLInfo(urlInfo.ShortURL); err == nil {
+		t.Fatal("Expected the short URL of the deleted user to be deleted")
+	}
+	tRequireAuthCode(t, s, "deleted user", login.AuthToken, codeUnauthorized)
+
+	// Users without a password do not send one.
+	identity := &db.UserIdentity{Provider: "https://idp.test", Subject: "sub", Email: "sso@email.com"}
+	if err := s.db.CreateIdentityUser("ssouser", identity); err != nil {
+		t.Fatalf("s.db.CreateIdentityUser error: %s", err)
+	}
+	if resp := deleteUser(s.authHeaders(t, identity.Email), nil); resp.Code != codeOk {
+		t.Fatalf("Expected the identity user to be deleted but got %d (%s)", resp.Code, resp.Message)
+	}
+}
@@ -3,10 +3,13 @@ package webserver
 import (
 	"crypto/rand"
 	"errors"
+	"net"
 	"net/http"
 	"net/mail"
+	"net/url"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/ukane-philemon/bob/db"
 )
@@ -19,12 +22,23 @@ const (
 	codeBadRequest   = http.StatusBadRequest
 	codeInternal     = http.StatusInternalServerError
 	codeUnauthorized = http.StatusUnauthorized
+	codeForbidden    = http.StatusForbidden
+	codeNotFound     = http.StatusNotFound
+	codeGone         = http.StatusGone
 	codeFound        = http.StatusFound
+	codeSeeOther     = http.StatusSeeOther
+	codeTooMany      = http.StatusTooManyRequests
 )
 
 const (
 	// ctxID is the key used to retrieve a user's ID as set by the auth handler
 	ctxID = "id"
+	// ctxSessionID is the key used to retrieve the session ID of a user's auth
+	// token as set by the auth handler.
+	ctxSessionID = "session_id"
+	// ctxAPIKey is the key used to retrieve the *db.APIKey a request was
+	// authenticated with as set by the auth handler.
+	ctxAPIKey = "api_key"
 )
 
 func isValidEmail(email string) bool {
@@ -48,9 +62,66 @@ func translateDBError(err error) error {
 		return nil
 	}
 
-	if errors.Is(err, db.ErrorBadRequest) {
+	switch {
+	case errors.Is(err, db.ErrorBadRequest):
 		return errBadRequest(err.Error())
+	case errors.Is(err, db.ErrorNotFound):
+		return errNotFound(err.Error())
+	case errors.Is(err, db.ErrorForbidden):
+		return errForbidden("you are not authorized to access this resource")
+	case errors.Is(err, db.ErrorInactive):
+		return errGone("Link is no longer active")
 	}
 
 	return errInternal(err)
 }
+
+// validateActiveWindow checks the click budget and active window settings of a
+// short URL. Nil values are not checked, zero values remove a setting.
+func validateActiveWindow(maxClicks *int32, activeFrom, activeUntil *int64) error {
+	if maxClicks != nil && *maxClicks < 0 {
+		return errBadRequest("max clicks must not be negative")
+	}
+
+	if activeFrom != nil && *activeFrom < 0 {
+		return errBadRequest("active from time must not be negative")
+	}
+
+	if activeUntil != nil && *activeUntil != 0 {
+		if *activeUntil <= time.Now().Unix() {
+			return errBadRequest("active until time must be in the future")
+		}
+
+		if activeFrom != nil && *activeFrom >= *activeUntil {
+			return errBadRequest("active from time must be before active until time")
+		}
+	}
+
+	return nil
+}
+
+// referrerDomain returns the lowercase host name of referrer without the
+// "www." prefix. An empty string is returned if referrer is not a valid
+// absolute URL.
+func referrerDomain(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// locateClick sets the country, region and city of click from its IP address.
+// The location is left empty if it cannot be resolved.
+func (s *WebServer) locateClick(click *db.ShortURLClick) {
+	loc, err := s.geoIP.Lookup(net.ParseIP(click.IP))
+	if err != nil {
+		appLog.Printf("\ngeoIP.Lookup error: %v\n", err)
+		return
+	}
+
+	if loc != nil {
+		click.Country, click.Region, click.City = loc.Country, loc.Region, loc.City
+	}
+}
@@ -6,25 +6,105 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/ukane-philemon/bob/cachebus"
 	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/geoip"
+	"github.com/ukane-philemon/bob/mailer"
 )
 
 // AppName is the name of the application.
 const AppName = "B.O.B"
 
+const (
+	// expiredURLSweepInterval is how often short URLs whose expiry time has
+	// passed are marked as expired.
+	expiredURLSweepInterval = time.Minute
+	// expiredRecordSweepInterval is how often expired sessions, user tokens
+	// and workspace invitations and stale failed logins are deleted.
+	expiredRecordSweepInterval = time.Hour
+	// defaultStatsRange is the time range of click statistics when no start
+	// time is specified.
+	defaultStatsRange = 30 * 24 * time.Hour
+	// maxStatsBuckets is the maximum number of time series buckets returned
+	// for click statistics.
+	maxStatsBuckets = 1000
+)
+
 var appLog = log.New(os.Stdout, "[webserver] ", log.LstdFlags|log.Lshortfile)
 
+// auditLog logs security events, e.g. login lockouts, separately from the
+// other logs of the server.
+var auditLog = log.New(os.Stdout, "[audit] ", log.LstdFlags|log.LUTC)
+
 // Config is the configuration for the web server.
 type Config struct {
 	Host string `long:"host" env:"HOST" default:"127.0.0.1" description:"Server host"`
 	Port string `long:"port" env:"PORT" default:"8080" description:"Server port"`
+	// GeoIPDatabase is the path to a MaxMind DB file, e.g. GeoLite2-City.mmdb,
+	// used to resolve the location of clicks. Locations are not resolved if
+	// it is empty.
+	GeoIPDatabase string `long:"geoipdb" env:"GEOIP_DATABASE" description:"Path to a MaxMind DB (.mmdb) file used to resolve the country, region and city of clicks"`
+	// CacheSize is the maximum number of short URLs kept in the redirect
+	// cache.
+	CacheSize int `long:"cachesize" env:"CACHE_SIZE" default:"100000" description:"Maximum number of short URLs kept in the redirect cache"`
+	// CacheTTL is how long short URLs are kept in the redirect cache.
+	CacheTTL time.Duration `long:"cachettl" env:"CACHE_TTL" default:"10m" description:"How long short URLs are kept in the redirect cache"`
+	// CacheNegativeTTL is how long short URLs that do not exist are kept in
+	// the redirect cache.
+	CacheNegativeTTL time.Duration `long:"cachenegativettl" env:"CACHE_NEGATIVE_TTL" default:"30s" description:"How long short URLs that do not exist are kept in the redirect cache"`
+	// JWTKeyFile is the path to a PEM file with the keys used to sign and
+	// verify auth tokens. See RotateJWTKey.
+	JWTKeyFile string `long:"jwtkeyfile" env:"JWT_KEY_FILE" description:"Path to a PEM file with the Ed25519, RSA or HMAC keys used to sign auth tokens, it is reloaded when modified"`
+	// JWTSecret is the HS256 secret used to sign auth tokens if JWTKeyFile is
+	// not set. A random secret is used if neither is set.
+	JWTSecret string `long:"jwtsecret" env:"JWT_SECRET" description:"Secret of at least 32 bytes used to sign auth tokens with HS256 if no key file is set, a random secret is generated on startup if not set"`
+	// JWTKeyGracePeriod is how long tokens signed with a retired key are
+	// accepted.
+	JWTKeyGracePeriod time.Duration `long:"jwtkeygraceperiod" env:"JWT_KEY_GRACE_PERIOD" default:"24h" description:"How long auth tokens signed with a retired key are still accepted"`
+	// PublicURL is the public base URL of the server, e.g.
+	// https://bob.example.com, used in the links sent by email. Emails
+	// contain the tokens without links if it is empty.
+	PublicURL string `long:"publicurl" env:"PUBLIC_URL" description:"Public base URL of the server used in links sent by email, e.g. https://bob.example.com"`
+	// PasswordResetURL is the URL of the page where users choose a new
+	// password. The reset token is added as the "token" query parameter.
+	PasswordResetURL string `long:"passwordreseturl" env:"PASSWORD_RESET_URL" description:"URL of the page where users choose a new password, the reset token is added as the token query parameter"`
+	// InvitationURL is the URL of the page where users accept workspace
+	// invitations. The invitation token is added as the "token" query
+	// parameter.
+	InvitationURL string `long:"invitationurl" env:"INVITATION_URL" description:"URL of the page where users accept workspace invitations, the invitation token is added as the token query parameter"`
+	// MetricsAddr is the host:port of a separate listener that serves the
+	// metrics of the server at /api/metrics. Metrics are not served if it is
+	// empty, they must not be reachable by the public.
+	MetricsAddr string `long:"metricsaddr" env:"METRICS_ADDR" description:"Separate host:port on which metrics are served at /api/metrics, e.g. 127.0.0.1:9090, metrics are not served if it is not set"`
+	// RequireVerifiedEmail prevents users whose email is not verified from
+	// creating short URLs.
+	RequireVerifiedEmail bool `long:"requireverifiedemail" env:"REQUIRE_VERIFIED_EMAIL" description:"Only allow users with a verified email to create short URLs"`
+	// InsecureCookies lets cookies be sent over plain HTTP. It is meant for
+	// development without TLS.
+	InsecureCookies bool `long:"insecurecookies" env:"INSECURE_COOKIES" description:"Send cookies over plain HTTP, for development without TLS only"`
+	// Mailer sends the emails of the server. Emails are logged to stdout if
+	// it is nil.
+	Mailer mailer.Mailer `no-flag:"true"`
+	// CacheBus propagates redirect cache invalidations to the other instances
+	// of the server. An in-process bus is used if it is nil, which is enough
+	// for a single instance.
+	CacheBus cachebus.Bus `no-flag:"true"`
+	// Clicks is the configuration for how clicks are stored. It is parsed as
+	// a separate group, see ClicksConfig.
+	Clicks ClicksConfig `no-flag:"true"`
+	// OIDC is the configuration for logging in with an OpenID Connect
+	// provider. It is parsed as a separate group, see OIDCConfig.
+	OIDC OIDCConfig `no-flag:"true"`
+	// Policy is the configuration of the rules usernames and passwords must
+	// follow. It is parsed as a separate group, see PolicyConfig.
+	Policy PolicyConfig `no-flag:"true"`
 }
 
 // WebServer is the main API server.
@@ -35,11 +115,38 @@ type WebServer struct {
 
 	db            db.DataStore
 	authenticator *jwtAuthenticator
+	geoIP         geoip.Resolver
+	ipAnonymizer  *ipAnonymizer
+	clicks        *clickIngester
+	// clickRetention is how long clicks are kept. Zero keeps them forever.
+	clickRetention time.Duration
+	// oidc is nil if OIDC login is not enabled.
+	oidc *oidcLogin
+	// policy checks the usernames and passwords chosen by users.
+	policy *accountPolicy
+
+	mailer mailer.Mailer
+	// publicURL, passwordResetURL and invitationURL are the base URLs of
+	// links sent by email. Links are left out if they are empty.
+	publicURL                 string
+	passwordResetURL          string
+	invitationURL             string
+	emailVerificationRequired bool
+	// secureCookies restricts the cookies of the server to HTTPS.
+	secureCookies bool
+
+	// urlCache holds information about recently created and followed short
+	// URLs to improve read time.
+	urlCache *urlCache
+	// cacheBus delivers invalidations of urlCache entries published by every
+	// instance of the server.
+	cacheBus         cachebus.Bus
+	unsubscribeCache func()
 
-	urlMtx sync.RWMutex
-	// urlCache holds information about recently shortened URLs to improve read
-	// time.
-	urlCache map[string]*db.ShortURLInfo
+	// metrics serves the metrics of the server on metricsAddr. It is nil if
+	// metrics are not served.
+	metrics     *fiber.App
+	metricsAddr string
 }
 
 // New creates a new WebServer.
@@ -65,21 +172,79 @@ func New(ctx context.Context, cfg Config, appDB db.DataStore) (*WebServer, error
 		SkipFailedRequests: true,
 	}))
 
-	authenticator, err := newJWTAuthenticator(jwtAlg)
+	authenticator, err := newJWTAuthenticator(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create authenticator: %w", err)
 	}
 
+	ipAnonymizer, err := newIPAnonymizer(cfg.Clicks)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcLogin, err := newOIDCLogin(cfg.OIDC)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := newAccountPolicy(cfg.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	geoIP, err := geoip.New(cfg.GeoIPDatabase)
+	if err != nil {
+		return nil, err
+	}
+
+	appMailer := cfg.Mailer
+	if appMailer == nil {
+		if appMailer, err = mailer.NewWriter(os.Stdout, fmt.Sprintf("%s <noreply@localhost>", AppName)); err != nil {
+			return nil, err
+		}
+	}
+
 	s := &WebServer{
-		addr:          cfg.Host + ":" + cfg.Port,
-		ctx:           ctx,
-		App:           a,
-		db:            appDB,
-		authenticator: authenticator,
-		urlCache:      make(map[string]*db.ShortURLInfo, 100000), // 93bytes * 100,000 = 20MB
+		addr:                      cfg.Host + ":" + cfg.Port,
+		ctx:                       ctx,
+		App:                       a,
+		db:                        appDB,
+		authenticator:             authenticator,
+		geoIP:                     geoIP,
+		ipAnonymizer:              ipAnonymizer,
+		clicks:                    newClickIngester(appDB, cfg.Clicks),
+		clickRetention:            time.Duration(cfg.Clicks.Retention),
+		oidc:                      oidcLogin,
+		policy:                    policy,
+		mailer:                    appMailer,
+		publicURL:                 strings.TrimSuffix(cfg.PublicURL, "/"),
+		passwordResetURL:          cfg.PasswordResetURL,
+		invitationURL:             cfg.InvitationURL,
+		emailVerificationRequired: cfg.RequireVerifiedEmail,
+		secureCookies:             !cfg.InsecureCookies,
+		urlCache:                  newURLCache(cfg.CacheSize, cfg.CacheTTL, cfg.CacheNegativeTTL),
+		cacheBus:                  cfg.CacheBus,
+		metricsAddr:               cfg.MetricsAddr,
+	}
+
+	if s.cacheBus == nil {
+		s.cacheBus = cachebus.NewInProcess()
 	}
+	s.unsubscribeCache = s.cacheBus.Subscribe(s.handleCacheInvalidation)
 
 	registerRoutes(s)
+
+	if s.metricsAddr != "" {
+		s.metrics = fiber.New(fiber.Config{
+			AppName:               AppName,
+			ErrorHandler:          errorHandler,
+			ReadTimeout:           5 * time.Second,
+			WriteTimeout:          60 * time.Second,
+			DisableStartupMessage: true,
+		})
+		s.metrics.Get("/api/metrics", s.handleMetrics)
+	}
+
 	return s, nil
 }
 
@@ -88,47 +253,212 @@ func registerRoutes(s *WebServer) {
 	s.Get("/", func(c *fiber.Ctx) error {
 		return c.Status(codeOk).SendString(s.Config().AppName + " is running")
 	})
+	s.Get("/.well-known/jwks.json", s.handleJWKS)
 	s.Get("/:shortUrl", s.handleShortUrlRedirect)
+	// Failed password attempts are skipped by the global limiter, limit them
+	// per client and short URL to slow down password guessing.
+	s.Post("/:shortUrl", limiter.New(limiter.Config{
+		Max:        10,
+		Expiration: time.Minute,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return c.IP() + "/" + c.Params("shortUrl")
+		},
+	}), s.handleShortURLUnlock)
 
 	api := s.Group("/api").Use(s.validateIfLoggedIn)
 
 	// User Endpoints
 	api.Post("/login", s.handleLogin)
+	api.Post("/login/2fa", mfaLimiter(), s.handleLoginMFA)
+	api.Post("/token/refresh", s.handleRefreshToken)
+	api.Post("/logout", s.handleLogout)
+	api.Post("/logout/all", s.handleLogoutAll)
 	api.Get("/username-exists", s.handleUsernameExists)
 	api.Post("/user", s.handleCreateAccount)
 	api.Get("/user", s.handleGetUser)
+	api.Patch("/user", s.handleUpdateUser)
+	api.Delete("/user", s.handleDeleteUser)
+	api.Post("/user/password", s.handleChangePassword)
+	api.Post("/2fa/totp", s.handleSetupTOTP)
+	api.Post("/2fa/totp/enable", mfaLimiter(), s.handleEnableTOTP)
+	api.Post("/2fa/totp/disable", mfaLimiter(), s.handleDisableTOTP)
+	api.Post("/2fa/recovery-codes", mfaLimiter(), s.handleRegenerateRecoveryCodes)
+	api.Get("/email/verify", s.handleVerifyEmailPage)
+	api.Post("/email/verify", s.handleVerifyEmail)
+	api.Post("/email/verify/resend", emailLimiter(), s.handleResendVerificationEmail)
+	api.Post("/password/forgot", emailLimiter(), s.handleForgotPassword)
+	api.Post("/password/reset", s.handleResetPassword)
+	api.Get("/auth/oidc/start", s.handleOIDCStart)
+	api.Get("/auth/oidc/callback", s.handleOIDCCallback)
+
+	// API Key Endpoints
+	api.Post("/keys", s.handleCreateAPIKey)
+	api.Get("/keys", s.handleGetAPIKeys)
+	api.Delete("/keys/:id", s.handleDeleteAPIKey)
 
-	// Short URL Endpoints
-	api.Post("/url", s.handleCreateShortURL)
-	api.Get("/url", s.handleGetAllURL)
-	api.Patch("/url", s.handleURLUpdate)
-	api.Get("/url/clicks", s.handleGetShortURLClicks)
-	api.Get("/url/:shortUrl", s.handleGetURL)
-	api.Get("/url/:shortUrl/qr", s.handleCreateURLQR)
+	// Short URL Endpoints, these also accept API keys with the required scope.
+	api.Post("/url", s.requireScope(scopeLinksWrite), s.handleCreateShortURL)
+	api.Get("/url", s.requireScope(scopeLinksRead), s.handleGetAllURL)
+	api.Patch("/url", s.requireScope(scopeLinksWrite), s.handleURLUpdate)
+	api.Get("/url/clicks", s.requireScope(scopeStatsRead), s.handleGetShortURLClicks)
+	api.Get("/url/:shortUrl", s.requireScope(scopeLinksRead), s.handleGetURL)
+	api.Get("/url/:shortUrl/qr", s.requireScope(scopeLinksRead), s.handleCreateURLQR)
+	api.Get("/url/:shortUrl/stats", s.requireScope(scopeStatsRead), s.handleGetShortURLStats)
+
+	// Workspace Endpoints
+	api.Post("/workspaces", s.handleCreateWorkspace)
+	api.Get("/workspaces", s.handleGetWorkspaces)
+	api.Delete("/workspaces/:id", s.handleDeleteWorkspace)
+	api.Get("/workspaces/:id/members", s.handleGetWorkspaceMembers)
+	api.Patch("/workspaces/:id/members", s.handleUpdateWorkspaceMember)
+	api.Delete("/workspaces/:id/members", s.handleRemoveWorkspaceMember)
+	api.Post("/workspaces/:id/invitations", emailLimiter(), s.handleCreateWorkspaceInvitation)
+	api.Get("/workspaces/:id/invitations", s.handleGetWorkspaceInvitations)
+	api.Delete("/workspaces/:id/invitations/:invitationId", s.handleDeleteWorkspaceInvitation)
+	api.Post("/invitations/accept", s.handleAcceptWorkspaceInvitation)
 }
 
 // Start starts the WebServer.
 func (s *WebServer) Start() error {
-	// Start a goroutine to clean cache.
-	go func() {
-		tick := time.NewTicker(time.Hour * 2)
-		defer tick.Stop()
-		for {
-			<-tick.C
-			halfDay := 12 * time.Hour
-			s.urlMtx.Lock()
-			for shortURL, l := range s.urlCache {
-				if time.Since(time.Unix(l.Timestamp, 0)) > halfDay {
-					delete(s.urlCache, shortURL)
-				}
+	go s.sweepExpiredURLs()
+
+	if s.clickRetention > 0 {
+		go s.deleteOldClicks()
+	}
+
+	go s.sweepExpiredRecords()
+
+	if s.authenticator.keyFile != "" {
+		go s.reloadJWTKeys()
+	}
+
+	if s.metrics != nil {
+		go func() {
+			if err := s.metrics.Listen(s.metricsAddr); err != nil {
+				appLog.Printf("\nerror serving metrics: %v\n", err)
 			}
-			s.urlMtx.Unlock()
-		}
-	}()
+		}()
+	}
+
 	return s.Listen(s.addr)
 }
 
-// Stop stops the WebServer.
+// sweepExpiredURLs periodically marks short URLs whose expiry time has passed
+// as expired until the server context is canceled.
+func (s *WebServer) sweepExpiredURLs() {
+	tick := time.NewTicker(expiredURLSweepInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-tick.C:
+			n, err := s.db.MarkExpiredShortURLs()
+			if err != nil {
+				appLog.Printf("\ndb.MarkExpiredShortURLs error: %v\n", err)
+				continue
+			}
+
+			if n > 0 {
+				appLog.Printf("Marked %d short URL(s) as expired", n)
+			}
+		}
+	}
+}
+
+// deleteOldClicks deletes clicks older than the click retention period on
+// start and then periodically until the server context is canceled.
+func (s *WebServer) deleteOldClicks() {
+	tick := time.NewTicker(clickRetentionSweepInterval)
+	defer tick.Stop()
+	for {
+		n, err := s.db.DeleteShortURLClicksBefore(time.Now().Add(-s.clickRetention).Unix())
+		if err != nil {
+			appLog.Printf("\ndb.DeleteShortURLClicksBefore error: %v\n", err)
+		} else if n > 0 {
+			appLog.Printf("Deleted %d click(s) older than %s", n, s.clickRetention)
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// sweepExpiredRecords deletes expired sessions, email verification and
+// password reset tokens, workspace invitations and stale failed logins on
+// start and then periodically until the server context is canceled.
+func (s *WebServer) sweepExpiredRecords() {
+	tick := time.NewTicker(expiredRecordSweepInterval)
+	defer tick.Stop()
+	for {
+		now := time.Now().Unix()
+		n, err := s.db.DeleteExpiredSessions(now)
+		if err != nil {
+			appLog.Printf("\ndb.DeleteExpiredSessions error: %v\n", err)
+		} else if n > 0 {
+			appLog.Printf("Deleted %d expired session(s)", n)
+		}
+
+		n, err = s.db.DeleteExpiredUserTokens(now)
+		if err != nil {
+			appLog.Printf("\ndb.DeleteExpiredUserTokens error: %v\n", err)
+		} else if n > 0 {
+			appLog.Printf("Deleted %d expired user token(s)", n)
+		}
+
+		n, err = s.db.DeleteExpiredWorkspaceInvitations(now)
+		if err != nil {
+			appLog.Printf("\ndb.DeleteExpiredWorkspaceInvitations error: %v\n", err)
+		} else if n > 0 {
+			appLog.Printf("Deleted %d expired workspace invitation(s)", n)
+		}
+
+		n, err = s.db.DeleteStaleLoginAttempts(now - int64(loginFailureWindow.Seconds()))
+		if err != nil {
+			appLog.Printf("\ndb.DeleteStaleLoginAttempts error: %v\n", err)
+		} else if n > 0 {
+			appLog.Printf("Deleted %d stale login attempt record(s)", n)
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// handleMetrics handles the "GET /api/metrics" endpoint of the metrics listener
+// and returns the click ingestion and redirect cache metrics.
+func (s *WebServer) handleMetrics(c *fiber.Ctx) error {
+	resp := &struct {
+		*APIResponse
+		Clicks *clickIngestionStats `json:"clicks"`
+		Cache  *urlCacheStats       `json:"cache"`
+	}{
+		APIResponse: newAPIResponse(true, codeOk, "Metrics retrieved"),
+		Clicks:      s.clicks.stats(),
+		Cache:       s.urlCache.stats(),
+	}
+
+	return c.Status(codeOk).JSON(resp)
+}
+
+// Stop stops the WebServer. Queued clicks are recorded before it returns.
 func (s *WebServer) Stop() error {
-	return s.Shutdown()
+	err := s.Shutdown()
+	if s.metrics != nil {
+		if metricsErr := s.metrics.Shutdown(); metricsErr != nil {
+			appLog.Printf("\nerror stopping metrics: %v\n", metricsErr)
+		}
+	}
+	s.unsubscribeCache()
+	s.clicks.stop()
+	if geoErr := s.geoIP.Close(); geoErr != nil {
+		appLog.Printf("\ngeoIP.Close error: %v\n", geoErr)
+	}
+	return err
 }
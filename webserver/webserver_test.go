@@ -6,11 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db"
 	"github.com/ukane-philemon/bob/db/mem"
 )
 
@@ -27,28 +30,77 @@ type tServer struct {
 // newTServer creates and starts a new server instance. Callers should
 // *WebServer.Stop to shutdown the server.
 func newTServer(t *testing.T) *tServer {
+	return startTServer(t, Config{}, mem.New())
+}
+
+// startTServer creates and starts a new server instance with cfg on a random
+// port. Callers should *WebServer.Stop to shutdown the server.
+func startTServer(t *testing.T, cfg Config, appDB db.DataStore) *tServer {
 	var port int
 	for port == 0 {
 		port = rand.Intn(65535)
 	}
 
-	cfg := Config{
-		Host: "127.0.0.1",
-		Port: fmt.Sprintf("%d", port),
-	}
+	cfg.Host = "127.0.0.1"
+	cfg.Port = fmt.Sprintf("%d", port)
+	cfg.Clicks.FlushInterval = 10 * time.Millisecond
 
 	// Create a new server.
-	s, err := New(tCtx, cfg, mem.New())
+	s, err := New(tCtx, cfg, appDB)
 	if err != nil {
 		t.Fatalf("Error creating server: %v", err)
 	}
 
-	// Start the server.
+	// Start the server and wait for it to accept connections.
 	go s.Start()
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", s.addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 
 	return &tServer{s}
 }
 
+// authHeaders starts a session for the user with the specified email and
+// returns the auth headers for it.
+func (ts *tServer) authHeaders(t *testing.T, email string) map[string]string {
+	t.Helper()
+	tokens, err := ts.createSession(email)
+	if err != nil {
+		t.Fatalf("s.createSession error: %s", err)
+	}
+	return map[string]string{fiber.HeaderAuthorization: fmt.Sprintf("Bearer %s", tokens.AuthToken)}
+}
+
+// waitForClicks waits for n clicks on shortURL to be recorded and returns
+// them.
+func (ts *tServer) waitForClicks(t *testing.T, ownerEmail, shortURL string, n int) []*db.ShortURLClick {
+	t.Helper()
+	var clicks []*db.ShortURLClick
+	for i := 0; i < 100; i++ {
+		var err error
+		clicks, err = ts.db.RetrieveShortURLClicks(ownerEmail, shortURL)
+		if err != nil {
+			t.Fatalf("s.db.RetrieveShortURLClicks error: %s", err)
+		}
+
+		if len(clicks) >= n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(clicks) != n {
+		t.Fatalf("Expected %d click(s) but got %d", n, len(clicks))
+	}
+
+	return clicks
+}
+
 // sendRequest mimics an actual http request to the server and unmarshals the
 // request result into resp. resp must be a pointer to a struct type.
 func (ts *tServer) sendRequest(method string, endpoint string, reqBody interface{}, resp interface{}, headers map[string]string) error {
@@ -0,0 +1,572 @@
+package webserver
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/mailer"
+)
+
+const (
+	// workspaceIDLength is the number of random bytes in workspace and
+	// invitation IDs.
+	workspaceIDLength = 8
+	// maxWorkspaceNameLength is the maximum length of a workspace name.
+	maxWorkspaceNameLength = 64
+	// maxWorkspacesPerUser is the maximum number of workspaces a user can be
+	// a member of.
+	maxWorkspacesPerUser = 25
+	// maxWorkspaceInvitations is the maximum number of pending invitations a
+	// workspace can have.
+	maxWorkspaceInvitations = 50
+	// workspaceInvitationExpiry is how long a workspace invitation is valid.
+	workspaceInvitationExpiry = 7 * 24 * time.Hour
+)
+
+// workspaceRoleRanks orders the workspace roles, every role can do what the
+// roles with a lower rank can do. Viewers can read the short URLs of a
+// workspace and their clicks and statistics, editors can also create and
+// update them and owners can also manage the workspace, its members and
+// invitations.
+var workspaceRoleRanks = map[string]int{
+	db.WorkspaceRoleViewer: 1,
+	db.WorkspaceRoleEditor: 2,
+	db.WorkspaceRoleOwner:  3,
+}
+
+// requireWorkspaceRole returns the membership of the user with the specified
+// email in the workspace with the specified ID, or an error if the user is
+// not a member with at least role.
+func (s *WebServer) requireWorkspaceRole(workspaceID, email, role string) (*db.WorkspaceMember, error) {
+	member, err := s.db.RetrieveWorkspaceMember(workspaceID, email)
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			// Workspaces of other users are not revealed.
+			return nil, errNotFound("workspace does not exist")
+		}
+
+		appLog.Printf("\ndb.RetrieveWorkspaceMember error: %v\n", err)
+		return nil, errInternal(err)
+	}
+
+	if err := checkWorkspaceRole(member, role); err != nil {
+		return nil, err
+	}
+
+	return member, nil
+}
+
+// checkWorkspaceRole returns an error if member does not have at least role.
+func checkWorkspaceRole(member *db.WorkspaceMember, role string) error {
+	if workspaceRoleRanks[member.Role] < workspaceRoleRanks[role] {
+		return errForbidden(fmt.Sprintf("the %s role in the workspace is required", role))
+	}
+	return nil
+}
+
+// shortURLOwnerID returns the owner ID the user with the specified email uses
+// to access the short URL. It is the workspace ID if the short URL belongs to
+// a workspace the user is a member of with at least role, and the email
+// otherwise so that the database checks the owner as usual, e.g. if the short
+// URL does not exist.
+func (s *WebServer) shortURLOwnerID(email, shortURL, role string) (string, error) {
+	urlInfo, err := s.db.RetrieveURLInfo(shortURL)
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return email, nil
+		}
+
+		appLog.Printf("\ndb.RetrieveURLInfo error: %v\n", err)
+		return "", translateDBError(err)
+	}
+
+	if !db.IsWorkspaceID(urlInfo.OwnerID) {
+		return email, nil
+	}
+
+	member, err := s.db.RetrieveWorkspaceMember(urlInfo.OwnerID, email)
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return "", errForbidden("you are not authorized to access this resource")
+		}
+
+		appLog.Printf("\ndb.RetrieveWorkspaceMember error: %v\n", err)
+		return "", errInternal(err)
+	}
+
+	if err := checkWorkspaceRole(member, role); err != nil {
+		return "", err
+	}
+
+	return urlInfo.OwnerID, nil
+}
+
+// newWorkspaceID returns a new random ID with the workspace ID prefix.
+func newWorkspaceID() (string, error) {
+	b, err := randomBytes(workspaceIDLength)
+	if err != nil {
+		return "", err
+	}
+	return db.WorkspaceIDPrefix + hex.EncodeToString(b), nil
+}
+
+// handleCreateWorkspace handles the "POST /api/workspaces" endpoint and
+// creates a new workspace owned by the user.
+func (s *WebServer) handleCreateWorkspace(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(createWorkspaceRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	name := strings.TrimSpace(form.Name)
+	if name == "" || len(name) > maxWorkspaceNameLength {
+		return errBadRequest(fmt.Sprintf("a name of at most %d characters is required", maxWorkspaceNameLength))
+	}
+
+	workspaces, err := s.db.RetrieveUserWorkspaces(email)
+	if err != nil {
+		appLog.Printf("\ndb.RetrieveUserWorkspaces error: %v\n", err)
+		return errInternal(err)
+	}
+
+	if len(workspaces) >= maxWorkspacesPerUser {
+		return errBadRequest(fmt.Sprintf("you can be a member of at most %d workspaces", maxWorkspacesPerUser))
+	}
+
+	id, err := newWorkspaceID()
+	if err != nil {
+		return errInternal(err)
+	}
+
+	workspace := &db.Workspace{
+		ID:        id,
+		Name:      strings.Clone(name),
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := s.db.CreateWorkspace(workspace, email); err != nil {
+		appLog.Printf("\ndb.CreateWorkspace error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	workspace.Role = db.WorkspaceRoleOwner
+	resp := &workspaceResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Workspace Created."),
+		Data:        workspace,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleGetWorkspaces handles the "GET /api/workspaces" endpoint and returns
+// the workspaces the user is a member of with the role of the user.
+func (s *WebServer) handleGetWorkspaces(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	workspaces, err := s.db.RetrieveUserWorkspaces(email)
+	if err != nil {
+		appLog.Printf("\ndb.RetrieveUserWorkspaces error: %v\n", err)
+		return errInternal(err)
+	}
+
+	if workspaces == nil {
+		workspaces = []*db.Workspace{}
+	}
+
+	resp := &workspacesResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Workspaces Retrieved."),
+		Data:        workspaces,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleDeleteWorkspace handles the "DELETE /api/workspaces/:id" endpoint and
+// deletes a workspace together with its short URLs. Only owners can delete a
+// workspace.
+func (s *WebServer) handleDeleteWorkspace(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	workspaceID := c.Params("id")
+	if _, err := s.requireWorkspaceRole(workspaceID, email, db.WorkspaceRoleOwner); err != nil {
+		return err
+	}
+
+	shortURLs, err := s.db.DeleteWorkspace(workspaceID)
+	if err != nil {
+		appLog.Printf("\ndb.DeleteWorkspace error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	for _, shortURL := range shortURLs {
+		s.invalidateCachedURL(shortURL)
+	}
+
+	resp := newAPIResponse(true, codeOk, "Workspace Deleted.")
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleGetWorkspaceMembers handles the "GET /api/workspaces/:id/members"
+// endpoint and returns the members of a workspace.
+func (s *WebServer) handleGetWorkspaceMembers(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	workspaceID := c.Params("id")
+	if _, err := s.requireWorkspaceRole(workspaceID, email, db.WorkspaceRoleViewer); err != nil {
+		return err
+	}
+
+	members, err := s.db.RetrieveWorkspaceMembers(workspaceID)
+	if err != nil {
+		appLog.Printf("\ndb.RetrieveWorkspaceMembers error: %v\n", err)
+		return errInternal(err)
+	}
+
+	resp := &workspaceMembersResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Workspace Members Retrieved."),
+		Data:        members,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleUpdateWorkspaceMember handles the "PATCH /api/workspaces/:id/members"
+// endpoint and changes the role of a member. Only owners can change roles and
+// the last owner cannot be demoted.
+func (s *WebServer) handleUpdateWorkspaceMember(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(updateWorkspaceMemberRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	if !db.IsValidWorkspaceRole(form.Role) {
+		return errBadRequest("invalid role, use one of owner, editor or viewer")
+	}
+
+	workspaceID := c.Params("id")
+	if _, err := s.requireWorkspaceRole(workspaceID, email, db.WorkspaceRoleOwner); err != nil {
+		return err
+	}
+
+	if err := s.db.UpdateWorkspaceMemberRole(workspaceID, form.Email, form.Role); err != nil {
+		if !errors.Is(err, db.ErrorNotFound) && !errors.Is(err, db.ErrorBadRequest) {
+			appLog.Printf("\ndb.UpdateWorkspaceMemberRole error: %v\n", err)
+		}
+		return translateDBError(err)
+	}
+
+	resp := newAPIResponse(true, codeOk, "Workspace Member Updated.")
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleRemoveWorkspaceMember handles the "DELETE
+// /api/workspaces/:id/members?email=" endpoint and removes a member from a
+// workspace. Owners can remove any member and every member can leave, but the
+// last owner cannot be removed.
+func (s *WebServer) handleRemoveWorkspaceMember(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	memberEmail := c.Query("email", email)
+	role := db.WorkspaceRoleOwner
+	if memberEmail == email {
+		role = db.WorkspaceRoleViewer
+	}
+
+	workspaceID := c.Params("id")
+	if _, err := s.requireWorkspaceRole(workspaceID, email, role); err != nil {
+		return err
+	}
+
+	if err := s.db.RemoveWorkspaceMember(workspaceID, memberEmail); err != nil {
+		if !errors.Is(err, db.ErrorNotFound) && !errors.Is(err, db.ErrorBadRequest) {
+			appLog.Printf("\ndb.RemoveWorkspaceMember error: %v\n", err)
+		}
+		return translateDBError(err)
+	}
+
+	resp := newAPIResponse(true, codeOk, "Workspace Member Removed.")
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleCreateWorkspaceInvitation handles the "POST
+// /api/workspaces/:id/invitations" endpoint and emails an invitation to join
+// a workspace. Only owners can invite users.
+func (s *WebServer) handleCreateWorkspaceInvitation(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(createWorkspaceInvitationRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	if !isValidEmail(form.Email) {
+		return errBadRequest("a valid email is required")
+	}
+
+	if !db.IsValidWorkspaceRole(form.Role) {
+		return errBadRequest("invalid role, use one of owner, editor or viewer")
+	}
+
+	workspaceID := c.Params("id")
+	if _, err := s.requireWorkspaceRole(workspaceID, email, db.WorkspaceRoleOwner); err != nil {
+		return err
+	}
+
+	if err := s.requireVerifiedEmail(email); err != nil {
+		return err
+	}
+
+	if _, err := s.db.RetrieveWorkspaceMember(workspaceID, form.Email); err == nil {
+		return errBadRequest("user is already a member of the workspace")
+	} else if !errors.Is(err, db.ErrorNotFound) {
+		appLog.Printf("\ndb.RetrieveWorkspaceMember error: %v\n", err)
+		return errInternal(err)
+	}
+
+	invitations, err := s.db.RetrieveWorkspaceInvitations(workspaceID)
+	if err != nil {
+		appLog.Printf("\ndb.RetrieveWorkspaceInvitations error: %v\n", err)
+		return errInternal(err)
+	}
+
+	if len(invitations) >= maxWorkspaceInvitations {
+		return errBadRequest(fmt.Sprintf("a workspace can have at most %d pending invitations, delete unused invitations first", maxWorkspaceInvitations))
+	}
+
+	workspace, err := s.db.RetrieveWorkspace(workspaceID)
+	if err != nil {
+		return translateDBError(err)
+	}
+
+	token, invitation, err := newWorkspaceInvitation(strings.Clone(workspaceID), strings.Clone(form.Email), form.Role, email)
+	if err != nil {
+		return errInternal(err)
+	}
+
+	if err := s.db.CreateWorkspaceInvitation(invitation); err != nil {
+		appLog.Printf("\ndb.CreateWorkspaceInvitation error: %v\n", err)
+		return translateDBError(err)
+	}
+
+	s.sendWorkspaceInvitationEmail(workspace, invitation, token)
+
+	resp := &workspaceInvitationResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Invitation Sent."),
+		Data:        invitation,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// newWorkspaceInvitation generates a new invitation to join a workspace and
+// returns its token with its database entry.
+func newWorkspaceInvitation(workspaceID, email, role, invitedBy string) (string, *db.WorkspaceInvitation, error) {
+	id, err := randomBytes(workspaceIDLength)
+	if err != nil {
+		return "", nil, err
+	}
+
+	b, err := randomBytes(userTokenLength)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	return token, &db.WorkspaceInvitation{
+		ID:          hex.EncodeToString(id),
+		WorkspaceID: workspaceID,
+		Email:       email,
+		Role:        role,
+		InvitedBy:   invitedBy,
+		TokenHash:   hashUserToken(token),
+		CreatedAt:   now.Unix(),
+		ExpiresAt:   now.Add(workspaceInvitationExpiry).Unix(),
+	}, nil
+}
+
+// sendWorkspaceInvitationEmail sends the token of an invitation to join
+// workspace to the invited email.
+func (s *WebServer) sendWorkspaceInvitationEmail(workspace *db.Workspace, invitation *db.WorkspaceInvitation, token string) {
+	link := tokenLink(s.invitationURL, token)
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s invited you to join the %q workspace on %s as %s.\n\n", invitation.InvitedBy, workspace.Name, AppName, articleRole(invitation.Role))
+	if link != "" {
+		fmt.Fprintf(&body, "Open this link to accept the invitation:\n\n%s\n\n", link)
+	} else {
+		fmt.Fprintf(&body, "Use this token to accept the invitation:\n\n%s\n\n", token)
+	}
+	fmt.Fprintf(&body, "Log in or create an account with this email first. The %s expires in %d days and can only be used once.\n", tokenNoun(link), int(workspaceInvitationExpiry.Hours()/24))
+
+	s.sendEmail(&mailer.Message{To: invitation.Email, Subject: "Join " + workspace.Name + " on " + AppName, Body: body.String()})
+}
+
+// articleRole returns role with its indefinite article, e.g. "an editor".
+func articleRole(role string) string {
+	if role == db.WorkspaceRoleOwner || role == db.WorkspaceRoleEditor {
+		return "an " + role
+	}
+	return "a " + role
+}
+
+// handleGetWorkspaceInvitations handles the "GET
+// /api/workspaces/:id/invitations" endpoint and returns the pending
+// invitations of a workspace. Only owners can see invitations.
+func (s *WebServer) handleGetWorkspaceInvitations(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	workspaceID := c.Params("id")
+	if _, err := s.requireWorkspaceRole(workspaceID, email, db.WorkspaceRoleOwner); err != nil {
+		return err
+	}
+
+	invitations, err := s.db.RetrieveWorkspaceInvitations(workspaceID)
+	if err != nil {
+		appLog.Printf("\ndb.RetrieveWorkspaceInvitations error: %v\n", err)
+		return errInternal(err)
+	}
+
+	if invitations == nil {
+		invitations = []*db.WorkspaceInvitation{}
+	}
+
+	resp := &workspaceInvitationsResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Invitations Retrieved."),
+		Data:        invitations,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleDeleteWorkspaceInvitation handles the "DELETE
+// /api/workspaces/:id/invitations/:invitationId" endpoint and revokes a
+// pending invitation. Only owners can revoke invitations.
+func (s *WebServer) handleDeleteWorkspaceInvitation(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	workspaceID := c.Params("id")
+	if _, err := s.requireWorkspaceRole(workspaceID, email, db.WorkspaceRoleOwner); err != nil {
+		return err
+	}
+
+	if err := s.db.DeleteWorkspaceInvitation(workspaceID, c.Params("invitationId")); err != nil {
+		if !errors.Is(err, db.ErrorNotFound) {
+			appLog.Printf("\ndb.DeleteWorkspaceInvitation error: %v\n", err)
+		}
+		return translateDBError(err)
+	}
+
+	resp := newAPIResponse(true, codeOk, "Invitation Deleted.")
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// handleAcceptWorkspaceInvitation handles the "POST /api/invitations/accept"
+// endpoint and adds the user to the workspace of an invitation sent to the
+// email of the user.
+func (s *WebServer) handleAcceptWorkspaceInvitation(c *fiber.Ctx) error {
+	email, ok := c.Context().UserValue(ctxID).(string)
+	if !ok {
+		return errUnauthorized("you are not unauthorized to access this resource")
+	}
+
+	form := new(acceptWorkspaceInvitationRequest)
+	if err := c.BodyParser(form); err != nil {
+		return errBadRequest("invalid request body")
+	}
+
+	if form.Token == "" {
+		return errBadRequest("token is required")
+	}
+
+	member, err := s.db.AcceptWorkspaceInvitation(hashUserToken(form.Token), email, time.Now().Unix())
+	if err != nil {
+		if errors.Is(err, db.ErrorNotFound) {
+			return errBadRequest("invalid or expired invitation")
+		}
+
+		if !errors.Is(err, db.ErrorBadRequest) {
+			appLog.Printf("\ndb.AcceptWorkspaceInvitation error: %v\n", err)
+		}
+		return translateDBError(err)
+	}
+
+	resp := &workspaceMemberResponse{
+		APIResponse: newAPIResponse(true, codeOk, "Invitation Accepted."),
+		Data:        member,
+	}
+
+	return c.Status(resp.Code).JSON(resp)
+}
+
+// requireNotLastWorkspaceOwner returns an error if the user with the specified
+// email is the only owner of a workspace, since the workspace would be left
+// without an owner.
+func (s *WebServer) requireNotLastWorkspaceOwner(email string) error {
+	workspaces, err := s.db.RetrieveUserWorkspaces(email)
+	if err != nil {
+		appLog.Printf("\ndb.RetrieveUserWorkspaces error: %v\n", err)
+		return errInternal(err)
+	}
+
+	for _, workspace := range workspaces {
+		if workspace.Role != db.WorkspaceRoleOwner {
+			continue
+		}
+
+		members, err := s.db.RetrieveWorkspaceMembers(workspace.ID)
+		if err != nil {
+			appLog.Printf("\ndb.RetrieveWorkspaceMembers error: %v\n", err)
+			return errInternal(err)
+		}
+
+		var owners int
+		for _, member := range members {
+			if member.Role == db.WorkspaceRoleOwner {
+				owners++
+			}
+		}
+
+		if owners == 1 {
+			return errBadRequest(fmt.Sprintf("you are the only owner of the %q workspace, add another owner or delete the workspace first", workspace.Name))
+		}
+	}
+
+	return nil
+}
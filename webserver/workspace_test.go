@@ -0,0 +1,264 @@
+package webserver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ukane-philemon/bob/db"
+	"github.com/ukane-philemon/bob/db/mem"
+)
+
+// tWorkspaceMember invites email to the workspace as role and accepts the
+// invitation with the emailed token.
+func tWorkspaceMember(t *testing.T, s *tServer, m *tMailer, ownerHeaders map[string]string, workspaceID, email, role string) map[string]string {
+	t.Helper()
+	var resp *APIResponse
+	req := createWorkspaceInvitationRequest{Email: email, Role: role}
+	if err := s.sendRequest(fiber.MethodPost, "api/workspaces/"+workspaceID+"/invitations", req, &resp, ownerHeaders); err != nil || resp.Code != codeOk {
+		t.Fatalf("Expected %s to be invited: %v %+v", email, err, resp)
+	}
+
+	_, token := m.nextEmail(t, email)
+	headers := s.authHeaders(t, email)
+	var memberResp *workspaceMemberResponse
+	if err := s.sendRequest(fiber.MethodPost, "api/invitations/accept", acceptWorkspaceInvitationRequest{Token: token}, &memberResp, headers); err != nil || memberResp.Code != codeOk {
+		t.Fatalf("Expected %s to accept the invitation: %v %+v", email, err, memberResp)
+	}
+
+	if memberResp.Data.Role != role {
+		t.Fatalf("Expected %s to join as %s but got %s", email, role, memberResp.Data.Role)
+	}
+
+	return headers
+}
+
+func TestWebServer_workspaces(t *testing.T) {
+	m := newTMailer()
+	s := startTServer(t, Config{Mailer: m, InvitationURL: "https://app.test/invite"}, mem.New())
+	defer s.Stop()
+
+	emails := []string{"owner@email.com", "editor@email.com", "viewer@email.com", "outsider@email.com"}
+	for _, email := range emails {
+		if err := s.db.CreateUser(email[:len(email)-len("@email.com")], email, []byte(dummyUserPassword)); err != nil {
+			t.Fatalf("s.db.CreateUser error: %s", err)
+		}
+	}
+	ownerHeaders, outsiderHeaders := s.authHeaders(t, emails[0]), s.authHeaders(t, emails[3])
+
+	var wsResp *workspaceResponse
+	if err := s.sendRequest(fiber.MethodPost, "api/workspaces", createWorkspaceRequest{Name: " "}, &wsResp, ownerHeaders); err != nil || wsResp.Code != codeBadRequest {
+		t.Fatalf("Expected a blank workspace name to be rejected: %v %+v", err, wsResp)
+	}
+
+	if err := s.sendRequest(fiber.MethodPost, "api/workspaces", createWorkspaceRequest{Name: "Marketing"}, &wsResp, ownerHeaders); err != nil || wsResp.Code != codeOk {
+		t.Fatalf("Expected the workspace to be created: %v %+v", err, wsResp)
+	}
+	workspaceID := wsResp.Data.ID
+	if !db.IsWorkspaceID(workspaceID) || wsResp.Data.Role != db.WorkspaceRoleOwner {
+		t.Fatalf("Unexpected workspace %+v", wsResp.Data)
+	}
+
+	editorHeaders := tWorkspaceMember(t, s, m, ownerHeaders, workspaceID, emails[1], db.WorkspaceRoleEditor)
+	viewerHeaders := tWorkspaceMember(t, s, m, ownerHeaders, workspaceID, emails[2], db.WorkspaceRoleViewer)
+
+	// Only owners can invite, and members cannot be invited again.
+	var resp *APIResponse
+	inviteURL := "api/workspaces/" + workspaceID + "/invitations"
+	inviteOutsider := createWorkspaceInvitationRequest{Email: emails[3], Role: db.WorkspaceRoleEditor}
+	if err := s.sendRequest(fiber.MethodPost, inviteURL, inviteOutsider, &resp, editorHeaders); err != nil || resp.Code != codeForbidden {
+		t.Fatalf("Expected an editor invitation to be forbidden: %v %+v", err, resp)
+	}
+
+	if err := s.sendRequest(fiber.MethodPost, inviteURL, createWorkspaceInvitationRequest{Email: emails[2], Role: db.WorkspaceRoleEditor}, &resp, ownerHeaders); err != nil || resp.Code != codeBadRequest {
+		t.Fatalf("Expected inviting a member to be rejected: %v %+v", err, resp)
+	}
+
+	// An invitation can only be accepted by the invited email.
+	if err := s.sendRequest(fiber.MethodPost, inviteURL, createWorkspaceInvitationRequest{Email: "someone@email.com", Role: db.WorkspaceRoleViewer}, &resp, ownerHeaders); err != nil || resp.Code != codeOk {
+		t.Fatalf("Expected the invitation to be sent: %v %+v", err, resp)
+	}
+	_, token := m.nextEmail(t, "someone@email.com")
+	if err := s.sendRequest(fiber.MethodPost, "api/invitations/accept", acceptWorkspaceInvitationRequest{Token: token}, &resp, outsiderHeaders); err != nil || resp.Code == codeOk {
+		t.Fatalf("Expected the invitation of another email to be rejected: %v %+v", err, resp)
+	}
+
+	var invitationsResp *workspaceInvitationsResponse
+	if err := s.sendRequest(fiber.MethodGet, inviteURL, nil, &invitationsResp, ownerHeaders); err != nil || len(invitationsResp.Data) != 1 {
+		t.Fatalf("Expected one pending invitation: %v %+v", err, invitationsResp)
+	}
+
+	var workspacesResp *workspacesResponse
+	if err := s.sendRequest(fiber.MethodGet, "api/workspaces", nil, &workspacesResp, viewerHeaders); err != nil || len(workspacesResp.Data) != 1 || workspacesResp.Data[0].Role != db.WorkspaceRoleViewer {
+		t.Fatalf("Expected the viewer to see the workspace: %v %+v", err, workspacesResp)
+	}
+
+	var membersResp *workspaceMembersResponse
+	membersURL := "api/workspaces/" + workspaceID + "/members"
+	if err := s.sendRequest(fiber.MethodGet, membersURL, nil, &membersResp, viewerHeaders); err != nil || len(membersResp.Data) != 3 {
+		t.Fatalf("Expected three members: %v %+v", err, membersResp)
+	}
+
+	if err := s.sendRequest(fiber.MethodGet, membersURL, nil, &resp, outsiderHeaders); err != nil || resp.Code != codeNotFound {
+		t.Fatalf("Expected a non-member to be rejected: %v %+v", err, resp)
+	}
+
+	// Workspace links are authorized by the role of the member.
+	if _, err := s.db.CreateNewShortURL(workspaceID, "https://example.com", "campaign", false, nil); err != nil {
+		t.Fatalf("s.db.CreateNewShortURL error: %s", err)
+	}
+
+	disable := true
+	tests := []struct {
+		name     string
+		method   string
+		endpoint string
+		req      interface{}
+		headers  map[string]string
+		wantCode int
+	}{{
+		name:     "viewer gets URL",
+		method:   fiber.MethodGet,
+		endpoint: "api/url/campaign",
+		headers:  viewerHeaders,
+		wantCode: codeOk,
+	}, {
+		name:     "non-member gets URL",
+		method:   fiber.MethodGet,
+		endpoint: "api/url/campaign",
+		headers:  outsiderHeaders,
+		wantCode: codeForbidden,
+	}, {
+		name:     "viewer gets workspace URLs",
+		method:   fiber.MethodGet,
+		endpoint: "api/url?workspaceID=" + workspaceID,
+		headers:  viewerHeaders,
+		wantCode: codeOk,
+	}, {
+		name:     "non-member gets workspace URLs",
+		method:   fiber.MethodGet,
+		endpoint: "api/url?workspaceID=" + workspaceID,
+		headers:  outsiderHeaders,
+		wantCode: codeNotFound,
+	}, {
+		name:     "viewer gets clicks",
+		method:   fiber.MethodGet,
+		endpoint: "api/url/clicks?shortUrl=campaign",
+		headers:  viewerHeaders,
+		wantCode: codeOk,
+	}, {
+		name:     "non-member gets stats",
+		method:   fiber.MethodGet,
+		endpoint: "api/url/campaign/stats",
+		headers:  outsiderHeaders,
+		wantCode: codeForbidden,
+	}, {
+		name:     "viewer creates workspace URL",
+		method:   fiber.MethodPost,
+		endpoint: "api/url",
+		req:      createShortURLRequest{LongURL: "https://example.com", WorkspaceID: workspaceID},
+		headers:  viewerHeaders,
+		wantCode: codeForbidden,
+	}, {
+		name:     "viewer disables URL",
+		method:   fiber.MethodPatch,
+		endpoint: "api/url?shortUrl=campaign",
+		req:      updateShortURLRequest{Disable: &disable},
+		headers:  viewerHeaders,
+		wantCode: codeForbidden,
+	}, {
+		name:     "non-member updates URL",
+		method:   fiber.MethodPatch,
+		endpoint: "api/url?shortUrl=campaign",
+		req:      updateShortURLRequest{LongURL: "https://example.org"},
+		headers:  outsiderHeaders,
+		wantCode: codeForbidden,
+	}, {
+		name:     "editor disables URL",
+		method:   fiber.MethodPatch,
+		endpoint: "api/url?shortUrl=campaign",
+		req:      updateShortURLRequest{Disable: &disable},
+		headers:  editorHeaders,
+		wantCode: codeOk,
+	}}
+
+	for _, tt := range tests {
+		var resp *APIResponse
+		if err := s.sendRequest(tt.method, tt.endpoint, tt.req, &resp, tt.headers); err != nil {
+			t.Fatalf("%s: s.sendRequest error: %s", tt.name, err)
+		}
+
+		if resp == nil {
+			t.Fatalf("%s: Expected an API response but got nothing", tt.name)
+		}
+
+		if resp.Code != tt.wantCode {
+			t.Fatalf("%s: Expected code %d got %d", tt.name, tt.wantCode, resp.Code)
+		}
+	}
+
+	urlInfo, err := s.db.RetrieveURLInfo("campaign")
+	if err != nil || !urlInfo.Disabled {
+		t.Fatalf("Expected the editor to disable the URL: %v %+v", err, urlInfo)
+	}
+
+	// The only owner cannot leave, step down or delete their account.
+	if err := s.sendRequest(fiber.MethodPatch, membersURL, updateWorkspaceMemberRequest{Email: emails[0], Role: db.WorkspaceRoleEditor}, &resp, ownerHeaders); err != nil || resp.Code != codeBadRequest {
+		t.Fatalf("Expected the only owner to keep their role: %v %+v", err, resp)
+	}
+
+	if err := s.sendRequest(fiber.MethodDelete, "api/user", deleteUserRequest{Password: dummyUserPassword}, &resp, ownerHeaders); err != nil || resp.Code != codeBadRequest {
+		t.Fatalf("Expected the only owner to keep their account: %v %+v", err, resp)
+	}
+
+	if err := s.sendRequest(fiber.MethodPatch, membersURL, updateWorkspaceMemberRequest{Email: emails[1], Role: db.WorkspaceRoleOwner}, &resp, editorHeaders); err != nil || resp.Code != codeForbidden {
+		t.Fatalf("Expected an editor promotion to be forbidden: %v %+v", err, resp)
+	}
+
+	if err := s.sendRequest(fiber.MethodPatch, membersURL, updateWorkspaceMemberRequest{Email: emails[1], Role: db.WorkspaceRoleOwner}, &resp, ownerHeaders); err != nil || resp.Code != codeOk {
+		t.Fatalf("Expected the editor to be promoted: %v %+v", err, resp)
+	}
+
+	// Members can leave and owners can remove other members.
+	if err := s.sendRequest(fiber.MethodDelete, membersURL, nil, &resp, viewerHeaders); err != nil || resp.Code != codeOk {
+		t.Fatalf("Expected the viewer to leave: %v %+v", err, resp)
+	}
+
+	if err := s.sendRequest(fiber.MethodDelete, membersURL+"?email="+emails[0], nil, &resp, editorHeaders); err != nil || resp.Code != codeOk {
+		t.Fatalf("Expected the new owner to remove the first owner: %v %+v", err, resp)
+	}
+
+	if err := s.sendRequest(fiber.MethodGet, "api/url/campaign", nil, &resp, ownerHeaders); err != nil || resp.Code != codeForbidden {
+		t.Fatalf("Expected a removed member to be rejected: %v %+v", err, resp)
+	}
+
+	// Deleting the workspace deletes its links.
+	if err := s.sendRequest(fiber.MethodDelete, "api/workspaces/"+workspaceID, nil, &resp, editorHeaders); err != nil || resp.Code != codeOk {
+		t.Fatalf("Expected the workspace to be deleted: %v %+v", err, resp)
+	}
+
+	if _, err := s.db.RetrieveURLInfo("campaign"); err == nil {
+		t.Fatal("Expected the workspace URL to be deleted")
+	}
+}
+
+func TestWebServer_shortURLOwnerID(t *testing.T) {
+	s := newTServer(t)
+	defer s.Stop()
+
+	const email = "owner@email.com"
+	tURLOwners(t, s, email, "other@email.com", "ownedurl")
+
+	// Short URLs that do not exist are checked by the database as usual.
+	if ownerID, err := s.shortURLOwnerID(email, "unknownurl", db.WorkspaceRoleViewer); err != nil || ownerID != email {
+		t.Fatalf("Expected the email as owner ID of an unknown short URL but got %q: %v", ownerID, err)
+	}
+
+	// Other database errors are not mistaken for a personal short URL.
+	s.db.(*mem.MemDB).SetError(dummyError)
+	_, err := s.shortURLOwnerID(email, "ownedurl", db.WorkspaceRoleViewer)
+	var resp *APIResponse
+	if !errors.As(err, &resp) || resp.Code != codeInternal {
+		t.Fatalf("Expected an internal error but got %v", err)
+	}
+}